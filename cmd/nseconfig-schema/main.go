@@ -0,0 +1,21 @@
+// nseconfig-schema prints the JSON Schema of the NSE configuration, for
+// editors and Helm values.schema.json files
+package main
+
+import (
+	"os"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/cisco-app-networking/nsm-nse/pkg/nseconfig"
+)
+
+func main() {
+	schema, err := nseconfig.MarshalSchema()
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	if _, err := os.Stdout.Write(schema); err != nil {
+		logrus.Fatal(err)
+	}
+}
@@ -0,0 +1,71 @@
+// ucnf-replay runs a scenario of connection requests through the endpoints
+// of a universal CNF configuration with the dry-run backend. The journal of
+// the dataplane configurations of two NSE versions can be diffed.
+package main
+
+import (
+	"context"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/networkservicemesh/networkservicemesh/sdk/common"
+	"github.com/sirupsen/logrus"
+
+	"github.com/cisco-app-networking/nsm-nse/pkg/nseconfig"
+	"github.com/cisco-app-networking/nsm-nse/pkg/universal-cnf/config"
+	"github.com/cisco-app-networking/nsm-nse/pkg/universal-cnf/dryrun"
+)
+
+func main() {
+	configPath := flag.String("config", "", "the universal CNF configuration file")
+	scenarioPath := flag.String("scenario", "", "the scenario file")
+	journalPath := flag.String("journal", "-", "the journal file, .json for JSON lines, - for YAML on stdout")
+	// the memif socket paths are part of the journal, a fixed workspace keeps them comparable
+	workspace := flag.String("workspace", filepath.Join(os.TempDir(), "ucnf-replay"), "the NSM workspace of the memif sockets")
+	flag.Parse()
+
+	if *configPath == "" || *scenarioPath == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	raw, err := ioutil.ReadFile(*configPath)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	cfg := &config.UniversalCNFConfig{}
+	if err := cfg.Load(raw, nseconfig.FormatFromPath(*configPath)); err != nil {
+		logrus.Fatal(err)
+	}
+
+	raw, err = ioutil.ReadFile(*scenarioPath)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	scenario, err := dryrun.LoadScenario(raw)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+
+	journal, err := dryrun.OpenJournal(*journalPath)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	if err := os.Setenv(common.WorkspaceEnv, *workspace); err != nil {
+		logrus.Fatal(err)
+	}
+
+	backend := &dryrun.UniversalCNFDryRunBackend{Journal: journal}
+	if err := backend.NewUniversalCNFBackend(); err != nil {
+		logrus.Fatal(err)
+	}
+	err = dryrun.Replay(context.Background(), cfg, backend, scenario)
+	if cerr := journal.Close(); cerr != nil {
+		logrus.Error(cerr)
+	}
+	if err != nil {
+		logrus.Fatal(err)
+	}
+}
@@ -26,8 +26,12 @@ import (
 	"github.com/sirupsen/logrus"
 
 	"github.com/cisco-app-networking/nsm-nse/pkg/nseconfig"
+	"github.com/cisco-app-networking/nsm-nse/pkg/universal-cnf/config"
 	"github.com/cisco-app-networking/nsm-nse/pkg/universal-cnf/ucnf"
-	"github.com/cisco-app-networking/nsm-nse/pkg/universal-cnf/vppagent"
+	// the backends selectable in the configuration
+	_ "github.com/cisco-app-networking/nsm-nse/pkg/universal-cnf/dryrun"
+	_ "github.com/cisco-app-networking/nsm-nse/pkg/universal-cnf/kernel"
+	_ "github.com/cisco-app-networking/nsm-nse/pkg/universal-cnf/vppagent"
 )
 
 const (
@@ -37,20 +41,30 @@ const (
 
 // Flags holds the command line flags as supplied with the binary invocation
 type Flags struct {
-	ConfigPath string
-	Verify     bool
+	ConfigPath   string
+	ConfigMap    string
+	Format       string
+	Verify       bool
+	Output       string
+	AllowInvalid bool
+	Watch        bool
 }
 
 // Process will parse the command line flags and init the structure members
 func (mf *Flags) Process() {
 	flag.StringVar(&mf.ConfigPath, "file", defaultConfigPath, " full path to the configuration file")
+	flag.StringVar(&mf.ConfigMap, "configmap", "", "read the configuration from a ConfigMap key instead of the file, in the namespace/name/key form")
+	flag.StringVar(&mf.Format, "format", "", "configuration format, yaml or json, selected by the file or key extension if not set")
 	flag.BoolVar(&mf.Verify, "verify", false, "only verify the configuration, don't run")
+	flag.StringVar(&mf.Output, "output", ucnf.OutputText, "output format of -verify, text or json")
+	flag.BoolVar(&mf.AllowInvalid, "allow-invalid-config", false, "start even if the configuration has errors")
+	flag.BoolVar(&mf.Watch, "watch", true, "reload the configuration file on change")
 	flag.Parse()
 }
 
 type defaultCompositeEndpointAddon string
 
-func (dcea defaultCompositeEndpointAddon) AddCompositeEndpoints(*common.NSConfiguration, *nseconfig.Endpoint) *[]networkservice.NetworkServiceServer {
+func (dcea defaultCompositeEndpointAddon) AddCompositeEndpoints(*common.NSConfiguration, *nseconfig.Endpoint, config.UniversalCNFBackend, config.SubnetConflictDetector) *[]networkservice.NetworkServiceServer {
 	return nil
 }
 
@@ -64,8 +78,32 @@ func main() {
 	mainFlags := &Flags{}
 	mainFlags.Process()
 
+	source, err := ucnf.NewSource(mainFlags.ConfigPath, mainFlags.ConfigMap, mainFlags.Format)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+
+	if mainFlags.Verify {
+		if err := ucnf.VerifyConfig(context.Background(), source, mainFlags.Output, os.Stdout); err != nil {
+			logrus.Error(err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
 	var defCEAddon defaultCompositeEndpointAddon
-	ucnfNse := ucnf.NewUcnfNse(mainFlags.ConfigPath, mainFlags.Verify, &vppagent.UniversalCNFVPPAgentBackend{}, defCEAddon, context.Background())
+	ucnfNse := ucnf.NewUcnfNse(source, mainFlags.AllowInvalid, defCEAddon, ctx)
 	defer ucnfNse.Cleanup()
+
+	if mainFlags.Watch {
+		go func() {
+			if err := ucnfNse.Watch(ctx); err != nil {
+				logrus.Errorf("Unable to watch the configuration: %v", err)
+			}
+		}()
+	}
 	<-c
 }
@@ -30,8 +30,12 @@ import (
 
 	"github.com/cisco-app-networking/nsm-nse/pkg/metrics"
 	"github.com/cisco-app-networking/nsm-nse/pkg/nseconfig"
+	"github.com/cisco-app-networking/nsm-nse/pkg/universal-cnf/config"
 	"github.com/cisco-app-networking/nsm-nse/pkg/universal-cnf/ucnf"
-	"github.com/cisco-app-networking/nsm-nse/pkg/universal-cnf/vppagent"
+	// the backends selectable in the configuration
+	_ "github.com/cisco-app-networking/nsm-nse/pkg/universal-cnf/dryrun"
+	_ "github.com/cisco-app-networking/nsm-nse/pkg/universal-cnf/kernel"
+	_ "github.com/cisco-app-networking/nsm-nse/pkg/universal-cnf/vppagent"
 )
 
 const (
@@ -47,8 +51,13 @@ const (
 
 // Flags holds the command line flags as supplied with the binary invocation
 type Flags struct {
-	ConfigPath string
-	Verify     bool
+	ConfigPath   string
+	ConfigMap    string
+	Format       string
+	Verify       bool
+	Output       string
+	AllowInvalid bool
+	Watch        bool
 }
 
 type fnGetNseName func() string
@@ -56,30 +65,40 @@ type fnGetNseName func() string
 // Process will parse the command line flags and init the structure members
 func (mf *Flags) Process() {
 	flag.StringVar(&mf.ConfigPath, "file", defaultConfigPath, " full path to the configuration file")
+	flag.StringVar(&mf.ConfigMap, "configmap", "", "read the configuration from a ConfigMap key instead of the file, in the namespace/name/key form")
+	flag.StringVar(&mf.Format, "format", "", "configuration format, yaml or json, selected by the file or key extension if not set")
 	flag.BoolVar(&mf.Verify, "verify", false, "only verify the configuration, don't run")
+	flag.StringVar(&mf.Output, "output", ucnf.OutputText, "output format of -verify, text or json")
+	flag.BoolVar(&mf.AllowInvalid, "allow-invalid-config", false, "start even if the configuration has errors")
+	flag.BoolVar(&mf.Watch, "watch", true, "reload the configuration file on change")
 	flag.Parse()
 }
 
 type vL3CompositeEndpoint struct {
 }
 
-func (e vL3CompositeEndpoint) AddCompositeEndpoints(nsConfig *common.NSConfiguration, ucnfEndpoint *nseconfig.Endpoint) *[]networkservice.NetworkServiceServer {
+func (e vL3CompositeEndpoint) AddCompositeEndpoints(nsConfig *common.NSConfiguration, ucnfEndpoint *nseconfig.Endpoint, backend config.UniversalCNFBackend, conflicts config.SubnetConflictDetector) *[]networkservice.NetworkServiceServer {
 
 	logrus.WithFields(logrus.Fields{
 		"prefixPool":         nsConfig.IPAddress,
 		"nsConfig.IPAddress": nsConfig.IPAddress,
 	}).Infof("Creating vL3 IPAM endpoint")
 
-	var nsRemoteIpList []string
-	nsRemoteIpListStr, ok := os.LookupEnv("NSM_REMOTE_NS_IP_LIST")
-	if ok {
-		nsRemoteIpList = strings.Split(nsRemoteIpListStr, ",")
+	// the endpoint subnets and the vL3 pools have one prefix per address family
+	var vl3Pools []string
+	for _, pool := range ucnfEndpoint.VL3.IPAM.Pools() {
+		vl3Pools = append(vl3Pools, pool.Prefix)
+	}
+	peerSelector, err := nseconfig.ParseSelector(ucnfEndpoint.VL3.PeerSelector)
+	if err != nil {
+		logrus.Errorf("Invalid vL3 peer selector, connecting to all peers: %v", err)
 	}
 	compositeEndpoints := []networkservice.NetworkServiceServer{
-		newVL3ConnectComposite(nsConfig, nsConfig.IPAddress,
-			&vppagent.UniversalCNFVPPAgentBackend{}, nsRemoteIpList, func() string {
+		newVL3ConnectComposite(nsConfig, strings.Split(nsConfig.IPAddress, ","),
+			backend, ucnfEndpoint.VL3.RemoteNsIPList, func() string {
 				return ucnfEndpoint.NseName
-			}, ucnfEndpoint.VL3.IPAM.DefaultPrefixPool, ucnfEndpoint.VL3.IPAM.ServerAddress, ucnfEndpoint.NseControl.ConnectivityDomain),
+			}, vl3Pools, ucnfEndpoint.VL3.IPAM.ServerAddress, ucnfEndpoint.NseControl.ConnectivityDomain,
+			ucnfEndpoint.ClusterName, conflicts, ucnfEndpoint.Interface, peerSelector),
 	}
 
 	return &compositeEndpoints
@@ -98,6 +117,19 @@ func main() {
 	mainFlags := &Flags{}
 	mainFlags.Process()
 
+	source, err := ucnf.NewSource(mainFlags.ConfigPath, mainFlags.ConfigMap, mainFlags.Format)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+
+	if mainFlags.Verify {
+		if err := ucnf.VerifyConfig(context.Background(), source, mainFlags.Output, os.Stdout); err != nil {
+			logrus.Error(err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
 	InitializeMetrics()
 
 	// Capture signals to cleanup before exiting
@@ -106,10 +138,18 @@ func main() {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 	vl3 := vL3CompositeEndpoint{}
-	ucnfNse := ucnf.NewUcnfNse(mainFlags.ConfigPath, mainFlags.Verify, &vppagent.UniversalCNFVPPAgentBackend{}, vl3, ctx)
+	ucnfNse := ucnf.NewUcnfNse(source, mainFlags.AllowInvalid, vl3, ctx)
 	logrus.Info("endpoint started")
 
 	defer ucnfNse.Cleanup()
+
+	if mainFlags.Watch {
+		go func() {
+			if err := ucnfNse.Watch(ctx); err != nil {
+				logrus.Errorf("Unable to watch the configuration: %v", err)
+			}
+		}()
+	}
 	<-c
 }
 
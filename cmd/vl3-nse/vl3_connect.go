@@ -3,11 +3,11 @@ package main
 import (
 	"context"
 	"os"
+	"strconv"
 	"sync"
 
 	"github.com/golang/protobuf/ptypes/empty"
 	"github.com/networkservicemesh/networkservicemesh/controlplane/api/connection"
-	"github.com/networkservicemesh/networkservicemesh/controlplane/api/connection/mechanisms/memif"
 	"github.com/networkservicemesh/networkservicemesh/controlplane/api/connectioncontext"
 	"github.com/networkservicemesh/networkservicemesh/controlplane/api/networkservice"
 	"github.com/networkservicemesh/networkservicemesh/controlplane/api/registry"
@@ -16,11 +16,12 @@ import (
 	"github.com/networkservicemesh/networkservicemesh/sdk/common"
 	"github.com/networkservicemesh/networkservicemesh/sdk/endpoint"
 	"github.com/sirupsen/logrus"
-	"go.ligato.io/vpp-agent/v3/proto/ligato/vpp"
 	"google.golang.org/grpc"
 
 	"github.com/cisco-app-networking/nsm-nse/pkg/metrics"
+	"github.com/cisco-app-networking/nsm-nse/pkg/nseconfig"
 	"github.com/cisco-app-networking/nsm-nse/pkg/universal-cnf/config"
+	"github.com/cisco-app-networking/nsm-nse/pkg/universal-cnf/dataplane"
 )
 
 const (
@@ -28,6 +29,8 @@ const (
 	NSREGISTRY_PORT = "5000"
 	NSCLIENT_PORT   = "5001"
 	LABEL_NSESOURCE = "vl3Nse/nseSource/endpointName"
+	// LABEL_LOCALSUBNETS tells the peer whether the subnets are calculated locally
+	LABEL_LOCALSUBNETS = "vl3Nse/localSubnets"
 )
 
 type vL3PeerState int
@@ -49,25 +52,31 @@ type vL3NsePeer struct {
 	connErr                   error
 	excludedPrefixes          []string
 	remoteIp                  string
+	// the client interface of the connection to the peer
+	dpconfig *dataplane.Config
 }
 
 type vL3ConnectComposite struct {
 	sync.RWMutex
 	//endpoint.BaseCompositeEndpoint
-	myEndpointName     string
-	nsConfig           *common.NSConfiguration
-	defaultRouteIpCidr string
-	remoteNsIpList     []string
-	vL3NetCidr         string
-	vl3NsePeers        map[string]*vL3NsePeer
-	nsRegGrpcClient    *grpc.ClientConn
-	nsDiscoveryClient  registry.NetworkServiceDiscoveryClient
+	myEndpointName      string
+	nsConfig            *common.NSConfiguration
+	defaultRouteIpCidrs []string
+	remoteNsIpList      []string
+	vL3NetCidrs         []string
+	vl3NsePeers         map[string]*vL3NsePeer
+	nsRegGrpcClient     *grpc.ClientConn
+	nsDiscoveryClient   registry.NetworkServiceDiscoveryClient
 	//nsClient networkservice.NetworkServiceClient
 	nsmClient      *client.NsmClient
 	backend        config.UniversalCNFBackend
 	myNseNameFunc  fnGetNseName
 	connDomain     string
 	nseControlAddr string
+	clusterName    string
+	conflicts      config.SubnetConflictDetector
+	iface          nseconfig.Interface
+	peerSelector   nseconfig.Selector
 }
 
 func (peer *vL3NsePeer) setPeerState(state vL3PeerState) {
@@ -149,12 +158,15 @@ func (vxc *vL3ConnectComposite) processPeerRequest(vl3SrcEndpointName string, re
 	peer.excludedPrefixes = removeDuplicates(append(peer.excludedPrefixes, incoming.Context.IpContext.ExcludedPrefixes...))
 	incoming.Context.IpContext.ExcludedPrefixes = peer.excludedPrefixes
 	peer.connHdl = request.GetConnection()
-
-	/* tell my peer to route to me for my vL3NetCidr */
-	mySubnetRoute := connectioncontext.Route{
-		Prefix: vxc.vL3NetCidr,
+	vxc.reportPeerSubnets(vl3SrcEndpointName, incoming.Context.IpContext.SrcRoutes, incoming.GetLabels())
+	vxc.setLocalSubnetsLabel(incoming.Labels)
+
+	/* tell my peer to route to me for my vL3NetCidrs */
+	for _, cidr := range vxc.vL3NetCidrs {
+		incoming.Context.IpContext.DstRoutes = append(incoming.Context.IpContext.DstRoutes, &connectioncontext.Route{
+			Prefix: cidr,
+		})
 	}
-	incoming.Context.IpContext.DstRoutes = append(incoming.Context.IpContext.DstRoutes, &mySubnetRoute)
 	peer.state = PEER_STATE_CONN_RX
 	return nil
 }
@@ -182,11 +194,12 @@ func (vxc *vL3ConnectComposite) Request(ctx context.Context,
 		_ = vxc.processPeerRequest(vl3SrcEndpointName, request, request.Connection)
 
 	} else {
-		/* set NSC route to this NSE for full vL3 CIDR */
-		nscVL3Route := connectioncontext.Route{
-			Prefix: vxc.defaultRouteIpCidr,
+		/* set NSC routes to this NSE for the full vL3 CIDRs */
+		for _, cidr := range vxc.defaultRouteIpCidrs {
+			request.Connection.Context.IpContext.DstRoutes = append(request.Connection.Context.IpContext.DstRoutes, &connectioncontext.Route{
+				Prefix: cidr,
+			})
 		}
-		request.Connection.Context.IpContext.DstRoutes = append(request.Connection.Context.IpContext.DstRoutes, &nscVL3Route)
 
 		vxc.SetMyNseName(request)
 		logger.Infof("vL3ConnectComposite serviceRegistry.DiscoveryClient")
@@ -236,7 +249,7 @@ func (vxc *vL3ConnectComposite) Request(ctx context.Context,
 			logger.Error(err)
 		} else {
 			err = serviceRegistry.RegisterWorkload(ctx, conn.Labels, vxc.connDomain,
-				processWorkloadIps(conn.Context.IpContext.SrcIpAddr, ";"), config.GetEndpointName())
+				processWorkloadIps(conn.Context.IpContext.SrcIpAddr, ";"), config.GetEndpointName(vxc.clusterName))
 			if err != nil {
 				logger.Error(err)
 			}
@@ -267,7 +280,7 @@ func (vxc *vL3ConnectComposite) Close(ctx context.Context, conn *connection.Conn
 			logrus.Error(err)
 		} else {
 			err = serviceRegistry.RemoveWorkload(ctx, conn.Labels, vxc.connDomain,
-				processWorkloadIps(conn.Context.IpContext.SrcIpAddr, ";"), config.GetEndpointName())
+				processWorkloadIps(conn.Context.IpContext.SrcIpAddr, ";"), config.GetEndpointName(vxc.clusterName))
 			if err != nil {
 				logrus.Error(err)
 			}
@@ -281,6 +294,40 @@ func (vxc *vL3ConnectComposite) Close(ctx context.Context, conn *connection.Conn
 	return &empty.Empty{}, nil
 }
 
+// Stop closes the connections to the vL3 peers and the registry connection
+// when the endpoint is replaced, the connections from the peers are closed
+// with the endpoint
+func (vxc *vL3ConnectComposite) Stop() {
+	vxc.Lock()
+	peers := make([]*vL3NsePeer, 0, len(vxc.vl3NsePeers))
+	for _, peer := range vxc.vl3NsePeers {
+		peers = append(peers, peer)
+	}
+	vxc.Unlock()
+
+	for _, peer := range peers {
+		peer.Lock()
+		if peer.state == PEER_STATE_CONN && peer.connHdl != nil {
+			if err := vxc.nsmClient.Close(context.TODO(), peer.connHdl); err != nil {
+				logrus.Errorf("Error closing the connection to vL3 peer %s: %v", peer.endpointName, err)
+			}
+			if err := vxc.backend.ProcessDPConfig(peer.dpconfig, false); err != nil {
+				logrus.Errorf("Error removing the interface of vL3 peer %s: %v", peer.endpointName, err)
+			}
+		}
+		peer.state = PEER_STATE_NOTCONN
+		peer.connHdl = nil
+		peer.dpconfig = nil
+		peer.Unlock()
+	}
+
+	if vxc.nsRegGrpcClient != nil {
+		if err := vxc.nsRegGrpcClient.Close(); err != nil {
+			logrus.Errorf("Error closing the NS registry connection: %v", err)
+		}
+	}
+}
+
 // Name returns the composite name
 func (vxc *vL3ConnectComposite) Name() string {
 	return "vL3 NSE"
@@ -293,6 +340,11 @@ func (vxc *vL3ConnectComposite) processNsEndpoints(ctx context.Context, response
 	// just create a new logger for this go thread
 	logger := logrus.New()
 	for _, vl3endpoint := range response.GetNetworkServiceEndpoints() {
+		if !vxc.peerSelector.Matches(vl3endpoint.GetLabels()) {
+			logger.Infof("Skipping vL3 service %s endpoint %s not selected by %s", vl3endpoint.NetworkServiceName,
+				vl3endpoint.GetName(), vxc.peerSelector)
+			continue
+		}
 		if vl3endpoint.GetName() != vxc.GetMyNseName() {
 			logger.Infof("Found vL3 service %s peer %s", vl3endpoint.NetworkServiceName,
 				vl3endpoint.GetName())
@@ -341,7 +393,7 @@ func (vxc *vL3ConnectComposite) createPeerConnectionRequest(ctx context.Context,
 	logger.WithFields(logrus.Fields{
 		"peer.Endpoint": peer.endpointName,
 	}).Infof("Performing connect to peer")
-	dpconfig := &vpp.ConfigData{}
+	dpconfig := vxc.backend.NewDPConfig()
 	peer.connHdl, peer.connErr = vxc.performPeerConnectRequest(ctx, peer, routes, dpconfig, logger)
 	if peer.connErr != nil {
 		logger.WithFields(logrus.Fields{
@@ -357,6 +409,7 @@ func (vxc *vL3ConnectComposite) createPeerConnectionRequest(ctx context.Context,
 		return peer.connErr
 	}
 
+	peer.dpconfig = dpconfig
 	peer.state = PEER_STATE_CONN
 	logger.WithFields(logrus.Fields{
 		"peer.Endpoint": peer.endpointName,
@@ -364,24 +417,54 @@ func (vxc *vL3ConnectComposite) createPeerConnectionRequest(ctx context.Context,
 	return nil
 }
 
-func (vxc *vL3ConnectComposite) performPeerConnectRequest(ctx context.Context, peer *vL3NsePeer, routes []string, dpconfig interface{}, logger logrus.FieldLogger) (*connection.Connection, error) {
+func (vxc *vL3ConnectComposite) performPeerConnectRequest(ctx context.Context, peer *vL3NsePeer, routes []string, dpconfig *dataplane.Config, logger logrus.FieldLogger) (*connection.Connection, error) {
 	/* expected to be called with peer.Lock() */
 	go func() {
 		metrics.PerormedConnRequests.Inc()
 	}()
 	ifName := peer.endpointName
 	vxc.nsmClient.ClientLabels[LABEL_NSESOURCE] = vxc.GetMyNseName()
-	conn, err := vxc.nsmClient.ConnectToEndpoint(ctx, peer.remoteIp, peer.endpointName, peer.networkServiceManagerName, ifName, memif.MECHANISM, "VPP interface "+ifName, routes)
+	vxc.setLocalSubnetsLabel(vxc.nsmClient.ClientLabels)
+	conn, err := vxc.nsmClient.ConnectToEndpoint(ctx, peer.remoteIp, peer.endpointName, peer.networkServiceManagerName, ifName, vxc.iface.Mechanism.NSMMechanism(), "VPP interface "+ifName, routes)
 	if err != nil {
 		logger.Errorf("Error creating %s: %v", ifName, err)
 		return nil, err
 	}
 
-	err = vxc.backend.ProcessClient(dpconfig, ifName, conn)
+	if err := vxc.backend.ProcessClient(dpconfig, ifName, vxc.iface, conn); err != nil {
+		logger.Errorf("Error processing the client interface %s: %v", ifName, err)
+		if cerr := vxc.nsmClient.Close(ctx, conn); cerr != nil {
+			logger.Errorf("Error closing the connection %s: %v", conn.GetId(), cerr)
+		}
+		return nil, err
+	}
+	vxc.reportPeerSubnets(peer.endpointName, conn.GetContext().GetIpContext().GetDstRoutes(), conn.GetLabels())
 
 	return conn, nil
 }
 
+// reportPeerSubnets passes the vL3 subnets announced by the peer to the
+// subnet conflict detection, with whether the peer calculated them locally
+func (vxc *vL3ConnectComposite) reportPeerSubnets(peerName string, routes []*connectioncontext.Route, labels map[string]string) {
+	if vxc.conflicts == nil {
+		return
+	}
+	var subnets []string
+	for _, r := range routes {
+		subnets = append(subnets, r.Prefix)
+	}
+	vxc.conflicts.PeerSubnets(peerName, subnets, labels[LABEL_LOCALSUBNETS] == "true")
+}
+
+// setLocalSubnetsLabel tells the peer whether the subnets of this NSE are
+// calculated locally
+func (vxc *vL3ConnectComposite) setLocalSubnetsLabel(labels map[string]string) {
+	if vxc.conflicts == nil || labels == nil {
+		return
+	}
+	labels[LABEL_LOCALSUBNETS] = strconv.FormatBool(vxc.conflicts.LocalSubnets())
+}
+
 func (vxc *vL3ConnectComposite) ConnectPeerEndpoint(ctx context.Context, peer *vL3NsePeer, logger logrus.FieldLogger) error {
 	/* expected to be called with peer.Lock() */
 	// build connection object
@@ -400,7 +483,7 @@ func (vxc *vL3ConnectComposite) ConnectPeerEndpoint(ctx context.Context, peer *v
 			"endpointName":              peer.endpointName,
 			"networkServiceManagerName": peer.networkServiceManagerName,
 		}).Info("request remote connection")
-		routes := []string{vxc.vL3NetCidr}
+		routes := vxc.vL3NetCidrs
 		return vxc.createPeerConnectionRequest(ctx, peer, routes, logger)
 	case PEER_STATE_CONN:
 		logger.WithFields(logrus.Fields{
@@ -445,7 +528,7 @@ func removeDuplicates(elements []string) []string {
 }
 
 // newVL3ConnectComposite creates a new VL3 composite
-func newVL3ConnectComposite(configuration *common.NSConfiguration, vL3NetCidr string, backend config.UniversalCNFBackend, remoteIpList []string, getNseName fnGetNseName, defaultCdPrefix, nseControlAddr, connDomain string) *vL3ConnectComposite {
+func newVL3ConnectComposite(configuration *common.NSConfiguration, vL3NetCidrs []string, backend config.UniversalCNFBackend, remoteIpList []string, getNseName fnGetNseName, defaultCdPrefixes []string, nseControlAddr, connDomain, clusterName string, conflicts config.SubnetConflictDetector, iface nseconfig.Interface, peerSelector nseconfig.Selector) *vL3ConnectComposite {
 	nsRegAddr, ok := os.LookupEnv("NSREGISTRY_ADDR")
 	if !ok {
 		nsRegAddr = NSREGISTRY_ADDR
@@ -535,19 +618,23 @@ func newVL3ConnectComposite(configuration *common.NSConfiguration, vL3NetCidr st
 	*/
 
 	newVL3ConnectComposite := &vL3ConnectComposite{
-		nsConfig:           configuration,
-		remoteNsIpList:     remoteIpList,
-		vL3NetCidr:         vL3NetCidr,
-		myEndpointName:     "",
-		vl3NsePeers:        make(map[string]*vL3NsePeer),
-		nsRegGrpcClient:    nsRegGrpcClient,
-		nsDiscoveryClient:  nsDiscoveryClient,
-		nsmClient:          nsmClient,
-		backend:            backend,
-		myNseNameFunc:      getNseName,
-		defaultRouteIpCidr: defaultCdPrefix,
-		nseControlAddr:     nseControlAddr,
-		connDomain:         connDomain,
+		nsConfig:            configuration,
+		remoteNsIpList:      remoteIpList,
+		vL3NetCidrs:         vL3NetCidrs,
+		myEndpointName:      "",
+		vl3NsePeers:         make(map[string]*vL3NsePeer),
+		nsRegGrpcClient:     nsRegGrpcClient,
+		nsDiscoveryClient:   nsDiscoveryClient,
+		nsmClient:           nsmClient,
+		backend:             backend,
+		myNseNameFunc:       getNseName,
+		defaultRouteIpCidrs: defaultCdPrefixes,
+		nseControlAddr:      nseControlAddr,
+		connDomain:          connDomain,
+		clusterName:         clusterName,
+		conflicts:           conflicts,
+		iface:               iface,
+		peerSelector:        peerSelector,
 	}
 
 	logrus.Infof("newVL3ConnectComposite returning")
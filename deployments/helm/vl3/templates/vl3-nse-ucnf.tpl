@@ -93,6 +93,7 @@ metadata:
   namespace: {{ .Release.Namespace }}
 data:
   config.yaml: |
+    apiVersion: v1
     endpoints:
     - name: {{ .Values.nsm.serviceName | quote }}
       labels:
@@ -112,6 +113,10 @@ data:
           serverAddress: "ipam-{{ .Values.nseControl.nsr.addr }}:50051"
 {{- end }}
           prefixLength: {{ .Values.nseControl.ipam.prefixLength }}
+{{- with .Values.nseControl.ipam.prefixPools }}
+          prefixPools:
+{{ toYaml . | indent 12 }}
+{{- end }}
           routes: []
        ifName: "endpoint0"
 {{- if .Values.nseControl.nameserver }}
@@ -8,7 +8,10 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
-const vl3Subsystem = "vl3"
+const (
+	vl3Subsystem  = "vl3"
+	ucnfSubsystem = "ucnf"
+)
 
 var (
 	ReceivedConnRequests = prometheus.NewCounter(
@@ -39,6 +42,41 @@ var (
 			Name:      "active_workload",
 			Help:      "Number of currently active workloads",
 		})
+	ClientConnectionsDown = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "nse",
+			Subsystem: ucnfSubsystem,
+			Name:      "client_connections_down_total",
+			Help:      "Total number of init action client connections found down",
+		}, []string{"client"})
+	ClientReconnects = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "nse",
+			Subsystem: ucnfSubsystem,
+			Name:      "client_reconnects_total",
+			Help:      "Total number of init action client reconnect attempts by result",
+		}, []string{"client", "result"})
+	ClientLastReconnect = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "nse",
+			Subsystem: ucnfSubsystem,
+			Name:      "client_last_reconnect_timestamp_seconds",
+			Help:      "Time of the last successful reconnect of an init action client",
+		}, []string{"client"})
+	VPPDrift = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "nse",
+			Subsystem: ucnfSubsystem,
+			Name:      "vpp_drift_total",
+			Help:      "Total number of VPP configuration items found missing, modified or extra by the reconciler",
+		}, []string{"kind"})
+	VPPCorrections = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "nse",
+			Subsystem: ucnfSubsystem,
+			Name:      "vpp_corrections_total",
+			Help:      "Total number of corrections of the vpp-agent to the desired configuration by result",
+		}, []string{"result"})
 )
 
 func ServeMetrics(addr string, path string) {
@@ -46,6 +84,11 @@ func ServeMetrics(addr string, path string) {
 	prometheus.MustRegister(PerormedConnRequests)
 	prometheus.MustRegister(FailedFindNetworkService)
 	prometheus.MustRegister(ActiveWorkloadCount)
+	prometheus.MustRegister(ClientConnectionsDown)
+	prometheus.MustRegister(ClientReconnects)
+	prometheus.MustRegister(ClientLastReconnect)
+	prometheus.MustRegister(VPPDrift)
+	prometheus.MustRegister(VPPCorrections)
 
 	http.Handle(path, promhttp.Handler())
 
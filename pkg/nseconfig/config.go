@@ -1,28 +1,78 @@
 package nseconfig
 
 import (
+	"fmt"
+	"reflect"
 	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
 )
 
 type config interface {
+	migrate(root *yaml.Node) error
+	overrideFromEnv() error
 	validate() error
 }
 
 type Config struct {
-	Endpoints []*Endpoint
+	APIVersion string      `yaml:"apiVersion"`
+	Endpoints  []*Endpoint `yaml:"endpoints"`
+
+	// Backend selects the dataplane backend of the universal CNF, vppagent
+	// when not set
+	Backend string `yaml:"backend"`
+
+	// InitActions are run in order of their dependencies before the endpoints
+	// are started
+	InitActions []*InitAction `yaml:"initActions"`
+	// CommandAllowlist are the binaries the init action commands may run, all
+	// binaries are allowed when empty
+	CommandAllowlist []string `yaml:"commandAllowlist"`
+	// MaxParallelClients limits the client init actions connecting at the
+	// same time, 8 when not set
+	MaxParallelClients int `yaml:"maxParallelClients"`
+
+	// VPPAgent configures the vppagent backend
+	VPPAgent VPPAgent `yaml:"vppAgent"`
+
+	// Warnings collects the deprecation notices of the migration
+	Warnings []error `yaml:"-"`
 }
 
 type Endpoint struct {
 	Name   string `yaml:"name"`
 	Labels Labels `yaml:"labels"`
 
-	NseName string `yaml:"nseName"` //TODO temporary in order to be able to run examples
+	// NseName is the endpoint name assigned by NSM at runtime
+	NseName string `yaml:"-"`
 
 	NseControl *NseControl `yaml:"nseControl"`
 
+	// PodIP is the IP of the NSE pod, overridden by NSE_POD_IP
+	PodIP string `yaml:"podIP"`
+	// ClusterName is the name of the cluster running the NSE, overridden by CLUSTER_NAME
+	ClusterName string `yaml:"clusterName"`
+	// NatIP enables source NAT of the endpoint interfaces to this IP, overridden by NSE_NAT_IP.
+	// Deprecated: it is replaced by a NAT with a pool of this IP, use NAT.
+	NatIP string `yaml:"natIP"`
+	// NAT configures NAT44 of the endpoint connections
+	NAT *NAT `yaml:"nat"`
+
+	// Interface configures the mechanism and the VPP interfaces of the connections
+	Interface Interface `yaml:"interface"`
+
 	VL3 VL3 `yaml:"vl3"`
 }
 
+// VPPAgent configures the vppagent backend
+type VPPAgent struct {
+	// ReconcileInterval is the period of the reconciliation of the vpp-agent
+	// configuration with the one the backend applied, 30s when not set and
+	// disabled when 0
+	ReconcileInterval *time.Duration `yaml:"reconcileInterval"`
+}
+
 type NseControl struct {
 	Name               string `yaml:"name"`
 	Address            string `yaml:"address"`
@@ -35,29 +85,100 @@ type VL3 struct {
 	Ifname      string   `yaml:"ifName"`
 	NameServers []string `yaml:"nameServers"`
 	DNSZones    []string `yaml:"dnsZones"`
+	// RemoteNsIPList are the addresses of the remote NSM peers, overridden by
+	// the comma separated NSM_REMOTE_NS_IP_LIST
+	RemoteNsIPList []string `yaml:"remoteNsIPList"`
+	// PeerSelector selects the vL3 peers to connect to by their labels, all
+	// endpoints of the network service are peers when not set
+	PeerSelector string `yaml:"peerSelector"`
 }
 
 type IPAM struct {
-	DefaultPrefixPool string   `yaml:"defaultPrefixPool"`
-	PrefixLength      int      `yaml:"prefixLength"`
-	Routes            []string `yaml:"routes"`
-	ServerAddress     string   `yaml:"serverAddress"`
+	DefaultPrefixPool string `yaml:"defaultPrefixPool"`
+	PrefixLength      int    `yaml:"prefixLength"`
+	// PrefixPools are the pools of the other address families of a
+	// dual-stack endpoint, or all pools when DefaultPrefixPool is not set
+	PrefixPools   []PrefixPool `yaml:"prefixPools"`
+	Routes        []string     `yaml:"routes"`
+	ServerAddress string       `yaml:"serverAddress"`
+	// LocalAllocation selects how the endpoint subnets are calculated when
+	// the central IPAM is not available, hash is used when not set
+	LocalAllocation LocalAllocation `yaml:"localAllocation"`
+	// UniqueOctet is the third octet of the subnet calculated by the podOctet
+	// allocation, the octet of PodIP is used when not set. Overridden by
+	// NSE_IPAM_UNIQUE_OCTET
+	UniqueOctet *int `yaml:"uniqueOctet"`
 }
 
 type decoder interface {
 	Decode(v interface{}) error
 }
 
+// DecoderFn decodes the configuration into v, like yaml.Unmarshal or
+// json.Unmarshal do. NewConfig decodes the configuration with it into a
+// generic value, the errors found in the value have no position.
 type DecoderFn func(v interface{}) error
 
 func (d DecoderFn) Decode(v interface{}) error { return d(v) }
 
+// NodeDecoderFn decodes the configuration document into a yaml.Node for
+// NewConfig, which decodes the node into the configuration itself
+type NodeDecoderFn func(node *yaml.Node) error
+
+// Decode calls d with v, NewConfig only decodes into a *yaml.Node
+func (d NodeDecoderFn) Decode(v interface{}) error {
+	node, ok := v.(*yaml.Node)
+	if !ok {
+		return fmt.Errorf("NodeDecoderFn decodes into a *yaml.Node, not a %T", v)
+	}
+	return d(node)
+}
+
+// NewConfig decodes, migrates, expands the environment variable references and
+// validates the configuration. Except for a DecoderFn, the decoder has
+// to support decoding into a *yaml.Node, like the yaml.v3 Decoder does, so
+// that unknown fields can be reported with their position.
 func NewConfig(decoder decoder, cfg config) error {
-	if err := decoder.Decode(cfg); err != nil {
+	root := &yaml.Node{}
+	if err := decodeNode(decoder, root); err != nil {
+		return err
+	}
+
+	if err := cfg.migrate(root); err != nil {
 		return err
 	}
 
-	return cfg.validate()
+	var errs InvalidConfigErrors
+	errs = append(errs, expandEnv(root, "")...)
+	errs = append(errs, unknownFields(root, reflect.TypeOf(cfg), "")...)
+
+	if err := root.Decode(cfg); err != nil {
+		return err
+	}
+
+	errs = appendErrors(errs, "", cfg.overrideFromEnv())
+	errs = appendErrors(errs, "", cfg.validate())
+	resolvePositions(root, errs)
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// decodeNode decodes the configuration document into root, a DecoderFn
+// decodes it into a generic value that is encoded into root
+func decodeNode(decoder decoder, root *yaml.Node) error {
+	d, ok := decoder.(DecoderFn)
+	if !ok {
+		return decoder.Decode(root)
+	}
+
+	var doc interface{}
+	if err := d(&doc); err != nil {
+		return err
+	}
+	return root.Encode(doc)
 }
 
 func empty(s string) bool {
@@ -2,9 +2,12 @@ package nseconfig
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"net"
+	"os"
 	"testing"
+	"time"
 
 	"gopkg.in/yaml.v3"
 	"gotest.tools/assert"
@@ -12,13 +15,15 @@ import (
 
 func TestNewConfig(t *testing.T) {
 	for name, tc := range map[string]struct {
-		file   string
-		config *Config
-		err    error
+		file     string
+		env      map[string]string
+		config   *Config
+		warnings []string
+		err      error
 	}{
 		"success": {
 			file: testFile1,
-			config: &Config{Endpoints: []*Endpoint{{NseControl: &NseControl{
+			config: &Config{APIVersion: APIVersion, Endpoints: []*Endpoint{{NseControl: &NseControl{
 				Name:               "wcm1",
 				Address:            "golang.com:9000",
 				AccessToken:        "123123",
@@ -28,15 +33,16 @@ func TestNewConfig(t *testing.T) {
 					DefaultPrefixPool: "192.168.33.0/24",
 					PrefixLength:      24,
 					Routes:            []string{"192.168.34.0/24"},
-					ServerAddress:     "ipam-example.wcm-cisco.com",
+					ServerAddress:     "ipam-example.wcm-cisco.com:50051",
 				},
 				Ifname:      "nsm3",
-				NameServers: []string{"nms.google.com", "nms.google.com2"},
+				NameServers: []string{"8.8.8.8", "2001:4860:4860::8888"},
+				DNSZones:    []string{"example.com", "cluster.local."},
 			}}}},
 		},
 		"success-minimal-config": {
 			file: testFile3,
-			config: &Config{Endpoints: []*Endpoint{{VL3: VL3{
+			config: &Config{APIVersion: APIVersion, Endpoints: []*Endpoint{{VL3: VL3{
 				IPAM: IPAM{
 					DefaultPrefixPool: "192.168.33.0/24",
 					Routes:            []string{"192.168.34.0/24"},
@@ -47,16 +53,223 @@ func TestNewConfig(t *testing.T) {
 		"validation-errors": {
 			file: testFile2,
 			err: InvalidConfigErrors([]error{
-				fmt.Errorf("nseControl address is not set"),
-				fmt.Errorf("nseControl name is not set"),
-				fmt.Errorf("connectivity domain is not set"),
-				fmt.Errorf("prefix pool is not a valid subnet: %s", &net.ParseError{Type: "CIDR address", Text: "invalid-pull"}),
-				fmt.Errorf("route nr %d with value %s is not a valid subnet: %s", 0, "invalid-route1", &net.ParseError{Type: "CIDR address", Text: "invalid-route1"}),
-				fmt.Errorf("route nr %d with value %s is not a valid subnet: %s", 1, "invalid-route2", &net.ParseError{Type: "CIDR address", Text: "invalid-route2"}),
+				fmt.Errorf("line 5, column 16: nseControl address is not set"),
+				fmt.Errorf("line 4, column 13: nseControl name is not set"),
+				fmt.Errorf("line 4, column 7: connectivity domain is not set"),
+				fmt.Errorf("line 8, column 28: prefix pool is not a valid subnet: %s", &net.ParseError{Type: "CIDR address", Text: "invalid-pull"}),
+				fmt.Errorf("line 10, column 18: route nr %d with value %s is not a valid subnet: %s", 0, "invalid-route1", &net.ParseError{Type: "CIDR address", Text: "invalid-route1"}),
+				fmt.Errorf("line 10, column 34: route nr %d with value %s is not a valid subnet: %s", 1, "invalid-route2", &net.ParseError{Type: "CIDR address", Text: "invalid-route2"}),
+			}),
+		},
+		"semantic-errors": {
+			file: testFile7,
+			err: InvalidConfigErrors([]error{
+				fmt.Errorf("line 8, column 23: prefix length 16 is shorter than the prefix pool 192.168.33.0/24 mask length 24"),
+				fmt.Errorf("line 9, column 18: route nr 0 with value 192.168.33.128/25 overlaps the prefix pool 192.168.33.0/24"),
+				fmt.Errorf("line 9, column 50: route nr 2 with value 10.1.2.0/24 overlaps route nr 1 with value 10.1.0.0/16"),
+				fmt.Errorf("line 10, column 24: ipam server address ipam.example.com is not in host:port form: address ipam.example.com: missing port in address"),
+				fmt.Errorf("line 12, column 21: name server nms.google.com is not a valid IP address"),
+				fmt.Errorf("line 13, column 18: dns zone -example.com is not a valid domain name: label \"-example\" must not start or end with a hyphen"),
+				fmt.Errorf("line 18, column 23: prefix length 130 exceeds the address length 128 of the prefix pool fd00::/64"),
+				fmt.Errorf("line 19, column 24: ipam server address ipam.example.com:http is not in host:port form: port http is not in range 1-65535"),
+				fmt.Errorf("line 22, column 18: dns zone example..com is not a valid domain name: label \"\" length must be between 1 and 63 characters"),
+				fmt.Errorf("line 23, column 11: endpoint nr 2 shares the name \"vl3\" and interface \"endpoint0\" with endpoint nr 0"),
+				fmt.Errorf("line 26, column 28: prefix pool 192.168.0.0/16 of endpoint nr 2 overlaps the prefix pool 192.168.33.0/24 of endpoint nr 0"),
+			}),
+		},
+		"unknown-fields": {
+			file: testFile4,
+			err: InvalidConfigErrors([]error{
+				fmt.Errorf("line 6, column 9: unknown field endpoints[0].vl3.ipam.prefixlength"),
+				fmt.Errorf("line 8, column 7: unknown field endpoints[0].vl3.ifname"),
+			}),
+		},
+		"migrate-unversioned": {
+			file: testFile5,
+			config: &Config{
+				APIVersion: APIVersion,
+				Endpoints: []*Endpoint{{Name: "vl3", VL3: VL3{
+					IPAM: IPAM{
+						DefaultPrefixPool: "192.168.33.0/24",
+					},
+					Ifname: "endpoint0",
+				}}},
+			},
+			warnings: []string{
+				"apiVersion is not set, migrating the configuration to v1",
+				"line 4, column 5: endpoints[0].nseName is deprecated and ignored, the name is assigned by NSM",
+			},
+		},
+		"env-expansion": {
+			file: testFile8,
+			env: map[string]string{
+				"NSE_NAME":              "vl3-service",
+				"PREFIX_LENGTH":         "26",
+				"NSE_POD_IP":            "10.244.1.7",
+				"NSM_REMOTE_NS_IP_LIST": "172.18.0.2, 172.18.0.3",
+				"NSE_IPAM_UNIQUE_OCTET": "12",
+			},
+			config: &Config{APIVersion: APIVersion, Endpoints: []*Endpoint{{
+				Name:        "vl3-service",
+				PodIP:       "10.244.1.7",
+				ClusterName: "cluster-1",
+				NAT: &NAT{
+					Pools:              []NATPool{{FirstIP: "${NOT_EXPANDED}"}},
+					LegacyPortForwards: true,
+				},
+				VL3: VL3{
+					IPAM: IPAM{
+						DefaultPrefixPool: "192.168.0.0/16",
+						PrefixLength:      26,
+						UniqueOctet:       intPtr(12),
+					},
+					Ifname:         "endpoint0",
+					RemoteNsIPList: []string{"172.18.0.2", "172.18.0.3"},
+				},
+			}}},
+			warnings: []string{
+				"endpoints[0].natIP (or NSE_NAT_IP) is deprecated, use endpoints[0].nat",
+			},
+		},
+		"env-errors": {
+			file: testFile9,
+			env: map[string]string{
+				"NSE_IPAM_UNIQUE_OCTET": "x",
+			},
+			err: InvalidConfigErrors([]error{
+				fmt.Errorf("line 4, column 11: endpoints[0].name: environment variable NSE_NAME is not set"),
+				fmt.Errorf("line 7, column 28: endpoints[0].vl3.ipam.defaultPrefixPool: unterminated variable reference ${POOL"),
+				fmt.Errorf("line 7, column 9: NSE_IPAM_UNIQUE_OCTET value x is not valid: strconv.Atoi: parsing \"x\": invalid syntax"),
+				fmt.Errorf("line 7, column 28: prefix pool is not a valid subnet: %s", &net.ParseError{Type: "CIDR address", Text: "${POOL"}),
+			}),
+		},
+		"dual-stack": {
+			file: testFile10,
+			config: &Config{APIVersion: APIVersion, Endpoints: []*Endpoint{{VL3: VL3{
+				IPAM: IPAM{
+					DefaultPrefixPool: "192.168.0.0/16",
+					PrefixLength:      24,
+					PrefixPools: []PrefixPool{
+						{Family: IPv6, Prefix: "fd00:10::/48", PrefixLength: 64},
+					},
+					Routes: []string{"10.1.0.0/16", "fd00:20::/48"},
+				},
+				Ifname: "endpoint0",
+			}}}},
+		},
+		"dual-stack-errors": {
+			file: testFile11,
+			err: InvalidConfigErrors([]error{
+				fmt.Errorf("line 7, column 22: prefix pool fd00::/56 is not an ipv4 subnet"),
+				fmt.Errorf("line 8, column 22: prefix pool 10.0.0.0/16 is not an ipv6 subnet"),
+				fmt.Errorf("line 9, column 49: prefix length 130 exceeds the address length 32 of the prefix pool 10.0.0.0/16"),
+				fmt.Errorf("line 9, column 22: prefix pool 10.0.0.0/16 is not the only ipv4 pool of the endpoint"),
+				fmt.Errorf("line 9, column 22: prefix pool 10.0.0.0/16 overlaps the prefix pool 10.0.0.0/16"),
+				fmt.Errorf("line 10, column 22: address family ipx is not one of ipv4, ipv6"),
+				fmt.Errorf("line 10, column 35: prefix pool fd00::/48 is not the only ipv6 pool of the endpoint"),
+				fmt.Errorf("line 10, column 35: prefix pool fd00::/48 overlaps the prefix pool fd00::/56"),
+				fmt.Errorf("line 11, column 18: route nr 0 with value fd00:0:0:1::/64 overlaps the prefix pool fd00::/56"),
+				fmt.Errorf("line 11, column 18: route nr 0 with value fd00:0:0:1::/64 overlaps the prefix pool fd00::/48"),
+			}),
+		},
+		"interface": {
+			file: testFile12,
+			config: &Config{APIVersion: APIVersion, Endpoints: []*Endpoint{{
+				Interface: Interface{
+					Mechanism: MechanismMemif,
+					RxMode:    RxModePolling,
+					Memif:     Memif{RingSize: 2048, BufferSize: 4096, Queues: 4},
+				},
+				VL3: VL3{
+					IPAM:   IPAM{DefaultPrefixPool: "192.168.0.0/16", PrefixLength: 24},
+					Ifname: "endpoint0",
+				},
+			}}},
+		},
+		"interface-errors": {
+			file: testFile13,
+			err: InvalidConfigErrors([]error{
+				fmt.Errorf("line 6, column 18: mechanism vhost is not one of memif, kernel"),
+				fmt.Errorf("line 7, column 15: rx-mode busy is not one of polling, interrupt, adaptive"),
+				fmt.Errorf("line 9, column 19: ring size 1000 is not a power of 2 in range 8-16384"),
+				fmt.Errorf("line 10, column 17: queue count 256 is not in range 0-255"),
+				fmt.Errorf("line 18, column 9: memif parameters are set for the kernel mechanism"),
+			}),
+		},
+		"nat": {
+			file: testFile17,
+			config: &Config{APIVersion: APIVersion, Endpoints: []*Endpoint{{
+				Name: "vl3",
+				NAT: &NAT{
+					Pools: []NATPool{
+						{FirstIP: "192.0.2.1"},
+						{FirstIP: "192.0.2.10", LastIP: "192.0.2.20", TwiceNAT: true},
+					},
+					OutsideInterfaces: []string{"eth0"},
+					PortForwards: []PortForward{
+						{Name: "http", ExternalPorts: "8000-8999", LocalPorts: "80", TwiceNAT: true},
+						{Name: "dns", Protocol: ProtocolUDP},
+					},
+				},
+				VL3: VL3{
+					IPAM:   IPAM{DefaultPrefixPool: "192.168.0.0/16"},
+					Ifname: "endpoint0",
+				},
+			}}},
+		},
+		"nat-ip-env": {
+			file: testFile12,
+			env: map[string]string{
+				"NSE_NAT_IP": "192.0.2.1",
+			},
+			config: &Config{APIVersion: APIVersion, Endpoints: []*Endpoint{{
+				NAT: &NAT{
+					Pools:              []NATPool{{FirstIP: "192.0.2.1"}},
+					LegacyPortForwards: true,
+				},
+				Interface: Interface{
+					Mechanism: MechanismMemif,
+					RxMode:    RxModePolling,
+					Memif:     Memif{RingSize: 2048, BufferSize: 4096, Queues: 4},
+				},
+				VL3: VL3{
+					IPAM:   IPAM{DefaultPrefixPool: "192.168.0.0/16", PrefixLength: 24},
+					Ifname: "endpoint0",
+				},
+			}}},
+			warnings: []string{
+				"endpoints[0].natIP (or NSE_NAT_IP) is deprecated, use endpoints[0].nat",
+			},
+		},
+		"nat-errors": {
+			file: testFile18,
+			err: InvalidConfigErrors([]error{
+				fmt.Errorf("line 5, column 12: natIP (or NSE_NAT_IP) is set together with nat"),
+				fmt.Errorf("line 9, column 19: NAT pool address 192.0.2.1 is lower than the first address 192.0.2.10"),
+				fmt.Errorf("line 10, column 20: NAT pool address fd00::1 is not a valid IPv4 address"),
+				fmt.Errorf("line 11, column 27: outside interface name is empty"),
+				fmt.Errorf("line 14, column 21: protocol sctp is not one of tcp, udp"),
+				fmt.Errorf("line 15, column 26: port range 9000-8000 is not valid: last port 8000 is lower than first port 9000"),
+				fmt.Errorf("line 16, column 17: port forward http is declared twice"),
+				fmt.Errorf("line 17, column 23: port range 0-80 is not valid: port 0 is not in range 1-65535"),
+				fmt.Errorf("line 18, column 21: port forward http is twice-NAT and the NAT has no twice-NAT pool"),
+				fmt.Errorf("line 19, column 17: port forward name \"bad name\" does not make a valid label key"),
+			}),
+		},
+		"unsupported-api-version": {
+			file: testFile6,
+			err: InvalidConfigErrors([]error{
+				fmt.Errorf("line 2, column 13: unsupported apiVersion v0, expected v1"),
 			}),
 		},
 	} {
 		t.Run(name, func(t *testing.T) {
+			lookupEnv = func(key string) (string, bool) {
+				value, ok := tc.env[key]
+				return value, ok
+			}
+			defer func() { lookupEnv = os.LookupEnv }()
+
 			cfg := &Config{}
 			err := NewConfig(yaml.NewDecoder(bytes.NewBufferString(tc.file)), cfg)
 			if tc.err != nil {
@@ -66,13 +279,24 @@ func TestNewConfig(t *testing.T) {
 
 				assert.Equal(t, tc.err.Error(), err.Error())
 			} else {
+				var warnings []string
+				for _, w := range cfg.Warnings {
+					warnings = append(warnings, w.Error())
+				}
+				cfg.Warnings = nil
+				assert.DeepEqual(t, tc.warnings, warnings)
 				assert.DeepEqual(t, tc.config, cfg)
 			}
 		})
 	}
 }
 
+func intPtr(i int) *int {
+	return &i
+}
+
 const testFile1 = `
+apiVersion: v1
 endpoints:
   - nseControl:
       name: wcm1
@@ -84,9 +308,10 @@ endpoints:
         defaultPrefixPool: 192.168.33.0/24
         prefixLength: 24
         routes: [192.168.34.0/24]
-        serverAddress: ipam-example.wcm-cisco.com
+        serverAddress: ipam-example.wcm-cisco.com:50051
       ifName: nsm3
-      nameServers: [nms.google.com, nms.google.com2]
+      nameServers: [8.8.8.8, "2001:4860:4860::8888"]
+      dnsZones: [example.com, cluster.local.]
 `
 
 const testFile2 = `
@@ -104,6 +329,7 @@ endpoints:
 `
 
 const testFile3 = `
+apiVersion: v1
 endpoints:
   - vl3:
       ipam:
@@ -111,3 +337,370 @@ endpoints:
         routes: [192.168.34.0/24]
       ifName: endpoint0
 `
+
+const testFile4 = `
+apiVersion: v1
+endpoints:
+  - vl3:
+      ipam:
+        prefixlength: 24
+        defaultPrefixPool: 192.168.33.0/24
+      ifname: endpoint0
+`
+
+const testFile5 = `
+endpoints:
+  - name: vl3
+    nseName: vl3-nse-example
+    vl3:
+      ipam:
+        defaultPrefixPool: 192.168.33.0/24
+      ifName: endpoint0
+`
+
+const testFile6 = `
+apiVersion: v0
+endpoints:
+  - vl3:
+      ipam:
+        defaultPrefixPool: 192.168.33.0/24
+      ifName: endpoint0
+`
+
+const testFile7 = `
+apiVersion: v1
+endpoints:
+  - name: vl3
+    vl3:
+      ipam:
+        defaultPrefixPool: 192.168.33.0/24
+        prefixLength: 16
+        routes: [192.168.33.128/25, 10.1.0.0/16, 10.1.2.0/24]
+        serverAddress: ipam.example.com
+      ifName: endpoint0
+      nameServers: [nms.google.com]
+      dnsZones: [-example.com]
+  - name: vl3-v6
+    vl3:
+      ipam:
+        defaultPrefixPool: fd00::/64
+        prefixLength: 130
+        serverAddress: ipam.example.com:http
+      ifName: endpoint0
+      nameServers: ["fd00::53"]
+      dnsZones: [example..com]
+  - name: vl3
+    vl3:
+      ipam:
+        defaultPrefixPool: 192.168.0.0/16
+      ifName: endpoint0
+`
+
+const testFile8 = `
+apiVersion: v1
+endpoints:
+  - name: ${NSE_NAME}
+    clusterName: ${CLUSTER_NAME:-cluster-1}
+    natIP: $${NOT_EXPANDED}
+    vl3:
+      ipam:
+        defaultPrefixPool: ${POOL:-192.168.0.0/16}
+        prefixLength: ${PREFIX_LENGTH}
+      ifName: endpoint0
+`
+
+const testFile9 = `
+apiVersion: v1
+endpoints:
+  - name: ${NSE_NAME}
+    vl3:
+      ipam:
+        defaultPrefixPool: ${POOL
+      ifName: endpoint0
+`
+
+const testFile10 = `
+apiVersion: v1
+endpoints:
+  - vl3:
+      ipam:
+        defaultPrefixPool: 192.168.0.0/16
+        prefixLength: 24
+        prefixPools:
+          - {family: ipv6, prefix: "fd00:10::/48", prefixLength: 64}
+        routes: [10.1.0.0/16, "fd00:20::/48"]
+      ifName: endpoint0
+`
+
+const testFile11 = `
+apiVersion: v1
+endpoints:
+  - vl3:
+      ipam:
+        prefixPools:
+          - {family: ipv4, prefix: "fd00::/56"}
+          - {family: ipv6, prefix: 10.0.0.0/16}
+          - {prefix: 10.0.0.0/16, prefixLength: 130}
+          - {family: ipx, prefix: "fd00::/48"}
+        routes: ["fd00:0:0:1::/64"]
+      ifName: endpoint0
+`
+
+const testFile12 = `
+apiVersion: v1
+endpoints:
+  - interface:
+      mechanism: memif
+      rxMode: polling
+      memif:
+        ringSize: 2048
+        bufferSize: 4096
+        queues: 4
+    vl3:
+      ipam:
+        defaultPrefixPool: 192.168.0.0/16
+        prefixLength: 24
+      ifName: endpoint0
+`
+
+const testFile13 = `
+apiVersion: v1
+endpoints:
+  - name: vl3
+    interface:
+      mechanism: vhost
+      rxMode: busy
+      memif:
+        ringSize: 1000
+        queues: 256
+    vl3:
+      ipam:
+        defaultPrefixPool: 192.168.0.0/16
+  - name: vl3-kernel
+    interface:
+      mechanism: kernel
+      memif:
+        ringSize: 1024
+    vl3:
+      ipam:
+        defaultPrefixPool: 10.60.0.0/16
+`
+
+func TestMigrateUCNFConfig(t *testing.T) {
+	cfg := &Config{}
+	err := NewConfig(yaml.NewDecoder(bytes.NewBufferString(testFile14)), cfg)
+	assert.NilError(t, err)
+
+	var warnings []string
+	for _, w := range cfg.Warnings {
+		warnings = append(warnings, w.Error())
+	}
+	assert.DeepEqual(t, []string{
+		"apiVersion is not set, migrating the configuration to v1",
+		"line 2, column 1: initactions is deprecated, use initActions",
+		"line 7, column 5: initActions[1].dpconfig is deprecated, use initActions[1].dpconfig.vpp",
+		"line 13, column 5: endpoints[0].ifname is deprecated, use endpoints[0].vl3.ifName",
+		"line 15, column 7: endpoints[0].ipam.prefixpool is deprecated, use endpoints[0].vl3.ipam.defaultPrefixPool",
+		"line 14, column 5: endpoints[0].ipam is deprecated, use endpoints[0].vl3.ipam",
+		"line 17, column 5: endpoints[0].action is not supported and ignored, use initActions",
+	}, warnings)
+
+	assert.Equal(t, 2, len(cfg.InitActions))
+	var action struct {
+		Client   map[string]string `yaml:"client"`
+		DPConfig struct {
+			VPP map[string][]map[string]string `yaml:"vpp"`
+		} `yaml:"dpconfig"`
+	}
+	assert.NilError(t, cfg.InitActions[1].Decode("initActions[1]", &action))
+	assert.DeepEqual(t, map[string][]map[string]string{"interfaces": {{"name": "loop0"}}}, action.DPConfig.VPP)
+
+	assert.DeepEqual(t, []*Endpoint{{
+		Name:   "packet-filtering",
+		Labels: Labels{"app": "packet-filter"},
+		VL3: VL3{
+			IPAM: IPAM{
+				DefaultPrefixPool: "10.60.3.0/24",
+				Routes:            []string{"10.60.1.0/24"},
+			},
+			Ifname: "endpoint0",
+		},
+	}}, cfg.Endpoints)
+}
+
+func TestInitActions(t *testing.T) {
+	for name, tc := range map[string]struct {
+		file string
+		err  string
+	}{
+		"without-endpoints": {file: testFile15},
+		"errors": {
+			file: testFile16,
+			err: InvalidConfigErrors{
+				fmt.Errorf("line 4, column 5: init action is not a mapping"),
+				fmt.Errorf("line 5, column 21: max parallel clients -1 is negative"),
+				fmt.Errorf("line 7, column 22: reconcile interval -1s is negative"),
+			}.Error(),
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			err := NewConfig(yaml.NewDecoder(bytes.NewBufferString(tc.file)), &Config{})
+			if tc.err == "" {
+				assert.NilError(t, err)
+				return
+			}
+			assert.Error(t, err, tc.err)
+		})
+	}
+}
+
+func TestVPPAgent(t *testing.T) {
+	cfg := &Config{}
+	err := NewConfig(yaml.NewDecoder(bytes.NewBufferString(testFile15)), cfg)
+	assert.NilError(t, err)
+	assert.Assert(t, cfg.VPPAgent.ReconcileInterval == nil)
+
+	err = NewConfig(yaml.NewDecoder(bytes.NewBufferString("apiVersion: v1\nvppAgent:\n  reconcileInterval: 1m\n")), cfg)
+	assert.NilError(t, err)
+	assert.Equal(t, time.Minute, *cfg.VPPAgent.ReconcileInterval)
+}
+
+func TestDecoderFn(t *testing.T) {
+	cfg := &Config{}
+	decoder := DecoderFn(func(v interface{}) error {
+		return json.Unmarshal([]byte(`{"apiVersion": "v1", "initActions": [{"name": "version"}]}`), v)
+	})
+	assert.NilError(t, NewConfig(decoder, cfg))
+	assert.Equal(t, 1, len(cfg.InitActions))
+	var action struct {
+		Name string `yaml:"name"`
+	}
+	assert.NilError(t, cfg.InitActions[0].Decode("initActions[0]", &action))
+	assert.Equal(t, "version", action.Name)
+}
+
+func TestNodeDecoderFn(t *testing.T) {
+	cfg := &Config{}
+	decoder := NodeDecoderFn(func(node *yaml.Node) error {
+		return yaml.Unmarshal([]byte(testFile15), node)
+	})
+	assert.NilError(t, NewConfig(decoder, cfg))
+	assert.Equal(t, 2, len(cfg.InitActions))
+
+	assert.Error(t, decoder.Decode(cfg), "NodeDecoderFn decodes into a *yaml.Node, not a *nseconfig.Config")
+}
+
+func TestInitActionDecode(t *testing.T) {
+	type action struct {
+		Name    string
+		Command struct {
+			Name string
+			Args []string
+		}
+		Retries int `yaml:"retries"`
+	}
+
+	cfg := &Config{}
+	err := NewConfig(yaml.NewDecoder(bytes.NewBufferString(testFile15)), cfg)
+	assert.NilError(t, err)
+
+	a := &action{}
+	assert.NilError(t, cfg.InitActions[0].Decode("initActions[0]", a))
+	assert.Equal(t, "version", a.Name)
+	assert.DeepEqual(t, []string{"show", "version"}, a.Command.Args)
+
+	err = cfg.InitActions[1].Decode("initActions[1]", a)
+	assert.Error(t, err, InvalidConfigErrors{
+		fmt.Errorf("line 9, column 5: unknown field initActions[1].unknown"),
+		fmt.Errorf("initActions[1]: line 8: cannot unmarshal !!str `many` into int"),
+	}.Error())
+}
+
+const testFile14 = `
+initactions:
+  - command:
+      name: vppctl
+  - client:
+      name: packet-filtering
+    dpconfig:
+      interfaces: [{name: loop0}]
+endpoints:
+  - name: packet-filtering
+    labels:
+      app: packet-filter
+    ifname: endpoint0
+    ipam:
+      prefixpool: 10.60.3.0/24
+      routes: [10.60.1.0/24]
+    action:
+      dpconfig: {}
+`
+
+const testFile15 = `
+apiVersion: v1
+initActions:
+  - name: version
+    command:
+      name: vppctl
+      args: [show, version]
+  - retries: many
+    unknown: true
+`
+
+const testFile16 = `
+apiVersion: v1
+initActions:
+  - just a string
+maxParallelClients: -1
+vppAgent:
+  reconcileInterval: -1s
+`
+
+const testFile17 = `
+apiVersion: v1
+endpoints:
+  - name: vl3
+    nat:
+      pools:
+        - firstIp: 192.0.2.1
+        - firstIp: 192.0.2.10
+          lastIp: 192.0.2.20
+          twiceNat: true
+      outsideInterfaces: [eth0]
+      portForwards:
+        - name: http
+          externalPorts: 8000-8999
+          localPorts: 80
+          twiceNat: true
+        - name: dns
+          protocol: udp
+    vl3:
+      ipam:
+        defaultPrefixPool: 192.168.0.0/16
+      ifName: endpoint0
+`
+
+const testFile18 = `
+apiVersion: v1
+endpoints:
+  - name: vl3
+    natIP: 192.0.2.1
+    nat:
+      pools:
+        - firstIp: 192.0.2.10
+          lastIp: 192.0.2.1
+        - firstIp: fd00::1
+      outsideInterfaces: [""]
+      portForwards:
+        - name: http
+          protocol: sctp
+          externalPorts: 9000-8000
+        - name: http
+          localPorts: 0-80
+          twiceNat: true
+        - name: bad name
+    vl3:
+      ipam:
+        defaultPrefixPool: 192.168.0.0/16
+      ifName: endpoint0
+`
@@ -0,0 +1,73 @@
+package nseconfig
+
+import (
+	"reflect"
+)
+
+// EndpointsDiff holds the changes between two endpoint lists
+type EndpointsDiff struct {
+	// Added endpoints have to be started
+	Added []*Endpoint
+	// Removed endpoints have to be deleted
+	Removed []*Endpoint
+	// Updated endpoints only changed routes or DNS settings and can be
+	// applied to the running endpoint and its live connections
+	Updated []*Endpoint
+}
+
+// Empty returns true if there are no changes
+func (d *EndpointsDiff) Empty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Updated) == 0
+}
+
+// Key identifies an endpoint across configuration reloads
+func (e *Endpoint) Key() string {
+	return e.Name + "/" + e.VL3.Ifname
+}
+
+// DiffEndpoints compares the old and new endpoint lists. Endpoints with changes
+// other than routes or DNS settings are reported as removed and added again.
+func DiffEndpoints(old, new []*Endpoint) *EndpointsDiff {
+	diff := &EndpointsDiff{}
+
+	oldByKey := map[string]*Endpoint{}
+	for _, e := range old {
+		oldByKey[e.Key()] = e
+	}
+
+	newKeys := map[string]bool{}
+	for _, e := range new {
+		newKeys[e.Key()] = true
+		o, ok := oldByKey[e.Key()]
+		switch {
+		case !ok:
+			diff.Added = append(diff.Added, e)
+		case !reflect.DeepEqual(staticPart(o), staticPart(e)):
+			diff.Removed = append(diff.Removed, o)
+			diff.Added = append(diff.Added, e)
+		case !reflect.DeepEqual(o.VL3.IPAM.Routes, e.VL3.IPAM.Routes) ||
+			!reflect.DeepEqual(o.VL3.NameServers, e.VL3.NameServers) ||
+			!reflect.DeepEqual(o.VL3.DNSZones, e.VL3.DNSZones):
+			diff.Updated = append(diff.Updated, e)
+		}
+	}
+
+	for _, e := range old {
+		if !newKeys[e.Key()] {
+			diff.Removed = append(diff.Removed, e)
+		}
+	}
+
+	return diff
+}
+
+// staticPart returns a copy of the endpoint without the attributes which can
+// be changed on a running endpoint
+func staticPart(e *Endpoint) Endpoint {
+	s := *e
+	s.NseName = ""
+	s.VL3.IPAM.Routes = nil
+	s.VL3.NameServers = nil
+	s.VL3.DNSZones = nil
+	return s
+}
@@ -0,0 +1,68 @@
+package nseconfig
+
+import (
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func TestDiffEndpoints(t *testing.T) {
+	endpoint := func(name string, routes ...string) *Endpoint {
+		return &Endpoint{
+			Name: name,
+			VL3: VL3{
+				IPAM: IPAM{
+					DefaultPrefixPool: "192.168.33.0/24",
+					Routes:            routes,
+				},
+				Ifname: "endpoint0",
+			},
+		}
+	}
+
+	replaced := endpoint("vl3")
+	replaced.VL3.IPAM.DefaultPrefixPool = "10.60.0.0/16"
+
+	running := endpoint("vl3", "192.168.34.0/24")
+	running.NseName = "vl3-nse-1"
+
+	for name, tc := range map[string]struct {
+		old, new []*Endpoint
+		diff     *EndpointsDiff
+	}{
+		"no-changes": {
+			old:  []*Endpoint{running},
+			new:  []*Endpoint{endpoint("vl3", "192.168.34.0/24")},
+			diff: &EndpointsDiff{},
+		},
+		"added-and-removed": {
+			old: []*Endpoint{endpoint("vl3")},
+			new: []*Endpoint{endpoint("ucnf")},
+			diff: &EndpointsDiff{
+				Added:   []*Endpoint{endpoint("ucnf")},
+				Removed: []*Endpoint{endpoint("vl3")},
+			},
+		},
+		"routes-updated": {
+			old: []*Endpoint{endpoint("vl3", "192.168.34.0/24")},
+			new: []*Endpoint{endpoint("vl3", "192.168.34.0/24", "192.168.35.0/24")},
+			diff: &EndpointsDiff{
+				Updated: []*Endpoint{endpoint("vl3", "192.168.34.0/24", "192.168.35.0/24")},
+			},
+		},
+		"pool-changed": {
+			old: []*Endpoint{endpoint("vl3")},
+			new: []*Endpoint{replaced},
+			diff: &EndpointsDiff{
+				Added:   []*Endpoint{replaced},
+				Removed: []*Endpoint{endpoint("vl3")},
+			},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			diff := DiffEndpoints(tc.old, tc.new)
+			assert.DeepEqual(t, tc.diff, diff)
+			assert.Equal(t, tc.diff.Empty(), diff.Empty())
+		})
+	}
+}
@@ -0,0 +1,86 @@
+package nseconfig
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Environment variables overriding the configuration of every endpoint
+const (
+	PodIPEnv           = "NSE_POD_IP"
+	ClusterNameEnv     = "CLUSTER_NAME"
+	NatIPEnv           = "NSE_NAT_IP"
+	RemoteNsIPListEnv  = "NSM_REMOTE_NS_IP_LIST"
+	IPAMUniqueOctetEnv = "NSE_IPAM_UNIQUE_OCTET"
+)
+
+// lookupEnv is replaced in tests
+var lookupEnv = os.LookupEnv
+
+// envOverride sets the endpoint field to the value of the environment variable
+type envOverride struct {
+	env   string
+	field string
+	apply func(e *Endpoint, value string) error
+}
+
+var envOverrides = []envOverride{
+	{env: PodIPEnv, field: "podIP", apply: func(e *Endpoint, value string) error {
+		e.PodIP = value
+		return nil
+	}},
+	{env: ClusterNameEnv, field: "clusterName", apply: func(e *Endpoint, value string) error {
+		e.ClusterName = value
+		return nil
+	}},
+	{env: NatIPEnv, field: "natIP", apply: func(e *Endpoint, value string) error {
+		e.NatIP = value
+		return nil
+	}},
+	{env: RemoteNsIPListEnv, field: "vl3.remoteNsIPList", apply: func(e *Endpoint, value string) error {
+		e.VL3.RemoteNsIPList = nil
+		for _, ip := range strings.Split(value, ",") {
+			if ip = strings.TrimSpace(ip); ip != "" {
+				e.VL3.RemoteNsIPList = append(e.VL3.RemoteNsIPList, ip)
+			}
+		}
+		return nil
+	}},
+	{env: IPAMUniqueOctetEnv, field: "vl3.ipam.uniqueOctet", apply: func(e *Endpoint, value string) error {
+		octet, err := strconv.Atoi(value)
+		if err != nil {
+			return err
+		}
+		e.VL3.IPAM.UniqueOctet = &octet
+		return nil
+	}},
+}
+
+func (c *Config) overrideFromEnv() error {
+	var errs InvalidConfigErrors
+
+	for _, o := range envOverrides {
+		value, ok := lookupEnv(o.env)
+		if !ok {
+			continue
+		}
+		for i, e := range c.Endpoints {
+			if e == nil {
+				continue
+			}
+			if err := o.apply(e, value); err != nil {
+				errs = append(errs, fieldError(fmt.Sprintf("endpoints[%d].%s", i, o.field),
+					"%s value %s is not valid: %s", o.env, value, err))
+			}
+		}
+	}
+
+	errs = append(errs, c.migrateNatIP()...)
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+package nseconfig
+
+import (
+	"fmt"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// expandEnv replaces the ${VAR} and ${VAR:-default} references in the scalar
+// values of the document with the environment variable values. The default is
+// used when VAR is unset or empty, $${ is kept as a literal ${.
+func expandEnv(node *yaml.Node, path string) []error {
+	var errs []error
+
+	switch node.Kind {
+	case yaml.DocumentNode:
+		for _, n := range node.Content {
+			errs = append(errs, expandEnv(n, path)...)
+		}
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			errs = append(errs, expandEnv(node.Content[i+1], joinPath(path, node.Content[i].Value))...)
+		}
+	case yaml.SequenceNode:
+		for i, n := range node.Content {
+			errs = append(errs, expandEnv(n, fmt.Sprintf("%s[%d]", path, i))...)
+		}
+	case yaml.ScalarNode:
+		if !strings.Contains(node.Value, "${") {
+			return nil
+		}
+		value, err := expandString(node.Value)
+		if err != nil {
+			return []error{&FieldError{
+				Field:  path,
+				Line:   node.Line,
+				Column: node.Column,
+				Err:    fmt.Errorf("%s: %s", path, err),
+			}}
+		}
+		node.Value = value
+		if node.Style&(yaml.DoubleQuotedStyle|yaml.SingleQuotedStyle|yaml.LiteralStyle|yaml.FoldedStyle) == 0 {
+			// resolve the tag of plain scalars again, ${PORT} may expand to an int
+			node.Tag = ""
+		}
+	}
+
+	return errs
+}
+
+func expandString(s string) (string, error) {
+	var b strings.Builder
+
+	for {
+		i := strings.Index(s, "${")
+		if i < 0 {
+			b.WriteString(s)
+			return b.String(), nil
+		}
+		if i > 0 && s[i-1] == '$' {
+			b.WriteString(s[:i-1] + "${")
+			s = s[i+2:]
+			continue
+		}
+		b.WriteString(s[:i])
+
+		end := strings.Index(s[i:], "}")
+		if end < 0 {
+			return "", fmt.Errorf("unterminated variable reference %s", s[i:])
+		}
+		value, err := expandVariable(s[i+2 : i+end])
+		if err != nil {
+			return "", err
+		}
+		b.WriteString(value)
+		s = s[i+end+1:]
+	}
+}
+
+// expandVariable returns the value of a VAR or VAR:-default reference
+func expandVariable(ref string) (string, error) {
+	name, def, hasDefault := ref, "", false
+	if i := strings.Index(ref, ":-"); i >= 0 {
+		name, def, hasDefault = ref[:i], ref[i+2:], true
+	}
+
+	if !validEnvName(name) {
+		return "", fmt.Errorf("invalid variable reference ${%s}", ref)
+	}
+
+	value, ok := lookupEnv(name)
+	switch {
+	case hasDefault && value == "":
+		return def, nil
+	case !ok:
+		return "", fmt.Errorf("environment variable %s is not set", name)
+	}
+	return value, nil
+}
+
+func validEnvName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i, r := range name {
+		if !(r == '_' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || i > 0 && r >= '0' && r <= '9') {
+			return false
+		}
+	}
+	return true
+}
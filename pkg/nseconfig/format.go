@@ -0,0 +1,80 @@
+package nseconfig
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Format of a configuration document
+type Format string
+
+const (
+	FormatYAML Format = "yaml"
+	FormatJSON Format = "json"
+)
+
+// ParseFormat returns the format named s, an empty name selects YAML
+func ParseFormat(s string) (Format, error) {
+	switch Format(strings.ToLower(s)) {
+	case FormatYAML, "yml", "":
+		return FormatYAML, nil
+	case FormatJSON:
+		return FormatJSON, nil
+	}
+	return "", fmt.Errorf("unknown config format %q, expected %s or %s", s, FormatYAML, FormatJSON)
+}
+
+// FormatFromPath selects the format by the file extension, .json files are
+// JSON and everything else is YAML
+func FormatFromPath(path string) Format {
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		return FormatJSON
+	}
+	return FormatYAML
+}
+
+// Load decodes raw in the given format into cfg, see NewConfig. JSON is
+// decoded with the YAML decoder once its syntax is checked, so both formats
+// report the same errors with positions.
+func Load(raw []byte, format Format, cfg config) error {
+	if format == FormatJSON && !json.Valid(raw) {
+		return jsonSyntaxError(raw)
+	}
+	return NewConfig(yaml.NewDecoder(bytes.NewReader(raw)), cfg)
+}
+
+func jsonSyntaxError(raw []byte) error {
+	var v interface{}
+	err := json.Unmarshal(raw, &v)
+	serr, ok := err.(*json.SyntaxError)
+	if !ok {
+		if err == nil {
+			err = fmt.Errorf("invalid JSON document")
+		}
+		return InvalidConfigErrors{err}
+	}
+
+	// Offset is the number of bytes read including the invalid one
+	offset := int(serr.Offset) - 1
+	if offset < 0 {
+		offset = 0
+	} else if offset > len(raw) {
+		offset = len(raw)
+	}
+
+	line, column := 1, 1
+	for _, c := range raw[:offset] {
+		if c == '\n' {
+			line++
+			column = 1
+		} else {
+			column++
+		}
+	}
+	return InvalidConfigErrors{&FieldError{Line: line, Column: column, Err: serr}}
+}
@@ -0,0 +1,60 @@
+package nseconfig
+
+import (
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func TestLoadJSON(t *testing.T) {
+	yamlCfg := &Config{}
+	assert.NilError(t, Load([]byte(testFile3), FormatYAML, yamlCfg))
+
+	jsonCfg := &Config{}
+	assert.NilError(t, Load([]byte(testJSONFile), FormatJSON, jsonCfg))
+
+	assert.DeepEqual(t, yamlCfg, jsonCfg)
+}
+
+func TestLoadJSONErrors(t *testing.T) {
+	for name, tc := range map[string]struct {
+		file string
+		err  string
+	}{
+		"syntax": {
+			file: "{\n  \"apiVersion\": \"v1\",\n  \"endpoints\": [}\n",
+			err:  "validation failed with errors: \n\tline 3, column 17: invalid character '}' looking for beginning of value\n",
+		},
+		"unknown-field": {
+			file: `{"apiVersion": "v1", "endpoints": [{"vl3": {"ipam": {"defaultPrefixPool": "192.168.33.0/24"}, "ifname": "endpoint0"}}]}`,
+			err:  "validation failed with errors: \n\tline 1, column 95: unknown field endpoints[0].vl3.ifname\n",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			err := Load([]byte(tc.file), FormatJSON, &Config{})
+			assert.Error(t, err, tc.err)
+		})
+	}
+}
+
+func TestFormatFromPath(t *testing.T) {
+	assert.Equal(t, FormatJSON, FormatFromPath("/etc/universal-cnf/config.JSON"))
+	assert.Equal(t, FormatYAML, FormatFromPath("/etc/universal-cnf/config.yaml"))
+	assert.Equal(t, FormatYAML, FormatFromPath("config"))
+}
+
+const testJSONFile = `{
+  "apiVersion": "v1",
+  "endpoints": [
+    {
+      "vl3": {
+        "ipam": {
+          "defaultPrefixPool": "192.168.33.0/24",
+          "routes": ["192.168.34.0/24"]
+        },
+        "ifName": "endpoint0"
+      }
+    }
+  ]
+}
+`
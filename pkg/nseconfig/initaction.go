@@ -0,0 +1,53 @@
+package nseconfig
+
+import (
+	"fmt"
+	"reflect"
+
+	"gopkg.in/yaml.v3"
+)
+
+// InitAction is an init action as written in the configuration. The actions
+// are run by the universal CNF, which decodes them into its own action model.
+type InitAction struct {
+	node *yaml.Node
+}
+
+// UnmarshalYAML keeps the node of the action for Decode
+func (a *InitAction) UnmarshalYAML(value *yaml.Node) error {
+	a.node = value
+	return nil
+}
+
+// Decode decodes the action into v like the configuration is decoded: the
+// unknown fields and the decoding errors are reported with their position and
+// the field path starting at path
+func (a *InitAction) Decode(path string, v interface{}) error {
+	if a == nil || a.node == nil {
+		return nil
+	}
+
+	var errs InvalidConfigErrors
+	errs = append(errs, unknownFields(a.node, reflect.TypeOf(v), path)...)
+	if err := a.node.Decode(v); err != nil {
+		terr, ok := err.(*yaml.TypeError)
+		if !ok {
+			return append(errs, &FieldError{Field: path, Line: a.node.Line, Column: a.node.Column, Err: err})
+		}
+		for _, e := range terr.Errors {
+			errs = append(errs, &FieldError{Field: path, Err: fmt.Errorf("%s: %s", path, e)})
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func (a *InitAction) validate() error {
+	if a == nil || a.node == nil || a.node.Kind != yaml.MappingNode {
+		return fmt.Errorf("init action is not a mapping")
+	}
+	return nil
+}
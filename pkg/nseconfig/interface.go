@@ -0,0 +1,104 @@
+package nseconfig
+
+import (
+	"github.com/networkservicemesh/networkservicemesh/controlplane/api/connection/mechanisms/kernel"
+	"github.com/networkservicemesh/networkservicemesh/controlplane/api/connection/mechanisms/memif"
+)
+
+// Mechanism is the NSM mechanism of the connections
+type Mechanism string
+
+const (
+	MechanismMemif Mechanism = "memif"
+	// MechanismKernel connects through a kernel veth or tap interface
+	MechanismKernel Mechanism = "kernel"
+)
+
+// NSMMechanism returns the NSM mechanism type, memif when not set
+func (m Mechanism) NSMMechanism() string {
+	if m == MechanismKernel {
+		return kernel.MECHANISM
+	}
+	return memif.MECHANISM
+}
+
+// RxMode is the rx-mode of the VPP interfaces of the connections
+type RxMode string
+
+const (
+	RxModePolling   RxMode = "polling"
+	RxModeInterrupt RxMode = "interrupt"
+	RxModeAdaptive  RxMode = "adaptive"
+)
+
+// limits of the memif parameters accepted by VPP
+const (
+	minMemifRingSize   = 8
+	maxMemifRingSize   = 1 << 14
+	maxMemifBufferSize = 1<<16 - 1
+	maxMemifQueues     = 255
+)
+
+// Interface configures the connection mechanism and the VPP interfaces of
+// the connections
+type Interface struct {
+	// Mechanism is memif when not set
+	Mechanism Mechanism `yaml:"mechanism"`
+	// RxMode is interrupt for the endpoint interfaces when not set
+	RxMode RxMode `yaml:"rxMode"`
+	Memif  Memif  `yaml:"memif"`
+}
+
+// Memif holds the memif parameters, VPP defaults are used for the ones not
+// set except the ring size, which is 512 when not set
+type Memif struct {
+	RingSize   int `yaml:"ringSize"`
+	BufferSize int `yaml:"bufferSize"`
+	// Queues is the number of rx and tx queues
+	Queues int `yaml:"queues"`
+}
+
+func (i Interface) validate() error {
+	var errs InvalidConfigErrors
+
+	switch i.Mechanism {
+	case "", MechanismMemif, MechanismKernel:
+	default:
+		errs = append(errs, fieldError("mechanism", "mechanism %s is not one of %s, %s", i.Mechanism, MechanismMemif, MechanismKernel))
+	}
+
+	switch i.RxMode {
+	case "", RxModePolling, RxModeInterrupt, RxModeAdaptive:
+	default:
+		errs = append(errs, fieldError("rxMode", "rx-mode %s is not one of %s, %s, %s", i.RxMode, RxModePolling, RxModeInterrupt, RxModeAdaptive))
+	}
+
+	if i.Mechanism == MechanismKernel && i.Memif != (Memif{}) {
+		errs = append(errs, fieldError("memif", "memif parameters are set for the %s mechanism", i.Mechanism))
+	}
+	errs = appendErrors(errs, "memif", i.Memif.validate())
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func (m Memif) validate() error {
+	var errs InvalidConfigErrors
+
+	if m.RingSize != 0 && (m.RingSize < minMemifRingSize || m.RingSize > maxMemifRingSize || m.RingSize&(m.RingSize-1) != 0) {
+		errs = append(errs, fieldError("ringSize", "ring size %d is not a power of 2 in range %d-%d", m.RingSize, minMemifRingSize, maxMemifRingSize))
+	}
+	if m.BufferSize < 0 || m.BufferSize > maxMemifBufferSize {
+		errs = append(errs, fieldError("bufferSize", "buffer size %d is not in range 0-%d", m.BufferSize, maxMemifBufferSize))
+	}
+	if m.Queues < 0 || m.Queues > maxMemifQueues {
+		errs = append(errs, fieldError("queues", "queue count %d is not in range 0-%d", m.Queues, maxMemifQueues))
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+package nseconfig
+
+import (
+	"fmt"
+	"net"
+)
+
+// AddressFamily of a prefix pool
+type AddressFamily string
+
+const (
+	IPv4 AddressFamily = "ipv4"
+	IPv6 AddressFamily = "ipv6"
+)
+
+// LocalAllocation is the strategy of the local subnet calculation
+type LocalAllocation string
+
+const (
+	// LocalAllocationHash hashes the endpoint identity into the pool and
+	// re-picks the subnet on collisions with the vL3 peers
+	LocalAllocationHash LocalAllocation = "hash"
+	// LocalAllocationPodOctet uses the unique octet or the octet of the pod IP
+	// as the subnet index
+	LocalAllocationPodOctet LocalAllocation = "podOctet"
+)
+
+// PrefixPool is a pool of a single address family the endpoint subnet is
+// allocated from
+type PrefixPool struct {
+	// Family is derived from Prefix when not set
+	Family AddressFamily `yaml:"family"`
+	Prefix string        `yaml:"prefix"`
+	// PrefixLength is the length of the endpoint subnet allocated from the pool
+	PrefixLength int `yaml:"prefixLength"`
+}
+
+// FamilyOf returns the address family of the IP
+func FamilyOf(ip net.IP) AddressFamily {
+	if ip.To4() != nil {
+		return IPv4
+	}
+	return IPv6
+}
+
+// Pools returns the prefix pools of the endpoint, the default pool first. The
+// default pool uses the IPAM prefix length and the families are filled in.
+// Invalid prefixes are skipped.
+func (i IPAM) Pools() []PrefixPool {
+	var pools []PrefixPool
+
+	add := func(p PrefixPool) {
+		ip, _, err := net.ParseCIDR(p.Prefix)
+		if err != nil {
+			return
+		}
+		p.Family = FamilyOf(ip)
+		pools = append(pools, p)
+	}
+
+	if !empty(i.DefaultPrefixPool) {
+		add(PrefixPool{Prefix: i.DefaultPrefixPool, PrefixLength: i.PrefixLength})
+	}
+	for _, p := range i.PrefixPools {
+		add(p)
+	}
+
+	return pools
+}
+
+func (p PrefixPool) validate() error {
+	var errs InvalidConfigErrors
+
+	ip, pool, err := net.ParseCIDR(p.Prefix)
+	if err != nil {
+		errs = append(errs, fieldError("prefix", "prefix pool is not a valid subnet: %s", err))
+	}
+
+	switch p.Family {
+	case "":
+	case IPv4, IPv6:
+		if ip != nil && FamilyOf(ip) != p.Family {
+			errs = append(errs, fieldError("family", "prefix pool %s is not an %s subnet", p.Prefix, p.Family))
+		}
+	default:
+		errs = append(errs, fieldError("family", "address family %s is not one of %s, %s", p.Family, IPv4, IPv6))
+	}
+
+	if err := validatePrefixLength(p.PrefixLength, pool, p.Prefix); err != nil {
+		errs = append(errs, fieldError("prefixLength", "%s", err))
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func validatePrefixLength(length int, pool *net.IPNet, prefix string) error {
+	if pool == nil || length == 0 {
+		return nil
+	}
+	ones, bits := pool.Mask.Size()
+	if length < ones {
+		return fmt.Errorf("prefix length %d is shorter than the prefix pool %s mask length %d", length, prefix, ones)
+	} else if length > bits {
+		return fmt.Errorf("prefix length %d exceeds the address length %d of the prefix pool %s", length, bits, prefix)
+	}
+	return nil
+}
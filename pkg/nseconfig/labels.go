@@ -1,15 +1,225 @@
 package nseconfig
 
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
 type Labels map[string]string
 
+// String returns the canonical k=v,k2=v2 encoding of the labels, sorted by key
 func (l Labels) String() string {
-	labelString := ""
-	for k, v := range l {
-		if len(labelString) > 0 {
-			labelString += ","
+	keys := make([]string, 0, len(l))
+	for k := range l {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	pairs := make([]string, 0, len(keys))
+	for _, k := range keys {
+		pairs = append(pairs, k+"="+l[k])
+	}
+	return strings.Join(pairs, ",")
+}
+
+// ParseLabels parses the k=v,k2=v2 encoding of the labels
+func ParseLabels(s string) (Labels, error) {
+	labels := Labels{}
+	if strings.TrimSpace(s) == "" {
+		return labels, nil
+	}
+
+	for _, pair := range strings.Split(s, ",") {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("label %q is not in key=value form", pair)
+		}
+		key, value := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])
+		if err := validateLabelKey(key); err != nil {
+			return nil, err
+		}
+		if _, ok := labels[key]; ok {
+			return nil, fmt.Errorf("label %s is set more than once", key)
+		}
+		labels[key] = value
+	}
+	return labels, nil
+}
+
+// Operator of a selector requirement
+type Operator string
+
+const (
+	OperatorEquals       Operator = "="
+	OperatorNotEquals    Operator = "!="
+	OperatorIn           Operator = "in"
+	OperatorNotIn        Operator = "notin"
+	OperatorExists       Operator = "exists"
+	OperatorDoesNotExist Operator = "!"
+)
+
+// Requirement is a single condition on the value of a label
+type Requirement struct {
+	Key      string
+	Operator Operator
+	Values   []string
+}
+
+// Matches reports whether the labels satisfy the requirement
+func (r Requirement) Matches(labels map[string]string) bool {
+	value, ok := labels[r.Key]
+	switch r.Operator {
+	case OperatorEquals:
+		return ok && value == r.Values[0]
+	case OperatorNotEquals:
+		return !ok || value != r.Values[0]
+	case OperatorIn:
+		return ok && contains(r.Values, value)
+	case OperatorNotIn:
+		return !ok || !contains(r.Values, value)
+	case OperatorExists:
+		return ok
+	case OperatorDoesNotExist:
+		return !ok
+	}
+	return false
+}
+
+func (r Requirement) String() string {
+	switch r.Operator {
+	case OperatorEquals, OperatorNotEquals:
+		return r.Key + string(r.Operator) + r.Values[0]
+	case OperatorIn, OperatorNotIn:
+		return r.Key + " " + string(r.Operator) + " (" + strings.Join(r.Values, ",") + ")"
+	case OperatorDoesNotExist:
+		return "!" + r.Key
+	}
+	return r.Key
+}
+
+// Selector selects the labels satisfying all of its requirements, the empty
+// selector selects all labels. The selector syntax follows the Kubernetes
+// label selectors: key=value, key!=value, key in (v1,v2), key notin (v1,v2),
+// key and !key, separated by commas.
+type Selector []Requirement
+
+// Matches reports whether the labels satisfy all requirements of the selector
+func (s Selector) Matches(labels map[string]string) bool {
+	for _, r := range s {
+		if !r.Matches(labels) {
+			return false
+		}
+	}
+	return true
+}
+
+func (s Selector) String() string {
+	requirements := make([]string, 0, len(s))
+	for _, r := range s {
+		requirements = append(requirements, r.String())
+	}
+	return strings.Join(requirements, ",")
+}
+
+// ParseSelector parses the selector syntax
+func ParseSelector(s string) (Selector, error) {
+	var selector Selector
+	for _, term := range splitSelector(s) {
+		term = strings.TrimSpace(term)
+		if term == "" {
+			if strings.TrimSpace(s) == "" {
+				break
+			}
+			return nil, fmt.Errorf("selector %q has an empty requirement", s)
+		}
+		r, err := parseRequirement(term)
+		if err != nil {
+			return nil, err
+		}
+		selector = append(selector, r)
+	}
+	return selector, nil
+}
+
+// splitSelector splits the selector at the commas outside the value sets
+func splitSelector(s string) []string {
+	var terms []string
+	depth, start := 0, 0
+	for i, c := range s {
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				terms = append(terms, s[start:i])
+				start = i + 1
+			}
 		}
-		labelString = labelString + k + "=" + v
 	}
+	return append(terms, s[start:])
+}
 
-	return labelString
+func parseRequirement(term string) (Requirement, error) {
+	if strings.HasPrefix(term, "!") && !strings.Contains(term, "=") {
+		key := strings.TrimSpace(term[1:])
+		return Requirement{Key: key, Operator: OperatorDoesNotExist}, validateLabelKey(key)
+	}
+
+	for _, op := range []string{"!=", "==", "="} {
+		if i := strings.Index(term, op); i >= 0 {
+			key, value := strings.TrimSpace(term[:i]), strings.TrimSpace(term[i+len(op):])
+			operator := OperatorEquals
+			if op == "!=" {
+				operator = OperatorNotEquals
+			}
+			return Requirement{Key: key, Operator: operator, Values: []string{value}}, validateLabelKey(key)
+		}
+	}
+
+	if fields := strings.Fields(term); len(fields) >= 2 {
+		operator := Operator(fields[1])
+		if operator == OperatorIn || operator == OperatorNotIn {
+			key := fields[0]
+			set := strings.TrimSpace(term[len(key):])
+			set = strings.TrimSpace(set[len(operator):])
+			if !strings.HasPrefix(set, "(") || !strings.HasSuffix(set, ")") {
+				return Requirement{}, fmt.Errorf("requirement %q values are not in parentheses", term)
+			}
+			var values []string
+			for _, v := range strings.Split(set[1:len(set)-1], ",") {
+				if v = strings.TrimSpace(v); v != "" {
+					values = append(values, v)
+				}
+			}
+			if len(values) == 0 {
+				return Requirement{}, fmt.Errorf("requirement %q has no values", term)
+			}
+			return Requirement{Key: key, Operator: operator, Values: values}, validateLabelKey(key)
+		}
+		return Requirement{}, fmt.Errorf("requirement %q has an unknown operator %s", term, fields[1])
+	}
+
+	return Requirement{Key: term, Operator: OperatorExists}, validateLabelKey(term)
+}
+
+func validateLabelKey(key string) error {
+	if key == "" {
+		return fmt.Errorf("label key is empty")
+	}
+	if strings.ContainsAny(key, " \t=!,()") {
+		return fmt.Errorf("label key %q contains an invalid character", key)
+	}
+	return nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
 }
@@ -0,0 +1,91 @@
+package nseconfig
+
+import (
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func TestLabelsString(t *testing.T) {
+	labels := Labels{"zone": "a", "app": "vl3", "env": "prod"}
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, "app=vl3,env=prod,zone=a", labels.String())
+	}
+	assert.Equal(t, "", Labels{}.String())
+}
+
+func TestParseLabels(t *testing.T) {
+	for name, tc := range map[string]struct {
+		s      string
+		labels Labels
+		err    string
+	}{
+		"empty":     {s: "", labels: Labels{}},
+		"pairs":     {s: "app=vl3, env=prod", labels: Labels{"app": "vl3", "env": "prod"}},
+		"empty-val": {s: "app=", labels: Labels{"app": ""}},
+		"no-value":  {s: "app", err: `label "app" is not in key=value form`},
+		"no-key":    {s: "=vl3", err: "label key is empty"},
+		"duplicate": {s: "app=a,app=b", err: "label app is set more than once"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			labels, err := ParseLabels(tc.s)
+			if tc.err != "" {
+				assert.Error(t, err, tc.err)
+				return
+			}
+			assert.NilError(t, err)
+			assert.DeepEqual(t, tc.labels, labels)
+			if len(labels) > 0 {
+				roundTrip, err := ParseLabels(labels.String())
+				assert.NilError(t, err)
+				assert.DeepEqual(t, labels, roundTrip)
+			}
+		})
+	}
+}
+
+func TestSelector(t *testing.T) {
+	labels := map[string]string{"app": "vl3", "env": "prod", "zone": "a"}
+	for name, tc := range map[string]struct {
+		selector string
+		matches  bool
+		str      string
+	}{
+		"empty":              {selector: "", matches: true, str: ""},
+		"equals":             {selector: "app=vl3", matches: true, str: "app=vl3"},
+		"double-equals":      {selector: "app==vl3", matches: true, str: "app=vl3"},
+		"equals-mismatch":    {selector: "app=web", matches: false, str: "app=web"},
+		"not-equals":         {selector: "env!=dev", matches: true, str: "env!=dev"},
+		"not-equals-missing": {selector: "tier!=db", matches: true, str: "tier!=db"},
+		"in":                 {selector: "zone in (a, b)", matches: true, str: "zone in (a,b)"},
+		"in-missing":         {selector: "tier in (db)", matches: false, str: "tier in (db)"},
+		"notin":              {selector: "zone notin (b,c)", matches: true, str: "zone notin (b,c)"},
+		"exists":             {selector: "app", matches: true, str: "app"},
+		"does-not-exist":     {selector: "!app", matches: false, str: "!app"},
+		"all":                {selector: "app=vl3,zone in (a,b),!tier", matches: true, str: "app=vl3,zone in (a,b),!tier"},
+		"one-fails":          {selector: "app=vl3,env in (dev,test)", matches: false, str: "app=vl3,env in (dev,test)"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			selector, err := ParseSelector(tc.selector)
+			assert.NilError(t, err)
+			assert.Equal(t, tc.matches, selector.Matches(labels))
+			assert.Equal(t, tc.str, selector.String())
+		})
+	}
+}
+
+func TestParseSelectorErrors(t *testing.T) {
+	for selector, expected := range map[string]string{
+		"app=vl3,":        `selector "app=vl3," has an empty requirement`,
+		"zone in a,b":     `requirement "zone in a" values are not in parentheses`,
+		"zone in ()":      `requirement "zone in ()" has no values`,
+		"zone within (a)": `requirement "zone within (a)" has an unknown operator within`,
+		"=vl3":            "label key is empty",
+		"!":               "label key is empty",
+		"app(x)=vl3":      `label key "app(x)" contains an invalid character`,
+		"zone notin (a,b": `requirement "zone notin (a,b" values are not in parentheses`,
+	} {
+		_, err := ParseSelector(selector)
+		assert.Error(t, err, expected, selector)
+	}
+}
@@ -0,0 +1,252 @@
+package nseconfig
+
+import (
+	"fmt"
+
+	"gopkg.in/yaml.v3"
+)
+
+// APIVersion is the version of the configuration schema implemented by Config
+const APIVersion = "v1"
+
+// migration upgrades a configuration document from one schema version to the
+// next one and returns the deprecation warnings
+type migration struct {
+	from    string
+	to      string
+	migrate func(doc *yaml.Node) []error
+}
+
+// migrations are applied in order starting with the one matching the
+// apiVersion of the document, the empty version is the layout used before
+// apiVersion was introduced
+var migrations = []migration{
+	{from: "", to: "v1", migrate: migrateUnversioned},
+}
+
+func (c *Config) migrate(root *yaml.Node) error {
+	doc := documentContent(root)
+	if doc == nil || doc.Kind != yaml.MappingNode {
+		// nothing to migrate, decoding and validation report the problem
+		return nil
+	}
+
+	version := ""
+	versionNode := mappingValue(doc, "apiVersion")
+	if versionNode != nil {
+		version = versionNode.Value
+	}
+	if version == APIVersion {
+		return nil
+	}
+
+	if versionNode == nil {
+		c.Warnings = append(c.Warnings, fmt.Errorf("apiVersion is not set, migrating the configuration to %s", APIVersion))
+	}
+
+	for _, m := range migrations {
+		if m.from != version {
+			continue
+		}
+		c.Warnings = append(c.Warnings, m.migrate(doc)...)
+		version = m.to
+	}
+
+	if version != APIVersion {
+		return InvalidConfigErrors{&FieldError{
+			Field:  "apiVersion",
+			Line:   versionNode.Line,
+			Column: versionNode.Column,
+			Err:    fmt.Errorf("unsupported apiVersion %s, expected %s", versionNode.Value, APIVersion),
+		}}
+	}
+
+	setMappingValue(doc, "apiVersion", APIVersion)
+	return nil
+}
+
+// migrateUnversioned drops the nseName endpoint field, the name is assigned by
+// NSM, and moves the fields of the former universal CNF configuration:
+// initactions becomes initActions, the VPP configuration of the action
+// dpconfig moves to dpconfig.vpp and the endpoint ifname and ipam move to vl3
+func migrateUnversioned(doc *yaml.Node) []error {
+	var warnings []error
+
+	if key := renameMappingKey(doc, "initactions", "initActions"); key != nil {
+		warnings = append(warnings, movedWarning(key, "initactions", "initActions"))
+	}
+
+	if actions := mappingValue(doc, "initActions"); actions != nil && actions.Kind == yaml.SequenceNode {
+		for i, a := range actions.Content {
+			path := fmt.Sprintf("initActions[%d].dpconfig", i)
+			if key, dpconfig := takeMappingKey(a, "dpconfig"); key != nil {
+				setMappingNode(mappingChild(a, "dpconfig"), "vpp", dpconfig)
+				warnings = append(warnings, movedWarning(key, path, path+".vpp"))
+			}
+		}
+	}
+
+	endpoints := mappingValue(doc, "endpoints")
+	if endpoints == nil || endpoints.Kind != yaml.SequenceNode {
+		return warnings
+	}
+
+	for i, e := range endpoints.Content {
+		if key := removeMappingKey(e, "nseName"); key != nil {
+			field := fmt.Sprintf("endpoints[%d].nseName", i)
+			warnings = append(warnings, &FieldError{
+				Field:  field,
+				Line:   key.Line,
+				Column: key.Column,
+				Err:    fmt.Errorf("%s is deprecated and ignored, the name is assigned by NSM", field),
+			})
+		}
+		warnings = append(warnings, migrateUCNFEndpoint(e, fmt.Sprintf("endpoints[%d]", i))...)
+	}
+
+	return warnings
+}
+
+// migrateUCNFEndpoint moves the ifname and ipam fields of a universal CNF
+// endpoint to vl3 and drops its action, which was never run
+func migrateUCNFEndpoint(e *yaml.Node, path string) []error {
+	var warnings []error
+
+	// the fields are kept when vl3 sets them as well, they are reported as unknown
+	vl3 := mappingValue(e, "vl3")
+	if mappingValue(e, "ifname") != nil && (vl3 == nil || mappingValue(vl3, "ifName") == nil) {
+		key, value := takeMappingKey(e, "ifname")
+		setMappingNode(mappingChild(e, "vl3"), "ifName", value)
+		warnings = append(warnings, movedWarning(key, path+".ifname", path+".vl3.ifName"))
+	}
+
+	if mappingValue(e, "ipam") != nil && (vl3 == nil || mappingValue(vl3, "ipam") == nil) {
+		key, ipam := takeMappingKey(e, "ipam")
+		if k := renameMappingKey(ipam, "prefixpool", "defaultPrefixPool"); k != nil {
+			warnings = append(warnings, movedWarning(k, path+".ipam.prefixpool", path+".vl3.ipam.defaultPrefixPool"))
+		}
+		setMappingNode(mappingChild(e, "vl3"), "ipam", ipam)
+		warnings = append(warnings, movedWarning(key, path+".ipam", path+".vl3.ipam"))
+	}
+
+	if key := removeMappingKey(e, "action"); key != nil {
+		warnings = append(warnings, &FieldError{
+			Field:  path + ".action",
+			Line:   key.Line,
+			Column: key.Column,
+			Err:    fmt.Errorf("%s.action is not supported and ignored, use initActions", path),
+		})
+	}
+
+	return warnings
+}
+
+func movedWarning(key *yaml.Node, from, to string) error {
+	return &FieldError{
+		Field:  from,
+		Line:   key.Line,
+		Column: key.Column,
+		Err:    fmt.Errorf("%s is deprecated, use %s", from, to),
+	}
+}
+
+func documentContent(root *yaml.Node) *yaml.Node {
+	if root.Kind == yaml.DocumentNode {
+		if len(root.Content) == 0 {
+			return nil
+		}
+		return root.Content[0]
+	}
+	return root
+}
+
+// mappingValue returns the value node of key in the mapping node m
+func mappingValue(m *yaml.Node, key string) *yaml.Node {
+	if m.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(m.Content); i += 2 {
+		if m.Content[i].Value == key {
+			return m.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// removeMappingKey removes key from the mapping node m and returns the removed key node
+func removeMappingKey(m *yaml.Node, key string) *yaml.Node {
+	if m.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(m.Content); i += 2 {
+		if m.Content[i].Value == key {
+			k := m.Content[i]
+			m.Content = append(m.Content[:i], m.Content[i+2:]...)
+			return k
+		}
+	}
+	return nil
+}
+
+// takeMappingKey removes key from the mapping node m and returns the removed
+// key and value nodes
+func takeMappingKey(m *yaml.Node, key string) (*yaml.Node, *yaml.Node) {
+	value := mappingValue(m, key)
+	if value == nil {
+		return nil, nil
+	}
+	return removeMappingKey(m, key), value
+}
+
+// renameMappingKey renames key of the mapping node m unless the new key is
+// already set and returns the renamed key node
+func renameMappingKey(m *yaml.Node, key, to string) *yaml.Node {
+	if m.Kind != yaml.MappingNode || mappingValue(m, to) != nil {
+		return nil
+	}
+	for i := 0; i+1 < len(m.Content); i += 2 {
+		if m.Content[i].Value == key {
+			m.Content[i].Value = to
+			return m.Content[i]
+		}
+	}
+	return nil
+}
+
+// mappingChild returns the mapping value of key in the mapping node m, an
+// empty mapping is added when key is not set
+func mappingChild(m *yaml.Node, key string) *yaml.Node {
+	if v := mappingValue(m, key); v != nil {
+		return v
+	}
+	child := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+	setMappingNode(m, key, child)
+	return child
+}
+
+// setMappingNode sets key to the value node in the mapping node m
+func setMappingNode(m *yaml.Node, key string, value *yaml.Node) {
+	if m.Kind != yaml.MappingNode {
+		return
+	}
+	for i := 0; i+1 < len(m.Content); i += 2 {
+		if m.Content[i].Value == key {
+			m.Content[i+1] = value
+			return
+		}
+	}
+	m.Content = append(m.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key}, value)
+}
+
+// setMappingValue sets key to the scalar value in the mapping node m
+func setMappingValue(m *yaml.Node, key, value string) {
+	if v := mappingValue(m, key); v != nil {
+		v.Kind = yaml.ScalarNode
+		v.Tag = "!!str"
+		v.Value = value
+		return
+	}
+	m.Content = append(m.Content,
+		&yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key},
+		&yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: value})
+}
@@ -0,0 +1,325 @@
+package nseconfig
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// PortForwardLabel prefixes the connection labels requesting a port forward
+// of the endpoint NAT, nat-port-forward-<name>: <ports>. The ports are the
+// external port or port range followed by the local port the range is
+// forwarded to when it differs, like 80, 8000-8009 or 8080:80.
+const PortForwardLabel = "nat-port-forward-"
+
+// MaxPortForwardPorts is the number of ports a port forward label may request
+const MaxPortForwardPorts = 1024
+
+// Protocol is the transport protocol of a port forward
+type Protocol string
+
+const (
+	ProtocolTCP Protocol = "tcp"
+	ProtocolUDP Protocol = "udp"
+)
+
+// NAT translates the traffic of the endpoint connections leaving through the
+// outside interfaces to the pool addresses and forwards the ports the
+// connections request to the clients
+type NAT struct {
+	// Pools are the external addresses of the endpoint, the port forwards
+	// use the first address of the first pool that is not a twice-NAT pool
+	Pools []NATPool `yaml:"pools"`
+	// OutsideInterfaces are the interfaces facing the external network, the
+	// endpoint interfaces are the inside interfaces
+	OutsideInterfaces []string `yaml:"outsideInterfaces"`
+	// PortForwards are the port forwards the connections may request
+	PortForwards []PortForward `yaml:"portForwards"`
+
+	// LegacyPortForwards is set for the NAT of the deprecated natIP, which
+	// forwards the port of any label with the nat-port-forward prefix
+	LegacyPortForwards bool `yaml:"-"`
+}
+
+// NATPool is a range of external addresses
+type NATPool struct {
+	FirstIP string `yaml:"firstIp"`
+	// LastIP is FirstIP when not set
+	LastIP string `yaml:"lastIp"`
+	// TwiceNAT pools translate the source of the twice-NAT port forwards
+	TwiceNAT bool `yaml:"twiceNat"`
+}
+
+// PortForward is a port forward the connections request with the
+// nat-port-forward-<name> label
+type PortForward struct {
+	Name string `yaml:"name"`
+	// Protocol is tcp when not set
+	Protocol Protocol `yaml:"protocol"`
+	// ExternalPorts are the ports the connections may request, like 8000-8999
+	ExternalPorts PortRange `yaml:"externalPorts"`
+	// LocalPorts are the client ports the requested ports may be forwarded
+	// to, all ports when not set
+	LocalPorts PortRange `yaml:"localPorts"`
+	// TwiceNAT translates the source of the forwarded traffic to a twice-NAT
+	// pool address, so that the clients reply through the endpoint
+	TwiceNAT bool `yaml:"twiceNat"`
+}
+
+// PortRange is a port or a first-last range of ports
+type PortRange string
+
+// Bounds returns the first and the last port of the range, all ports when
+// the range is not set
+func (r PortRange) Bounds() (first, last int, err error) {
+	if r == "" {
+		return 1, 65535, nil
+	}
+	bounds := strings.SplitN(string(r), "-", 2)
+	if first, err = parsePort(bounds[0]); err != nil {
+		return 0, 0, err
+	}
+	last = first
+	if len(bounds) == 2 {
+		if last, err = parsePort(bounds[1]); err != nil {
+			return 0, 0, err
+		}
+	}
+	if last < first {
+		return 0, 0, fmt.Errorf("last port %d is lower than first port %d", last, first)
+	}
+	return first, last, nil
+}
+
+func parsePort(s string) (int, error) {
+	port, err := strconv.Atoi(strings.TrimSpace(s))
+	if err != nil || port < 1 || port > 65535 {
+		return 0, fmt.Errorf("port %s is not in range 1-65535", s)
+	}
+	return port, nil
+}
+
+// ExternalIP returns the address of the port forwards
+func (n *NAT) ExternalIP() string {
+	for _, pool := range n.Pools {
+		if !pool.TwiceNAT {
+			return pool.FirstIP
+		}
+	}
+	return ""
+}
+
+// PortForwardRequest is a port forward requested by a connection label, the
+// Count ports from ExternalPort are forwarded to the ports from LocalPort
+type PortForwardRequest struct {
+	// Label is the key of the connection label
+	Label        string
+	Forward      PortForward
+	ExternalPort int
+	LocalPort    int
+	Count        int
+}
+
+// RequestedPortForwards returns the port forwards requested by the labels,
+// sorted by label, and the reasons of the labels it skips. The labels of port
+// forwards the NAT does not declare are skipped, the requests of ports out of
+// the declared ranges are errors. The legacy NAT of the deprecated natIP
+// forwards the port of every label with the nat-port-forward prefix to the
+// same port, UDP for the labels with udp in their key, and skips the labels
+// that are not a port. A nil NAT forwards nothing.
+func (n *NAT) RequestedPortForwards(labels map[string]string) ([]PortForwardRequest, []error, error) {
+	if n == nil {
+		return nil, nil, nil
+	}
+
+	prefix := PortForwardLabel
+	if n.LegacyPortForwards {
+		prefix = strings.TrimSuffix(PortForwardLabel, "-")
+	}
+	var keys []string
+	for k := range labels {
+		if strings.HasPrefix(k, prefix) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	var requests []PortForwardRequest
+	var skipped []error
+	for _, k := range keys {
+		if n.LegacyPortForwards {
+			request, err := legacyRequest(k, labels[k])
+			if err != nil {
+				skipped = append(skipped, fmt.Errorf("label %s=%s is not valid: %v", k, labels[k], err))
+				continue
+			}
+			requests = append(requests, request)
+			continue
+		}
+
+		name := strings.TrimPrefix(k, PortForwardLabel)
+		var forward *PortForward
+		for i := range n.PortForwards {
+			if n.PortForwards[i].Name == name {
+				forward = &n.PortForwards[i]
+			}
+		}
+		if forward == nil {
+			skipped = append(skipped, fmt.Errorf("port forward %s requested by label %s is not declared by the endpoint", name, k))
+			continue
+		}
+
+		request, err := forward.request(labels[k])
+		if err != nil {
+			return nil, skipped, fmt.Errorf("label %s=%s is not valid: %v", k, labels[k], err)
+		}
+		request.Label = k
+		requests = append(requests, request)
+	}
+	return requests, skipped, nil
+}
+
+// legacyRequest returns the request of a port forward label of the legacy NAT
+func legacyRequest(key, value string) (PortForwardRequest, error) {
+	port, err := strconv.Atoi(value)
+	if err != nil {
+		return PortForwardRequest{}, err
+	}
+	protocol := ProtocolTCP
+	if strings.Contains(key, "udp") {
+		protocol = ProtocolUDP
+	}
+	return PortForwardRequest{
+		Label:        key,
+		Forward:      PortForward{Name: strings.TrimPrefix(key, PortForwardLabel), Protocol: protocol},
+		ExternalPort: port,
+		LocalPort:    port,
+		Count:        1,
+	}, nil
+}
+
+// request parses the ports of a label requesting the port forward and checks
+// them against its ranges
+func (f PortForward) request(value string) (PortForwardRequest, error) {
+	external, local := value, ""
+	if i := strings.Index(value, ":"); i >= 0 {
+		external, local = value[:i], value[i+1:]
+	}
+	first, last, err := PortRange(external).Bounds()
+	if err != nil || external == "" {
+		return PortForwardRequest{}, fmt.Errorf("ports are not in <external>[-<last>][:<local>] form")
+	}
+	request := PortForwardRequest{Forward: f, ExternalPort: first, LocalPort: first, Count: last - first + 1}
+	if request.Count > MaxPortForwardPorts {
+		return PortForwardRequest{}, fmt.Errorf("%d ports are requested, at most %d can be", request.Count, MaxPortForwardPorts)
+	}
+	if local != "" {
+		if request.LocalPort, err = parsePort(local); err != nil {
+			return PortForwardRequest{}, err
+		}
+	}
+
+	minPort, maxPort, _ := f.ExternalPorts.Bounds()
+	if first < minPort || last > maxPort {
+		return PortForwardRequest{}, fmt.Errorf("external ports %d-%d are not in range %d-%d", first, last, minPort, maxPort)
+	}
+	minPort, maxPort, _ = f.LocalPorts.Bounds()
+	if request.LocalPort < minPort || request.LocalPort+request.Count-1 > maxPort {
+		return PortForwardRequest{}, fmt.Errorf("local ports %d-%d are not in range %d-%d",
+			request.LocalPort, request.LocalPort+request.Count-1, minPort, maxPort)
+	}
+	return request, nil
+}
+
+func (n *NAT) validate() error {
+	var errs InvalidConfigErrors
+
+	hasPool, hasTwiceNATPool := false, false
+	for i, pool := range n.Pools {
+		field := fmt.Sprintf("pools[%d]", i)
+		first, last := net.ParseIP(pool.FirstIP), net.ParseIP(pool.LastIP)
+		switch {
+		case first == nil || first.To4() == nil:
+			errs = append(errs, fieldError(field+".firstIp", "NAT pool address %s is not a valid IPv4 address", pool.FirstIP))
+		case !empty(pool.LastIP) && (last == nil || last.To4() == nil):
+			errs = append(errs, fieldError(field+".lastIp", "NAT pool address %s is not a valid IPv4 address", pool.LastIP))
+		case last != nil && bytes.Compare(last.To4(), first.To4()) < 0:
+			errs = append(errs, fieldError(field+".lastIp", "NAT pool address %s is lower than the first address %s", pool.LastIP, pool.FirstIP))
+		}
+		if pool.TwiceNAT {
+			hasTwiceNATPool = true
+		} else {
+			hasPool = true
+		}
+	}
+	if !hasPool {
+		errs = append(errs, fieldError("pools", "NAT has no pool that is not a twice-NAT pool"))
+	}
+
+	for i, ifName := range n.OutsideInterfaces {
+		if empty(ifName) {
+			errs = append(errs, fieldError(fmt.Sprintf("outsideInterfaces[%d]", i), "outside interface name is empty"))
+		}
+	}
+
+	names := map[string]bool{}
+	for i, f := range n.PortForwards {
+		field := fmt.Sprintf("portForwards[%d]", i)
+		if err := validateLabelKey(PortForwardLabel + f.Name); err != nil || empty(f.Name) {
+			errs = append(errs, fieldError(field+".name", "port forward name %q does not make a valid label key", f.Name))
+		} else if names[f.Name] {
+			errs = append(errs, fieldError(field+".name", "port forward %s is declared twice", f.Name))
+		}
+		names[f.Name] = true
+
+		switch f.Protocol {
+		case "", ProtocolTCP, ProtocolUDP:
+		default:
+			errs = append(errs, fieldError(field+".protocol", "protocol %s is not one of %s, %s", f.Protocol, ProtocolTCP, ProtocolUDP))
+		}
+		if _, _, err := f.ExternalPorts.Bounds(); err != nil {
+			errs = append(errs, fieldError(field+".externalPorts", "port range %s is not valid: %s", f.ExternalPorts, err))
+		}
+		if _, _, err := f.LocalPorts.Bounds(); err != nil {
+			errs = append(errs, fieldError(field+".localPorts", "port range %s is not valid: %s", f.LocalPorts, err))
+		}
+		if f.TwiceNAT && !hasTwiceNATPool {
+			errs = append(errs, fieldError(field+".twiceNat", "port forward %s is twice-NAT and the NAT has no twice-NAT pool", f.Name))
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// migrateNatIP replaces the deprecated natIP of the endpoints with a legacy
+// NAT of a single pool. It runs after the environment
+// overrides so that NSE_NAT_IP is converted too.
+func (c *Config) migrateNatIP() InvalidConfigErrors {
+	var errs InvalidConfigErrors
+	for i, e := range c.Endpoints {
+		if e == nil || empty(e.NatIP) {
+			continue
+		}
+		field := fmt.Sprintf("endpoints[%d].natIP", i)
+		if e.NAT != nil {
+			errs = append(errs, fieldError(field, "natIP (or %s) is set together with nat", NatIPEnv))
+			continue
+		}
+		c.Warnings = append(c.Warnings, &FieldError{
+			Field: field,
+			Err:   fmt.Errorf("%s (or %s) is deprecated, use endpoints[%d].nat", field, NatIPEnv, i),
+		})
+		e.NAT = &NAT{
+			Pools:              []NATPool{{FirstIP: e.NatIP}},
+			LegacyPortForwards: true,
+		}
+		e.NatIP = ""
+	}
+	return errs
+}
@@ -0,0 +1,96 @@
+package nseconfig
+
+import (
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func TestRequestedPortForwards(t *testing.T) {
+	http := PortForward{Name: "http", ExternalPorts: "8000-8999", LocalPorts: "80-89"}
+	dns := PortForward{Name: "dns", Protocol: ProtocolUDP}
+	nat := &NAT{
+		Pools:        []NATPool{{FirstIP: "192.0.2.1"}},
+		PortForwards: []PortForward{http, dns},
+	}
+
+	for name, tc := range map[string]struct {
+		nat      *NAT
+		labels   map[string]string
+		requests []PortForwardRequest
+		skipped  []string
+		err      string
+	}{
+		"none": {nat: nat, labels: map[string]string{"app": "web"}},
+		"port": {
+			nat:    nat,
+			labels: map[string]string{"nat-port-forward-dns": "53"},
+			requests: []PortForwardRequest{
+				{Label: "nat-port-forward-dns", Forward: dns, ExternalPort: 53, LocalPort: 53, Count: 1},
+			},
+		},
+		"range": {
+			nat:    nat,
+			labels: map[string]string{"nat-port-forward-http": "8080-8081:80", "nat-port-forward-dns": "5353:53"},
+			requests: []PortForwardRequest{
+				{Label: "nat-port-forward-dns", Forward: dns, ExternalPort: 5353, LocalPort: 53, Count: 1},
+				{Label: "nat-port-forward-http", Forward: http, ExternalPort: 8080, LocalPort: 80, Count: 2},
+			},
+		},
+		"undeclared": {
+			nat:    nat,
+			labels: map[string]string{"nat-port-forward-ssh": "22", "nat-port-forward-dns": "53"},
+			requests: []PortForwardRequest{
+				{Label: "nat-port-forward-dns", Forward: dns, ExternalPort: 53, LocalPort: 53, Count: 1},
+			},
+			skipped: []string{"port forward ssh requested by label nat-port-forward-ssh is not declared by the endpoint"},
+		},
+		"no-nat": {
+			labels: map[string]string{"nat-port-forward-dns": "53"},
+		},
+		"legacy": {
+			nat:    &NAT{Pools: []NATPool{{FirstIP: "192.0.2.1"}}, LegacyPortForwards: true},
+			labels: map[string]string{"nat-port-forward-http": "80", "nat-port-forwardudp": "53", "nat-port-forward-tcp": "http"},
+			requests: []PortForwardRequest{
+				{Label: "nat-port-forward-http", Forward: PortForward{Name: "http", Protocol: ProtocolTCP}, ExternalPort: 80, LocalPort: 80, Count: 1},
+				{Label: "nat-port-forwardudp", Forward: PortForward{Name: "nat-port-forwardudp", Protocol: ProtocolUDP}, ExternalPort: 53, LocalPort: 53, Count: 1},
+			},
+			skipped: []string{`label nat-port-forward-tcp=http is not valid: strconv.Atoi: parsing "http": invalid syntax`},
+		},
+		"not-a-port": {
+			nat:    nat,
+			labels: map[string]string{"nat-port-forward-dns": "dns"},
+			err:    "label nat-port-forward-dns=dns is not valid: ports are not in <external>[-<last>][:<local>] form",
+		},
+		"external-range": {
+			nat:    nat,
+			labels: map[string]string{"nat-port-forward-http": "80"},
+			err:    "label nat-port-forward-http=80 is not valid: external ports 80-80 are not in range 8000-8999",
+		},
+		"too-many-ports": {
+			nat:    nat,
+			labels: map[string]string{"nat-port-forward-dns": "1-65535"},
+			err:    "label nat-port-forward-dns=1-65535 is not valid: 65535 ports are requested, at most 1024 can be",
+		},
+		"local-range": {
+			nat:    nat,
+			labels: map[string]string{"nat-port-forward-http": "8000-8009:85"},
+			err:    "label nat-port-forward-http=8000-8009:85 is not valid: local ports 85-94 are not in range 80-89",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			requests, skipped, err := tc.nat.RequestedPortForwards(tc.labels)
+			if tc.err != "" {
+				assert.Error(t, err, tc.err)
+				return
+			}
+			assert.NilError(t, err)
+			assert.DeepEqual(t, tc.requests, requests)
+			var reasons []string
+			for _, reason := range skipped {
+				reasons = append(reasons, reason.Error())
+			}
+			assert.DeepEqual(t, tc.skipped, reasons)
+		})
+	}
+}
@@ -1,7 +1,6 @@
 package nseconfig
 
 import (
-	"github.com/networkservicemesh/networkservicemesh/controlplane/api/connection/mechanisms/memif"
 	"github.com/networkservicemesh/networkservicemesh/sdk/common"
 )
 
@@ -13,7 +12,7 @@ func (e *Endpoint) ToNSConfiguration() *common.NSConfiguration {
 	configuration := &common.NSConfiguration{
 		EndpointNetworkService: e.Name,
 		EndpointLabels:         e.Labels.String(),
-		MechanismType:          memif.MECHANISM,
+		MechanismType:          e.Interface.Mechanism.NSMMechanism(),
 		IPAddress:              e.VL3.IPAM.DefaultPrefixPool,
 		Routes:                 e.VL3.IPAM.Routes,
 		NscInterfaceName:       e.VL3.Ifname,
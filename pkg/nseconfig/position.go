@@ -0,0 +1,69 @@
+package nseconfig
+
+import (
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// resolvePositions sets the line and column of the field errors from the
+// document. Fields missing in the document get the position of the closest
+// enclosing node.
+func resolvePositions(root *yaml.Node, errs InvalidConfigErrors) {
+	for _, err := range errs {
+		ferr, ok := err.(*FieldError)
+		if !ok || ferr.Line > 0 || ferr.Field == "" {
+			continue
+		}
+		if node := lookupPath(root, ferr.Field); node != nil {
+			ferr.Line, ferr.Column = node.Line, node.Column
+		}
+	}
+}
+
+// lookupPath returns the deepest node matching a field path like endpoints[0].vl3.routes[1]
+func lookupPath(root *yaml.Node, path string) *yaml.Node {
+	node := documentContent(root)
+	if node == nil {
+		return nil
+	}
+
+	for _, elem := range strings.Split(path, ".") {
+		key, indexes := splitIndexes(elem)
+
+		next := mappingValue(node, key)
+		if next == nil {
+			return node
+		}
+		node = next
+
+		for _, i := range indexes {
+			if node.Kind != yaml.SequenceNode || i >= len(node.Content) {
+				return node
+			}
+			node = node.Content[i]
+		}
+	}
+
+	return node
+}
+
+// splitIndexes splits routes[1] into the key routes and the indexes [1]
+func splitIndexes(elem string) (string, []int) {
+	var indexes []int
+
+	key := elem
+	if i := strings.Index(elem, "["); i >= 0 {
+		key = elem[:i]
+		for _, idx := range strings.Split(strings.TrimSuffix(elem[i+1:], "]"), "][") {
+			n, err := strconv.Atoi(idx)
+			if err != nil {
+				break
+			}
+			indexes = append(indexes, n)
+		}
+	}
+
+	return key, indexes
+}
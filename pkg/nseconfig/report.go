@@ -0,0 +1,71 @@
+package nseconfig
+
+// Severity of a configuration issue
+type Severity string
+
+const (
+	SeverityError   Severity = "error"
+	SeverityWarning Severity = "warning"
+)
+
+// Issue is the machine readable form of a configuration error or warning
+type Issue struct {
+	Field    string   `json:"field,omitempty"`
+	Line     int      `json:"line,omitempty"`
+	Column   int      `json:"column,omitempty"`
+	Message  string   `json:"message"`
+	Severity Severity `json:"severity"`
+}
+
+// Report is the result of loading a configuration
+type Report struct {
+	Valid  bool    `json:"valid"`
+	Issues []Issue `json:"issues"`
+}
+
+// NewReport builds the report from the loaded configuration and the error
+// returned by NewConfig
+func NewReport(cfg *Config, err error) *Report {
+	report := &Report{
+		Valid:  err == nil,
+		Issues: []Issue{},
+	}
+
+	if cfg != nil {
+		for _, w := range cfg.Warnings {
+			report.Issues = append(report.Issues, newIssue(w, SeverityWarning))
+		}
+	}
+
+	if err == nil {
+		return report
+	}
+
+	errs, ok := err.(InvalidConfigErrors)
+	if !ok {
+		errs = InvalidConfigErrors{err}
+	}
+	for _, e := range errs {
+		report.Issues = append(report.Issues, newIssue(e, SeverityError))
+	}
+
+	return report
+}
+
+func newIssue(err error, severity Severity) Issue {
+	ferr, ok := err.(*FieldError)
+	if !ok {
+		return Issue{
+			Message:  err.Error(),
+			Severity: severity,
+		}
+	}
+
+	return Issue{
+		Field:    ferr.Field,
+		Line:     ferr.Line,
+		Column:   ferr.Column,
+		Message:  ferr.Err.Error(),
+		Severity: severity,
+	}
+}
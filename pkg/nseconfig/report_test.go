@@ -0,0 +1,29 @@
+package nseconfig
+
+import (
+	"fmt"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func TestNewReport(t *testing.T) {
+	cfg := &Config{
+		Warnings: []error{fmt.Errorf("apiVersion is not set, migrating the configuration to v1")},
+	}
+	err := InvalidConfigErrors{
+		&FieldError{Field: "endpoints[0].vl3.ipam.routes[1]", Line: 10, Column: 34, Err: fmt.Errorf("route nr 1 is not a valid subnet")},
+		fmt.Errorf("no endpoints provided"),
+	}
+
+	assert.DeepEqual(t, &Report{
+		Valid: false,
+		Issues: []Issue{
+			{Message: "apiVersion is not set, migrating the configuration to v1", Severity: SeverityWarning},
+			{Field: "endpoints[0].vl3.ipam.routes[1]", Line: 10, Column: 34, Message: "route nr 1 is not a valid subnet", Severity: SeverityError},
+			{Message: "no endpoints provided", Severity: SeverityError},
+		},
+	}, NewReport(cfg, err))
+
+	assert.DeepEqual(t, &Report{Valid: true, Issues: []Issue{}}, NewReport(&Config{}, nil))
+}
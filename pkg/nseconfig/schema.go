@@ -0,0 +1,105 @@
+package nseconfig
+
+import (
+	"encoding/json"
+	"reflect"
+	"time"
+)
+
+//go:generate sh -c "go run ../../cmd/nseconfig-schema > nseconfig.schema.json"
+
+// SchemaID is the $id of the generated JSON Schema
+const SchemaID = "https://github.com/cisco-app-networking/nsm-nse/pkg/nseconfig/nseconfig.schema.json"
+
+// JSONSchema is the subset of the JSON Schema draft-07 vocabulary used to
+// describe the configuration
+type JSONSchema struct {
+	Schema               string                 `json:"$schema,omitempty"`
+	ID                   string                 `json:"$id,omitempty"`
+	Title                string                 `json:"title,omitempty"`
+	Type                 string                 `json:"type,omitempty"`
+	Enum                 []string               `json:"enum,omitempty"`
+	Properties           map[string]*JSONSchema `json:"properties,omitempty"`
+	AdditionalProperties interface{}            `json:"additionalProperties,omitempty"`
+	Items                *JSONSchema            `json:"items,omitempty"`
+}
+
+// Schema returns the JSON Schema of the configuration, generated from the
+// Config type and its yaml field names
+func Schema() *JSONSchema {
+	s := schemaOf(reflect.TypeOf(Config{}))
+	s.Schema = "http://json-schema.org/draft-07/schema#"
+	s.ID = SchemaID
+	s.Title = "NSE configuration"
+	s.Properties["apiVersion"].Enum = []string{APIVersion}
+	return s
+}
+
+// MarshalSchema returns the indented JSON encoding of the Schema
+func MarshalSchema() ([]byte, error) {
+	b, err := json.MarshalIndent(Schema(), "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(b, '\n'), nil
+}
+
+// schemaEnums are the allowed values of the enumeration types
+var schemaEnums = map[reflect.Type][]string{
+	reflect.TypeOf(AddressFamily("")):   {string(IPv4), string(IPv6)},
+	reflect.TypeOf(LocalAllocation("")): {string(LocalAllocationHash), string(LocalAllocationPodOctet)},
+	reflect.TypeOf(Mechanism("")):       {string(MechanismMemif), string(MechanismKernel)},
+	reflect.TypeOf(Protocol("")):        {string(ProtocolTCP), string(ProtocolUDP)},
+	reflect.TypeOf(RxMode("")):          {string(RxModePolling), string(RxModeInterrupt), string(RxModeAdaptive)},
+}
+
+func schemaOf(t reflect.Type) *JSONSchema {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	if enum, ok := schemaEnums[t]; ok {
+		return &JSONSchema{Type: "string", Enum: enum}
+	}
+	if t == reflect.TypeOf(time.Duration(0)) {
+		// a duration like 30s
+		return &JSONSchema{Type: "string"}
+	}
+	if t == reflect.TypeOf(InitAction{}) {
+		// the action model belongs to the universal CNF
+		return &JSONSchema{Type: "object"}
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		s := &JSONSchema{
+			Type:                 "object",
+			Properties:           map[string]*JSONSchema{},
+			AdditionalProperties: false,
+		}
+		for name, field := range yamlFields(t) {
+			s.Properties[name] = schemaOf(field.Type)
+		}
+		return s
+	case reflect.Map:
+		return &JSONSchema{
+			Type:                 "object",
+			AdditionalProperties: schemaOf(t.Elem()),
+		}
+	case reflect.Slice, reflect.Array:
+		return &JSONSchema{
+			Type:  "array",
+			Items: schemaOf(t.Elem()),
+		}
+	case reflect.Bool:
+		return &JSONSchema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return &JSONSchema{Type: "integer"}
+	case reflect.Float32, reflect.Float64:
+		return &JSONSchema{Type: "number"}
+	case reflect.String:
+		return &JSONSchema{Type: "string"}
+	}
+	return &JSONSchema{}
+}
@@ -0,0 +1,18 @@
+package nseconfig
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func TestSchemaUpToDate(t *testing.T) {
+	expected, err := MarshalSchema()
+	assert.NilError(t, err)
+
+	actual, err := ioutil.ReadFile("nseconfig.schema.json")
+	assert.NilError(t, err)
+
+	assert.Equal(t, string(expected), string(actual), "nseconfig.schema.json is outdated, run go generate ./pkg/nseconfig")
+}
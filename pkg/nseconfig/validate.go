@@ -4,10 +4,28 @@ import (
 	"bytes"
 	"fmt"
 	"net"
+	"strconv"
+	"strings"
 )
 
 type InvalidConfigErrors []error
 
+// FieldError is an error of a single configuration field, with the position
+// of the field in the source document when it is known
+type FieldError struct {
+	Field  string
+	Line   int
+	Column int
+	Err    error
+}
+
+func (e *FieldError) Error() string {
+	if e.Line > 0 {
+		return fmt.Sprintf("line %d, column %d: %s", e.Line, e.Column, e.Err)
+	}
+	return e.Err.Error()
+}
+
 func (v InvalidConfigErrors) Error() string {
 	b := bytes.NewBufferString("validation failed with errors: \n")
 	for _, err := range v {
@@ -16,19 +34,43 @@ func (v InvalidConfigErrors) Error() string {
 	return b.String()
 }
 
+func fieldError(field, format string, args ...interface{}) error {
+	return &FieldError{Field: field, Err: fmt.Errorf(format, args...)}
+}
+
+// appendErrors flattens err into errs and prefixes the field paths with prefix
+func appendErrors(errs InvalidConfigErrors, prefix string, err error) InvalidConfigErrors {
+	if err == nil {
+		return errs
+	}
+
+	verrs, ok := err.(InvalidConfigErrors)
+	if !ok {
+		verrs = InvalidConfigErrors{err}
+	}
+
+	for _, e := range verrs {
+		if ferr, ok := e.(*FieldError); ok {
+			ferr.Field = joinPath(prefix, ferr.Field)
+		}
+		errs = append(errs, e)
+	}
+	return errs
+}
+
 func (c *NseControl) validate() error {
 	if c == nil {
 		return nil
 	}
 	var errs InvalidConfigErrors
 	if empty(c.Address) {
-		errs = append(errs, fmt.Errorf("nseControl address is not set"))
+		errs = append(errs, fieldError("address", "nseControl address is not set"))
 	}
 	if empty(c.Name) {
-		errs = append(errs, fmt.Errorf("nseControl name is not set"))
+		errs = append(errs, fieldError("name", "nseControl name is not set"))
 	}
 	if empty(c.ConnectivityDomain) {
-		errs = append(errs, fmt.Errorf("connectivity domain is not set"))
+		errs = append(errs, fieldError("connectivityDomain", "connectivity domain is not set"))
 	}
 
 	if len(errs) > 0 {
@@ -37,15 +79,88 @@ func (c *NseControl) validate() error {
 	return nil
 }
 
-func (v VL3) validate() error {
+func (i IPAM) validate() error {
 	var errs InvalidConfigErrors
 
-	if _, _, err := net.ParseCIDR(v.IPAM.DefaultPrefixPool); err != nil {
-		errs = append(errs, fmt.Errorf("prefix pool is not a valid subnet: %s", err))
+	// the parsed pools of the endpoint and their values, for the overlap checks
+	var pools []*net.IPNet
+	var poolValues []string
+	families := map[AddressFamily]bool{}
+
+	if !empty(i.DefaultPrefixPool) || len(i.PrefixPools) == 0 {
+		_, pool, err := net.ParseCIDR(i.DefaultPrefixPool)
+		if err != nil {
+			errs = append(errs, fieldError("defaultPrefixPool", "prefix pool is not a valid subnet: %s", err))
+		}
+
+		if err := validatePrefixLength(i.PrefixLength, pool, i.DefaultPrefixPool); err != nil {
+			errs = append(errs, fieldError("prefixLength", "%s", err))
+		}
+
+		if pool != nil {
+			pools = append(pools, pool)
+			poolValues = append(poolValues, i.DefaultPrefixPool)
+			families[FamilyOf(pool.IP)] = true
+		}
+	}
+
+	for n, p := range i.PrefixPools {
+		field := fmt.Sprintf("prefixPools[%d]", n)
+		errs = appendErrors(errs, field, p.validate())
+
+		_, pool, err := net.ParseCIDR(p.Prefix)
+		if err != nil {
+			continue
+		}
+		family := FamilyOf(pool.IP)
+		if families[family] {
+			errs = append(errs, fieldError(field+".prefix", "prefix pool %s is not the only %s pool of the endpoint", p.Prefix, family))
+		}
+		families[family] = true
+
+		for m, other := range pools {
+			if overlaps(other, pool) {
+				errs = append(errs, fieldError(field+".prefix", "prefix pool %s overlaps the prefix pool %s", p.Prefix, poolValues[m]))
+			}
+		}
+		pools = append(pools, pool)
+		poolValues = append(poolValues, p.Prefix)
 	}
-	for i, r := range v.IPAM.Routes {
-		if _, _, err := net.ParseCIDR(r); err != nil {
-			errs = append(errs, fmt.Errorf("route nr %d with value %s is not a valid subnet: %s", i, r, err))
+
+	var routes []*net.IPNet
+	for n, r := range i.Routes {
+		_, route, err := net.ParseCIDR(r)
+		if err != nil {
+			errs = append(errs, fieldError(fmt.Sprintf("routes[%d]", n), "route nr %d with value %s is not a valid subnet: %s", n, r, err))
+			continue
+		}
+		for m, pool := range pools {
+			if overlaps(pool, route) {
+				errs = append(errs, fieldError(fmt.Sprintf("routes[%d]", n), "route nr %d with value %s overlaps the prefix pool %s", n, r, poolValues[m]))
+			}
+		}
+		for m, other := range routes {
+			if other != nil && overlaps(other, route) {
+				errs = append(errs, fieldError(fmt.Sprintf("routes[%d]", n), "route nr %d with value %s overlaps route nr %d with value %s", n, r, m, i.Routes[m]))
+			}
+		}
+		routes = append(routes, route)
+	}
+
+	switch i.LocalAllocation {
+	case "", LocalAllocationHash, LocalAllocationPodOctet:
+	default:
+		errs = append(errs, fieldError("localAllocation", "local allocation %s is not one of %s, %s",
+			i.LocalAllocation, LocalAllocationHash, LocalAllocationPodOctet))
+	}
+
+	if i.UniqueOctet != nil && (*i.UniqueOctet < 0 || *i.UniqueOctet > 255) {
+		errs = append(errs, fieldError("uniqueOctet", "unique octet %d is not in range 0-255", *i.UniqueOctet))
+	}
+
+	if !empty(i.ServerAddress) {
+		if err := validateHostPort(i.ServerAddress); err != nil {
+			errs = append(errs, fieldError("serverAddress", "ipam server address %s is not in host:port form: %s", i.ServerAddress, err))
 		}
 	}
 
@@ -55,26 +170,48 @@ func (v VL3) validate() error {
 	return nil
 }
 
-func (e Endpoint) validate() error {
+func (v VL3) validate() error {
 	var errs InvalidConfigErrors
+
+	errs = appendErrors(errs, "ipam", v.IPAM.validate())
+
+	for n, s := range v.NameServers {
+		if net.ParseIP(s) == nil {
+			errs = append(errs, fieldError(fmt.Sprintf("nameServers[%d]", n), "name server %s is not a valid IP address", s))
+		}
+	}
+	for n, z := range v.DNSZones {
+		if err := validateDomainName(z); err != nil {
+			errs = append(errs, fieldError(fmt.Sprintf("dnsZones[%d]", n), "dns zone %s is not a valid domain name: %s", z, err))
+		}
+	}
+	for n, r := range v.RemoteNsIPList {
+		if net.ParseIP(r) == nil && validateDomainName(r) != nil {
+			errs = append(errs, fieldError(fmt.Sprintf("remoteNsIPList[%d]", n), "remote NSM address %s is not a valid IP address or host name", r))
+		}
+	}
+	if _, err := ParseSelector(v.PeerSelector); err != nil {
+		errs = append(errs, fieldError("peerSelector", "peer selector %s is not valid: %s", v.PeerSelector, err))
+	}
+
 	if len(errs) > 0 {
 		return errs
 	}
-	for _, err := range []error{
-		e.NseControl.validate(),
-		e.VL3.validate(),
-	} {
-		if err != nil {
-			if verr, ok := err.(InvalidConfigErrors); ok {
-				errs = append(errs, verr...)
-			} else {
-				errs = append(errs, err)
-			}
-		}
+	return nil
+}
+
+func (e Endpoint) validate() error {
+	var errs InvalidConfigErrors
+	errs = appendErrors(errs, "nseControl", e.NseControl.validate())
+	if !empty(e.PodIP) && net.ParseIP(e.PodIP) == nil {
+		errs = append(errs, fieldError("podIP", "pod IP %s is not a valid IP address", e.PodIP))
 	}
-	if e.NseControl == nil {
-		e.NseControl = &NseControl{}
+	if e.NAT != nil {
+		errs = appendErrors(errs, "nat", e.NAT.validate())
 	}
+	errs = appendErrors(errs, "interface", e.Interface.validate())
+	errs = appendErrors(errs, "vl3", e.VL3.validate())
+
 	if len(errs) > 0 {
 		return errs
 	}
@@ -82,23 +219,118 @@ func (e Endpoint) validate() error {
 }
 
 func (c Config) validate() error {
-	if len(c.Endpoints) == 0 {
+	if len(c.Endpoints) == 0 && len(c.InitActions) == 0 {
 		return fmt.Errorf("no endpoints provided")
 	}
 
 	var errs InvalidConfigErrors
 
-	for _, endp := range c.Endpoints {
-		if err := endp.validate(); err != nil {
-			if verr, ok := err.(InvalidConfigErrors); ok {
-				errs = append(errs, verr...)
-			} else {
-				errs = append(errs, err)
-			}
+	for i, endp := range c.Endpoints {
+		errs = appendErrors(errs, fmt.Sprintf("endpoints[%d]", i), endp.validate())
+	}
+	for i, a := range c.InitActions {
+		if err := a.validate(); err != nil {
+			errs = append(errs, fieldError(fmt.Sprintf("initActions[%d]", i), "%v", err))
 		}
 	}
+	if c.MaxParallelClients < 0 {
+		errs = append(errs, fieldError("maxParallelClients", "max parallel clients %d is negative", c.MaxParallelClients))
+	}
+	if interval := c.VPPAgent.ReconcileInterval; interval != nil && *interval < 0 {
+		errs = append(errs, fieldError("vppAgent.reconcileInterval", "reconcile interval %s is negative", *interval))
+	}
+
+	errs = append(errs, c.validateEndpointsUnique()...)
+
 	if len(errs) > 0 {
 		return errs
 	}
 	return nil
 }
+
+// validateEndpointsUnique reports endpoints sharing the name and interface
+// and endpoints with overlapping prefix pools, which share the VPP routing table
+func (c Config) validateEndpointsUnique() InvalidConfigErrors {
+	var errs InvalidConfigErrors
+
+	for i, e := range c.Endpoints {
+		fields, pools := endpointPools(e)
+		for j, other := range c.Endpoints[:i] {
+			if e.Name == other.Name && e.VL3.Ifname == other.VL3.Ifname {
+				errs = append(errs, fieldError(fmt.Sprintf("endpoints[%d].name", i),
+					"endpoint nr %d shares the name %q and interface %q with endpoint nr %d", i, e.Name, e.VL3.Ifname, j))
+			}
+			_, otherPools := endpointPools(other)
+			for n, pool := range pools {
+				for _, otherPool := range otherPools {
+					if overlaps(pool, otherPool) {
+						errs = append(errs, fieldError(fmt.Sprintf("endpoints[%d].vl3.ipam.%s", i, fields[n]),
+							"prefix pool %s of endpoint nr %d overlaps the prefix pool %s of endpoint nr %d", pool, i, otherPool, j))
+					}
+				}
+			}
+		}
+	}
+
+	return errs
+}
+
+// endpointPools returns the valid prefix pools of the endpoint and their field paths
+func endpointPools(e *Endpoint) ([]string, []*net.IPNet) {
+	var fields []string
+	var pools []*net.IPNet
+
+	if _, pool, err := net.ParseCIDR(e.VL3.IPAM.DefaultPrefixPool); err == nil {
+		fields = append(fields, "defaultPrefixPool")
+		pools = append(pools, pool)
+	}
+	for n, p := range e.VL3.IPAM.PrefixPools {
+		if _, pool, err := net.ParseCIDR(p.Prefix); err == nil {
+			fields = append(fields, fmt.Sprintf("prefixPools[%d].prefix", n))
+			pools = append(pools, pool)
+		}
+	}
+
+	return fields, pools
+}
+
+func overlaps(a, b *net.IPNet) bool {
+	return a.Contains(b.IP) || b.Contains(a.IP)
+}
+
+func validateHostPort(address string) error {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if empty(host) {
+		return fmt.Errorf("host is not set")
+	}
+	if p, err := strconv.Atoi(port); err != nil || p < 1 || p > 65535 {
+		return fmt.Errorf("port %s is not in range 1-65535", port)
+	}
+	return nil
+}
+
+// validateDomainName checks the RFC 1123 host name syntax, a trailing dot is allowed
+func validateDomainName(name string) error {
+	name = strings.TrimSuffix(name, ".")
+	if len(name) == 0 || len(name) > 253 {
+		return fmt.Errorf("length must be between 1 and 253 characters")
+	}
+
+	for _, label := range strings.Split(name, ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return fmt.Errorf("label %q length must be between 1 and 63 characters", label)
+		}
+		if label[0] == '-' || label[len(label)-1] == '-' {
+			return fmt.Errorf("label %q must not start or end with a hyphen", label)
+		}
+		for _, r := range label {
+			if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-') {
+				return fmt.Errorf("label %q contains the invalid character %q", label, r)
+			}
+		}
+	}
+	return nil
+}
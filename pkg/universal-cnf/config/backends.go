@@ -0,0 +1,73 @@
+package config
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/cisco-app-networking/nsm-nse/pkg/nseconfig"
+)
+
+// DefaultBackend is the backend used when the configuration does not select one
+const DefaultBackend = "vppagent"
+
+// BackendFactory creates a backend, NewUniversalCNFBackend is called on it
+// before it is used
+type BackendFactory func() UniversalCNFBackend
+
+// ConfigurableBackend is a backend with settings in the NSE configuration,
+// Configure is called before NewUniversalCNFBackend
+type ConfigurableBackend interface {
+	Configure(cfg *nseconfig.Config) error
+}
+
+var (
+	backendsMu sync.RWMutex
+	backends   = map[string]BackendFactory{}
+)
+
+// RegisterBackend makes a backend selectable by name in the configuration,
+// it is called from the init function of the backend package. Registering a
+// name twice panics.
+func RegisterBackend(name string, factory BackendFactory) {
+	backendsMu.Lock()
+	defer backendsMu.Unlock()
+
+	if factory == nil {
+		panic("config: RegisterBackend factory is nil")
+	}
+	if _, ok := backends[name]; ok {
+		panic("config: RegisterBackend called twice for backend " + name)
+	}
+	backends[name] = factory
+}
+
+// NewBackend creates the backend registered as name, DefaultBackend when
+// name is empty
+func NewBackend(name string) (UniversalCNFBackend, error) {
+	if name == "" {
+		name = DefaultBackend
+	}
+
+	backendsMu.RLock()
+	factory, ok := backends[name]
+	backendsMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("backend %s is not one of %s", name, strings.Join(Backends(), ", "))
+	}
+	return factory(), nil
+}
+
+// Backends returns the sorted names of the registered backends
+func Backends() []string {
+	backendsMu.RLock()
+	defer backendsMu.RUnlock()
+
+	names := make([]string, 0, len(backends))
+	for name := range backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,51 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/cisco-app-networking/nsm-nse/pkg/nseconfig"
+)
+
+func init() {
+	RegisterBackend("test", func() UniversalCNFBackend { return testBackend{} })
+}
+
+func TestBackendRegistry(t *testing.T) {
+	assert.Contains(t, Backends(), "test")
+
+	b, err := NewBackend("test")
+	require.NoError(t, err)
+	assert.Equal(t, testBackend{}, b)
+
+	_, err = NewBackend("nope")
+	assert.EqualError(t, err, "backend nope is not one of "+joinBackends())
+
+	assert.Panics(t, func() {
+		RegisterBackend("test", func() UniversalCNFBackend { return testBackend{} })
+	})
+}
+
+func TestUniversalCNFConfigBackend(t *testing.T) {
+	cfg := &UniversalCNFConfig{}
+	require.NoError(t, cfg.Load([]byte("backend: test\ninitActions:\n  - command:\n      name: \"true\"\n"), nseconfig.FormatYAML))
+	assert.Equal(t, "test", cfg.Backend)
+
+	cfg = &UniversalCNFConfig{}
+	err := cfg.Load([]byte("backend: nope\ninitActions:\n  - command:\n      name: \"true\"\n"), nseconfig.FormatYAML)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "backend nope is not one of test")
+}
+
+func joinBackends() string {
+	names := ""
+	for i, name := range Backends() {
+		if i > 0 {
+			names += ", "
+		}
+		names += name
+	}
+	return names
+}
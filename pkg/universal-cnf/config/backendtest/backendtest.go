@@ -0,0 +1,314 @@
+// Package backendtest is the conformance suite of the universal CNF backends,
+// every backend registered with config.RegisterBackend runs it in its tests
+package backendtest
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/networkservicemesh/networkservicemesh/controlplane/api/connection"
+	"github.com/networkservicemesh/networkservicemesh/controlplane/api/connection/mechanisms/common"
+	"github.com/networkservicemesh/networkservicemesh/controlplane/api/connectioncontext"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/cisco-app-networking/nsm-nse/pkg/nseconfig"
+	"github.com/cisco-app-networking/nsm-nse/pkg/universal-cnf/config"
+	"github.com/cisco-app-networking/nsm-nse/pkg/universal-cnf/dataplane"
+)
+
+const (
+	clientIfName = "nsm0"
+	endpointName = "conformance"
+	endpointIf   = "endpoint0"
+	srcIPAddr    = "10.60.1.1/30"
+	dstIPAddr    = "10.60.1.2/30"
+	srcRoute     = "10.60.0.0/16"
+	dstRoute     = "10.70.0.0/16"
+	natIP        = "192.0.2.1"
+)
+
+// Suite describes the backend under test
+type Suite struct {
+	// New returns a backend ready to process connections, without calling
+	// NewUniversalCNFBackend when that needs the dataplane
+	New func(t *testing.T) config.UniversalCNFBackend
+	// Apply also checks ProcessDPConfig, for the backends that can apply a
+	// configuration in the test environment
+	Apply bool
+}
+
+// Run runs the conformance tests against the backend of the suite
+func Run(t *testing.T, suite Suite) {
+	t.Run("NewDPConfig", func(t *testing.T) {
+		assert.NotNil(t, suite.New(t).NewDPConfig())
+	})
+
+	t.Run("ProcessClient", func(t *testing.T) {
+		b := suite.New(t)
+		dpconfig := b.NewDPConfig()
+		require.NoError(t, b.ProcessClient(dpconfig, clientIfName, kernelInterface(), newConnection(0)))
+
+		iface := findInterface(dpconfig, clientIfName)
+		require.NotNil(t, iface, "client interface %s", clientIfName)
+		assert.Equal(t, dataplane.InterfaceKernel, iface.Type)
+		assert.Equal(t, clientIfName, iface.HostIfName)
+		assert.Contains(t, iface.Addresses, srcIPAddr)
+		assertRoute(t, dpconfig, dstRoute, ip(dstIPAddr))
+	})
+
+	t.Run("ProcessEndpoint", func(t *testing.T) {
+		b := suite.New(t)
+		dpconfig := b.NewDPConfig()
+		endpoint := &nseconfig.Endpoint{
+			Name:      endpointName,
+			Interface: kernelInterface(),
+			VL3:       nseconfig.VL3{Ifname: endpointIf},
+		}
+		require.NoError(t, b.ProcessEndpoint(dpconfig, endpoint, newConnection(0)))
+		require.NoError(t, b.ProcessEndpoint(dpconfig, endpoint, newConnection(1)))
+
+		require.Len(t, dpconfig.Interfaces, 2)
+		first, second := dpconfig.Interfaces[0], dpconfig.Interfaces[1]
+		assert.True(t, strings.HasPrefix(first.Name, endpointIf), first.Name)
+		assert.True(t, strings.HasPrefix(second.Name, endpointIf), second.Name)
+		assert.NotEqual(t, first.Name, second.Name, "the connections of an endpoint need their own interface")
+		assert.Contains(t, first.Addresses, dstIPAddr)
+		assertRoute(t, dpconfig, srcRoute, ip(srcIPAddr))
+	})
+
+	t.Run("NoAddresses", func(t *testing.T) {
+		b := suite.New(t)
+		dpconfig := b.NewDPConfig()
+		conn := newConnection(0)
+		conn.Context.IpContext.SrcIpAddr = ""
+		conn.Context.IpContext.DstIpAddr = ""
+		require.NoError(t, b.ProcessClient(dpconfig, clientIfName, kernelInterface(), conn))
+		require.NoError(t, b.ProcessEndpoint(dpconfig, &nseconfig.Endpoint{
+			Name:      endpointName,
+			Interface: kernelInterface(),
+			VL3:       nseconfig.VL3{Ifname: endpointIf},
+		}, conn))
+
+		// the routes have no next hop without the address of the other side
+		assert.Len(t, dpconfig.Interfaces, 2)
+		assert.Empty(t, dpconfig.Routes)
+	})
+
+	t.Run("ReleaseEndpoint", func(t *testing.T) {
+		b := suite.New(t)
+		endpoint := &nseconfig.Endpoint{
+			Name:      endpointName,
+			Interface: kernelInterface(),
+			VL3:       nseconfig.VL3{Ifname: endpointIf},
+		}
+		ifName := func(i int) string {
+			dpconfig := b.NewDPConfig()
+			require.NoError(t, b.ProcessEndpoint(dpconfig, endpoint, newConnection(i)))
+			require.Len(t, dpconfig.Interfaces, 1)
+			return dpconfig.Interfaces[0].Name
+		}
+
+		first, second := ifName(0), ifName(1)
+		assert.Equal(t, first, ifName(0), "a refreshed connection keeps its interface")
+		b.ReleaseEndpoint(endpoint, newConnection(0))
+		assert.Equal(t, first, ifName(2), "the interface of a closed connection is reused")
+		assert.Equal(t, second, ifName(1))
+	})
+
+	t.Run("ProcessEndpointConcurrent", func(t *testing.T) {
+		b := suite.New(t)
+		endpoint := &nseconfig.Endpoint{
+			Name:      endpointName,
+			Interface: kernelInterface(),
+			VL3:       nseconfig.VL3{Ifname: endpointIf},
+		}
+
+		names := make([]string, 16)
+		var wg sync.WaitGroup
+		for i := range names {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				dpconfig := b.NewDPConfig()
+				assert.NoError(t, b.ProcessEndpoint(dpconfig, endpoint, newConnection(i)))
+				names[i] = dpconfig.Interfaces[0].Name
+			}(i)
+		}
+		wg.Wait()
+
+		unique := map[string]bool{}
+		for _, name := range names {
+			unique[name] = true
+		}
+		assert.Len(t, unique, len(names), "the connections of an endpoint need their own interface")
+	})
+
+	t.Run("SetupEndpoint", func(t *testing.T) {
+		b := suite.New(t)
+		dpconfig := b.NewDPConfig()
+		require.NoError(t, b.SetupEndpoint(dpconfig, &nseconfig.Endpoint{Name: endpointName, NAT: endpointNAT()}))
+		require.Len(t, dpconfig.NAT.Pools, 1)
+		assert.Equal(t, natIP, dpconfig.NAT.Pools[0].FirstIP)
+		assert.Equal(t, []*dataplane.NATInterface{{Name: "eth0", Outside: true}}, dpconfig.NAT.Interfaces)
+
+		dpconfig = b.NewDPConfig()
+		require.NoError(t, b.SetupEndpoint(dpconfig, &nseconfig.Endpoint{Name: endpointName}))
+		assert.Empty(t, dpconfig.NAT.Pools)
+	})
+
+	t.Run("PortForward", func(t *testing.T) {
+		b := suite.New(t)
+		dpconfig := b.NewDPConfig()
+		endpoint := &nseconfig.Endpoint{
+			Name:      endpointName,
+			Interface: kernelInterface(),
+			VL3:       nseconfig.VL3{Ifname: endpointIf},
+			NAT:       endpointNAT(),
+		}
+		conn := newConnection(0)
+		conn.Labels[nseconfig.PortForwardLabel+"dns"] = "8053-8054:53"
+		require.NoError(t, b.ProcessEndpoint(dpconfig, endpoint, conn))
+
+		require.Len(t, dpconfig.Interfaces, 1)
+		assert.Equal(t, []*dataplane.NATInterface{{Name: dpconfig.Interfaces[0].Name, Inside: true}}, dpconfig.NAT.Interfaces)
+		// the port range is forwarded by a single mapping
+		require.Len(t, dpconfig.NAT.StaticMappings, 1)
+		m := dpconfig.NAT.StaticMappings[0]
+		assert.Equal(t, dataplane.ProtocolUDP, m.Protocol)
+		assert.Equal(t, natIP, m.ExternalIP)
+		assert.Equal(t, uint32(8053), m.ExternalPort)
+		assert.Equal(t, ip(srcIPAddr), m.LocalIP)
+		assert.Equal(t, uint32(53), m.LocalPort)
+		assert.Equal(t, uint32(2), m.Ports())
+
+		// the requests are checked before anything is added
+		for _, value := range []string{"8054", "9000", "8053:80", "dns"} {
+			conn := newConnection(1)
+			conn.Labels[nseconfig.PortForwardLabel+"dns"] = value
+			assert.Error(t, b.ProcessEndpoint(dpconfig, endpoint, conn), value)
+		}
+		assert.Len(t, dpconfig.Interfaces, 1)
+		assert.Len(t, dpconfig.NAT.StaticMappings, 1)
+
+		// the port forwards of a connection may not overlap each other
+		overlapping := *endpoint
+		overlapping.NAT = endpointNAT()
+		overlapping.NAT.PortForwards = append(overlapping.NAT.PortForwards, nseconfig.PortForward{
+			Name: "dns-alt", Protocol: nseconfig.ProtocolUDP, ExternalPorts: "9000-9099",
+		})
+		conn = newConnection(1)
+		conn.Labels[nseconfig.PortForwardLabel+"dns"] = "8060-8070:60"
+		conn.Labels[nseconfig.PortForwardLabel+"dns-alt"] = "9000"
+		require.NoError(t, b.ProcessEndpoint(b.NewDPConfig(), &overlapping, conn))
+		overlapping.NAT.PortForwards[1].ExternalPorts = "8000-8099"
+		conn.Labels[nseconfig.PortForwardLabel+"dns-alt"] = "8065"
+		assert.Error(t, b.ProcessEndpoint(b.NewDPConfig(), &overlapping, conn))
+
+		// the labels of undeclared port forwards are skipped
+		conn = newConnection(1)
+		conn.Labels[nseconfig.PortForwardLabel+"ssh"] = "22"
+		require.NoError(t, b.ProcessEndpoint(dpconfig, endpoint, conn))
+		assert.Len(t, dpconfig.Interfaces, 2)
+		assert.Len(t, dpconfig.NAT.StaticMappings, 1)
+		dpconfig.Interfaces = dpconfig.Interfaces[:1]
+		dpconfig.NAT.Interfaces = dpconfig.NAT.Interfaces[:1]
+
+		// and so are all port forward labels without a NAT
+		noNAT := b.NewDPConfig()
+		conn = newConnection(2)
+		conn.Labels[nseconfig.PortForwardLabel+"dns"] = "8053"
+		require.NoError(t, b.ProcessEndpoint(noNAT, &nseconfig.Endpoint{
+			Name:      endpointName,
+			Interface: kernelInterface(),
+			VL3:       nseconfig.VL3{Ifname: endpointIf},
+		}, conn))
+		assert.Empty(t, noNAT.NAT.Interfaces)
+		assert.Empty(t, noNAT.NAT.StaticMappings)
+
+		removed := dpconfig.RemoveEndpointNAT(dpconfig.Interfaces[0].Name, ip(srcIPAddr))
+		assert.Len(t, removed.Interfaces, 1)
+		assert.Len(t, removed.StaticMappings, 1)
+		assert.Empty(t, dpconfig.NAT.Interfaces)
+		assert.Empty(t, dpconfig.NAT.StaticMappings)
+	})
+
+	if !suite.Apply {
+		return
+	}
+
+	t.Run("ProcessDPConfig", func(t *testing.T) {
+		b := suite.New(t)
+		dpconfig := b.NewDPConfig()
+		require.NoError(t, b.ProcessClient(dpconfig, clientIfName, kernelInterface(), newConnection(0)))
+		require.NoError(t, b.ProcessDPConfig(dpconfig, true))
+		require.NoError(t, b.ProcessDPConfig(dpconfig, false))
+	})
+}
+
+func kernelInterface() nseconfig.Interface {
+	return nseconfig.Interface{Mechanism: nseconfig.MechanismKernel}
+}
+
+// newConnection returns the i-th connection of the suite, a kernel interface
+// connection with a route on each side
+// endpointNAT forwards the UDP ports 8053-8099 of natIP to the ports 53-99
+func endpointNAT() *nseconfig.NAT {
+	return &nseconfig.NAT{
+		Pools:             []nseconfig.NATPool{{FirstIP: natIP}},
+		OutsideInterfaces: []string{"eth0"},
+		PortForwards: []nseconfig.PortForward{{
+			Name:          "dns",
+			Protocol:      nseconfig.ProtocolUDP,
+			ExternalPorts: "8053-8099",
+			LocalPorts:    "53-99",
+		}},
+	}
+}
+
+func newConnection(i int) *connection.Connection {
+	return &connection.Connection{
+		Id: fmt.Sprintf("conformance-%d", i),
+		Context: &connectioncontext.ConnectionContext{
+			IpContext: &connectioncontext.IPContext{
+				SrcIpAddr: srcIPAddr,
+				DstIpAddr: dstIPAddr,
+				SrcRoutes: []*connectioncontext.Route{{Prefix: srcRoute}},
+				DstRoutes: []*connectioncontext.Route{{Prefix: dstRoute}},
+			},
+		},
+		Mechanism: &connection.Mechanism{
+			Type:       nseconfig.MechanismKernel.NSMMechanism(),
+			Parameters: map[string]string{common.InterfaceNameKey: clientIfName},
+		},
+		Labels: map[string]string{},
+	}
+}
+
+func findInterface(dpconfig *dataplane.Config, name string) *dataplane.Interface {
+	for _, iface := range dpconfig.Interfaces {
+		if iface.Name == name {
+			return iface
+		}
+	}
+	return nil
+}
+
+func assertRoute(t *testing.T, dpconfig *dataplane.Config, dst, nextHop string) {
+	t.Helper()
+	for _, route := range dpconfig.Routes {
+		if route.Dst == dst {
+			assert.Equal(t, nextHop, route.NextHop, "next hop of the route to %s", dst)
+			return
+		}
+	}
+	t.Errorf("no route to %s in %v", dst, dpconfig.Routes)
+}
+
+func ip(cidr string) string {
+	addr, _, _ := net.ParseCIDR(cidr)
+	return addr.String()
+}
@@ -0,0 +1,219 @@
+package config
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/networkservicemesh/networkservicemesh/controlplane/api/connection"
+	"github.com/networkservicemesh/networkservicemesh/sdk/client"
+	"github.com/sirupsen/logrus"
+
+	"github.com/cisco-app-networking/nsm-nse/pkg/metrics"
+	"github.com/cisco-app-networking/nsm-nse/pkg/universal-cnf/dataplane"
+)
+
+// default delay between the reconnect attempts of a client whose connection went down
+const defaultReconnectDelay = client.RequestDelay
+
+// NSMConnector is the part of the NSM client used by the client actions
+type NSMConnector interface {
+	ConnectRetry(ctx context.Context, name, mechanism, description string, retryCount int,
+		retryDelay time.Duration) (*connection.Connection, error)
+	ConnectToEndpoint(ctx context.Context, remoteIp, destEndpointName, destEndpointManager, name, mechanism,
+		description string, routes []string) (*connection.Connection, error)
+	Close(ctx context.Context, conn *connection.Connection) error
+}
+
+// ConnectionMonitor detects the client connections going down
+type ConnectionMonitor interface {
+	// WaitDown blocks until the connection is down or deleted, an error is
+	// returned when the connection can't be monitored or ctx is done
+	WaitDown(ctx context.Context, conn *connection.Connection) error
+}
+
+// newConnectionMonitor creates the monitor of the connections of an NSM
+// client, nil when the connections can't be monitored
+var newConnectionMonitor = func(connector NSMConnector) ConnectionMonitor {
+	nsmClient, ok := connector.(*client.NsmClient)
+	if !ok || nsmClient.NsmConnection == nil || nsmClient.GrpcClient == nil {
+		return nil
+	}
+	return &nsmConnectionMonitor{client: connection.NewMonitorConnectionClient(nsmClient.GrpcClient)}
+}
+
+// nsmConnectionMonitor follows the connection events of the local NSM
+type nsmConnectionMonitor struct {
+	client connection.MonitorConnectionClient
+}
+
+func (m *nsmConnectionMonitor) WaitDown(ctx context.Context, conn *connection.Connection) error {
+	stream, err := m.client.MonitorConnections(ctx, &connection.MonitorScopeSelector{})
+	if err != nil {
+		return fmt.Errorf("unable to monitor the connection %s: %v", conn.GetId(), err)
+	}
+
+	for {
+		event, err := stream.Recv()
+		if err != nil {
+			return fmt.Errorf("monitoring the connection %s failed: %v", conn.GetId(), err)
+		}
+
+		c, ok := event.GetConnections()[conn.GetId()]
+		if !ok {
+			continue
+		}
+		if event.GetType() == connection.ConnectionEventType_DELETE {
+			logrus.Infof("Connection %s of network service %s was deleted", conn.GetId(), conn.GetNetworkService())
+			return nil
+		}
+		if c.GetState() == connection.State_DOWN {
+			logrus.Infof("Connection %s of network service %s is down", conn.GetId(), conn.GetNetworkService())
+			return nil
+		}
+	}
+}
+
+// clientMonitor re-requests the connection of a client action whenever it
+// goes down and replaces its interface and routes in the dataplane
+type clientMonitor struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// startMonitor starts monitoring the client connection of the action, the
+// monitor is stopped by Cleanup
+func (a *Action) startMonitor(backend UniversalCNFBackend, monitor ConnectionMonitor) {
+	if monitor == nil || a.monitor != nil {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	a.monitor = &clientMonitor{cancel: cancel, done: make(chan struct{})}
+	go func(done chan struct{}) {
+		defer close(done)
+		a.watchClient(ctx, backend, monitor)
+	}(a.monitor.done)
+}
+
+// stopMonitor stops the monitor and waits for a running reconnect to finish
+func (a *Action) stopMonitor() {
+	if a.monitor == nil {
+		return
+	}
+	a.monitor.cancel()
+	<-a.monitor.done
+	a.monitor = nil
+}
+
+func (a *Action) watchClient(ctx context.Context, backend UniversalCNFBackend, monitor ConnectionMonitor) {
+	delay := a.Client.ReconnectDelay
+	if delay <= 0 {
+		delay = defaultReconnectDelay
+	}
+
+	for {
+		err := monitor.WaitDown(ctx, a.clientConn)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			logrus.Warningf("Action %s: %v, monitoring again in %v", a.Name, err, delay)
+			if !sleepContext(ctx, delay) {
+				return
+			}
+			continue
+		}
+
+		metrics.ClientConnectionsDown.WithLabelValues(a.Client.Name).Inc()
+		for {
+			err := a.reconnect(ctx, backend)
+			if ctx.Err() != nil {
+				return
+			}
+			if err == nil {
+				metrics.ClientReconnects.WithLabelValues(a.Client.Name, "succeeded").Inc()
+				metrics.ClientLastReconnect.WithLabelValues(a.Client.Name).SetToCurrentTime()
+				logrus.Infof("Action %s reconnected the client %s", a.Name, a.Client.Name)
+				break
+			}
+			metrics.ClientReconnects.WithLabelValues(a.Client.Name, "failed").Inc()
+			logrus.Errorf("Action %s failed reconnecting the client %s, retrying in %v: %v", a.Name, a.Client.Name, delay, err)
+			if !sleepContext(ctx, delay) {
+				return
+			}
+		}
+	}
+}
+
+// reconnect closes the connection that went down, requests a new one and
+// replaces the client interface and routes of the old connection
+func (a *Action) reconnect(ctx context.Context, backend UniversalCNFBackend) error {
+	if old := a.clientConn; old != nil {
+		if err := a.nsmClient.Close(ctx, old); err != nil {
+			logrus.Warningf("Unable to close the connection %s: %v", old.GetId(), err)
+		}
+		a.removeConn(old)
+		a.clientConn = nil
+	}
+
+	fresh := &dataplane.Config{}
+	conn, err := a.Client.Process(ctx, backend, fresh, a.nsmClient)
+	if conn != nil {
+		a.conns = append(a.conns, conn)
+		a.clientConn = conn
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := backend.ProcessDPConfig(a.clientConfig, false); err != nil {
+		logrus.Warningf("Unable to remove the interface and routes of the old connection: %v", err)
+	}
+	// the dpconfig lists the new interface and routes also when they could
+	// not be applied, so that the next attempt or the cleanup removes them
+	a.replaceClientConfig(fresh)
+	if err := backend.ProcessDPConfig(fresh, true); err != nil {
+		return fmt.Errorf("dpconfig failed: %v", err)
+	}
+	return nil
+}
+
+func (a *Action) removeConn(conn *connection.Connection) {
+	for i, c := range a.conns {
+		if c == conn {
+			a.conns = append(a.conns[:i], a.conns[i+1:]...)
+			return
+		}
+	}
+}
+
+// replaceClientConfig replaces the client interface and routes in the dpconfig of the action
+func (a *Action) replaceClientConfig(fresh *dataplane.Config) {
+	old := a.clientConfig
+	a.DPConfig.Interfaces = splice(a.DPConfig.Interfaces, a.clientInterfaces, len(old.Interfaces), fresh.Interfaces)
+	a.DPConfig.Routes = spliceRoutes(a.DPConfig.Routes, a.clientRoutes, len(old.Routes), fresh.Routes)
+	a.clientConfig = fresh
+}
+
+func splice(s []*dataplane.Interface, at, n int, with []*dataplane.Interface) []*dataplane.Interface {
+	result := append([]*dataplane.Interface{}, s[:at]...)
+	result = append(result, with...)
+	return append(result, s[at+n:]...)
+}
+
+func spliceRoutes(s []*dataplane.Route, at, n int, with []*dataplane.Route) []*dataplane.Route {
+	result := append([]*dataplane.Route{}, s[:at]...)
+	result = append(result, with...)
+	return append(result, s[at+n:]...)
+}
+
+// sleepContext waits for the delay and reports whether ctx is still not done
+func sleepContext(ctx context.Context, delay time.Duration) bool {
+	select {
+	case <-time.After(delay):
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -0,0 +1,189 @@
+package config
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/networkservicemesh/networkservicemesh/controlplane/api/connection"
+	"github.com/networkservicemesh/networkservicemesh/sdk/common"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/cisco-app-networking/nsm-nse/pkg/metrics"
+	"github.com/cisco-app-networking/nsm-nse/pkg/nseconfig"
+	"github.com/cisco-app-networking/nsm-nse/pkg/universal-cnf/dataplane"
+)
+
+type fakeConnector struct {
+	sync.Mutex
+	connected int
+	closed    []string
+}
+
+func (c *fakeConnector) ConnectRetry(ctx context.Context, name, mechanism, description string, retryCount int,
+	retryDelay time.Duration) (*connection.Connection, error) {
+	c.Lock()
+	defer c.Unlock()
+	c.connected++
+	return &connection.Connection{Id: fmt.Sprintf("conn-%d", c.connected)}, nil
+}
+
+func (c *fakeConnector) ConnectToEndpoint(ctx context.Context, remoteIp, destEndpointName, destEndpointManager, name,
+	mechanism, description string, routes []string) (*connection.Connection, error) {
+	return c.ConnectRetry(ctx, name, mechanism, description, 1, 0)
+}
+
+func (c *fakeConnector) Close(ctx context.Context, conn *connection.Connection) error {
+	c.Lock()
+	defer c.Unlock()
+	c.closed = append(c.closed, conn.GetId())
+	return nil
+}
+
+type fakeMonitor struct {
+	down chan struct{}
+}
+
+func (m *fakeMonitor) WaitDown(ctx context.Context, conn *connection.Connection) error {
+	select {
+	case <-m.down:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// clientBackend adds an interface named by the connection id for the clients
+// and records the dpconfig changes
+type clientBackend struct {
+	testBackend
+	sync.Mutex
+	calls     []string
+	updateErr error
+	clientErr error
+}
+
+func (b *clientBackend) ProcessClient(dpconfig *dataplane.Config, ifName string, iface nseconfig.Interface, conn *connection.Connection) error {
+	dpconfig.Interfaces = append(dpconfig.Interfaces, &dataplane.Interface{Name: conn.GetId()})
+	return b.clientErr
+}
+
+func (b *clientBackend) ProcessDPConfig(dpconfig *dataplane.Config, update bool) error {
+	op := "delete"
+	if update {
+		op = "update"
+	}
+	b.Lock()
+	defer b.Unlock()
+	b.calls = append(b.calls, op+" "+strings.Join(interfaceNames(dpconfig), ","))
+	if update {
+		return b.updateErr
+	}
+	return nil
+}
+
+func (b *clientBackend) recorded() []string {
+	b.Lock()
+	defer b.Unlock()
+	return append([]string{}, b.calls...)
+}
+
+func interfaceNames(dpconfig *dataplane.Config) []string {
+	var names []string
+	for _, i := range dpconfig.Interfaces {
+		names = append(names, i.Name)
+	}
+	return names
+}
+
+func TestClientReconnect(t *testing.T) {
+	connector := &fakeConnector{}
+	monitor := &fakeMonitor{down: make(chan struct{})}
+	defer func(newClient func(context.Context, *common.NSConfiguration) (NSMConnector, error),
+		newMonitor func(NSMConnector) ConnectionMonitor) {
+		newNSMClient, newConnectionMonitor = newClient, newMonitor
+	}(newNSMClient, newConnectionMonitor)
+	newNSMClient = func(context.Context, *common.NSConfiguration) (NSMConnector, error) { return connector, nil }
+	newConnectionMonitor = func(NSMConnector) ConnectionMonitor { return monitor }
+
+	action := &Action{
+		Name:     "upstream",
+		Client:   &Client{Name: "upstream-service", IfName: "up0", ReconnectDelay: time.Millisecond},
+		DPConfig: &dataplane.Config{Interfaces: []*dataplane.Interface{{Name: "loop0"}}},
+	}
+	backend := &clientBackend{}
+	pia, err := NewProcessInitActions(backend, []*Action{action}, &common.NSConfiguration{}, nil)
+	require.NoError(t, err)
+	_, err = pia.Process(context.Background(), backend)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"update loop0,conn-1"}, backend.recorded())
+
+	reconnects := testutil.ToFloat64(metrics.ClientReconnects.WithLabelValues("upstream-service", "succeeded"))
+	monitor.down <- struct{}{}
+	require.Eventually(t, func() bool { return len(backend.recorded()) == 3 }, time.Second, time.Millisecond)
+	assert.Equal(t, []string{"update loop0,conn-1", "delete conn-1", "update conn-2"}, backend.recorded())
+	assert.Equal(t, reconnects+1, testutil.ToFloat64(metrics.ClientReconnects.WithLabelValues("upstream-service", "succeeded")))
+
+	// the cleanup stops the monitor and removes the replaced interface
+	pia.Cleanup()
+	assert.Equal(t, "delete loop0,conn-2", backend.recorded()[3])
+	assert.Equal(t, []string{"conn-1", "conn-2"}, connector.closed)
+	assert.Nil(t, action.monitor)
+}
+
+func TestClientRetryDPConfig(t *testing.T) {
+	connector := &fakeConnector{}
+	backend := &clientBackend{updateErr: fmt.Errorf("vpp-agent is down")}
+	action := &Action{
+		Name:     "upstream",
+		Client:   &Client{Name: "upstream-service", IfName: "up0"},
+		DPConfig: &dataplane.Config{Interfaces: []*dataplane.Interface{{Name: "loop0"}}},
+	}
+
+	require.Error(t, action.Process(context.Background(), backend, connector))
+	assert.Equal(t, []string{"conn-1"}, connector.closed, "the connection of the failed attempt is closed")
+	assert.Equal(t, []string{"loop0"}, interfaceNames(action.DPConfig))
+
+	// the retry connects again and applies a single client interface
+	backend.updateErr = nil
+	require.NoError(t, action.Process(context.Background(), backend, connector))
+	action.stopMonitor()
+	assert.Equal(t, []string{"update loop0,conn-1", "update loop0,conn-2"}, backend.recorded())
+	assert.Equal(t, []string{"conn-2"}, connectionIDs(action.conns))
+}
+
+func TestClientRetryProcessClient(t *testing.T) {
+	connector := &fakeConnector{}
+	backend := &clientBackend{clientErr: fmt.Errorf("no memif socket")}
+	action := &Action{
+		Name:     "upstream",
+		Client:   &Client{Name: "upstream-service", IfName: "up0"},
+		DPConfig: &dataplane.Config{Interfaces: []*dataplane.Interface{{Name: "loop0"}}},
+	}
+
+	// every failed attempt closes its connection
+	require.Error(t, action.Process(context.Background(), backend, connector))
+	require.Error(t, action.Process(context.Background(), backend, connector))
+	assert.Equal(t, []string{"conn-1", "conn-2"}, connector.closed)
+	assert.Empty(t, action.conns)
+	assert.Equal(t, []string{"loop0"}, interfaceNames(action.DPConfig))
+
+	backend.clientErr = nil
+	require.NoError(t, action.Process(context.Background(), backend, connector))
+	action.stopMonitor()
+	assert.Equal(t, []string{"update loop0,conn-3"}, backend.recorded())
+	assert.Equal(t, []string{"conn-3"}, connectionIDs(action.conns))
+}
+
+func connectionIDs(conns []*connection.Connection) []string {
+	var ids []string
+	for _, conn := range conns {
+		ids = append(ids, conn.GetId())
+	}
+	return ids
+}
@@ -0,0 +1,176 @@
+package config
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// maximum length of the command output kept in the result and the logs
+const maxCommandOutput = 4096
+
+// Command is a struct to describe exec.Command call arguments
+type Command struct {
+	Name string
+	Args []string
+	// Timeout kills the command when it runs longer, unlimited when not set
+	Timeout time.Duration `yaml:"timeout"`
+	// Env is added to the environment of the CNF, or replaces it with ClearEnv
+	Env      map[string]string `yaml:"env"`
+	ClearEnv bool              `yaml:"clearEnv"`
+	// WorkDir is the working directory, the one of the CNF when not set
+	WorkDir string `yaml:"workDir"`
+	// Stdin is written to the standard input of the command
+	Stdin string `yaml:"stdin"`
+	// ExitCodes are the exit codes of a successful run, 0 when not set
+	ExitCodes []int `yaml:"exitCodes"`
+}
+
+// CommandResult is the outcome of a command run
+type CommandResult struct {
+	ExitCode int
+	Stdout   string
+	Stderr   string
+	Duration time.Duration
+}
+
+func (c *Command) String() string {
+	return strings.Join(append([]string{c.Name}, c.Args...), " ")
+}
+
+// Run runs the command if its binary is allowed. An exit code not listed in
+// ExitCodes is an error, the result is returned whenever the command ran.
+func (c *Command) Run(ctx context.Context, allowlist []string) (*CommandResult, error) {
+	if err := checkAllowed(c.Name, c.WorkDir, allowlist); err != nil {
+		return nil, err
+	}
+
+	if c.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.Timeout)
+		defer cancel()
+	}
+
+	cmd := exec.CommandContext(ctx, c.Name, c.Args...) // #nosec
+	cmd.Dir = c.WorkDir
+	cmd.Env = c.environ()
+	cmd.Stdin = strings.NewReader(c.Stdin)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+
+	start := time.Now()
+	err := cmd.Run()
+	result := &CommandResult{
+		ExitCode: -1,
+		Stdout:   truncateOutput(stdout.String()),
+		Stderr:   truncateOutput(stderr.String()),
+		Duration: time.Since(start),
+	}
+	if cmd.ProcessState != nil {
+		result.ExitCode = cmd.ProcessState.ExitCode()
+	}
+
+	logger := logrus.WithFields(logrus.Fields{
+		"command":  c.String(),
+		"exitCode": result.ExitCode,
+		"duration": result.Duration,
+		"stdout":   result.Stdout,
+		"stderr":   result.Stderr,
+	})
+
+	switch {
+	case ctx.Err() == context.DeadlineExceeded:
+		logger.Error("Command timed out")
+		return result, fmt.Errorf("command %s timed out", c.Name)
+	case cmd.ProcessState == nil:
+		logger.Errorf("Command could not be run: %v", err)
+		return nil, fmt.Errorf("command %s could not be run: %v", c.Name, err)
+	case !c.expectedExitCode(result.ExitCode):
+		logger.Error("Command failed")
+		return result, fmt.Errorf("command %s exited with code %d: %s", c.Name, result.ExitCode, strings.TrimSpace(result.Stderr))
+	}
+	logger.Info("Command succeeded")
+	return result, nil
+}
+
+func (c *Command) environ() []string {
+	if len(c.Env) == 0 && !c.ClearEnv {
+		return nil
+	}
+
+	var env []string
+	if !c.ClearEnv {
+		env = os.Environ()
+	}
+	keys := make([]string, 0, len(c.Env))
+	for k := range c.Env {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		env = append(env, k+"="+c.Env[k])
+	}
+	// an empty non-nil slice runs the command without environment
+	if env == nil {
+		env = []string{}
+	}
+	return env
+}
+
+func (c *Command) expectedExitCode(code int) bool {
+	if len(c.ExitCodes) == 0 {
+		return code == 0
+	}
+	for _, expected := range c.ExitCodes {
+		if code == expected {
+			return true
+		}
+	}
+	return false
+}
+
+// checkAllowed checks the binary against the allowlist. A name without a path
+// separator is looked up in PATH, an entry matches it as configured or its
+// resolved path. A name with a path separator is resolved against workDir
+// like exec does, only an entry with its absolute path matches it. All
+// binaries are allowed when the allowlist is empty.
+func checkAllowed(name, workDir string, allowlist []string) error {
+	if len(allowlist) == 0 {
+		return nil
+	}
+
+	var path string
+	if strings.ContainsRune(name, filepath.Separator) {
+		path = name
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(workDir, path)
+		}
+		path, _ = filepath.Abs(path)
+	} else if lookedUp, err := exec.LookPath(name); err == nil {
+		path, _ = filepath.Abs(lookedUp)
+	}
+	for _, allowed := range allowlist {
+		if path != "" && allowed == path {
+			return nil
+		}
+		if allowed == name && !strings.ContainsRune(name, filepath.Separator) {
+			return nil
+		}
+	}
+	return fmt.Errorf("command %s is not in the command allowlist", name)
+}
+
+func truncateOutput(out string) string {
+	if len(out) > maxCommandOutput {
+		return out[:maxCommandOutput] + "...(truncated)"
+	}
+	return out
+}
@@ -0,0 +1,162 @@
+package config
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCommandRun(t *testing.T) {
+	dir, err := ioutil.TempDir("", "command")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	for name, tc := range map[string]struct {
+		command  Command
+		stdout   string
+		stderr   string
+		exitCode int
+		err      string
+	}{
+		"stdout": {
+			command: Command{Name: "echo", Args: []string{"hello"}},
+			stdout:  "hello\n",
+		},
+		"stderr": {
+			command:  Command{Name: "sh", Args: []string{"-c", "echo oops >&2; exit 3"}},
+			stderr:   "oops\n",
+			exitCode: 3,
+			err:      "command sh exited with code 3: oops",
+		},
+		"expected-exit-code": {
+			command:  Command{Name: "sh", Args: []string{"-c", "exit 3"}, ExitCodes: []int{0, 3}},
+			exitCode: 3,
+		},
+		"env": {
+			command: Command{Name: "sh", Args: []string{"-c", "echo $GREETING"}, Env: map[string]string{"GREETING": "hi"}},
+			stdout:  "hi\n",
+		},
+		"clear-env": {
+			command: Command{Name: "/usr/bin/env", ClearEnv: true, Env: map[string]string{"ONLY": "this"}},
+			stdout:  "ONLY=this\n",
+		},
+		"workdir": {
+			command: Command{Name: "pwd", WorkDir: dir},
+			stdout:  dir + "\n",
+		},
+		"stdin": {
+			command: Command{Name: "cat", Stdin: "input"},
+			stdout:  "input",
+		},
+		"timeout": {
+			command:  Command{Name: "sleep", Args: []string{"10"}, Timeout: 50 * time.Millisecond},
+			exitCode: -1,
+			err:      "command sleep timed out",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			result, err := tc.command.Run(context.Background(), nil)
+			if tc.err != "" {
+				require.EqualError(t, err, tc.err)
+			} else {
+				require.NoError(t, err)
+			}
+			require.NotNil(t, result)
+			assert.Equal(t, tc.stdout, result.Stdout)
+			assert.Equal(t, tc.stderr, result.Stderr)
+			assert.Equal(t, tc.exitCode, result.ExitCode)
+		})
+	}
+}
+
+func TestCommandRunNotFound(t *testing.T) {
+	result, err := (&Command{Name: "no-such-binary"}).Run(context.Background(), nil)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "command no-such-binary could not be run")
+	assert.Nil(t, result)
+}
+
+func TestCommandAllowlist(t *testing.T) {
+	truePath, err := exec.LookPath("true")
+	require.NoError(t, err)
+	truePath, err = filepath.Abs(truePath)
+	require.NoError(t, err)
+
+	for name, tc := range map[string]struct {
+		allowlist []string
+		allowed   bool
+	}{
+		"empty":    {allowed: true},
+		"name":     {allowlist: []string{"true"}, allowed: true},
+		"path":     {allowlist: []string{truePath}, allowed: true},
+		"rejected": {allowlist: []string{"echo", "/bin/sh"}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			result, err := (&Command{Name: "true"}).Run(context.Background(), tc.allowlist)
+			if tc.allowed {
+				require.NoError(t, err)
+				assert.Equal(t, 0, result.ExitCode)
+				return
+			}
+			require.EqualError(t, err, "command true is not in the command allowlist")
+			assert.Nil(t, result)
+		})
+	}
+}
+
+func TestCommandAllowlistRelative(t *testing.T) {
+	dir, err := ioutil.TempDir("", "command")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "bin"), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "bin", "run"), []byte("#!/bin/sh\n"), 0755))
+	cwd, err := os.Getwd()
+	require.NoError(t, err)
+
+	for name, tc := range map[string]struct {
+		command   string
+		allowlist []string
+		allowed   bool
+	}{
+		"resolved in workDir": {command: "./bin/run", allowlist: []string{filepath.Join(dir, "bin", "run")}, allowed: true},
+		"parent of workDir":   {command: "../bin/run", allowlist: []string{filepath.Join(dir, "bin", "run")}},
+		"cwd path":            {command: "./bin/run", allowlist: []string{filepath.Join(cwd, "bin", "run")}},
+		"relative entry":      {command: "./bin/run", allowlist: []string{"./bin/run"}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			err := checkAllowed(tc.command, dir, tc.allowlist)
+			if tc.allowed {
+				assert.NoError(t, err)
+				return
+			}
+			assert.EqualError(t, err, "command "+tc.command+" is not in the command allowlist")
+		})
+	}
+}
+
+func TestCommandOutputTruncated(t *testing.T) {
+	result, err := (&Command{Name: "head", Args: []string{"-c", "10000", "/dev/zero"}}).Run(context.Background(), nil)
+	require.NoError(t, err)
+	assert.True(t, strings.HasSuffix(result.Stdout, "...(truncated)"))
+	assert.Len(t, result.Stdout, maxCommandOutput+len("...(truncated)"))
+}
+
+func TestInitActionsCommandAllowlist(t *testing.T) {
+	pia, err := NewProcessInitActions(testBackend{}, []*Action{
+		{Name: "allowed", Command: &Command{Name: "sh", Args: []string{"-c", "exit 2"}, ExitCodes: []int{2}}},
+		{Name: "denied", Command: &Command{Name: "echo"}},
+	}, nil, []string{"sh"})
+	require.NoError(t, err)
+
+	report, err := pia.Process(context.Background(), testBackend{})
+	require.Error(t, err)
+	assert.Equal(t, "allowed: succeeded (exit code 2)\n"+
+		"denied: failed: command echo is not in the command allowlist\n", report.String())
+}
@@ -15,16 +15,22 @@
 
 package config
 
+import "github.com/cisco-app-networking/nsm-nse/pkg/nseconfig"
+
 func labelStringFromMap(labelMap map[string]string) string {
-	labelString := ""
+	return nseconfig.Labels(labelMap).String()
+}
 
-	for k, v := range labelMap {
-		if len(labelString) > 0 {
-			labelString += ","
-		}
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
 
-		labelString = labelString + k + "=" + v
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
 	}
 
-	return labelString
+	return true
 }
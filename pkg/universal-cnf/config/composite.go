@@ -19,23 +19,36 @@ import (
 	"context"
 	"fmt"
 	"github.com/cisco-app-networking/nsm-nse/pkg/nseconfig"
+	"github.com/cisco-app-networking/nsm-nse/pkg/universal-cnf/dataplane"
 	"github.com/golang/protobuf/ptypes/empty"
 	"github.com/networkservicemesh/networkservicemesh/controlplane/api/connection"
 	"github.com/networkservicemesh/networkservicemesh/controlplane/api/connectioncontext"
 	"github.com/networkservicemesh/networkservicemesh/controlplane/api/networkservice"
 	"github.com/networkservicemesh/networkservicemesh/sdk/endpoint"
 	"github.com/sirupsen/logrus"
-	"go.ligato.io/vpp-agent/v3/proto/ligato/vpp"
-	l3 "go.ligato.io/vpp-agent/v3/proto/ligato/vpp/l3"
 	"net"
+	"sort"
+	"sync"
 )
 
 // UniversalCNFEndpoint is a Universal CNF Endpoint composite implementation
 type UniversalCNFEndpoint struct {
 	//endpoint.BaseCompositeEndpoint
-	endpoint *nseconfig.Endpoint
-	backend  UniversalCNFBackend
-	dpConfig *vpp.ConfigData
+	sync.RWMutex
+	endpoint    *nseconfig.Endpoint
+	backend     UniversalCNFBackend
+	dpConfig    *dataplane.Config
+	connections map[string]*connection.Connection
+	// what the configuration added to the context of the connections, it is
+	// replaced when the configuration changes
+	added map[string]*configContext
+}
+
+// configContext are the routes and the DNS config the configuration added to
+// the context of a connection
+type configContext struct {
+	routes []string
+	dns    *connectioncontext.DNSConfig
 }
 
 // Request implements the request handler
@@ -43,20 +56,47 @@ func (uce *UniversalCNFEndpoint) Request(ctx context.Context,
 	request *networkservice.NetworkServiceRequest) (*connection.Connection, error) {
 	conn := request.GetConnection()
 
+	uce.Lock()
+	defer uce.Unlock()
+
 	if uce.dpConfig == nil {
-		uce.dpConfig = uce.backend.NewDPConfig()
+		dpConfig := uce.backend.NewDPConfig()
+		if err := uce.backend.SetupEndpoint(dpConfig, uce.endpoint); err != nil {
+			logrus.Errorf("Failed to set up: %+v", uce.endpoint)
+			return nil, err
+		}
+		uce.dpConfig = dpConfig
 	}
 
-	if err := uce.backend.ProcessEndpoint(uce.dpConfig, uce.endpoint.Name, uce.endpoint.VL3.Ifname, conn); err != nil {
+	// a refreshed connection keeps its interface ID, its new interface and
+	// routes replace the old ones
+	old, refreshed := uce.connections[conn.GetId()]
+	if refreshed {
+		removeConfig, err := uce.removeClientInterface(old)
+		if err != nil {
+			logrus.Warnf("Refreshing connection %s: %v", conn.GetId(), err)
+		} else if err := uce.backend.ProcessDPConfig(removeConfig, false); err != nil {
+			logrus.Errorf("Refreshing connection %s: %v", conn.GetId(), err)
+			// the old interface is still there
+			uce.restoreConfig(removeConfig)
+			return nil, err
+		}
+	}
+
+	if err := uce.backend.ProcessEndpoint(uce.dpConfig, uce.endpoint, conn); err != nil {
 		logrus.Errorf("Failed to process: %+v", uce.endpoint)
+		uce.dropRequested(conn, refreshed)
 		return nil, err
 	}
 
 	if err := uce.backend.ProcessDPConfig(uce.dpConfig, true); err != nil {
 		logrus.Errorf("Error processing dpconfig: %+v", uce.dpConfig)
+		uce.dropRequested(conn, refreshed)
 		return nil, err
 	}
 
+	uce.connections[conn.GetId()] = conn
+
 	if endpoint.Next(ctx) != nil {
 		return endpoint.Next(ctx).Request(ctx, request)
 	}
@@ -64,10 +104,36 @@ func (uce *UniversalCNFEndpoint) Request(ctx context.Context,
 	return request.GetConnection(), nil
 }
 
-// Removes the client interfaces from the dpConfig and
-// Returns a new *vpp.ConfigData which contains the removed interfaces.
-func (uce *UniversalCNFEndpoint) removeClientInterface(connection *connection.Connection) (*vpp.ConfigData, error) {
-	dstIpAddr := connection.Context.IpContext.DstIpAddr
+// dropRequested forgets the connection whose request failed. The interface
+// ID of a refreshed connection is released when the connection is closed,
+// its old interface is already removed. uce is locked
+func (uce *UniversalCNFEndpoint) dropRequested(conn *connection.Connection, refreshed bool) {
+	delete(uce.connections, conn.GetId())
+	delete(uce.added, conn.GetId())
+	if !refreshed {
+		uce.backend.ReleaseEndpoint(uce.endpoint, conn)
+	}
+}
+
+// restoreConfig adds the interfaces, routes and NAT of a removal that failed
+// back to the dpConfig, uce is locked
+func (uce *UniversalCNFEndpoint) restoreConfig(removeConfig *dataplane.Config) {
+	uce.dpConfig.Interfaces = append(uce.dpConfig.Interfaces, removeConfig.Interfaces...)
+	uce.dpConfig.Routes = append(uce.dpConfig.Routes, removeConfig.Routes...)
+	uce.dpConfig.NAT.Interfaces = append(uce.dpConfig.NAT.Interfaces, removeConfig.NAT.Interfaces...)
+	uce.dpConfig.NAT.StaticMappings = append(uce.dpConfig.NAT.StaticMappings, removeConfig.NAT.StaticMappings...)
+}
+
+// Removes the client interfaces, routes and NAT from the dpConfig and
+// Returns a new *dataplane.Config which contains the removed interfaces.
+func (uce *UniversalCNFEndpoint) removeClientInterface(connection *connection.Connection) (*dataplane.Config, error) {
+	dstIpAddr := connection.GetContext().GetIpContext().GetDstIpAddr()
+	if dstIpAddr == "" {
+		return nil, fmt.Errorf("connection %s has no destination address", connection.GetId())
+	}
+	if uce.dpConfig == nil {
+		return nil, fmt.Errorf("no connection was processed before connection %s", connection.GetId())
+	}
 
 	// find the interface index in the dpConfig.Interface slice
 	index := -1
@@ -75,7 +141,7 @@ func (uce *UniversalCNFEndpoint) removeClientInterface(connection *connection.Co
 		if index != -1 {
 			break
 		}
-		for _, ipAddr := range inter.IpAddresses {
+		for _, ipAddr := range inter.Addresses {
 			if ipAddr == dstIpAddr {
 				index = i
 				break
@@ -99,17 +165,21 @@ func (uce *UniversalCNFEndpoint) removeClientInterface(connection *connection.Co
 	// Append the interface that has to be removed.
 	removeConfig.Interfaces = append(removeConfig.Interfaces, inter)
 
-	srcIP, _, _ := net.ParseCIDR(connection.GetContext().GetIpContext().GetSrcIpAddr())
+	// the connections without a source address have no routes and NAT
+	srcIP := ""
+	if ip, _, err := net.ParseCIDR(connection.GetContext().GetIpContext().GetSrcIpAddr()); err == nil {
+		srcIP = ip.String()
+	}
 
 	// Create a new Routes slice for the routes that are kept in the dpConfig
 	// Create a removedRoutes slice which is going to be passed to the vpp
-	var removedRoutes, newRoutes []*l3.Route
+	var removedRoutes, newRoutes []*dataplane.Route
 	srcRoutes := connection.GetContext().GetIpContext().GetSrcRoutes()
 	for _, route := range uce.dpConfig.Routes {
-		if route.NextHopAddr == srcIP.String() {
+		if srcIP != "" && route.NextHop == srcIP {
 			found := false
 			for _, r := range srcRoutes {
-				if route.DstNetwork == r.Prefix {
+				if route.Dst == r.Prefix {
 					found = true
 				}
 			}
@@ -127,6 +197,9 @@ func (uce *UniversalCNFEndpoint) removeClientInterface(connection *connection.Co
 	removeConfig.Routes = removedRoutes
 	uce.dpConfig.Routes = newRoutes
 
+	// Remove the NAT inside interface and the port forwards of the client
+	removeConfig.NAT = uce.dpConfig.RemoveEndpointNAT(inter.Name, srcIP)
+
 	return removeConfig, nil
 }
 
@@ -134,16 +207,39 @@ func (uce *UniversalCNFEndpoint) removeClientInterface(connection *connection.Co
 func (uce *UniversalCNFEndpoint) Close(ctx context.Context, connection *connection.Connection) (*empty.Empty, error) {
 	logrus.Infof("Universal CNF DeleteConnection: %v", connection)
 
+	uce.Lock()
+	defer uce.Unlock()
+
+	old, known := uce.connections[connection.GetId()]
+	added, based := uce.added[connection.GetId()]
+	delete(uce.connections, connection.GetId())
+	delete(uce.added, connection.GetId())
+
 	removeConfig, err := uce.removeClientInterface(connection)
-	if err != nil && endpoint.Next(ctx) != nil {
-		return endpoint.Next(ctx).Close(ctx, connection)
+	if err != nil {
+		logrus.Errorf("Closing connection %s: %v", connection.GetId(), err)
+		uce.backend.ReleaseEndpoint(uce.endpoint, connection)
+		if endpoint.Next(ctx) != nil {
+			return endpoint.Next(ctx).Close(ctx, connection)
+		}
+		return &empty.Empty{}, nil
 	}
 
 	// Remove the interfaces from the vpp agent
 	if err := uce.backend.ProcessDPConfig(removeConfig, false); err != nil {
 		logrus.Errorf("Error processing dpconfig: %+v", uce.dpConfig)
+		// the interface is still there, it keeps its ID and stays in the
+		// dpConfig so that closing the connection again removes it
+		uce.restoreConfig(removeConfig)
+		if known {
+			uce.connections[connection.GetId()] = old
+		}
+		if based {
+			uce.added[connection.GetId()] = added
+		}
 		return nil, err
 	}
+	uce.backend.ReleaseEndpoint(uce.endpoint, connection)
 
 	if endpoint.Next(ctx) != nil {
 		return endpoint.Next(ctx).Close(ctx, connection)
@@ -157,43 +253,153 @@ func (uce *UniversalCNFEndpoint) Name() string {
 	return "Universal CNF"
 }
 
+// Endpoint returns the current endpoint configuration
+func (uce *UniversalCNFEndpoint) Endpoint() *nseconfig.Endpoint {
+	uce.RLock()
+	defer uce.RUnlock()
+	return uce.endpoint
+}
+
+// UpdateEndpoint replaces the endpoint configuration and the routes and DNS
+// settings of the live connections. New and refreshed connections get the
+// new values through the route and DNS mutators, the clients get them when
+// the live connections are sent to them again.
+func (uce *UniversalCNFEndpoint) UpdateEndpoint(e *nseconfig.Endpoint) {
+	uce.Lock()
+	defer uce.Unlock()
+
+	uce.endpoint = e
+
+	for _, conn := range uce.connections {
+		logrus.Infof("Universal CNF updating connection %s with routes %v and DNS servers %v",
+			conn.GetId(), e.VL3.IPAM.Routes, e.VL3.NameServers)
+		uce.setRoutes(conn)
+		uce.setDNSContext(conn)
+	}
+}
+
+// Connections returns copies of the live connections, sorted by ID
+func (uce *UniversalCNFEndpoint) Connections() []*connection.Connection {
+	uce.RLock()
+	defer uce.RUnlock()
+
+	conns := make([]*connection.Connection, 0, len(uce.connections))
+	for _, conn := range uce.connections {
+		conns = append(conns, conn.Clone())
+	}
+	sort.Slice(conns, func(i, j int) bool { return conns[i].GetId() < conns[j].GetId() })
+	return conns
+}
+
 // NewUniversalCNFEndpoint creates a MonitorEndpoint
 func NewUniversalCNFEndpoint(backend UniversalCNFBackend, e *nseconfig.Endpoint) *UniversalCNFEndpoint {
 	self := &UniversalCNFEndpoint{
-		backend:  backend,
-		endpoint: e,
+		backend:     backend,
+		endpoint:    e,
+		connections: make(map[string]*connection.Connection),
+		added:       make(map[string]*configContext),
 	}
 
 	return self
 }
 
-func makeRouteMutator(routes []string) endpoint.ConnectionMutator {
+func makeRouteMutator(uce *UniversalCNFEndpoint) endpoint.ConnectionMutator {
 	return func(ctx context.Context, c *connection.Connection) error {
-		for _, r := range routes {
-			c.GetContext().GetIpContext().DstRoutes = append(c.GetContext().GetIpContext().DstRoutes, &connectioncontext.Route{
-				Prefix: r,
-			})
-		}
+		uce.Lock()
+		defer uce.Unlock()
+		uce.setRoutes(c)
 		return nil
 	}
 }
 
-func makeDnsMutator(dnsZones, nameservers []string) endpoint.ConnectionMutator {
+func makeDnsMutator(uce *UniversalCNFEndpoint) endpoint.ConnectionMutator {
 	return func(ctx context.Context, c *connection.Connection) error {
 		logrus.Infof("Universal CNF DNS composite endpoint: %v", c)
-		dnsConfig := &connectioncontext.DNSConfig{}
-		for _, zone := range dnsZones {
-			dnsConfig.SearchDomains = append(dnsConfig.SearchDomains, zone)
+		uce.Lock()
+		defer uce.Unlock()
+		uce.setDNSContext(c)
+		return nil
+	}
+}
+
+// configContext returns what the configuration added to the context of the
+// connection, uce is locked
+func (uce *UniversalCNFEndpoint) configContext(c *connection.Connection) *configContext {
+	added, ok := uce.added[c.GetId()]
+	if !ok {
+		added = &configContext{}
+		uce.added[c.GetId()] = added
+	}
+	return added
+}
+
+// setRoutes replaces the routes the configuration added to the destination
+// routes of the connection by the current ones. The other routes, like the
+// ones of the client or of the vL3 peers, are kept. uce is locked
+func (uce *UniversalCNFEndpoint) setRoutes(c *connection.Connection) {
+	ipContext := c.GetContext().GetIpContext()
+	if ipContext == nil {
+		return
+	}
+	added := uce.configContext(c)
+
+	remove := map[string]bool{}
+	for _, r := range added.routes {
+		remove[r] = true
+	}
+
+	var routes []*connectioncontext.Route
+	for _, r := range ipContext.DstRoutes {
+		if !remove[r.Prefix] {
+			routes = append(routes, r)
+		}
+	}
+	for _, r := range uce.endpoint.VL3.IPAM.Routes {
+		routes = append(routes, &connectioncontext.Route{
+			Prefix: r,
+		})
+	}
+	ipContext.DstRoutes = routes
+	added.routes = append([]string{}, uce.endpoint.VL3.IPAM.Routes...)
+}
+
+// setDNSContext replaces the DNS config the configuration added to the DNS
+// context of the connection by the current one. The other DNS configs are
+// kept, the context is left alone when no name servers were configured.
+// uce is locked
+func (uce *UniversalCNFEndpoint) setDNSContext(c *connection.Connection) {
+	if c.GetContext() == nil {
+		return
+	}
+	added := uce.configContext(c)
+	vl3 := uce.endpoint.VL3
+	if added.dns == nil && len(vl3.NameServers) == 0 {
+		return
+	}
+
+	if c.GetContext().GetDnsContext() == nil {
+		c.GetContext().DnsContext = &connectioncontext.DNSContext{}
+	}
+
+	var configs []*connectioncontext.DNSConfig
+	for _, dnsConfig := range c.GetContext().DnsContext.Configs {
+		if added.dns == nil || !equalStrings(dnsConfig.SearchDomains, added.dns.SearchDomains) ||
+			!equalStrings(dnsConfig.DnsServerIps, added.dns.DnsServerIps) {
+			configs = append(configs, dnsConfig)
 		}
-		for _, server := range nameservers {
-			dnsConfig.DnsServerIps = append(dnsConfig.DnsServerIps, server)
+	}
+	added.dns = nil
+	if len(vl3.NameServers) > 0 {
+		dnsConfig := &connectioncontext.DNSConfig{
+			SearchDomains: append([]string{}, vl3.DNSZones...),
+			DnsServerIps:  append([]string{}, vl3.NameServers...),
 		}
 		logrus.Infof("Universal CNF DNS composite endpoint adding DNSConfig: %v", dnsConfig)
-		if c.GetContext().GetDnsContext() == nil {
-			c.GetContext().DnsContext = &connectioncontext.DNSContext{}
+		configs = append(configs, dnsConfig)
+		added.dns = &connectioncontext.DNSConfig{
+			SearchDomains: dnsConfig.SearchDomains,
+			DnsServerIps:  dnsConfig.DnsServerIps,
 		}
-		c.GetContext().DnsContext.Configs = append(c.GetContext().DnsContext.Configs,
-			dnsConfig)
-		return nil
 	}
+	c.GetContext().DnsContext.Configs = configs
 }
@@ -0,0 +1,287 @@
+package config
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/networkservicemesh/networkservicemesh/controlplane/api/connection"
+	"github.com/networkservicemesh/networkservicemesh/controlplane/api/connectioncontext"
+	"github.com/networkservicemesh/networkservicemesh/controlplane/api/networkservice"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/cisco-app-networking/nsm-nse/pkg/nseconfig"
+	"github.com/cisco-app-networking/nsm-nse/pkg/universal-cnf/dataplane"
+)
+
+// compositeBackend adds the endpoint connections to the dpconfig and records
+// the removed dpconfigs and the released connections
+type compositeBackend struct {
+	testBackend
+	deleteErr error
+	deleted   []*dataplane.Config
+	released  []string
+}
+
+func (b *compositeBackend) ProcessEndpoint(dpconfig *dataplane.Config, e *nseconfig.Endpoint, conn *connection.Connection) error {
+	return dpconfig.AddEndpoint(e.VL3.Ifname+"/"+conn.GetId(), e, conn)
+}
+
+func (b *compositeBackend) ProcessDPConfig(dpconfig *dataplane.Config, update bool) error {
+	if update {
+		return nil
+	}
+	b.deleted = append(b.deleted, dpconfig)
+	return b.deleteErr
+}
+
+func (b *compositeBackend) ReleaseEndpoint(e *nseconfig.Endpoint, conn *connection.Connection) {
+	b.released = append(b.released, conn.GetId())
+}
+
+func compositeConnection(id string) *connection.Connection {
+	return &connection.Connection{
+		Id: id,
+		Context: &connectioncontext.ConnectionContext{
+			IpContext: &connectioncontext.IPContext{
+				SrcIpAddr: "10.60.1.1/30",
+				DstIpAddr: "10.60.1.2/30",
+				SrcRoutes: []*connectioncontext.Route{{Prefix: "10.70.0.0/16"}},
+			},
+		},
+		Labels: map[string]string{},
+	}
+}
+
+func TestCompositeClose(t *testing.T) {
+	b := &compositeBackend{}
+	uce := NewUniversalCNFEndpoint(b, &nseconfig.Endpoint{Name: "ucnf", VL3: nseconfig.VL3{Ifname: "endpoint0"}})
+
+	// closing connections the endpoint does not know is not an error
+	_, err := uce.Close(context.Background(), compositeConnection("unknown"))
+	assert.NoError(t, err)
+	_, err = uce.Close(context.Background(), &connection.Connection{Id: "no-context"})
+	assert.NoError(t, err)
+	assert.Empty(t, b.deleted)
+
+	conn := compositeConnection("1")
+	_, err = uce.Request(context.Background(), &networkservice.NetworkServiceRequest{Connection: conn})
+	require.NoError(t, err)
+	_, err = uce.Close(context.Background(), conn)
+	require.NoError(t, err)
+	require.Len(t, b.deleted, 1)
+	assert.Equal(t, "endpoint0/1", b.deleted[0].Interfaces[0].Name)
+	assert.Len(t, b.deleted[0].Routes, 1)
+	assert.Empty(t, uce.dpConfig.Interfaces)
+	assert.Empty(t, uce.dpConfig.Routes)
+}
+
+func TestCompositeCloseFailed(t *testing.T) {
+	b := &compositeBackend{deleteErr: fmt.Errorf("vpp-agent is down")}
+	uce := NewUniversalCNFEndpoint(b, &nseconfig.Endpoint{Name: "ucnf", VL3: nseconfig.VL3{Ifname: "endpoint0"}})
+
+	conn := compositeConnection("1")
+	_, err := uce.Request(context.Background(), &networkservice.NetworkServiceRequest{Connection: conn})
+	require.NoError(t, err)
+	_, err = uce.Close(context.Background(), conn)
+	assert.Error(t, err)
+	assert.Empty(t, b.released, "the interface ID is released once the interface is removed")
+
+	// closing the connection again removes the interface
+	b.deleteErr = nil
+	_, err = uce.Close(context.Background(), conn)
+	require.NoError(t, err)
+	require.Len(t, b.deleted, 2)
+	assert.Equal(t, b.deleted[0], b.deleted[1])
+	assert.Equal(t, []string{"1"}, b.released)
+	assert.Empty(t, uce.dpConfig.Interfaces)
+}
+
+// clientServer stands for the route and DNS mutators followed by the monitor,
+// it records the connections the clients get
+type clientServer struct {
+	networkservice.NetworkServiceServer
+	uce  *UniversalCNFEndpoint
+	sent []*connection.Connection
+}
+
+func (s *clientServer) Request(ctx context.Context, request *networkservice.NetworkServiceRequest) (*connection.Connection, error) {
+	for _, mutate := range []func(context.Context, *connection.Connection) error{
+		makeRouteMutator(s.uce), makeDnsMutator(s.uce),
+	} {
+		if err := mutate(ctx, request.GetConnection()); err != nil {
+			return nil, err
+		}
+	}
+	s.sent = append(s.sent, request.GetConnection().Clone())
+	return request.GetConnection(), nil
+}
+
+func TestApplyUpdatedEndpoint(t *testing.T) {
+	vl3 := func(route, nameServer string) *nseconfig.Endpoint {
+		return &nseconfig.Endpoint{Name: "ucnf", VL3: nseconfig.VL3{
+			Ifname:      "endpoint0",
+			IPAM:        nseconfig.IPAM{Routes: []string{route}},
+			NameServers: []string{nameServer},
+		}}
+	}
+	b := &compositeBackend{}
+	e := vl3("10.80.0.0/16", "10.80.0.10")
+	uce := NewUniversalCNFEndpoint(b, e)
+	client := &clientServer{uce: uce}
+	pe := &ProcessEndpoints{
+		Endpoints: []*SingleEndpoint{{updates: client, Endpoint: e, ucnfEndpoint: uce}},
+		ctx:       context.Background(),
+	}
+
+	_, err := uce.Request(context.Background(), &networkservice.NetworkServiceRequest{Connection: compositeConnection("1")})
+	require.NoError(t, err)
+
+	require.NoError(t, pe.Apply(&nseconfig.EndpointsDiff{Updated: []*nseconfig.Endpoint{vl3("10.90.0.0/16", "10.90.0.10")}}))
+
+	// the client gets the connection with its addresses and the new routes and DNS server
+	require.Len(t, client.sent, 1)
+	updated := client.sent[0].GetContext()
+	assert.Equal(t, "10.60.1.1/30", updated.GetIpContext().GetSrcIpAddr())
+	assert.Equal(t, "10.60.1.2/30", updated.GetIpContext().GetDstIpAddr())
+	assert.Equal(t, []*connectioncontext.Route{{Prefix: "10.90.0.0/16"}}, updated.GetIpContext().GetDstRoutes())
+	assert.Equal(t, []*connectioncontext.DNSConfig{{SearchDomains: []string{}, DnsServerIps: []string{"10.90.0.10"}}},
+		updated.GetDnsContext().GetConfigs())
+
+	// the dataplane state of the connection is left as it is
+	assert.Empty(t, b.deleted)
+	assert.Len(t, uce.dpConfig.Interfaces, 1)
+	assert.Len(t, uce.dpConfig.Routes, 1)
+
+	// applying the diff again does not send the connection again
+	require.NoError(t, pe.Apply(&nseconfig.EndpointsDiff{Updated: []*nseconfig.Endpoint{vl3("10.90.0.0/16", "10.90.0.10")}}))
+	assert.Len(t, client.sent, 1)
+}
+
+func TestMutatorsReplaceConfigContext(t *testing.T) {
+	b := &compositeBackend{}
+	uce := NewUniversalCNFEndpoint(b, &nseconfig.Endpoint{Name: "ucnf", VL3: nseconfig.VL3{
+		Ifname:      "endpoint0",
+		IPAM:        nseconfig.IPAM{Routes: []string{"10.90.0.0/16"}},
+		NameServers: []string{"10.90.0.10"},
+	}})
+	mutate := func(conn *connection.Connection) {
+		require.NoError(t, makeRouteMutator(uce)(context.Background(), conn))
+		require.NoError(t, makeDnsMutator(uce)(context.Background(), conn))
+	}
+	clientDNS := &connectioncontext.DNSConfig{DnsServerIps: []string{"10.1.1.1"}}
+	configDNS := &connectioncontext.DNSConfig{SearchDomains: []string{}, DnsServerIps: []string{"10.90.0.10"}}
+
+	conn := compositeConnection("1")
+	conn.Context.IpContext.DstRoutes = []*connectioncontext.Route{{Prefix: "10.50.0.0/16"}}
+	mutate(conn)
+	assert.Equal(t, []*connectioncontext.Route{{Prefix: "10.50.0.0/16"}, {Prefix: "10.90.0.0/16"}},
+		conn.GetContext().GetIpContext().GetDstRoutes())
+	_, err := uce.Request(context.Background(), &networkservice.NetworkServiceRequest{Connection: conn})
+	require.NoError(t, err)
+
+	// the connection requested again got a vL3 peer route and a DNS config of
+	// the client since, they are kept and the ones of the configuration are
+	// not added twice
+	again := conn.Clone()
+	again.Context.IpContext.DstRoutes = append(again.Context.IpContext.DstRoutes, &connectioncontext.Route{Prefix: "10.60.0.0/16"})
+	again.Context.DnsContext.Configs = append([]*connectioncontext.DNSConfig{clientDNS}, again.Context.DnsContext.Configs...)
+	mutate(again)
+	assert.Equal(t, []*connectioncontext.Route{{Prefix: "10.50.0.0/16"}, {Prefix: "10.60.0.0/16"}, {Prefix: "10.90.0.0/16"}},
+		again.GetContext().GetIpContext().GetDstRoutes())
+	assert.Equal(t, []*connectioncontext.DNSConfig{clientDNS, configDNS}, again.GetContext().GetDnsContext().GetConfigs())
+
+	// the old interface of the refreshed connection is removed from the dataplane
+	_, err = uce.Request(context.Background(), &networkservice.NetworkServiceRequest{Connection: again})
+	require.NoError(t, err)
+	require.Len(t, b.deleted, 1)
+	assert.Equal(t, "endpoint0/1", b.deleted[0].Interfaces[0].Name)
+	assert.Len(t, uce.dpConfig.Interfaces, 1)
+
+	_, err = uce.Close(context.Background(), again)
+	require.NoError(t, err)
+	assert.Empty(t, uce.added)
+}
+
+func TestMutatorsWithoutNameServers(t *testing.T) {
+	uce := NewUniversalCNFEndpoint(&compositeBackend{}, &nseconfig.Endpoint{Name: "ucnf", VL3: nseconfig.VL3{Ifname: "endpoint0"}})
+	clientDNS := &connectioncontext.DNSConfig{DnsServerIps: []string{"10.1.1.1"}}
+
+	conn := compositeConnection("1")
+	conn.Context.DnsContext = &connectioncontext.DNSContext{Configs: []*connectioncontext.DNSConfig{clientDNS}}
+	require.NoError(t, makeDnsMutator(uce)(context.Background(), conn))
+	assert.Equal(t, []*connectioncontext.DNSConfig{clientDNS}, conn.GetContext().GetDnsContext().GetConfigs())
+
+	other := compositeConnection("2")
+	require.NoError(t, makeDnsMutator(uce)(context.Background(), other))
+	assert.Nil(t, other.GetContext().GetDnsContext())
+}
+
+func TestCompositeRefreshFailed(t *testing.T) {
+	b := &compositeBackend{}
+	uce := NewUniversalCNFEndpoint(b, &nseconfig.Endpoint{Name: "ucnf", VL3: nseconfig.VL3{Ifname: "endpoint0"}})
+
+	conn := compositeConnection("1")
+	_, err := uce.Request(context.Background(), &networkservice.NetworkServiceRequest{Connection: conn})
+	require.NoError(t, err)
+
+	// the old interface can not be removed, it stays in the dpConfig
+	b.deleteErr = fmt.Errorf("vpp-agent is down")
+	_, err = uce.Request(context.Background(), &networkservice.NetworkServiceRequest{Connection: conn.Clone()})
+	assert.Error(t, err)
+	assert.Len(t, uce.dpConfig.Interfaces, 1)
+	assert.Len(t, uce.dpConfig.Routes, 1)
+	assert.Len(t, uce.Connections(), 1)
+}
+
+// stoppedAddon records whether it was stopped
+type stoppedAddon struct {
+	networkservice.NetworkServiceServer
+	stopped bool
+}
+
+func (a *stoppedAddon) Stop() {
+	a.stopped = true
+}
+
+func TestSingleEndpointStop(t *testing.T) {
+	b := &compositeBackend{}
+	e := &nseconfig.Endpoint{Name: "ucnf", VL3: nseconfig.VL3{Ifname: "endpoint0"}}
+	uce := NewUniversalCNFEndpoint(b, e)
+	addon := &stoppedAddon{}
+	deleted := false
+	se := &SingleEndpoint{
+		NSComposite:  uce,
+		Endpoint:     e,
+		Cleanup:      func() { deleted = true },
+		ucnfEndpoint: uce,
+		addons:       []networkservice.NetworkServiceServer{addon},
+	}
+
+	for _, id := range []string{"1", "2"} {
+		conn := compositeConnection(id)
+		conn.Context.IpContext.DstIpAddr = "10.60.1." + id + "/30"
+		_, err := uce.Request(context.Background(), &networkservice.NetworkServiceRequest{Connection: conn})
+		require.NoError(t, err)
+	}
+
+	se.stop(context.Background())
+	assert.True(t, deleted)
+	assert.True(t, addon.stopped)
+	assert.Empty(t, uce.Connections())
+	assert.Empty(t, uce.dpConfig.Interfaces)
+	assert.ElementsMatch(t, []string{"1", "2"}, b.released)
+}
+
+func TestApplyAgain(t *testing.T) {
+	e := &nseconfig.Endpoint{Name: "ucnf", VL3: nseconfig.VL3{Ifname: "endpoint0"}}
+	pe := &ProcessEndpoints{
+		Endpoints: []*SingleEndpoint{{Endpoint: e, ucnfEndpoint: NewUniversalCNFEndpoint(&compositeBackend{}, e)}},
+		ctx:       context.Background(),
+	}
+
+	// the endpoint started by the failed Apply is not started twice
+	require.NoError(t, pe.Apply(&nseconfig.EndpointsDiff{Added: []*nseconfig.Endpoint{e}}))
+	assert.Len(t, pe.Endpoints, 1)
+}
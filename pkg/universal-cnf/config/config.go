@@ -17,131 +17,295 @@ package config
 
 import (
 	"context"
+	"fmt"
 	"io/ioutil"
 	"os"
-	"os/exec"
+	"time"
 
+	"github.com/cisco-app-networking/nsm-nse/pkg/nseconfig"
+	"github.com/cisco-app-networking/nsm-nse/pkg/universal-cnf/dataplane"
 	"github.com/davecgh/go-spew/spew"
 	"github.com/networkservicemesh/networkservicemesh/controlplane/api/connection"
-	"github.com/networkservicemesh/networkservicemesh/controlplane/api/connection/mechanisms/memif"
+	"github.com/networkservicemesh/networkservicemesh/controlplane/api/registry"
 	"github.com/networkservicemesh/networkservicemesh/sdk/client"
 	"github.com/sirupsen/logrus"
-	"go.ligato.io/vpp-agent/v3/proto/ligato/vpp"
-	"gopkg.in/yaml.v2"
 )
 
 const (
 	PEER_NAME = "ucnf/peerName"
 	PodName = "nsepod.name"
 
-	nsePodNameEnv  = "NSE_POD_NAME"
-	nsePodName     = "example"
-	clusterNameEnv = "CLUSTER_NAME"
-	cluster        = "test"
+	nsePodNameEnv = "NSE_POD_NAME"
+	nsePodName    = "example"
+	cluster       = "test"
 )
 
-// Command is a struct to describe exec.Command call arguments
-type Command struct {
-	Name string
-	Args []string
-}
-
 // Client is a struct to describe a NS Client setup
 type Client struct {
-	Name   string
-	Labels map[string]string
-	Routes []string
-	IfName string
+	Name      string
+	Labels    map[string]string
+	Routes    []string
+	IfName    string
+	Interface nseconfig.Interface
+	// Selector selects the endpoint of the network service to connect to by
+	// its labels, NSM selects the endpoint when not set
+	Selector string
+	// ReconnectDelay is the delay between the attempts to reconnect a
+	// connection that went down, 5 seconds when not set
+	ReconnectDelay time.Duration `yaml:"reconnectDelay"`
+
+	discovery registry.NetworkServiceDiscoveryClient
 }
 
+// Process connects the client and adds its interface to the dpconfig, the
+// connection is returned also when the interface could not be added so that
+// it can be closed
 func (c *Client) Process(ctx context.Context,
-	backend UniversalCNFBackend, dpconfig interface{}, nsmclient *client.NsmClient) error {
-	conn, err := nsmclient.ConnectRetry(ctx, c.IfName, memif.MECHANISM, "VPP interface "+c.IfName, client.ConnectionRetry, client.RequestDelay)
+	backend UniversalCNFBackend, dpconfig *dataplane.Config, nsmclient NSMConnector) (*connection.Connection, error) {
+	var conn *connection.Connection
+	var err error
+	if c.Selector != "" {
+		conn, err = c.connectSelected(ctx, nsmclient)
+	} else {
+		conn, err = nsmclient.ConnectRetry(ctx, c.IfName, c.Interface.Mechanism.NSMMechanism(), "VPP interface "+c.IfName, client.ConnectionRetry, client.RequestDelay)
+	}
 	if err != nil {
 		logrus.Errorf("Error creating %s: %v", c.IfName, err)
-		return err
+		return nil, err
+	}
+
+	err = backend.ProcessClient(dpconfig, c.IfName, c.Interface, conn)
+
+	return conn, err
+}
+
+// connectSelected connects to the first endpoint of the network service
+// selected by the client selector
+func (c *Client) connectSelected(ctx context.Context, nsmclient NSMConnector) (*connection.Connection, error) {
+	selector, err := nseconfig.ParseSelector(c.Selector)
+	if err != nil {
+		return nil, err
+	}
+	if c.discovery == nil {
+		return nil, fmt.Errorf("no network service discovery to select the endpoint by %s", selector)
 	}
 
-	err = backend.ProcessClient(dpconfig, c.IfName, conn)
+	endpoints, err := FindEndpoints(ctx, c.discovery, c.Name, selector)
+	if err != nil {
+		return nil, err
+	}
+	if len(endpoints) == 0 {
+		return nil, fmt.Errorf("no endpoint of the network service %s is selected by %s", c.Name, selector)
+	}
 
-	return err
+	e := endpoints[0]
+	logrus.Infof("Connecting to endpoint %s selected by %s", e.GetName(), selector)
+	return nsmclient.ConnectToEndpoint(ctx, "", e.GetName(), e.NetworkServiceManagerName, c.IfName,
+		c.Interface.Mechanism.NSMMechanism(), "VPP interface "+c.IfName, c.Routes)
 }
 
 // Action is a struct to describe exec.Command, a Client initiation or a Forwarder configuration
 type Action struct {
+	// Name identifies the action in DependsOn and in the report, action-<index>
+	// is used when not set
+	Name string `yaml:"name"`
+	// DependsOn are the names of the actions that have to succeed before this one
+	DependsOn []string `yaml:"dependsOn"`
+	// OnFailure is the failure policy, the pipeline is aborted when not set
+	OnFailure *FailurePolicy `yaml:"onFailure"`
+	// Timeout limits a single attempt of the action, unlimited when not set
+	Timeout time.Duration `yaml:"timeout"`
+
 	Command  *Command
 	Client   *Client
-	DPConfig *vpp.ConfigData
+	DPConfig *dataplane.Config
+	// CleanupCommand is run when the action is cleaned up after it ran
+	CleanupCommand *Command `yaml:"cleanupCommand"`
+
+	// allowlist of the command binaries, all are allowed when empty
+	allowlist []string
+	// result of the last command run
+	commandResult *CommandResult
+
+	// what the action created, undone by Cleanup
+	ran       bool
+	conns     []*connection.Connection
+	nsmClient NSMConnector
+	applied   *dataplane.Config
+
+	// the live client connection, its interface and routes at their index in
+	// the dpconfig and its monitor
+	clientConn       *connection.Connection
+	clientConfig     *dataplane.Config
+	clientInterfaces int
+	clientRoutes     int
+	monitor          *clientMonitor
 }
 
-// Process executes the actions as defined
-func (a *Action) Process(ctx context.Context, backend UniversalCNFBackend, nsmclient *client.NsmClient) error {
+// Process executes the actions as defined, the first failing step fails the
+// action. The client connection is monitored and reconnected once the action
+// succeeded.
+func (a *Action) Process(ctx context.Context, backend UniversalCNFBackend, nsmclient NSMConnector) error {
+	if a.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, a.Timeout)
+		defer cancel()
+	}
+
 	command := a.Command
 	if command != nil && len(command.Name) > 0 {
 		logrus.Infof("Executing %v", command)
 
-		out, err := exec.Command(command.Name, command.Args...).Output() // #nosec
-		logrus.Infof("Result %s", out)
-
+		result, err := command.Run(ctx, a.allowlist)
+		a.commandResult = result
+		if result != nil {
+			a.ran = true
+		}
 		if err != nil {
-			logrus.Errorf("Command execution failed with: %v", err)
+			return err
 		}
 	}
 
+	connected := false
 	client := a.Client
 	if client != nil && nsmclient != nil {
 		logrus.Infof("Running client %+v", client)
 
 		if a.DPConfig == nil {
-			a.DPConfig = &vpp.ConfigData{}
+			a.DPConfig = &dataplane.Config{}
 		}
-
-		if err := client.Process(ctx, backend, a.DPConfig, nsmclient); err != nil {
+		a.ran = true
+		a.nsmClient = nsmclient
+
+		// drop the client interface, routes and connection of a failed attempt
+		// before a retry
+		interfaces, routes := len(a.DPConfig.Interfaces), len(a.DPConfig.Routes)
+		conn, err := client.Process(ctx, backend, a.DPConfig, nsmclient)
+		if conn != nil {
+			a.conns = append(a.conns, conn)
+		}
+		if err != nil {
 			logrus.Errorf("Error running the client: %v", err)
+			a.DPConfig.Interfaces, a.DPConfig.Routes = a.DPConfig.Interfaces[:interfaces], a.DPConfig.Routes[:routes]
+			if conn != nil {
+				a.closeConn(ctx, conn)
+			}
+			return fmt.Errorf("client %s failed: %v", client.Name, err)
+		}
+		connected = true
+		a.clientConn = conn
+		a.clientInterfaces, a.clientRoutes = interfaces, routes
+		a.clientConfig = &dataplane.Config{
+			Interfaces: append([]*dataplane.Interface{}, a.DPConfig.Interfaces[interfaces:]...),
+			Routes:     append([]*dataplane.Route{}, a.DPConfig.Routes[routes:]...),
 		}
 	}
 
-	if err := backend.ProcessDPConfig(a.DPConfig, true); err != nil {
-		logrus.Errorf("Error processing dpconfig: %+v", a.DPConfig)
+	if a.DPConfig != nil {
+		a.ran = true
+		if err := backend.ProcessDPConfig(a.DPConfig, true); err != nil {
+			logrus.Errorf("Error processing dpconfig: %+v", a.DPConfig)
+			if connected {
+				a.dropClient(ctx)
+			}
+			return fmt.Errorf("dpconfig failed: %v", err)
+		}
+		a.applied = a.DPConfig
 	}
 
+	if a.clientConn != nil {
+		a.startMonitor(backend, newConnectionMonitor(nsmclient))
+	}
 	return nil
 }
 
-// Cleanup the action
-func (a *Action) Cleanup() error {
-	return nil
+// dropClient removes the client interface and routes of a failed attempt from
+// the dpconfig and closes its connection, so that a retry connects again
+func (a *Action) dropClient(ctx context.Context) {
+	a.DPConfig.Interfaces, a.DPConfig.Routes = a.DPConfig.Interfaces[:a.clientInterfaces], a.DPConfig.Routes[:a.clientRoutes]
+
+	conn := a.clientConn
+	a.clientConn, a.clientConfig = nil, nil
+	a.closeConn(ctx, conn)
 }
 
-// IPAM holds the configuration of the IP address management
-type IPAM struct {
-	PrefixPool string
-	Routes     []string
+// closeConn closes the connection of a failed attempt and forgets it, a
+// connection failing to close is closed again by Cleanup
+func (a *Action) closeConn(ctx context.Context, conn *connection.Connection) {
+	if err := a.nsmClient.Close(ctx, conn); err != nil {
+		logrus.Errorf("Closing the connection %s of action %s: %v", conn.GetId(), a.Name, err)
+		return
+	}
+	a.removeConn(conn)
 }
 
-// Endpoint is a struct to describe a NS Endpoint setup and the related VPP config changes
-type Endpoint struct {
-	Name    string
-	Labels  map[string]string
-	IfName  string
-	Ipam    *IPAM
-	Action  *Action
-	NseName string
+// Cleanup undoes what the action created in reverse order: it removes the
+// applied dpconfig, closes the client connections and runs the cleanup
+// command. An action that did not run is not cleaned up.
+func (a *Action) Cleanup(ctx context.Context, backend UniversalCNFBackend) error {
+	a.stopMonitor()
+	if !a.ran {
+		return nil
+	}
+	var errs errors
+
+	if a.applied != nil {
+		logrus.Infof("Removing the dpconfig of action %s", a.Name)
+		if err := backend.ProcessDPConfig(a.applied, false); err != nil {
+			errs = append(errs, fmt.Errorf("removing the dpconfig failed: %v", err))
+		} else {
+			a.applied = nil
+		}
+	}
+
+	for i := len(a.conns) - 1; i >= 0; i-- {
+		logrus.Infof("Closing the connection %s of action %s", a.conns[i].GetId(), a.Name)
+		if err := a.nsmClient.Close(ctx, a.conns[i]); err != nil {
+			errs = append(errs, fmt.Errorf("closing the connection %s failed: %v", a.conns[i].GetId(), err))
+		}
+	}
+	a.conns, a.clientConn = nil, nil
+
+	if command := a.CleanupCommand; command != nil && len(command.Name) > 0 {
+		logrus.Infof("Executing the cleanup %v of action %s", command, a.Name)
+		if _, err := command.Run(ctx, a.allowlist); err != nil {
+			errs = append(errs, fmt.Errorf("cleanup %v", err))
+		}
+	}
+	a.ran = false
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
 }
 
+// UniversalCNFBackend translates the dataplane intent of the init actions and
+// the connections to its dataplane
 type UniversalCNFBackend interface {
-	NewDPConfig() *vpp.ConfigData
+	NewDPConfig() *dataplane.Config
 	NewUniversalCNFBackend() error
-	ProcessClient(dpconfig interface{}, ifName string, conn *connection.Connection) error
-	ProcessEndpoint(dpconfig interface{}, serviceName, ifName string, conn *connection.Connection) error
-	ProcessDPConfig(dpconfig interface{}, update bool) error
+	// ProcessClient adds the interface and routes of a client connection to the dpconfig
+	ProcessClient(dpconfig *dataplane.Config, ifName string, iface nseconfig.Interface, conn *connection.Connection) error
+	// SetupEndpoint adds the configuration the connections of an endpoint
+	// share, like its NAT pool, to the dpconfig of the endpoint once
+	SetupEndpoint(dpconfig *dataplane.Config, endpoint *nseconfig.Endpoint) error
+	// ProcessEndpoint adds the interface, routes and NAT of an endpoint connection to the dpconfig
+	ProcessEndpoint(dpconfig *dataplane.Config, endpoint *nseconfig.Endpoint, conn *connection.Connection) error
+	// ReleaseEndpoint releases what ProcessEndpoint allocated for the
+	// connection, like its interface ID, once it is closed
+	ReleaseEndpoint(endpoint *nseconfig.Endpoint, conn *connection.Connection)
+	// ProcessDPConfig applies the dpconfig, or removes it when update is false
+	ProcessDPConfig(dpconfig *dataplane.Config, update bool) error
 }
 
-// UniversalCNFConfig hold the CNF configuration
+// UniversalCNFConfig holds the CNF configuration: the NSE configuration with
+// the endpoints and the init actions decoded into Actions
 type UniversalCNFConfig struct {
-	InitActions []*Action
-	Endpoints   []*Endpoint
-	backend     UniversalCNFBackend
+	nseconfig.Config
+	// Actions are the decoded InitActions
+	Actions []*Action
+	backend UniversalCNFBackend
 }
 
 // NewUniversalCNFConfig creates an empty CNF configuration
@@ -168,7 +332,7 @@ func (c *UniversalCNFConfig) InitConfig(configpath string) error {
 
 // InitConfigFromRawYaml init CNF config from a byte slice
 func (c *UniversalCNFConfig) InitConfigFromRawYaml(rawyaml []byte) error {
-	err := yaml.UnmarshalStrict(rawyaml, &c)
+	err := c.Load(rawyaml, nseconfig.FormatYAML)
 	if err != nil {
 		logrus.Errorf("error: %v", err)
 		return err
@@ -177,6 +341,70 @@ func (c *UniversalCNFConfig) InitConfigFromRawYaml(rawyaml []byte) error {
 	return nil
 }
 
+// Load decodes the configuration in the given format, see nseconfig.Load,
+// and its init actions
+func (c *UniversalCNFConfig) Load(raw []byte, format nseconfig.Format) error {
+	err := nseconfig.Load(raw, format, &c.Config)
+	errs, ok := err.(nseconfig.InvalidConfigErrors)
+	if err != nil && !ok {
+		return err
+	}
+
+	actions, aerr := DecodeInitActions(&c.Config)
+	c.Actions = actions
+	if aerr != nil {
+		errs = append(errs, aerr.(nseconfig.InvalidConfigErrors)...)
+	}
+	if c.Backend != "" {
+		if _, err := NewBackend(c.Backend); err != nil {
+			errs = append(errs, &nseconfig.FieldError{Field: "backend", Err: err})
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// DecodeInitActions decodes the init actions of the configuration and checks
+// their dependencies and failure policies
+func DecodeInitActions(cfg *nseconfig.Config) ([]*Action, error) {
+	var errs nseconfig.InvalidConfigErrors
+	var actions []*Action
+	for i, ia := range cfg.InitActions {
+		a := &Action{}
+		if err := ia.Decode(fmt.Sprintf("initActions[%d]", i), a); err != nil {
+			errs = append(errs, err.(nseconfig.InvalidConfigErrors)...)
+			continue
+		}
+		if a.DPConfig != nil {
+			if err := a.DPConfig.Validate(); err != nil {
+				errs = append(errs, &nseconfig.FieldError{
+					Field: fmt.Sprintf("initActions[%d].dpconfig", i),
+					Err:   fmt.Errorf("initActions[%d].dpconfig: %v", i, err),
+				})
+				continue
+			}
+		}
+		actions = append(actions, a)
+	}
+	if len(errs) > 0 {
+		return nil, errs
+	}
+
+	if _, err := orderActions(actions); err != nil {
+		if list, ok := err.(errors); ok {
+			for _, e := range list {
+				errs = append(errs, &nseconfig.FieldError{Field: "initActions", Err: e})
+			}
+		} else {
+			errs = append(errs, &nseconfig.FieldError{Field: "initActions", Err: err})
+		}
+		return nil, errs
+	}
+	return actions, nil
+}
+
 func (c *UniversalCNFConfig) GetBackend() UniversalCNFBackend {
 	return c.backend
 }
@@ -186,14 +414,14 @@ func (c *UniversalCNFConfig) Dump() {
 	spew.Dump(c)
 }
 
-func GetEndpointName() string {
+// GetEndpointName returns the name of the NSE pod, prefixed with the cluster name
+func GetEndpointName(clusterName string) string {
 	podName, ok := os.LookupEnv(nsePodNameEnv)
 	if !ok {
 		podName = nsePodName
 	}
 
-	clusterName, ok := os.LookupEnv(clusterNameEnv)
-	if !ok {
+	if clusterName == "" {
 		clusterName = cluster
 	}
 
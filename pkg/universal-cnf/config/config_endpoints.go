@@ -17,13 +17,12 @@ package config
 
 import (
 	"context"
-	"fmt"
 	"net"
-	"os"
-	"strconv"
+	"reflect"
+	"strings"
+	"sync"
 
 	"github.com/cisco-app-networking/nsm-nse/pkg/nseconfig"
-	"github.com/networkservicemesh/networkservicemesh/controlplane/api/connection/mechanisms/memif"
 	"github.com/networkservicemesh/networkservicemesh/controlplane/api/networkservice"
 
 	"github.com/networkservicemesh/networkservicemesh/sdk/common"
@@ -35,176 +34,313 @@ import (
 type SingleEndpoint struct {
 	NSConfiguration *common.NSConfiguration
 	NSComposite     networkservice.NetworkServiceServer
+	updates         networkservice.NetworkServiceServer
 	Endpoint        *nseconfig.Endpoint
 	Cleanup         func()
+	ucnfEndpoint    *UniversalCNFEndpoint
+	subnets         *localSubnets
+	addons          []networkservice.NetworkServiceServer
 }
 
 // ProcessEndpoints keeps the state of the running network service endpoints
 type ProcessEndpoints struct {
+	sync.Mutex
 	Endpoints []*SingleEndpoint
+	backend   UniversalCNFBackend
+	nsconfig  *common.NSConfiguration
+	ceAddons  CompositeEndpointAddons
+	ctx       context.Context
 }
 
 type CompositeEndpointAddons interface {
-	AddCompositeEndpoints(*common.NSConfiguration, *nseconfig.Endpoint) *[]networkservice.NetworkServiceServer
+	AddCompositeEndpoints(*common.NSConfiguration, *nseconfig.Endpoint, UniversalCNFBackend, SubnetConflictDetector) *[]networkservice.NetworkServiceServer
 }
 
-func buildIpPrefixFromLocal(defaultPrefixPool string) string {
-	nsPodIp, ok := os.LookupEnv("NSE_POD_IP")
-	if !ok {
-		nsPodIp = "2.2.20.0" // needs to be set to make sense
-	}
-	ipamUseNsPodOctet := false
-	nseUniqueOctet, ok := os.LookupEnv("NSE_IPAM_UNIQUE_OCTET")
-	if !ok {
-		ipamUseNsPodOctet = true
-	}
-	prefixPool := defaultPrefixPool
-	logrus.Infof("IPAM local calc--default prefix pool IP %s",
-		defaultPrefixPool)
-	// Find the 3rd octet of the pod IP
-	if defaultPrefixPool != "" {
-		prefixPoolIP, defaultPrefixIPNet, err := net.ParseCIDR(defaultPrefixPool)
-		if err != nil {
-			logrus.Errorf("Failed to parse configured prefix pool IP")
-			prefixPoolIP = net.ParseIP("1.1.0.0")
-		}
-		defaultPrefixMaskOnes, _ := defaultPrefixIPNet.Mask.Size()
-		logrus.Infof("IPAM local calc--default prefix pool IP %s (len = %d)",
-			defaultPrefixPool, defaultPrefixMaskOnes)
-		// this default IPAM pool logic assumes ipv4
-		if defaultPrefixMaskOnes <= 16 {
-			var ipamUniqueOctet int
-			if ipamUseNsPodOctet {
-				podIP := net.ParseIP(nsPodIp)
-				if podIP == nil {
-					logrus.Errorf("Failed to parse configured pod IP")
-					ipamUniqueOctet = 0
-				} else {
-					ipamUniqueOctet = int(podIP.To4()[2])
-				}
-			} else {
-				ipamUniqueOctet, _ = strconv.Atoi(nseUniqueOctet)
-			}
-			prefixPool = fmt.Sprintf("%d.%d.%d.%d/24",
-				prefixPoolIP.To4()[0],
-				prefixPoolIP.To4()[1],
-				ipamUniqueOctet,
-				0)
-		}
-	}
-	return prefixPool
+// CompositeEndpointStopper is implemented by the add-on composite endpoints
+// that release their own connections and state when their endpoint is replaced
+type CompositeEndpointStopper interface {
+	Stop()
 }
 
 // NewProcessEndpoints returns a new ProcessInitCommands struct
 func NewProcessEndpoints(backend UniversalCNFBackend, endpoints []*nseconfig.Endpoint, nsconfig *common.NSConfiguration, ceAddons CompositeEndpointAddons, ctx context.Context) *ProcessEndpoints {
-	result := &ProcessEndpoints{}
+	result := &ProcessEndpoints{
+		backend:  backend,
+		nsconfig: nsconfig,
+		ceAddons: ceAddons,
+		ctx:      ctx,
+	}
 
 	for _, e := range endpoints {
-		endpointLabels := e.Labels
-		endpointLabels[PodName] = GetEndpointName()
-
-		configuration := &common.NSConfiguration{
-			NsmServerSocket:        nsconfig.NsmServerSocket,
-			NsmClientSocket:        nsconfig.NsmClientSocket,
-			Workspace:              nsconfig.Workspace,
-			EndpointNetworkService: e.Name,
-			ClientNetworkService:   nsconfig.ClientNetworkService,
-			EndpointLabels:         labelStringFromMap(endpointLabels),
-			ClientLabels:           nsconfig.ClientLabels,
-			MechanismType:          memif.MECHANISM,
-			IPAddress:              "",
-			Routes:                 nil,
-		}
-		if e.VL3.IPAM.ServerAddress != "" {
-			var err error
-			ipamService, err := NewIpamService(ctx, e.VL3.IPAM.ServerAddress)
+		result.Endpoints = append(result.Endpoints, result.newSingleEndpoint(e, nil))
+	}
+
+	return result
+}
+
+// newSingleEndpoint builds the endpoint composite, the locally calculated
+// subnets avoid the used subnets
+func (pe *ProcessEndpoints) newSingleEndpoint(e *nseconfig.Endpoint, used []*net.IPNet) *SingleEndpoint {
+	nsconfig := pe.nsconfig
+
+	endpointLabels := map[string]string{}
+	for k, v := range e.Labels {
+		endpointLabels[k] = v
+	}
+	endpointLabels[PodName] = GetEndpointName(e.ClusterName)
+
+	configuration := &common.NSConfiguration{
+		NsmServerSocket:        nsconfig.NsmServerSocket,
+		NsmClientSocket:        nsconfig.NsmClientSocket,
+		Workspace:              nsconfig.Workspace,
+		EndpointNetworkService: e.Name,
+		ClientNetworkService:   nsconfig.ClientNetworkService,
+		EndpointLabels:         labelStringFromMap(endpointLabels),
+		ClientLabels:           nsconfig.ClientLabels,
+		MechanismType:          e.Interface.Mechanism.NSMMechanism(),
+		IPAddress:              "",
+		Routes:                 nil,
+	}
+	var prefixes []string
+	if e.VL3.IPAM.ServerAddress != "" {
+		var err error
+		ipamService, err := NewIpamService(pe.ctx, e.VL3.IPAM.ServerAddress)
+		if err != nil {
+			logrus.Warningf("Unable to connect to IPAM Service %v", err)
+		} else {
+			prefixes, err = ipamService.AllocateSubnets(e)
 			if err != nil {
-				logrus.Warningf("Unable to connect to IPAM Service %v",err)
+				logrus.Warningf("Unable to allocate subnet from IPAM Service %v", err)
+				prefixes = nil
 			} else {
-				configuration.IPAddress, err = ipamService.AllocateSubnet(e)
-				if err != nil {
-					logrus.Warningf("Unable to allocate subnet from IPAM Service %v", err)
-					configuration.IPAddress = ""
-				} else {
-					logrus.Infof("Obtained subnet from IPAM Service: %s", configuration.IPAddress)
-				}
+				logrus.Infof("Obtained subnets from IPAM Service: %v", prefixes)
 			}
 		}
-		if configuration.IPAddress == "" {
-			// central ipam server address is not set so attempt a local calculation of IPAM subnet
-			configuration.IPAddress = buildIpPrefixFromLocal(e.VL3.IPAM.DefaultPrefixPool)
-			logrus.Infof("Using locally calculated subnet for IPAM: %s", configuration.IPAddress)
-		}
-		// Build the list of composites
-		compositeEndpoints := []networkservice.NetworkServiceServer{
-			endpoint.NewMonitorEndpoint(configuration),
-			endpoint.NewConnectionEndpoint(configuration),
-		}
+	}
+	local := len(prefixes) == 0
+	if local {
+		// central ipam server address is not set so attempt a local calculation of IPAM subnet
+		prefixes = buildIpPrefixesFromLocal(e, used)
+		logrus.Infof("Using locally calculated subnets for IPAM: %v", prefixes)
+	}
+	subnets := newLocalSubnets(prefixes, local, used)
+	// the composite endpoint add-ons get the subnets of all address families
+	configuration.IPAddress = strings.Join(prefixes, ",")
 
-		if configuration.IPAddress != "" {
-			compositeEndpoints = append(compositeEndpoints, endpoint.NewIpamEndpoint(&common.NSConfiguration{
-				NsmServerSocket:        nsconfig.NsmServerSocket,
-				NsmClientSocket:        nsconfig.NsmClientSocket,
-				Workspace:              nsconfig.Workspace,
-				EndpointNetworkService: nsconfig.EndpointNetworkService,
-				ClientNetworkService:   nsconfig.ClientNetworkService,
-				EndpointLabels:         nsconfig.EndpointLabels,
-				ClientLabels:           nsconfig.ClientLabels,
-				MechanismType:          nsconfig.MechanismType,
-				IPAddress:              configuration.IPAddress,
-				Routes:                 nil,
-			}))
-		}
-		// Invoke any additional composite endpoint constructors via the add-on interface
-		addCompositeEndpoints := ceAddons.AddCompositeEndpoints(configuration, e)
-		if addCompositeEndpoints != nil {
-			compositeEndpoints = append(compositeEndpoints, *addCompositeEndpoints...)
+	// Build the list of composites
+	monitor := endpoint.NewMonitorEndpoint(configuration)
+	compositeEndpoints := []networkservice.NetworkServiceServer{
+		monitor,
+		endpoint.NewConnectionEndpoint(configuration),
+	}
+
+	if len(prefixes) > 0 {
+		ipam, err := newIpamEndpoint(prefixes)
+		if err != nil {
+			logrus.Errorf("Unable to create the IPAM endpoint: %v", err)
+		} else {
+			compositeEndpoints = append(compositeEndpoints, ipam)
 		}
+	}
+	// Invoke any additional composite endpoint constructors via the add-on interface
+	var addons []networkservice.NetworkServiceServer
+	if addCompositeEndpoints := pe.ceAddons.AddCompositeEndpoints(configuration, e, pe.backend, subnets); addCompositeEndpoints != nil {
+		addons = *addCompositeEndpoints
+		compositeEndpoints = append(compositeEndpoints, addons...)
+	}
+
+	// The routes and DNS mutators set the routes and DNS context of the current
+	// configuration, so they are always added in order to pick up changes on
+	// configuration reload
+	ucnfEndpoint := NewUniversalCNFEndpoint(pe.backend, e)
+	routeAddr := endpoint.NewCustomFuncEndpoint("route", makeRouteMutator(ucnfEndpoint))
+	dnsServers := endpoint.NewCustomFuncEndpoint("dns", makeDnsMutator(ucnfEndpoint))
+	compositeEndpoints = append(compositeEndpoints, routeAddr, dnsServers)
 
-		if len(e.VL3.IPAM.Routes) > 0 {
-			routeAddr := makeRouteMutator(e.VL3.IPAM.Routes)
-			compositeEndpoints = append(compositeEndpoints, endpoint.NewCustomFuncEndpoint("route", routeAddr))
+	compositeEndpoints = append(compositeEndpoints, ucnfEndpoint)
+	// Compose the Endpoint
+	composite := endpoint.NewCompositeEndpoint(compositeEndpoints...)
+	// The live connections are updated by the routes and DNS mutators only and
+	// sent to the clients by the monitor of the endpoint composite
+	updates := endpoint.NewCompositeEndpoint(monitor, routeAddr, dnsServers)
+
+	se := &SingleEndpoint{
+		NSConfiguration: configuration,
+		NSComposite:     composite,
+		updates:         updates,
+		Endpoint:        e,
+		ucnfEndpoint:    ucnfEndpoint,
+		subnets:         subnets,
+		addons:          addons,
+	}
+	subnets.name = func() string { return e.NseName }
+	subnets.onConflict = func(used []*net.IPNet) { pe.repick(se, used) }
+	return se
+}
+
+// repick replaces the endpoint by one with subnets avoiding the used subnets
+// of the peers
+func (pe *ProcessEndpoints) repick(se *SingleEndpoint, used []*net.IPNet) {
+	pe.Lock()
+	defer pe.Unlock()
+
+	for i, current := range pe.Endpoints {
+		if current != se {
+			continue
 		}
-		if len(e.VL3.NameServers) > 0 {
-			dnsServers := makeDnsMutator(e.VL3.DNSZones, e.VL3.NameServers)
-			compositeEndpoints = append(compositeEndpoints, endpoint.NewCustomFuncEndpoint("dns", dnsServers))
+		logrus.Infof("Picking new subnets for endpoint %s", se.Endpoint.NseName)
+		se.stop(pe.ctx)
+		replacement := pe.newSingleEndpoint(se.Endpoint, used)
+		if err := replacement.start(pe.ctx); err != nil {
+			logrus.Errorf("Failed to restart endpoint %s: %v", se.Endpoint.Name, err)
+			pe.Endpoints = append(pe.Endpoints[:i], pe.Endpoints[i+1:]...)
+			return
 		}
+		pe.Endpoints[i] = replacement
+		return
+	}
+}
+
+// start registers the endpoint with NSM
+func (se *SingleEndpoint) start(ctx context.Context) error {
+	nsEndpoint, err := endpoint.NewNSMEndpoint(ctx, se.NSConfiguration, se.NSComposite)
+	if err != nil {
+		return err
+	}
 
-		compositeEndpoints = append(compositeEndpoints, NewUniversalCNFEndpoint(backend, e))
-		// Compose the Endpoint
-		composite := endpoint.NewCompositeEndpoint(compositeEndpoints...)
+	_ = nsEndpoint.Start()
+	se.Endpoint.NseName = nsEndpoint.GetName()
+	logrus.Infof("Started endpoint %s", nsEndpoint.GetName())
+	se.Cleanup = func() { _ = nsEndpoint.Delete() }
 
-		result.Endpoints = append(result.Endpoints, &SingleEndpoint{
-			NSConfiguration: configuration,
-			NSComposite:     composite,
-			Endpoint:        e,
-		})
+	return nil
+}
+
+// stop deletes the endpoint from NSM, closes its live connections, which
+// removes their dataplane state and tells their clients, and stops the add-on
+// composite endpoints
+func (se *SingleEndpoint) stop(ctx context.Context) {
+	if se.Cleanup != nil {
+		se.Cleanup()
+	}
+	if se.ucnfEndpoint != nil {
+		for _, conn := range se.ucnfEndpoint.Connections() {
+			if _, err := se.NSComposite.Close(ctx, conn); err != nil {
+				logrus.Errorf("Failed to close connection %s of endpoint %s: %v", conn.GetId(), se.Endpoint.NseName, err)
+			}
+		}
+	}
+	for _, addon := range se.addons {
+		if stopper, ok := addon.(CompositeEndpointStopper); ok {
+			stopper.Stop()
+		}
 	}
+}
 
-	return result
+// refreshConnections sends copies of the live connections with the updated
+// routes and DNS settings to the clients. The addresses and the dataplane
+// state of the connections are left as they are
+func (se *SingleEndpoint) refreshConnections(ctx context.Context) {
+	for _, conn := range se.ucnfEndpoint.Connections() {
+		request := &networkservice.NetworkServiceRequest{Connection: conn}
+		if _, err := se.updates.Request(ctx, request); err != nil {
+			logrus.Errorf("Failed to refresh connection %s of endpoint %s: %v", conn.GetId(), se.Endpoint.NseName, err)
+		}
+	}
 }
 
 // Process iterates over the init commands and applies them
 func (pe *ProcessEndpoints) Process() error {
 	for _, e := range pe.Endpoints {
-		nsEndpoint, err := endpoint.NewNSMEndpoint(context.TODO(), e.NSConfiguration, e.NSComposite)
-		if err != nil {
+		if err := e.start(context.TODO()); err != nil {
 			logrus.Fatalf("%v", err)
 			return err
 		}
+	}
 
-		_ = nsEndpoint.Start()
-		e.Endpoint.NseName = nsEndpoint.GetName()
-		logrus.Infof("Started endpoint %s", nsEndpoint.GetName())
-		e.Cleanup = func() { _ = nsEndpoint.Delete() }
+	return nil
+}
+
+// Apply starts the added endpoints, deletes the removed ones and pushes the
+// route and DNS changes of the updated ones to their live connections and
+// their clients. Applying a diff again after an error only starts the
+// added endpoints that failed to start, the endpoints already updated are
+// left as they are
+func (pe *ProcessEndpoints) Apply(diff *nseconfig.EndpointsDiff) error {
+	pe.Lock()
+	defer pe.Unlock()
+
+	for _, e := range diff.Removed {
+		for i, se := range pe.Endpoints {
+			if se.Endpoint.Key() != e.Key() {
+				continue
+			}
+			logrus.Infof("Deleting endpoint %s", se.Endpoint.NseName)
+			if se.Cleanup != nil {
+				se.Cleanup()
+			}
+			pe.Endpoints = append(pe.Endpoints[:i], pe.Endpoints[i+1:]...)
+			break
+		}
+	}
+
+	for _, e := range diff.Updated {
+		for _, se := range pe.Endpoints {
+			if se.Endpoint.Key() != e.Key() {
+				continue
+			}
+			e.NseName = se.Endpoint.NseName
+			if reflect.DeepEqual(se.Endpoint, e) {
+				// updated by an Apply of the same diff that failed
+				break
+			}
+			logrus.Infof("Updating endpoint %s", se.Endpoint.NseName)
+			se.Endpoint = e
+			se.ucnfEndpoint.UpdateEndpoint(e)
+			se.refreshConnections(pe.ctx)
+			break
+		}
+	}
+
+	var errs errors
+	for _, e := range diff.Added {
+		if pe.running(e) {
+			// started by an Apply of the same diff that failed
+			continue
+		}
+		se := pe.newSingleEndpoint(e, nil)
+		if err := se.start(pe.ctx); err != nil {
+			logrus.Errorf("Failed to start endpoint %s: %v", e.Name, err)
+			errs = append(errs, err)
+			continue
+		}
+		pe.Endpoints = append(pe.Endpoints, se)
 	}
 
+	if len(errs) > 0 {
+		return errs
+	}
 	return nil
 }
 
+// running tells if an endpoint with the key of e is running, pe is locked
+func (pe *ProcessEndpoints) running(e *nseconfig.Endpoint) bool {
+	for _, se := range pe.Endpoints {
+		if se.Endpoint.Key() == e.Key() {
+			return true
+		}
+	}
+	return false
+}
+
 // Cleanup - cleans up before exit
 func (pe *ProcessEndpoints) Cleanup() {
+	pe.Lock()
+	defer pe.Unlock()
+
 	for _, e := range pe.Endpoints {
-		e.Cleanup()
+		if e.Cleanup != nil {
+			e.Cleanup()
+		}
 	}
 }
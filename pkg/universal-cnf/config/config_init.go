@@ -17,76 +17,442 @@ package config
 
 import (
 	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/networkservicemesh/networkservicemesh/sdk/client"
 	"github.com/networkservicemesh/networkservicemesh/sdk/common"
 	"github.com/sirupsen/logrus"
 )
 
+// FailureAction is what the pipeline does when an action fails
+type FailureAction string
+
+const (
+	// FailureAbort stops the pipeline, the remaining actions are not run
+	FailureAbort FailureAction = "abort"
+	// FailureRetry runs the action again, up to Retries times
+	FailureRetry FailureAction = "retry"
+	// FailureContinue goes on with the actions not depending on the failed one
+	FailureContinue FailureAction = "continue"
+)
+
+// default delay before the first retry, doubled on every further retry
+const defaultRetryBackoff = time.Second
+
+// default number of client actions connecting at the same time
+const defaultMaxParallelClients = 8
+
+// newNSMClient creates the NSM client of a client action
+var newNSMClient = func(ctx context.Context, nsConfig *common.NSConfiguration) (NSMConnector, error) {
+	return client.NewNSMClient(ctx, nsConfig)
+}
+
+// FailurePolicy describes the handling of a failed action
+type FailurePolicy struct {
+	Action FailureAction `yaml:"action"`
+	// Retries is the number of retries of the retry action
+	Retries int `yaml:"retries"`
+	// Backoff is the delay before the first retry, one second when not set
+	Backoff time.Duration `yaml:"backoff"`
+	// Then is abort or continue, applied when the retries are exhausted,
+	// abort when not set
+	Then FailureAction `yaml:"then"`
+}
+
+// ActionStatus is the outcome of an action
+type ActionStatus string
+
+const (
+	ActionSucceeded ActionStatus = "succeeded"
+	ActionFailed    ActionStatus = "failed"
+	// ActionSkipped is an action with a failed or skipped dependency
+	ActionSkipped ActionStatus = "skipped"
+	// ActionNotRun is an action left after the pipeline was aborted
+	ActionNotRun ActionStatus = "not run"
+)
+
+// ActionResult is the outcome of a single action of the pipeline
+type ActionResult struct {
+	Name     string
+	Status   ActionStatus
+	Attempts int
+	Duration time.Duration
+	Err      error
+	// Command is the result of the last command run of the action
+	Command *CommandResult
+}
+
+// InitReport lists the outcome of the init actions in the order they ran
+type InitReport struct {
+	Results []*ActionResult
+}
+
+// Succeeded reports whether all actions succeeded
+func (r *InitReport) Succeeded() bool {
+	for _, result := range r.Results {
+		if result.Status != ActionSucceeded {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *InitReport) String() string {
+	var b strings.Builder
+	for _, result := range r.Results {
+		fmt.Fprintf(&b, "%s: %s", result.Name, result.Status)
+		if result.Attempts > 1 {
+			fmt.Fprintf(&b, " after %d attempts", result.Attempts)
+		}
+		if result.Command != nil {
+			fmt.Fprintf(&b, " (exit code %d)", result.Command.ExitCode)
+		}
+		if result.Err != nil {
+			fmt.Fprintf(&b, ": %v", result.Err)
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
 // SingleClient is a single client instance combining the CNF configuration and the NS Client
 type SingleAction struct {
-	Action    *Action
-	nsmClient *client.NsmClient
+	Action *Action
+	// nsConfig is the own configuration of the NS Client of a client action
+	nsConfig  *common.NSConfiguration
+	nsmClient NSMConnector
 }
 
 // ProcessInitActions keeps the state of the initial setup
 type ProcessInitActions struct {
+	// InitActions are in the order they are run, the dependencies first
 	InitActions []*SingleAction
+	// MaxParallelClients limits the client actions connecting at the same
+	// time, defaultMaxParallelClients when not set
+	MaxParallelClients int
+	backend            UniversalCNFBackend
 }
 
-// NewProcessInitActions returns a new ProcessInitCommands struct
+// NewProcessInitActions returns a new ProcessInitCommands struct, the actions
+// are ordered by their dependencies and may only run the commands of the allowlist
 func NewProcessInitActions(backend UniversalCNFBackend, initactions []*Action,
-	nsConfig *common.NSConfiguration) *ProcessInitActions {
-	pia := &ProcessInitActions{}
+	nsConfig *common.NSConfiguration, allowlist []string) (*ProcessInitActions, error) {
+	ordered, err := orderActions(initactions)
+	if err != nil {
+		return nil, err
+	}
 
-	for _, a := range initactions {
-		var nsmClient *client.NsmClient
+	pia := &ProcessInitActions{backend: backend}
 
-		var err error
+	for _, a := range ordered {
+		a.allowlist = allowlist
+		sa := &SingleAction{Action: a}
 
 		if a.Client != nil {
 			c := a.Client
 
-			// Map the labels to a single comma separated string
-			labels := labelStringFromMap(c.Labels)
+			// Every client gets its own copy of the configuration, the labels
+			// are mapped to a single comma separated string
+			clientConfig := *nsConfig
+			clientConfig.ClientNetworkService = c.Name
+			clientConfig.ClientLabels = labelStringFromMap(c.Labels)
+			clientConfig.Routes = append([]string(nil), c.Routes...)
+			sa.nsConfig = &clientConfig
+
+			if c.Selector != "" {
+				var err error
+				if c.discovery, err = NewDiscoveryClient(); err != nil {
+					logrus.Errorf("Unable to connect to the network service discovery %v", err)
+				}
+			}
+		}
+
+		pia.InitActions = append(pia.InitActions, sa)
+	}
+
+	return pia, nil
+}
+
+// orderActions names the unnamed actions, checks the dependencies and the
+// failure policies and sorts the actions so that each one follows its
+// dependencies. Independent actions keep the configured order.
+func orderActions(actions []*Action) ([]*Action, error) {
+	var errs errors
+	byName := map[string]*Action{}
+	for i, a := range actions {
+		if a.Name == "" {
+			a.Name = fmt.Sprintf("action-%d", i)
+		}
+		if _, ok := byName[a.Name]; ok {
+			errs = append(errs, fmt.Errorf("action name %s is used more than once", a.Name))
+		}
+		byName[a.Name] = a
+		if err := a.OnFailure.validate(); err != nil {
+			errs = append(errs, fmt.Errorf("action %s: %v", a.Name, err))
+		}
+	}
+	for _, a := range actions {
+		for _, d := range a.DependsOn {
+			if _, ok := byName[d]; !ok {
+				errs = append(errs, fmt.Errorf("action %s depends on the unknown action %s", a.Name, d))
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return nil, errs
+	}
+
+	var ordered []*Action
+	done := map[string]bool{}
+	for len(ordered) < len(actions) {
+		progress := false
+		for _, a := range actions {
+			if done[a.Name] || !dependenciesDone(a, done) {
+				continue
+			}
+			ordered = append(ordered, a)
+			done[a.Name] = true
+			progress = true
+		}
+		if !progress {
+			var cycle []string
+			for _, a := range actions {
+				if !done[a.Name] {
+					cycle = append(cycle, a.Name)
+				}
+			}
+			return nil, fmt.Errorf("actions %s have cyclic dependencies", strings.Join(cycle, ", "))
+		}
+	}
+	return ordered, nil
+}
+
+func dependenciesDone(a *Action, done map[string]bool) bool {
+	for _, d := range a.DependsOn {
+		if !done[d] {
+			return false
+		}
+	}
+	return true
+}
+
+func (p *FailurePolicy) validate() error {
+	if p == nil {
+		return nil
+	}
+	switch p.Action {
+	case "", FailureAbort, FailureContinue:
+	case FailureRetry:
+		if p.Retries < 1 {
+			return fmt.Errorf("retry policy needs at least one retry")
+		}
+	default:
+		return fmt.Errorf("failure action %s is not one of %s, %s, %s", p.Action, FailureAbort, FailureRetry, FailureContinue)
+	}
+	switch p.Then {
+	case "", FailureAbort, FailureContinue:
+	default:
+		return fmt.Errorf("failure action %s after the retries is not one of %s, %s", p.Then, FailureAbort, FailureContinue)
+	}
+	return nil
+}
+
+// retries returns the number of retries and the delay before the first one
+func (p *FailurePolicy) retries() (int, time.Duration) {
+	if p == nil || p.Action != FailureRetry {
+		return 0, 0
+	}
+	backoff := p.Backoff
+	if backoff <= 0 {
+		backoff = defaultRetryBackoff
+	}
+	return p.Retries, backoff
+}
+
+// aborts reports whether the pipeline stops after the action finally failed
+func (p *FailurePolicy) aborts() bool {
+	if p == nil {
+		return true
+	}
+	if p.Action == FailureRetry {
+		return p.Then != FailureContinue
+	}
+	return p.Action != FailureContinue
+}
+
+// Process runs the init actions in dependency order and reports the outcome
+// of each. The actions depending on a failed action are skipped. Adjacent
+// client actions not depending on each other connect in parallel. The
+// returned error lists the failed actions that aborted the pipeline, the
+// failures their policy continues after are only in the report.
+func (pia *ProcessInitActions) Process(ctx context.Context, backend UniversalCNFBackend) (*InitReport, error) {
+	report := &InitReport{}
+	succeeded := map[string]bool{}
+	var errs errors
+	aborted := false
+
+	for i := 0; i < len(pia.InitActions); {
+		batch := pia.InitActions[i:parallelBatchEnd(pia.InitActions, i)]
+		i += len(batch)
 
-			// Call the NS Client initiation
-			nsConfig.ClientNetworkService = c.Name
-			nsConfig.ClientLabels = labels
-			nsConfig.Routes = c.Routes
+		var run []func()
+		results := make([]*ActionResult, len(batch))
+		for j, sa := range batch {
+			a := sa.Action
+			result := &ActionResult{Name: a.Name}
+			results[j] = result
+			report.Results = append(report.Results, result)
 
-			nsmClient, err = client.NewNSMClient(context.TODO(), nsConfig)
-			if err != nil {
-				logrus.Errorf("Unable to create the NSM client %v", err)
+			switch {
+			case aborted:
+				result.Status = ActionNotRun
+				continue
+			case !dependenciesDone(a, succeeded):
+				logrus.Warningf("Skipping action %s, its dependencies %v did not succeed", a.Name, a.DependsOn)
+				result.Status = ActionSkipped
+				continue
 			}
+
+			sa := sa
+			run = append(run, func() {
+				start := time.Now()
+				result.Err = sa.run(ctx, backend, result)
+				result.Duration = time.Since(start)
+				result.Command = sa.Action.commandResult
+			})
 		}
+		runBounded(pia.maxParallelClients(), run)
+
+		for j, result := range results {
+			if result.Status != "" {
+				continue
+			}
+			a := batch[j].Action
+			if result.Err == nil {
+				result.Status = ActionSucceeded
+				succeeded[a.Name] = true
+				continue
+			}
 
-		pia.InitActions = append(pia.InitActions, &SingleAction{
-			Action:    a,
-			nsmClient: nsmClient,
-		})
+			logrus.Errorf("Failed processing action %s: %v", a.Name, result.Err)
+			result.Status = ActionFailed
+			if a.OnFailure.aborts() {
+				errs = append(errs, fmt.Errorf("action %s: %v", a.Name, result.Err))
+				aborted = true
+			}
+		}
 	}
 
-	return pia
+	logrus.Infof("Init actions report:\n%s", report)
+	if len(errs) > 0 {
+		return report, errs
+	}
+	return report, nil
+}
+
+func (pia *ProcessInitActions) maxParallelClients() int {
+	if pia.MaxParallelClients > 0 {
+		return pia.MaxParallelClients
+	}
+	return defaultMaxParallelClients
 }
 
-// Process iterates over the init commands and applies them
-func (pia *ProcessInitActions) Process(ctx context.Context, backend UniversalCNFBackend) error {
-	for _, sa := range pia.InitActions {
-		if err := sa.Action.Process(ctx, backend, sa.nsmClient); err != nil {
-			logrus.Errorf("Failed processing %+v", sa.Action)
+// parallelBatchEnd returns the end of the batch of actions starting at start
+// that run in parallel: the adjacent client actions without a command that do
+// not depend on each other. Any other action is a batch of its own.
+func parallelBatchEnd(actions []*SingleAction, start int) int {
+	batch := map[string]bool{}
+	end := start
+	for ; end < len(actions); end++ {
+		a := actions[end].Action
+		if a.Client == nil || a.Command != nil {
+			break
+		}
+		if dependsOnAny(a, batch) {
+			break
+		}
+		batch[a.Name] = true
+	}
+	if end == start {
+		return start + 1
+	}
+	return end
+}
+
+func dependsOnAny(a *Action, names map[string]bool) bool {
+	for _, d := range a.DependsOn {
+		if names[d] {
+			return true
+		}
+	}
+	return false
+}
+
+// runBounded runs the functions with at most limit of them at the same time
+// and waits for all of them
+func runBounded(limit int, run []func()) {
+	if len(run) == 1 {
+		run[0]()
+		return
+	}
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, limit)
+	for _, f := range run {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(f func()) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			f()
+		}(f)
+	}
+	wg.Wait()
+}
+
+// run processes the action and retries it according to its failure policy,
+// the NSM client of a client action is created on the first attempt
+func (sa *SingleAction) run(ctx context.Context, backend UniversalCNFBackend, result *ActionResult) error {
+	retries, backoff := sa.Action.OnFailure.retries()
+	for {
+		result.Attempts++
+		err := sa.process(ctx, backend)
+		if err == nil || result.Attempts > retries {
 			return err
 		}
+
+		logrus.Warningf("Action %s failed, retrying in %v: %v", sa.Action.Name, backoff, err)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		backoff *= 2
 	}
+}
 
-	return nil
+func (sa *SingleAction) process(ctx context.Context, backend UniversalCNFBackend) error {
+	if sa.Action.Client != nil && sa.nsmClient == nil {
+		nsmClient, err := newNSMClient(ctx, sa.nsConfig)
+		if err != nil {
+			return fmt.Errorf("unable to create the NSM client: %v", err)
+		}
+		sa.nsmClient = nsmClient
+	}
+	return sa.Action.Process(ctx, backend, sa.nsmClient)
 }
 
-// Cleanup - cleans up before exit
+// Cleanup - cleans up before exit, the actions are undone in reverse order
 func (pia *ProcessInitActions) Cleanup() {
-	for _, sa := range pia.InitActions {
-		if err := sa.Action.Cleanup(); err != nil {
-			logrus.Errorf("Failed cleaning %+v", sa.Action)
+	for i := len(pia.InitActions) - 1; i >= 0; i-- {
+		a := pia.InitActions[i].Action
+		if err := a.Cleanup(context.TODO(), pia.backend); err != nil {
+			logrus.Errorf("Failed cleaning action %s: %v", a.Name, err)
 		}
 	}
 }
@@ -0,0 +1,305 @@
+package config
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/networkservicemesh/networkservicemesh/controlplane/api/connection"
+	"github.com/networkservicemesh/networkservicemesh/sdk/common"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/cisco-app-networking/nsm-nse/pkg/nseconfig"
+	"github.com/cisco-app-networking/nsm-nse/pkg/universal-cnf/dataplane"
+)
+
+type testBackend struct{}
+
+func (testBackend) NewDPConfig() *dataplane.Config                { return &dataplane.Config{} }
+func (testBackend) NewUniversalCNFBackend() error                 { return nil }
+func (testBackend) ProcessDPConfig(*dataplane.Config, bool) error { return nil }
+func (testBackend) ProcessClient(*dataplane.Config, string, nseconfig.Interface, *connection.Connection) error {
+	return nil
+}
+func (testBackend) SetupEndpoint(*dataplane.Config, *nseconfig.Endpoint) error { return nil }
+func (testBackend) ProcessEndpoint(*dataplane.Config, *nseconfig.Endpoint, *connection.Connection) error {
+	return nil
+}
+func (testBackend) ReleaseEndpoint(*nseconfig.Endpoint, *connection.Connection) {}
+
+func shellAction(name, script string, dependsOn ...string) *Action {
+	return &Action{
+		Name:      name,
+		DependsOn: dependsOn,
+		Command:   &Command{Name: "sh", Args: []string{"-c", script}},
+	}
+}
+
+func statuses(report *InitReport) map[string]ActionStatus {
+	result := map[string]ActionStatus{}
+	for _, r := range report.Results {
+		result[r.Name] = r.Status
+	}
+	return result
+}
+
+func TestInitActionsOrder(t *testing.T) {
+	pia, err := NewProcessInitActions(testBackend{}, []*Action{
+		shellAction("routes", "true", "interfaces"),
+		shellAction("interfaces", "true"),
+		shellAction("", "true"),
+	}, &common.NSConfiguration{}, nil)
+	require.NoError(t, err)
+
+	var names []string
+	for _, sa := range pia.InitActions {
+		names = append(names, sa.Action.Name)
+	}
+	assert.Equal(t, []string{"interfaces", "action-2", "routes"}, names)
+
+	report, err := pia.Process(context.Background(), testBackend{})
+	require.NoError(t, err)
+	assert.True(t, report.Succeeded())
+}
+
+func TestInitActionsInvalid(t *testing.T) {
+	for name, tc := range map[string]struct {
+		actions  []*Action
+		expected string
+	}{
+		"unknown-dependency": {
+			actions:  []*Action{shellAction("a", "true", "b")},
+			expected: "action a depends on the unknown action b",
+		},
+		"duplicate-name": {
+			actions:  []*Action{shellAction("a", "true"), shellAction("a", "true")},
+			expected: "action name a is used more than once",
+		},
+		"cycle": {
+			actions:  []*Action{shellAction("a", "true", "b"), shellAction("b", "true", "a"), shellAction("c", "true")},
+			expected: "actions a, b have cyclic dependencies",
+		},
+		"retry-without-retries": {
+			actions:  []*Action{{Name: "a", OnFailure: &FailurePolicy{Action: FailureRetry}}},
+			expected: "action a: retry policy needs at least one retry",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := NewProcessInitActions(testBackend{}, tc.actions, &common.NSConfiguration{}, nil)
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tc.expected)
+		})
+	}
+}
+
+func TestInitActionsFailurePolicy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "init-actions")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	marker := filepath.Join(dir, "marker")
+
+	for name, tc := range map[string]struct {
+		actions  []*Action
+		expected map[string]ActionStatus
+		attempts map[string]int
+		aborted  bool
+	}{
+		"abort": {
+			actions: []*Action{
+				shellAction("a", "exit 1"),
+				shellAction("b", "true"),
+			},
+			expected: map[string]ActionStatus{"a": ActionFailed, "b": ActionNotRun},
+			aborted:  true,
+		},
+		"continue": {
+			actions: []*Action{
+				{Name: "a", Command: &Command{Name: "false"}, OnFailure: &FailurePolicy{Action: FailureContinue}},
+				shellAction("b", "true", "a"),
+				shellAction("c", "true"),
+			},
+			expected: map[string]ActionStatus{"a": ActionFailed, "b": ActionSkipped, "c": ActionSucceeded},
+		},
+		"retry": {
+			actions: []*Action{
+				{
+					Name:      "a",
+					Command:   &Command{Name: "sh", Args: []string{"-c", "test -f " + marker + " || { touch " + marker + "; exit 1; }"}},
+					OnFailure: &FailurePolicy{Action: FailureRetry, Retries: 2, Backoff: time.Millisecond},
+				},
+				shellAction("b", "true", "a"),
+			},
+			expected: map[string]ActionStatus{"a": ActionSucceeded, "b": ActionSucceeded},
+			attempts: map[string]int{"a": 2},
+		},
+		"retry-exhausted": {
+			actions: []*Action{
+				{
+					Name:      "a",
+					Command:   &Command{Name: "false"},
+					OnFailure: &FailurePolicy{Action: FailureRetry, Retries: 2, Backoff: time.Millisecond, Then: FailureContinue},
+				},
+				shellAction("b", "true"),
+			},
+			expected: map[string]ActionStatus{"a": ActionFailed, "b": ActionSucceeded},
+			attempts: map[string]int{"a": 3},
+		},
+		"timeout": {
+			actions: []*Action{
+				{Name: "a", Command: &Command{Name: "sleep", Args: []string{"10"}}, Timeout: 50 * time.Millisecond},
+			},
+			expected: map[string]ActionStatus{"a": ActionFailed},
+			aborted:  true,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			pia, err := NewProcessInitActions(testBackend{}, tc.actions, &common.NSConfiguration{}, nil)
+			require.NoError(t, err)
+
+			report, err := pia.Process(context.Background(), testBackend{})
+			assert.Equal(t, tc.expected, statuses(report))
+			// only the failures aborting the pipeline are errors
+			assert.Equal(t, tc.aborted, err != nil)
+			for _, r := range report.Results {
+				if attempts, ok := tc.attempts[r.Name]; ok {
+					assert.Equal(t, attempts, r.Attempts, r.Name)
+				}
+			}
+		})
+	}
+}
+
+type recordingBackend struct {
+	testBackend
+	calls []string
+}
+
+func (b *recordingBackend) ProcessDPConfig(dpconfig *dataplane.Config, update bool) error {
+	op := "delete"
+	if update {
+		op = "update"
+	}
+	b.calls = append(b.calls, fmt.Sprintf("%s %d", op, len(dpconfig.Routes)))
+	return nil
+}
+
+func TestInitActionsCleanup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "init-actions")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	log := filepath.Join(dir, "log")
+	logAction := func(name string, routes int, dependsOn ...string) *Action {
+		a := shellAction(name, "true", dependsOn...)
+		a.DPConfig = &dataplane.Config{Routes: make([]*dataplane.Route, routes)}
+		a.CleanupCommand = &Command{Name: "sh", Args: []string{"-c", "echo " + name + " >> " + log}}
+		return a
+	}
+
+	backend := &recordingBackend{}
+	pia, err := NewProcessInitActions(backend, []*Action{
+		logAction("second", 2, "first"),
+		logAction("first", 1),
+		{Name: "failing", Command: &Command{Name: "false"}, CleanupCommand: &Command{Name: "sh", Args: []string{"-c", "echo failing >> " + log}},
+			OnFailure: &FailurePolicy{Action: FailureContinue}},
+		logAction("skipped", 3, "failing"),
+	}, &common.NSConfiguration{}, nil)
+	require.NoError(t, err)
+
+	// the failing action continues, the pipeline is not aborted
+	report, err := pia.Process(context.Background(), backend)
+	require.NoError(t, err)
+	assert.False(t, report.Succeeded())
+	assert.Equal(t, []string{"update 1", "update 2"}, backend.calls)
+
+	backend.calls = nil
+	pia.Cleanup()
+	assert.Equal(t, []string{"delete 2", "delete 1"}, backend.calls)
+
+	// the failed command ran, so its cleanup runs, the skipped action is not cleaned up
+	out, err := ioutil.ReadFile(log)
+	require.NoError(t, err)
+	assert.Equal(t, "second\nfailing\nfirst\n", string(out))
+
+	// a second cleanup does nothing
+	backend.calls = nil
+	pia.Cleanup()
+	assert.Empty(t, backend.calls)
+}
+
+func TestInitActionsClientConfig(t *testing.T) {
+	nsConfig := &common.NSConfiguration{NsmServerSocket: "nsm.sock"}
+	pia, err := NewProcessInitActions(testBackend{}, []*Action{
+		{Name: "a", Client: &Client{Name: "service-a", Labels: map[string]string{"app": "a"}, Routes: []string{"10.0.0.0/24"}}},
+		{Name: "b", Client: &Client{Name: "service-b", Labels: map[string]string{"app": "b"}}},
+		shellAction("c", "true"),
+	}, nsConfig, nil)
+	require.NoError(t, err)
+
+	a, b := pia.InitActions[0].nsConfig, pia.InitActions[1].nsConfig
+	assert.Equal(t, "service-a", a.ClientNetworkService)
+	assert.Equal(t, "app=a", a.ClientLabels)
+	assert.Equal(t, []string{"10.0.0.0/24"}, a.Routes)
+	assert.Equal(t, "service-b", b.ClientNetworkService)
+	assert.Equal(t, "app=b", b.ClientLabels)
+	assert.Empty(t, b.Routes)
+	assert.Equal(t, "nsm.sock", b.NsmServerSocket)
+	assert.Nil(t, pia.InitActions[2].nsConfig)
+
+	// the shared configuration is left alone
+	assert.Equal(t, &common.NSConfiguration{NsmServerSocket: "nsm.sock"}, nsConfig)
+}
+
+func TestParallelBatchEnd(t *testing.T) {
+	client := func(name string, dependsOn ...string) *SingleAction {
+		return &SingleAction{Action: &Action{Name: name, DependsOn: dependsOn, Client: &Client{Name: name}}}
+	}
+	command := &SingleAction{Action: shellAction("cmd", "true")}
+	withCommand := client("with-command")
+	withCommand.Action.Command = &Command{Name: "true"}
+
+	actions := []*SingleAction{command, client("a"), client("b"), client("c", "a"), withCommand, client("d")}
+	var batches [][]string
+	for i := 0; i < len(actions); {
+		end := parallelBatchEnd(actions, i)
+		var names []string
+		for _, sa := range actions[i:end] {
+			names = append(names, sa.Action.Name)
+		}
+		batches = append(batches, names)
+		i = end
+	}
+	assert.Equal(t, [][]string{{"cmd"}, {"a", "b"}, {"c"}, {"with-command"}, {"d"}}, batches)
+}
+
+func TestRunBounded(t *testing.T) {
+	var mu sync.Mutex
+	running, maxRunning, ran := 0, 0, 0
+	var run []func()
+	for i := 0; i < 10; i++ {
+		run = append(run, func() {
+			mu.Lock()
+			running++
+			if running > maxRunning {
+				maxRunning = running
+			}
+			mu.Unlock()
+
+			time.Sleep(10 * time.Millisecond)
+
+			mu.Lock()
+			running--
+			ran++
+			mu.Unlock()
+		})
+	}
+
+	runBounded(3, run)
+	assert.Equal(t, 10, ran)
+	assert.Equal(t, 3, maxRunning)
+}
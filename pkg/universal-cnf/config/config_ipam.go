@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"os"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/cisco-app-networking/nsm-nse/api/ipam/ipprovider"
@@ -18,7 +19,7 @@ import (
 )
 
 type IpamService interface {
-	AllocateSubnet(ucnfEndpoint *nseconfig.Endpoint) (string, error)
+	AllocateSubnets(ucnfEndpoint *nseconfig.Endpoint) ([]string, error)
 }
 
 type IpamServiceImpl struct {
@@ -26,59 +27,112 @@ type IpamServiceImpl struct {
 	RegisteredSubnets chan *ipprovider.Subnet
 }
 
-func (i *IpamServiceImpl) AllocateSubnet(ucnfEndpoint *nseconfig.Endpoint) (string, error) {
-	var subnet *ipprovider.Subnet
-	for j := 0; j < 6; j++ {
-		var err error
-		subnet, err = i.IpamAllocator.AllocateSubnet(context.Background(), &ipprovider.SubnetRequest{
+// attempts of a subnet allocation and the delay between them
+var (
+	ipamAllocateAttempts   = 6
+	ipamAllocateRetryDelay = 60 * time.Second
+)
+
+// AllocateSubnets allocates one subnet for each prefix pool, and so for each
+// address family, of the endpoint. The families are allocated concurrently,
+// when one fails the subnets allocated for the others are freed.
+func (i *IpamServiceImpl) AllocateSubnets(ucnfEndpoint *nseconfig.Endpoint) ([]string, error) {
+	pools := ucnfEndpoint.VL3.IPAM.Pools()
+	allocated := make([]*ipprovider.Subnet, len(pools))
+	g, ctx := errgroup.WithContext(context.Background())
+	for j, pool := range pools {
+		j, pool := j, pool
+		g.Go(func() error {
+			subnet, err := i.allocateSubnet(ctx, ucnfEndpoint, pool)
+			allocated[j] = subnet
+			return err
+		})
+	}
+	if err := g.Wait(); err != nil {
+		for _, subnet := range allocated {
+			if subnet == nil {
+				continue
+			}
+			if _, err := i.IpamAllocator.FreeSubnet(context.Background(), subnet); err != nil {
+				logrus.Errorf("Unable to free the subnet %s: %v", subnet.GetPrefix().GetSubnet(), err)
+			}
+		}
+		return nil, err
+	}
+
+	var subnets []string
+	for _, subnet := range allocated {
+		i.RegisteredSubnets <- subnet
+		subnets = append(subnets, subnet.Prefix.Subnet)
+	}
+	return subnets, nil
+}
+
+func (i *IpamServiceImpl) allocateSubnet(ctx context.Context, ucnfEndpoint *nseconfig.Endpoint, pool nseconfig.PrefixPool) (*ipprovider.Subnet, error) {
+	family := ipprovider.IpFamily_IPV4
+	if pool.Family == nseconfig.IPv6 {
+		family = ipprovider.IpFamily_IPV6
+	}
+
+	for j := 1; ; j++ {
+		subnet, err := i.IpamAllocator.AllocateSubnet(ctx, &ipprovider.SubnetRequest{
 			Identifier: &ipprovider.Identifier{
 				Fqdn:               ucnfEndpoint.NseControl.Address,
-				Name:               GetEndpointName(),
+				Name:               GetEndpointName(ucnfEndpoint.ClusterName),
 				ConnectivityDomain: ucnfEndpoint.NseControl.ConnectivityDomain,
 			},
-			AddrFamily: &ipprovider.IpFamily{Family: ipprovider.IpFamily_IPV4},
-			PrefixLen:  uint32(ucnfEndpoint.VL3.IPAM.PrefixLength),
+			AddrFamily: &ipprovider.IpFamily{Family: family},
+			PrefixLen:  uint32(pool.PrefixLength),
 		})
-		if err != nil {
-			if j == 5 {
-				return "", fmt.Errorf("ipam allocation not successful: %v", err)
-
-			}
-			logrus.Errorf("ipam allocation not successful: %v \n waiting 60 seconds before retrying \n", err)
-			time.Sleep(60 * time.Second)
-		} else {
-			break
+		if err == nil {
+			return subnet, nil
+		}
+		if j == ipamAllocateAttempts {
+			return nil, fmt.Errorf("ipam allocation not successful: %v", err)
+		}
+		logrus.Errorf("ipam allocation not successful: %v \n waiting %v before retrying \n", err, ipamAllocateRetryDelay)
+		select {
+		case <-time.After(ipamAllocateRetryDelay):
+		case <-ctx.Done():
+			return nil, ctx.Err()
 		}
 	}
-	i.RegisteredSubnets <- subnet
-	return subnet.Prefix.Subnet, nil
 }
 
 func (i *IpamServiceImpl) Renew(ctx context.Context, errorHandler func(err error)) error {
 	g, ctx := errgroup.WithContext(ctx)
+	var lock sync.Mutex
 	var subnets = make(map[string]*ipprovider.Subnet)
 	for {
 		select {
 		case subnet := <-i.RegisteredSubnets:
 			g.Go(func() error {
-				for range time.Tick(time.Duration(subnet.LeaseTimeout-1) * time.Hour) {
+				tick := time.Tick(time.Duration(subnet.LeaseTimeout-1) * time.Hour)
+				for {
+					select {
+					case <-tick:
+					case <-ctx.Done():
+						return nil
+					}
 					_, err := i.IpamAllocator.RenewSubnetLease(ctx, subnet)
 					if err != nil {
 						errorHandler(err)
 					}
 
-					subnets[subnet.Identifier.Name] = subnet
+					lock.Lock()
+					subnets[subnet.Identifier.Name+"/"+subnet.Prefix.GetAddrFamily().GetFamily().String()] = subnet
+					lock.Unlock()
 				}
-				return nil
 			})
 		case <-ctx.Done():
 			logrus.Info("Cleaning registered subnets")
 			close(i.RegisteredSubnets)
-			err := i.Cleanup(subnets)
-			if err != nil {
-				errorHandler(err)
+			// the renewals stop with ctx, the subnets are not written anymore
+			err := g.Wait()
+			if cerr := i.Cleanup(subnets); cerr != nil {
+				errorHandler(cerr)
 			}
-			return g.Wait()
+			return err
 		}
 	}
 }
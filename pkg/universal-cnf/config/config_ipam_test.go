@@ -0,0 +1,97 @@
+package config
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+
+	"github.com/cisco-app-networking/nsm-nse/api/ipam/ipprovider"
+	"github.com/cisco-app-networking/nsm-nse/pkg/nseconfig"
+)
+
+// fakeAllocator allocates the subnets of the families it does not fail and
+// records the freed ones
+type fakeAllocator struct {
+	ipprovider.AllocatorClient
+	sync.Mutex
+	fail  map[ipprovider.IpFamily_Family]bool
+	freed []string
+}
+
+func (a *fakeAllocator) AllocateSubnet(ctx context.Context, in *ipprovider.SubnetRequest, opts ...grpc.CallOption) (*ipprovider.Subnet, error) {
+	family := in.GetAddrFamily().GetFamily()
+	if a.fail[family] {
+		return nil, fmt.Errorf("no %s subnet left", family)
+	}
+	prefix := "10.60.1.0/24"
+	if family == ipprovider.IpFamily_IPV6 {
+		prefix = "fd00:60:1::/64"
+	}
+	return &ipprovider.Subnet{Identifier: in.GetIdentifier(), Prefix: &ipprovider.IpPrefix{Subnet: prefix}}, nil
+}
+
+func (a *fakeAllocator) FreeSubnet(ctx context.Context, in *ipprovider.Subnet, opts ...grpc.CallOption) (*ipprovider.Empty, error) {
+	a.Lock()
+	defer a.Unlock()
+	a.freed = append(a.freed, in.GetPrefix().GetSubnet())
+	return &ipprovider.Empty{}, nil
+}
+
+func TestAllocateSubnets(t *testing.T) {
+	defer func(attempts int, delay time.Duration) {
+		ipamAllocateAttempts, ipamAllocateRetryDelay = attempts, delay
+	}(ipamAllocateAttempts, ipamAllocateRetryDelay)
+	ipamAllocateAttempts, ipamAllocateRetryDelay = 2, time.Millisecond
+
+	e := &nseconfig.Endpoint{NseControl: &nseconfig.NseControl{}, VL3: nseconfig.VL3{IPAM: nseconfig.IPAM{
+		DefaultPrefixPool: "10.60.0.0/16",
+		PrefixLength:      24,
+		PrefixPools:       []nseconfig.PrefixPool{{Prefix: "fd00:60::/48", PrefixLength: 64}},
+	}}}
+
+	allocator := &fakeAllocator{}
+	ipam := &IpamServiceImpl{IpamAllocator: allocator, RegisteredSubnets: make(chan *ipprovider.Subnet, 2)}
+	subnets, err := ipam.AllocateSubnets(e)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"10.60.1.0/24", "fd00:60:1::/64"}, subnets)
+	assert.Len(t, ipam.RegisteredSubnets, 2)
+
+	// the IPv4 subnet is freed when the IPv6 one is not allocated
+	allocator = &fakeAllocator{fail: map[ipprovider.IpFamily_Family]bool{ipprovider.IpFamily_IPV6: true}}
+	ipam = &IpamServiceImpl{IpamAllocator: allocator, RegisteredSubnets: make(chan *ipprovider.Subnet, 2)}
+	_, err = ipam.AllocateSubnets(e)
+	assert.EqualError(t, err, "ipam allocation not successful: no IPV6 subnet left")
+	assert.Equal(t, []string{"10.60.1.0/24"}, allocator.freed)
+	assert.Empty(t, ipam.RegisteredSubnets, "the freed subnet is not renewed")
+}
+
+func TestRenewStops(t *testing.T) {
+	ipam := &IpamServiceImpl{IpamAllocator: &fakeAllocator{}, RegisteredSubnets: make(chan *ipprovider.Subnet, 2)}
+	for _, prefix := range []string{"10.60.1.0/24", "fd00:60:1::/64"} {
+		ipam.RegisteredSubnets <- &ipprovider.Subnet{
+			Identifier:   &ipprovider.Identifier{Name: "vl3"},
+			Prefix:       &ipprovider.IpPrefix{Subnet: prefix},
+			LeaseTimeout: 24,
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- ipam.Renew(ctx, func(err error) { t.Error(err) }) }()
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+
+	// the renewals stop with the context before the subnets are cleaned up
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("Renew did not return")
+	}
+}
@@ -0,0 +1,172 @@
+package config
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/cisco-app-networking/nsm-nse/pkg/nseconfig"
+	"github.com/cisco-app-networking/nsm-nse/pkg/universal-cnf/dataplane"
+)
+
+func TestUniversalCNFConfigLoad(t *testing.T) {
+	cfg := &UniversalCNFConfig{}
+	require.NoError(t, cfg.Load([]byte(testConfig1), nseconfig.FormatYAML))
+
+	require.Len(t, cfg.Actions, 2)
+	setup := cfg.Actions[0]
+	assert.Equal(t, "setup", setup.Name)
+	assert.Equal(t, &Command{Name: "vppctl", Args: []string{"show", "version"}, Timeout: 10 * time.Second}, setup.Command)
+	assert.Equal(t, &FailurePolicy{Action: FailureRetry, Retries: 3}, setup.OnFailure)
+
+	upstream := cfg.Actions[1]
+	assert.Equal(t, []string{"setup"}, upstream.DependsOn)
+	assert.Equal(t, "packet-filtering", upstream.Client.Name)
+	assert.Equal(t, "client0", upstream.Client.IfName)
+	assert.Equal(t, map[string]string{"app": "packet-filter"}, upstream.Client.Labels)
+	// the dpconfig of unversioned files is the VPP configuration
+	require.Len(t, upstream.DPConfig.VPP.GetInterfaces(), 1)
+	assert.Equal(t, "loop0", upstream.DPConfig.VPP.Interfaces[0].Name)
+
+	assert.Equal(t, []string{"vppctl"}, cfg.CommandAllowlist)
+	assert.Equal(t, 4, cfg.MaxParallelClients)
+	require.Len(t, cfg.Endpoints, 1)
+	assert.Equal(t, "endpoint0", cfg.Endpoints[0].VL3.Ifname)
+}
+
+func TestUniversalCNFConfigLoadErrors(t *testing.T) {
+	cfg := &UniversalCNFConfig{}
+	err := cfg.Load([]byte(testConfig2), nseconfig.FormatYAML)
+	require.Error(t, err)
+	assert.Equal(t, "validation failed with errors: \n"+
+		"\tline 6, column 21: max parallel clients -2 is negative\n"+
+		"\tline 5, column 7: unknown field initActions[0].command.nmae\n", err.Error())
+
+	cfg = &UniversalCNFConfig{}
+	err = cfg.Load([]byte(testConfig3), nseconfig.FormatYAML)
+	require.Error(t, err)
+	assert.Equal(t, "validation failed with errors: \n"+
+		"\tactions a, b have cyclic dependencies\n", err.Error())
+}
+
+func TestUniversalCNFConfigDPConfig(t *testing.T) {
+	cfg := &UniversalCNFConfig{}
+	require.NoError(t, cfg.Load([]byte(testConfig4), nseconfig.FormatYAML))
+
+	require.Len(t, cfg.Actions, 1)
+	assert.Equal(t, &dataplane.Config{
+		Interfaces: []*dataplane.Interface{
+			{Name: "tap0", Type: dataplane.InterfaceTap, Addresses: []string{"10.80.0.1/24"}, HostIfName: "ucnf0"},
+		},
+		Routes: []*dataplane.Route{{Dst: "10.90.0.0/16", NextHop: "10.80.0.2", Interface: "tap0"}},
+		NAT: dataplane.NAT{
+			Pools:      []*dataplane.NATPool{{FirstIP: "192.168.1.10"}},
+			Interfaces: []*dataplane.NATInterface{{Name: "tap0", Inside: true}},
+		},
+		ACLs: []*dataplane.ACL{{
+			Name: "web",
+			Rules: []*dataplane.ACLRule{
+				{Action: dataplane.ACLPermit, Protocol: dataplane.ProtocolTCP, DstPorts: &dataplane.Range{First: 80, Last: 80}},
+				{Action: dataplane.ACLDeny},
+			},
+			Ingress: []string{"tap0"},
+		}},
+	}, cfg.Actions[0].DPConfig)
+
+	cfg = &UniversalCNFConfig{}
+	err := cfg.Load([]byte(testConfig5), nseconfig.FormatYAML)
+	require.Error(t, err)
+	assert.Equal(t, "validation failed with errors: \n"+
+		"\tinitActions[0].dpconfig: interfaces[0]: interface type \"veth\" is not one of memif, kernel, tap, loopback; "+
+		"acls[0].rules[0]: ports need the tcp or udp protocol\n", err.Error())
+}
+
+const testConfig1 = `
+initactions:
+  - name: setup
+    command:
+      name: vppctl
+      args: [show, version]
+      timeout: 10s
+    onFailure:
+      action: retry
+      retries: 3
+  - dependsOn: [setup]
+    client:
+      name: packet-filtering
+      ifname: client0
+      labels:
+        app: packet-filter
+    dpconfig:
+      interfaces:
+        - name: loop0
+commandAllowlist: [vppctl]
+maxParallelClients: 4
+endpoints:
+  - name: packet-filtering
+    ifname: endpoint0
+    ipam:
+      prefixpool: 10.60.3.0/24
+`
+
+const testConfig2 = `
+apiVersion: v1
+initActions:
+  - command:
+      nmae: vppctl
+maxParallelClients: -2
+`
+
+const testConfig3 = `
+apiVersion: v1
+initActions:
+  - name: a
+    dependsOn: [b]
+  - name: b
+    dependsOn: [a]
+`
+
+const testConfig4 = `
+apiVersion: v1
+initActions:
+  - dpconfig:
+      interfaces:
+        - name: tap0
+          type: tap
+          hostIfName: ucnf0
+          addresses: [10.80.0.1/24]
+      routes:
+        - dst: 10.90.0.0/16
+          nextHop: 10.80.0.2
+          interface: tap0
+      nat:
+        pools:
+          - firstIp: 192.168.1.10
+        interfaces:
+          - name: tap0
+            inside: true
+      acls:
+        - name: web
+          ingress: [tap0]
+          rules:
+            - action: permit
+              protocol: tcp
+              dstPorts: {first: 80, last: 80}
+            - action: deny
+`
+
+const testConfig5 = `
+apiVersion: v1
+initActions:
+  - dpconfig:
+      interfaces:
+        - name: veth0
+          type: veth
+      acls:
+        - name: web
+          rules:
+            - action: permit
+              srcPorts: {first: 80, last: 80}
+`
@@ -0,0 +1,61 @@
+package config
+
+import (
+	"context"
+	"os"
+	"sort"
+
+	"github.com/networkservicemesh/networkservicemesh/controlplane/api/registry"
+	"github.com/networkservicemesh/networkservicemesh/pkg/tools"
+
+	"github.com/cisco-app-networking/nsm-nse/pkg/nseconfig"
+)
+
+// address of the NSM registry, overridden by NSREGISTRY_ADDR and NSREGISTRY_PORT
+const (
+	nsRegistryAddrEnv     = "NSREGISTRY_ADDR"
+	nsRegistryPortEnv     = "NSREGISTRY_PORT"
+	defaultNsRegistryAddr = "nsmgr.nsm-system"
+	defaultNsRegistryPort = "5000"
+)
+
+// NewDiscoveryClient connects to the network service discovery of the NSM registry
+func NewDiscoveryClient() (registry.NetworkServiceDiscoveryClient, error) {
+	addr, ok := os.LookupEnv(nsRegistryAddrEnv)
+	if !ok {
+		addr = defaultNsRegistryAddr
+	}
+	port, ok := os.LookupEnv(nsRegistryPortEnv)
+	if !ok {
+		port = defaultNsRegistryPort
+	}
+
+	conn, err := tools.DialTCP(addr + ":" + port)
+	if err != nil {
+		return nil, err
+	}
+	return registry.NewNetworkServiceDiscoveryClient(conn), nil
+}
+
+// FindEndpoints returns the endpoints of the network service selected by the
+// selector, sorted by name
+func FindEndpoints(ctx context.Context, discovery registry.NetworkServiceDiscoveryClient,
+	networkService string, selector nseconfig.Selector) ([]*registry.NetworkServiceEndpoint, error) {
+	response, err := discovery.FindNetworkService(ctx, &registry.FindNetworkServiceRequest{
+		NetworkServiceName: networkService,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var endpoints []*registry.NetworkServiceEndpoint
+	for _, e := range response.GetNetworkServiceEndpoints() {
+		if selector.Matches(e.GetLabels()) {
+			endpoints = append(endpoints, e)
+		}
+	}
+	sort.Slice(endpoints, func(i, j int) bool {
+		return endpoints[i].GetName() < endpoints[j].GetName()
+	})
+	return endpoints, nil
+}
@@ -0,0 +1,41 @@
+package config
+
+import (
+	"context"
+	"testing"
+
+	"github.com/networkservicemesh/networkservicemesh/controlplane/api/registry"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+
+	"github.com/cisco-app-networking/nsm-nse/pkg/nseconfig"
+)
+
+type fakeDiscovery struct {
+	endpoints []*registry.NetworkServiceEndpoint
+}
+
+func (d *fakeDiscovery) FindNetworkService(ctx context.Context, in *registry.FindNetworkServiceRequest,
+	opts ...grpc.CallOption) (*registry.FindNetworkServiceResponse, error) {
+	return &registry.FindNetworkServiceResponse{NetworkServiceEndpoints: d.endpoints}, nil
+}
+
+func TestFindEndpoints(t *testing.T) {
+	discovery := &fakeDiscovery{endpoints: []*registry.NetworkServiceEndpoint{
+		{Name: "vl3-c", Labels: map[string]string{"zone": "a"}},
+		{Name: "vl3-b", Labels: map[string]string{"zone": "b"}},
+		{Name: "vl3-a", Labels: map[string]string{"zone": "a"}},
+	}}
+
+	selector, err := nseconfig.ParseSelector("zone=a")
+	require.NoError(t, err)
+	endpoints, err := FindEndpoints(context.Background(), discovery, "vl3-service", selector)
+	require.NoError(t, err)
+
+	var names []string
+	for _, e := range endpoints {
+		names = append(names, e.GetName())
+	}
+	assert.Equal(t, []string{"vl3-a", "vl3-c"}, names)
+}
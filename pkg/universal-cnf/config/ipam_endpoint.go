@@ -0,0 +1,242 @@
+package config
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/golang/protobuf/ptypes/empty"
+	"github.com/networkservicemesh/networkservicemesh/controlplane/api/connection"
+	"github.com/networkservicemesh/networkservicemesh/controlplane/api/networkservice"
+	"github.com/networkservicemesh/networkservicemesh/sdk/endpoint"
+
+	"github.com/cisco-app-networking/nsm-nse/pkg/universal-cnf/dataplane"
+)
+
+// point-to-point subnet lengths of the connections, the source and the
+// destination address are the first two hosts of the subnet
+const (
+	p2pPrefixLengthIPv4 = 30
+	p2pPrefixLengthIPv6 = 126
+)
+
+// ipamEndpoint assigns the connection addresses from the endpoint subnets,
+// a point-to-point subnet of the first subnet of each address family. The
+// NSM IP context carries a single address pair, the one of the family of the
+// first subnet, the addresses of the other families are carried by the
+// dataplane.SrcIPAddrsLabel and dataplane.DstIPAddrsLabel labels.
+type ipamEndpoint struct {
+	sync.Mutex
+	prefixes  []*net.IPNet
+	allocated map[string]*net.IPNet
+	byConn    map[string][]*net.IPNet
+}
+
+func newIpamEndpoint(prefixes []string) (*ipamEndpoint, error) {
+	ipam := &ipamEndpoint{
+		allocated: map[string]*net.IPNet{},
+		byConn:    map[string][]*net.IPNet{},
+	}
+	families := map[bool]bool{}
+	for _, p := range prefixes {
+		_, prefix, err := net.ParseCIDR(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid endpoint subnet %s: %v", p, err)
+		}
+		if ipv6 := prefix.IP.To4() == nil; !families[ipv6] {
+			families[ipv6] = true
+			ipam.prefixes = append(ipam.prefixes, prefix)
+		}
+	}
+	if len(ipam.prefixes) == 0 {
+		return nil, fmt.Errorf("no endpoint subnets")
+	}
+	return ipam, nil
+}
+
+// Request assigns the source and destination addresses of the connection
+func (ie *ipamEndpoint) Request(ctx context.Context,
+	request *networkservice.NetworkServiceRequest) (*connection.Connection, error) {
+	conn := request.GetConnection()
+	ipContext := conn.GetContext().GetIpContext()
+	if ipContext == nil {
+		return nil, fmt.Errorf("connection %s has no IP context", conn.GetId())
+	}
+
+	known := ie.known(conn.GetId())
+	subnets, err := ie.allocate(conn.GetId(), ipContext.GetExcludedPrefixes())
+	if err != nil {
+		return nil, err
+	}
+
+	var srcIPs, dstIPs []string
+	for _, subnet := range subnets[1:] {
+		srcIPs = append(srcIPs, hostAddress(subnet, 1).String())
+		dstIPs = append(dstIPs, hostAddress(subnet, 2).String())
+	}
+	if ipContext.SrcIpRequired {
+		ipContext.SrcIpAddr = hostAddress(subnets[0], 1).String()
+		setAddressLabel(conn, dataplane.SrcIPAddrsLabel, srcIPs)
+	}
+	if ipContext.DstIpRequired {
+		ipContext.DstIpAddr = hostAddress(subnets[0], 2).String()
+		setAddressLabel(conn, dataplane.DstIPAddrsLabel, dstIPs)
+	}
+
+	if endpoint.Next(ctx) != nil {
+		result, err := endpoint.Next(ctx).Request(ctx, request)
+		if err != nil && !known {
+			// the new connection failed, a refreshed one keeps its subnets
+			ie.release(conn.GetId())
+		}
+		return result, err
+	}
+	return conn, nil
+}
+
+// Close releases the addresses of the connection once the next endpoints
+// closed it, the addresses of a connection failing to close stay in use
+func (ie *ipamEndpoint) Close(ctx context.Context, conn *connection.Connection) (*empty.Empty, error) {
+	if endpoint.Next(ctx) != nil {
+		result, err := endpoint.Next(ctx).Close(ctx, conn)
+		if err != nil {
+			return result, err
+		}
+		ie.release(conn.GetId())
+		return result, nil
+	}
+	ie.release(conn.GetId())
+	return &empty.Empty{}, nil
+}
+
+// setAddressLabel sets the label to the addresses, it is removed when there
+// are none
+func setAddressLabel(conn *connection.Connection, label string, addresses []string) {
+	if len(addresses) == 0 {
+		delete(conn.Labels, label)
+		return
+	}
+	if conn.Labels == nil {
+		conn.Labels = map[string]string{}
+	}
+	conn.Labels[label] = strings.Join(addresses, ",")
+}
+
+// allocate returns the point-to-point subnets of the connection, one of each
+// endpoint subnet. A refreshed connection keeps its subnets, nothing is
+// allocated when a subnet is full.
+func (ie *ipamEndpoint) allocate(connID string, excludedPrefixes []string) ([]*net.IPNet, error) {
+	ie.Lock()
+	defer ie.Unlock()
+
+	if subnets, ok := ie.byConn[connID]; ok {
+		return subnets, nil
+	}
+
+	var excluded []*net.IPNet
+	for _, p := range excludedPrefixes {
+		if _, prefix, err := net.ParseCIDR(p); err == nil {
+			excluded = append(excluded, prefix)
+		}
+	}
+
+	var subnets []*net.IPNet
+	for _, prefix := range ie.prefixes {
+		subnet, err := ie.allocateFrom(prefix, excluded)
+		if err != nil {
+			for _, s := range subnets {
+				delete(ie.allocated, s.String())
+			}
+			return nil, err
+		}
+		ie.allocated[subnet.String()] = subnet
+		subnets = append(subnets, subnet)
+	}
+	ie.byConn[connID] = subnets
+	return subnets, nil
+}
+
+// allocateFrom returns the first free point-to-point subnet of the prefix,
+// ie is locked
+func (ie *ipamEndpoint) allocateFrom(prefix *net.IPNet, excluded []*net.IPNet) (*net.IPNet, error) {
+	ones, bits := prefix.Mask.Size()
+	p2pOnes := p2pPrefixLengthIPv4
+	if bits == 8*net.IPv6len {
+		p2pOnes = p2pPrefixLengthIPv6
+	}
+	if ones > p2pOnes {
+		return nil, fmt.Errorf("endpoint subnet %s is too small for /%d connection subnets", prefix, p2pOnes)
+	}
+	mask := net.CIDRMask(p2pOnes, bits)
+
+	subnet := &net.IPNet{IP: prefix.IP, Mask: mask}
+	for {
+		if _, ok := ie.allocated[subnet.String()]; !ok && !overlapsAny(subnet, excluded) {
+			return subnet, nil
+		}
+		subnet = nextSubnet(subnet)
+		if !prefix.Contains(subnet.IP) || subnet.IP.Equal(prefix.IP) {
+			break
+		}
+	}
+
+	return nil, fmt.Errorf("no free /%d subnet left in the endpoint subnet %s", p2pOnes, prefix)
+}
+
+// known tells if subnets are allocated to the connection
+func (ie *ipamEndpoint) known(connID string) bool {
+	ie.Lock()
+	defer ie.Unlock()
+
+	_, ok := ie.byConn[connID]
+	return ok
+}
+
+func (ie *ipamEndpoint) release(connID string) {
+	ie.Lock()
+	defer ie.Unlock()
+
+	for _, subnet := range ie.byConn[connID] {
+		delete(ie.allocated, subnet.String())
+	}
+	delete(ie.byConn, connID)
+}
+
+// hostAddress returns the n-th address of the subnet in CIDR notation
+func hostAddress(subnet *net.IPNet, n byte) *net.IPNet {
+	ip := make(net.IP, len(subnet.IP))
+	copy(ip, subnet.IP)
+	ip[len(ip)-1] += n
+	return &net.IPNet{IP: ip, Mask: subnet.Mask}
+}
+
+// nextSubnet returns the subnet of the same size following subnet, the
+// result wraps around after the last subnet of the address space
+func nextSubnet(subnet *net.IPNet) *net.IPNet {
+	ones, bits := subnet.Mask.Size()
+	ip := make(net.IP, len(subnet.IP))
+	copy(ip, subnet.IP)
+
+	// add 1 at the last bit of the network part, with carry
+	bit := bits - ones
+	for i := len(ip) - 1 - bit/8; i >= 0; i-- {
+		sum := uint(ip[i]) + 1<<(uint(bit)%8)
+		ip[i] = byte(sum)
+		if sum < 256 {
+			break
+		}
+		bit = 0
+	}
+	return &net.IPNet{IP: ip, Mask: subnet.Mask}
+}
+
+func overlapsAny(subnet *net.IPNet, prefixes []*net.IPNet) bool {
+	for _, p := range prefixes {
+		if p.Contains(subnet.IP) || subnet.Contains(p.IP) {
+			return true
+		}
+	}
+	return false
+}
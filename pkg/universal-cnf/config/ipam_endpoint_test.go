@@ -0,0 +1,170 @@
+package config
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/golang/protobuf/ptypes/empty"
+	"github.com/networkservicemesh/networkservicemesh/controlplane/api/connection"
+	"github.com/networkservicemesh/networkservicemesh/controlplane/api/connectioncontext"
+	"github.com/networkservicemesh/networkservicemesh/controlplane/api/networkservice"
+	"github.com/networkservicemesh/networkservicemesh/sdk/endpoint"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/cisco-app-networking/nsm-nse/pkg/universal-cnf/dataplane"
+)
+
+func TestIpamEndpointAllocate(t *testing.T) {
+	for name, tc := range map[string]struct {
+		prefix   string
+		excluded []string
+		expected []string
+	}{
+		"ipv4": {
+			prefix:   "10.60.1.0/24",
+			excluded: []string{"10.60.1.4/31"},
+			expected: []string{"10.60.1.0/30", "10.60.1.8/30", "10.60.1.12/30"},
+		},
+		"ipv6": {
+			prefix:   "fd00:10:0:1::/64",
+			expected: []string{"fd00:10:0:1::/126", "fd00:10:0:1::4/126", "fd00:10:0:1::8/126"},
+		},
+		"carry": {
+			prefix:   "10.60.0.248/29",
+			expected: []string{"10.60.0.248/30", "10.60.0.252/30"},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			ipam, err := newIpamEndpoint([]string{tc.prefix})
+			require.NoError(t, err)
+
+			var allocated []string
+			for i := range tc.expected {
+				subnets, err := ipam.allocate(string(rune('a'+i)), tc.excluded)
+				require.NoError(t, err)
+				require.Len(t, subnets, 1)
+				allocated = append(allocated, subnets[0].String())
+			}
+			assert.Equal(t, tc.expected, allocated)
+
+			_, err = ipam.allocate("full", tc.excluded)
+			if name == "carry" {
+				assert.Error(t, err)
+			}
+
+			// a refreshed connection keeps its subnet and a released one is reused
+			subnets, err := ipam.allocate("a", tc.excluded)
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected[0], subnets[0].String())
+			ipam.release("a")
+			subnets, err = ipam.allocate("b2", tc.excluded)
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected[0], subnets[0].String())
+		})
+	}
+}
+
+// closer fails to close the connections while fail is set
+type closer struct {
+	fail        bool
+	failRequest bool
+}
+
+func (c *closer) Request(ctx context.Context, request *networkservice.NetworkServiceRequest) (*connection.Connection, error) {
+	if c.failRequest {
+		return nil, fmt.Errorf("request failed")
+	}
+	return request.GetConnection(), nil
+}
+
+func (c *closer) Close(ctx context.Context, conn *connection.Connection) (*empty.Empty, error) {
+	if c.fail {
+		return nil, fmt.Errorf("close failed")
+	}
+	return &empty.Empty{}, nil
+}
+
+func ipamRequest(id string) *networkservice.NetworkServiceRequest {
+	return &networkservice.NetworkServiceRequest{Connection: &connection.Connection{
+		Id: id,
+		Context: &connectioncontext.ConnectionContext{
+			IpContext: &connectioncontext.IPContext{SrcIpRequired: true, DstIpRequired: true},
+		},
+	}}
+}
+
+func TestIpamEndpointDualStack(t *testing.T) {
+	ipam, err := newIpamEndpoint([]string{"10.60.1.0/24", "fd00:10:0:1::/64", "10.60.2.0/24"})
+	require.NoError(t, err)
+	next := &closer{}
+	composite := endpoint.NewCompositeEndpoint(ipam, next)
+	ctx := context.Background()
+
+	// the addresses of the second family are carried by the labels
+	conn, err := composite.Request(ctx, ipamRequest("a"))
+	require.NoError(t, err)
+	ipContext := conn.GetContext().GetIpContext()
+	assert.Equal(t, "10.60.1.1/30", ipContext.GetSrcIpAddr())
+	assert.Equal(t, "10.60.1.2/30", ipContext.GetDstIpAddr())
+	assert.Equal(t, "fd00:10:0:1::1/126", conn.Labels[dataplane.SrcIPAddrsLabel])
+	assert.Equal(t, "fd00:10:0:1::2/126", conn.Labels[dataplane.DstIPAddrsLabel])
+
+	// the subnets stay allocated while the connection fails to close
+	next.fail = true
+	_, err = composite.Close(ctx, conn)
+	assert.Error(t, err)
+	subnets, err := ipam.allocate("b", nil)
+	require.NoError(t, err)
+	assert.Equal(t, "10.60.1.4/30", subnets[0].String())
+	assert.Equal(t, "fd00:10:0:1::4/126", subnets[1].String())
+
+	next.fail = false
+	_, err = composite.Close(ctx, conn)
+	require.NoError(t, err)
+	subnets, err = ipam.allocate("c", nil)
+	require.NoError(t, err)
+	assert.Equal(t, "10.60.1.0/30", subnets[0].String())
+	assert.Equal(t, "fd00:10:0:1::/126", subnets[1].String())
+}
+
+func TestIpamEndpointRequestFailed(t *testing.T) {
+	ipam, err := newIpamEndpoint([]string{"10.60.1.0/24", "fd00:10:0:1::/64"})
+	require.NoError(t, err)
+	next := &closer{}
+	composite := endpoint.NewCompositeEndpoint(ipam, next)
+	ctx := context.Background()
+
+	_, err = composite.Request(ctx, ipamRequest("a"))
+	require.NoError(t, err)
+
+	// a refreshed connection keeps its subnets, a new one releases them
+	next.failRequest = true
+	_, err = composite.Request(ctx, ipamRequest("a"))
+	assert.Error(t, err)
+	_, err = composite.Request(ctx, ipamRequest("b"))
+	assert.Error(t, err)
+	assert.Len(t, ipam.allocated, 2)
+	assert.Len(t, ipam.byConn, 1)
+}
+
+func TestIpamEndpointDualStackFull(t *testing.T) {
+	ipam, err := newIpamEndpoint([]string{"10.60.1.0/24", "fd00:10:0:1::/126"})
+	require.NoError(t, err)
+	_, err = ipam.allocate("a", nil)
+	require.NoError(t, err)
+
+	// the IPv4 subnet of a connection the IPv6 subnet is full for is freed
+	subnets, err := ipam.allocate("b", nil)
+	assert.Error(t, err)
+	assert.Nil(t, subnets)
+	assert.Len(t, ipam.allocated, 2)
+}
+
+func TestHostAddress(t *testing.T) {
+	_, subnet, _ := net.ParseCIDR("fd00:10:0:1::4/126")
+	assert.Equal(t, "fd00:10:0:1::5/126", hostAddress(subnet, 1).String())
+	assert.Equal(t, "fd00:10:0:1::6/126", hostAddress(subnet, 2).String())
+}
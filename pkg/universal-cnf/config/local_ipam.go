@@ -0,0 +1,301 @@
+package config
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"math/big"
+	"net"
+	"strconv"
+	"sync"
+
+	"github.com/cisco-app-networking/nsm-nse/pkg/nseconfig"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// the number of hashed picks tried before probing the pool for a free subnet
+	localHashAttempts = 16
+	// the number of subnets probed after the hashed picks, a large IPv6 pool
+	// is not walked through
+	localProbeLimit = 4096
+)
+
+// LocalAllocator calculates an endpoint subnet from a prefix pool when the
+// central IPAM is not available. The subnet must not overlap any of the used
+// subnets.
+type LocalAllocator interface {
+	Allocate(e *nseconfig.Endpoint, pool *net.IPNet, prefixLength int, used []*net.IPNet) (*net.IPNet, error)
+}
+
+// LocalAllocators are the local allocation strategies selectable by the ipam
+// localAllocation setting
+var LocalAllocators = map[nseconfig.LocalAllocation]LocalAllocator{
+	nseconfig.LocalAllocationHash:     hashAllocator{},
+	nseconfig.LocalAllocationPodOctet: podOctetAllocator{},
+}
+
+// SubnetConflictDetector is told the subnets of the vL3 peers learned through
+// discovery, so that a locally calculated subnet overlapping a peer subnet
+// can be picked again
+type SubnetConflictDetector interface {
+	// LocalSubnets reports whether the subnets of the endpoint are calculated locally
+	LocalSubnets() bool
+	// PeerSubnets records the subnets of the peer, peerLocal reports whether
+	// the peer calculated them locally
+	PeerSubnets(peerName string, subnets []string, peerLocal bool)
+}
+
+// buildIpPrefixesFromLocal calculates the endpoint subnets from the prefix
+// pools when the central IPAM is not available, avoiding the used subnets
+func buildIpPrefixesFromLocal(e *nseconfig.Endpoint, used []*net.IPNet) []string {
+	strategy := e.VL3.IPAM.LocalAllocation
+	if strategy == "" {
+		strategy = nseconfig.LocalAllocationHash
+	}
+	allocator, ok := LocalAllocators[strategy]
+	if !ok {
+		logrus.Errorf("Unknown local allocation %s", strategy)
+		return nil
+	}
+
+	var prefixes []string
+	for _, pool := range e.VL3.IPAM.Pools() {
+		_, poolNet, err := net.ParseCIDR(pool.Prefix)
+		if err != nil {
+			logrus.Errorf("Failed to parse configured prefix pool %s", pool.Prefix)
+			continue
+		}
+		subnet, err := allocator.Allocate(e, poolNet, pool.PrefixLength, used)
+		if err != nil {
+			logrus.Errorf("Failed to calculate a subnet of the prefix pool %s: %v", pool.Prefix, err)
+			continue
+		}
+		logrus.Infof("IPAM local calc--prefix pool %s, subnet %s, allocation %s", pool.Prefix, subnet, strategy)
+		prefixes = append(prefixes, subnet.String())
+	}
+	return prefixes
+}
+
+// hashAllocator picks the subnet indexed by the hash of the endpoint identity,
+// so that an endpoint gets the same subnet on every start and endpoints of
+// different pods, clusters and connectivity domains are spread over the pool
+type hashAllocator struct{}
+
+func (hashAllocator) Allocate(e *nseconfig.Endpoint, pool *net.IPNet, prefixLength int, used []*net.IPNet) (*net.IPNet, error) {
+	ones, bits := pool.Mask.Size()
+	subnetOnes := localSubnetLength(pool, prefixLength)
+	if subnetOnes == ones {
+		if overlapsAny(pool, used) {
+			return nil, fmt.Errorf("the prefix pool %s is used by a peer", pool)
+		}
+		return pool, nil
+	}
+
+	identity := localIdentity(e)
+	indexBits := uint(subnetOnes - ones)
+	for attempt := 0; attempt < localHashAttempts; attempt++ {
+		subnet := subnetAt(pool, subnetOnes, hashIndex(identity, attempt, indexBits))
+		if !overlapsAny(subnet, used) {
+			return subnet, nil
+		}
+	}
+
+	// the pool is crowded, take the next free subnet after the first pick
+	next := func(subnet *net.IPNet) *net.IPNet {
+		if subnet = nextSubnet(subnet); !pool.Contains(subnet.IP) {
+			subnet = &net.IPNet{IP: pool.IP, Mask: net.CIDRMask(subnetOnes, bits)}
+		}
+		return subnet
+	}
+	first := subnetAt(pool, subnetOnes, hashIndex(identity, 0, indexBits))
+	probes := 0
+	for subnet := next(first); !subnet.IP.Equal(first.IP); subnet = next(subnet) {
+		if probes++; probes > localProbeLimit {
+			return nil, fmt.Errorf("no free /%d subnet found in %d subnets of the prefix pool %s", subnetOnes, localProbeLimit, pool)
+		}
+		if !overlapsAny(subnet, used) {
+			return subnet, nil
+		}
+	}
+	return nil, fmt.Errorf("no free /%d subnet left in the prefix pool %s", subnetOnes, pool)
+}
+
+// localIdentity identifies the endpoint by its cluster, pod and connectivity domain
+func localIdentity(e *nseconfig.Endpoint) string {
+	identity := GetEndpointName(e.ClusterName)
+	if e.NseControl != nil {
+		identity += "/" + e.NseControl.ConnectivityDomain
+	}
+	return identity + "/" + e.Name
+}
+
+// hashIndex returns the subnet index of the identity for the attempt, as a
+// number of indexBits bits
+func hashIndex(identity string, attempt int, indexBits uint) *big.Int {
+	sum := sha256.Sum256([]byte(identity + "/" + strconv.Itoa(attempt)))
+	index := new(big.Int).SetBytes(sum[:])
+	mask := new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), indexBits), big.NewInt(1))
+	return index.And(index, mask)
+}
+
+// subnetAt returns the index-th subnet of length subnetOnes in the pool
+func subnetAt(pool *net.IPNet, subnetOnes int, index *big.Int) *net.IPNet {
+	_, bits := pool.Mask.Size()
+	offset := new(big.Int).Lsh(index, uint(bits-subnetOnes))
+	ip := new(big.Int).Or(new(big.Int).SetBytes(pool.IP), offset).Bytes()
+
+	subnetIP := make(net.IP, len(pool.IP))
+	copy(subnetIP[len(subnetIP)-len(ip):], ip)
+	return &net.IPNet{IP: subnetIP, Mask: net.CIDRMask(subnetOnes, bits)}
+}
+
+// localSubnetLength returns the length of the endpoint subnets of the pool,
+// /24 for IPv4 and /64 for IPv6 unless the prefix length is configured. A pool
+// smaller than the subnets is used as a whole.
+func localSubnetLength(pool *net.IPNet, prefixLength int) int {
+	ones, bits := pool.Mask.Size()
+	subnetOnes := prefixLength
+	if subnetOnes == 0 {
+		subnetOnes = 24
+		if bits == 8*net.IPv6len {
+			subnetOnes = 64
+		}
+	}
+	if subnetOnes < ones {
+		return ones
+	}
+	return subnetOnes
+}
+
+// podOctetAllocator is the legacy allocation, IPv4 pools up to /16 are split
+// into /24 subnets and IPv6 pools up to /56 into /64 subnets, indexed by the
+// unique octet. Smaller pools are used as a whole.
+type podOctetAllocator struct{}
+
+func (podOctetAllocator) Allocate(e *nseconfig.Endpoint, pool *net.IPNet, _ int, used []*net.IPNet) (*net.IPNet, error) {
+	_, subnet, err := net.ParseCIDR(localPrefix(pool, localSubnetIndex(e)))
+	if err != nil {
+		return nil, err
+	}
+	if overlapsAny(subnet, used) {
+		return nil, fmt.Errorf("the subnet %s is used by a peer", subnet)
+	}
+	return subnet, nil
+}
+
+// localSubnetIndex returns the configured unique octet, or the octet before
+// the last one of the pod IP
+func localSubnetIndex(e *nseconfig.Endpoint) byte {
+	if e.VL3.IPAM.UniqueOctet != nil {
+		return byte(*e.VL3.IPAM.UniqueOctet)
+	}
+
+	nsPodIp := e.PodIP
+	if nsPodIp == "" {
+		nsPodIp = "2.2.20.0" // needs to be set to make sense
+	}
+	podIP := net.ParseIP(nsPodIp)
+	if podIP == nil {
+		logrus.Errorf("Failed to parse configured pod IP")
+		return 0
+	}
+	if ip4 := podIP.To4(); ip4 != nil {
+		podIP = ip4
+	}
+	return podIP[len(podIP)-2]
+}
+
+func localPrefix(pool *net.IPNet, index byte) string {
+	ones, bits := pool.Mask.Size()
+
+	subnetOnes, maxPoolOnes := 24, 16
+	if bits == 8*net.IPv6len {
+		subnetOnes, maxPoolOnes = 64, 56
+	}
+	if ones > maxPoolOnes {
+		return pool.String()
+	}
+
+	ip := make(net.IP, len(pool.IP))
+	copy(ip, pool.IP)
+	ip[subnetOnes/8-1] = index
+	return (&net.IPNet{IP: ip, Mask: net.CIDRMask(subnetOnes, bits)}).String()
+}
+
+// localSubnets tracks the subnets of an endpoint and the subnets of its vL3
+// peers. When a locally calculated subnet overlaps a peer subnet, the endpoint
+// picks its subnets again through onConflict. Of two endpoints calculating
+// their subnets locally, the one with the greater name picks again; the
+// subnets of a peer using the central IPAM are not picked again by the peer.
+type localSubnets struct {
+	sync.Mutex
+	local      bool
+	subnets    []*net.IPNet
+	peers      map[string][]*net.IPNet
+	name       func() string
+	onConflict func(used []*net.IPNet)
+	conflicted bool
+}
+
+func newLocalSubnets(prefixes []string, local bool, used []*net.IPNet) *localSubnets {
+	ls := &localSubnets{
+		local: local,
+		peers: map[string][]*net.IPNet{},
+	}
+	for _, p := range prefixes {
+		if _, subnet, err := net.ParseCIDR(p); err == nil {
+			ls.subnets = append(ls.subnets, subnet)
+		}
+	}
+	// the subnets that caused a re-pick stay excluded
+	if len(used) > 0 {
+		ls.peers[""] = used
+	}
+	return ls
+}
+
+// LocalSubnets reports whether the subnets are calculated locally
+func (ls *localSubnets) LocalSubnets() bool {
+	return ls.local
+}
+
+// PeerSubnets records the subnets of the peer and checks them for conflicts
+func (ls *localSubnets) PeerSubnets(peerName string, subnets []string, peerLocal bool) {
+	ls.Lock()
+	defer ls.Unlock()
+
+	var peerSubnets []*net.IPNet
+	for _, s := range subnets {
+		if _, subnet, err := net.ParseCIDR(s); err == nil {
+			peerSubnets = append(peerSubnets, subnet)
+		}
+	}
+	ls.peers[peerName] = peerSubnets
+
+	if !ls.local || ls.conflicted || ls.onConflict == nil {
+		return
+	}
+	for _, subnet := range ls.subnets {
+		if !overlapsAny(subnet, peerSubnets) {
+			continue
+		}
+		name := ls.name()
+		logrus.Warningf("Local subnet %s of endpoint %s overlaps the subnets %v of the peer %s", subnet, name, subnets, peerName)
+		if peerLocal && name <= peerName {
+			// the peer picks again
+			return
+		}
+		ls.conflicted = true
+		go ls.onConflict(ls.used())
+		return
+	}
+}
+
+// used returns the subnets of all known peers
+func (ls *localSubnets) used() []*net.IPNet {
+	var used []*net.IPNet
+	for _, subnets := range ls.peers {
+		used = append(used, subnets...)
+	}
+	return used
+}
@@ -0,0 +1,178 @@
+package config
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/cisco-app-networking/nsm-nse/pkg/nseconfig"
+)
+
+func TestBuildIpPrefixesFromLocal(t *testing.T) {
+	octet := 7
+	for name, tc := range map[string]struct {
+		endpoint *nseconfig.Endpoint
+		expected []string
+	}{
+		"pod-ip": {
+			endpoint: &nseconfig.Endpoint{PodIP: "10.244.3.12", VL3: nseconfig.VL3{IPAM: nseconfig.IPAM{
+				DefaultPrefixPool: "192.168.0.0/16",
+				LocalAllocation:   nseconfig.LocalAllocationPodOctet,
+			}}},
+			expected: []string{"192.168.3.0/24"},
+		},
+		"dual-stack": {
+			endpoint: &nseconfig.Endpoint{VL3: nseconfig.VL3{IPAM: nseconfig.IPAM{
+				DefaultPrefixPool: "192.168.0.0/16",
+				PrefixPools:       []nseconfig.PrefixPool{{Prefix: "fd00:10::/48"}},
+				LocalAllocation:   nseconfig.LocalAllocationPodOctet,
+				UniqueOctet:       &octet,
+			}}},
+			expected: []string{"192.168.7.0/24", "fd00:10:0:7::/64"},
+		},
+		"ipv6-pod-ip": {
+			endpoint: &nseconfig.Endpoint{PodIP: "fd00:244::30c", VL3: nseconfig.VL3{IPAM: nseconfig.IPAM{
+				PrefixPools:     []nseconfig.PrefixPool{{Prefix: "fd00:10::/56"}},
+				LocalAllocation: nseconfig.LocalAllocationPodOctet,
+			}}},
+			expected: []string{"fd00:10:0:3::/64"},
+		},
+		"small-pool": {
+			endpoint: &nseconfig.Endpoint{VL3: nseconfig.VL3{IPAM: nseconfig.IPAM{
+				DefaultPrefixPool: "192.168.33.0/24",
+			}}},
+			expected: []string{"192.168.33.0/24"},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, buildIpPrefixesFromLocal(tc.endpoint, nil))
+		})
+	}
+}
+
+func TestHashAllocator(t *testing.T) {
+	endpoint := func(name string, prefixLength int) *nseconfig.Endpoint {
+		return &nseconfig.Endpoint{
+			Name:        name,
+			ClusterName: "cluster-1",
+			NseControl:  &nseconfig.NseControl{ConnectivityDomain: "domain-1"},
+			VL3: nseconfig.VL3{IPAM: nseconfig.IPAM{
+				DefaultPrefixPool: "10.60.0.0/16",
+				PrefixLength:      prefixLength,
+			}},
+		}
+	}
+	_, pool, _ := net.ParseCIDR("10.60.0.0/16")
+
+	first, err := hashAllocator{}.Allocate(endpoint("vl3", 0), pool, 0, nil)
+	require.NoError(t, err)
+	ones, _ := first.Mask.Size()
+	assert.Equal(t, 24, ones)
+	assert.True(t, pool.Contains(first.IP))
+
+	again, err := hashAllocator{}.Allocate(endpoint("vl3", 0), pool, 0, nil)
+	require.NoError(t, err)
+	assert.Equal(t, first.String(), again.String(), "the allocation is not deterministic")
+
+	other, err := hashAllocator{}.Allocate(endpoint("vl3-other", 0), pool, 0, nil)
+	require.NoError(t, err)
+	assert.NotEqual(t, first.String(), other.String())
+
+	prefixes := buildIpPrefixesFromLocal(endpoint("vl3", 26), nil)
+	require.Len(t, prefixes, 1)
+	_, subnet, _ := net.ParseCIDR(prefixes[0])
+	ones, _ = subnet.Mask.Size()
+	assert.Equal(t, 26, ones)
+
+	repicked, err := hashAllocator{}.Allocate(endpoint("vl3", 0), pool, 0, []*net.IPNet{first})
+	require.NoError(t, err)
+	assert.NotEqual(t, first.String(), repicked.String())
+	assert.True(t, pool.Contains(repicked.IP))
+}
+
+func TestHashAllocatorCrowdedPool(t *testing.T) {
+	e := &nseconfig.Endpoint{Name: "vl3"}
+	_, pool, _ := net.ParseCIDR("10.60.0.0/22")
+
+	// all but the last /24 are in use
+	var used []*net.IPNet
+	for _, p := range []string{"10.60.0.0/24", "10.60.1.0/24", "10.60.2.0/24"} {
+		_, subnet, _ := net.ParseCIDR(p)
+		used = append(used, subnet)
+	}
+	subnet, err := hashAllocator{}.Allocate(e, pool, 24, used)
+	require.NoError(t, err)
+	assert.Equal(t, "10.60.3.0/24", subnet.String())
+
+	_, last, _ := net.ParseCIDR("10.60.3.0/24")
+	_, err = hashAllocator{}.Allocate(e, pool, 24, append(used, last))
+	assert.EqualError(t, err, "no free /24 subnet left in the prefix pool 10.60.0.0/22")
+}
+
+func TestHashAllocatorIPv6(t *testing.T) {
+	_, pool, _ := net.ParseCIDR("fd00:10::/48")
+	subnet, err := hashAllocator{}.Allocate(&nseconfig.Endpoint{Name: "vl3"}, pool, 0, nil)
+	require.NoError(t, err)
+	ones, bits := subnet.Mask.Size()
+	assert.Equal(t, 64, ones)
+	assert.Equal(t, 128, bits)
+	assert.True(t, pool.Contains(subnet.IP))
+}
+
+func TestHashAllocatorProbeLimit(t *testing.T) {
+	_, pool, _ := net.ParseCIDR("fd00:10::/48")
+	// the whole pool is in use, the probing stops before walking the /64 subnets
+	_, err := hashAllocator{}.Allocate(&nseconfig.Endpoint{Name: "vl3"}, pool, 0, []*net.IPNet{pool})
+	assert.EqualError(t, err, "no free /64 subnet found in 4096 subnets of the prefix pool fd00:10::/48")
+}
+
+func TestLocalSubnetsConflict(t *testing.T) {
+	for name, tc := range map[string]struct {
+		local     bool
+		name      string
+		peer      string
+		peerLocal bool
+		subnets   []string
+		repicked  bool
+	}{
+		"greater-name-repicks": {
+			local: true, name: "nse-b", peer: "nse-a", peerLocal: true,
+			subnets: []string{"10.60.3.0/24"}, repicked: true,
+		},
+		"smaller-name-keeps": {
+			local: true, name: "nse-a", peer: "nse-b", peerLocal: true,
+			subnets: []string{"10.60.3.0/24"},
+		},
+		"central-peer-repicks": {
+			local: true, name: "nse-a", peer: "nse-b",
+			subnets: []string{"10.60.3.0/24"}, repicked: true,
+		},
+		"no-overlap": {
+			local: true, name: "nse-b", peer: "nse-a", peerLocal: true,
+			subnets: []string{"10.60.4.0/24"},
+		},
+		"central-ipam": {
+			name: "nse-b", peer: "nse-a",
+			subnets: []string{"10.60.3.0/24"},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			ls := newLocalSubnets([]string{"10.60.3.0/24"}, tc.local, nil)
+			ls.name = func() string { return tc.name }
+			repicked := make(chan []*net.IPNet, 1)
+			ls.onConflict = func(used []*net.IPNet) { repicked <- used }
+
+			ls.PeerSubnets(tc.peer, tc.subnets, tc.peerLocal)
+
+			if !tc.repicked {
+				assert.Empty(t, repicked)
+				return
+			}
+			used := <-repicked
+			require.Len(t, used, 1)
+			assert.Equal(t, tc.subnets[0], used[0].String())
+		})
+	}
+}
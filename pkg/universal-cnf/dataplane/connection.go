@@ -0,0 +1,233 @@
+package dataplane
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/networkservicemesh/networkservicemesh/controlplane/api/connection"
+	"github.com/networkservicemesh/networkservicemesh/controlplane/api/connection/mechanisms/common"
+	"github.com/networkservicemesh/networkservicemesh/controlplane/api/connection/mechanisms/memif"
+	"github.com/sirupsen/logrus"
+
+	"github.com/cisco-app-networking/nsm-nse/pkg/nseconfig"
+)
+
+// The IP context of a connection carries a single address pair, the labels
+// carry the addresses of the connection in the other address families of a
+// dual-stack endpoint, comma separated in CIDR notation
+const (
+	SrcIPAddrsLabel = "ucnf/srcIpAddrs"
+	DstIPAddrsLabel = "ucnf/dstIpAddrs"
+)
+
+// ConnectionInterface returns the interface of the connection mechanism: a
+// memif interface with the socket file of the connection or the kernel
+// interface NSM created. The endpoint is the memif master.
+func ConnectionInterface(name string, master bool, iface nseconfig.Interface, conn *connection.Connection) *Interface {
+	if iface.Mechanism == nseconfig.MechanismKernel {
+		return &Interface{
+			Name:       name,
+			Type:       InterfaceKernel,
+			HostIfName: conn.GetMechanism().GetParameters()[common.InterfaceNameKey],
+			RxMode:     iface.RxMode,
+		}
+	}
+
+	return &Interface{
+		Name: name,
+		Type: InterfaceMemif,
+		Memif: &Memif{
+			Master:     master,
+			SocketFile: memif.ToMechanism(conn.GetMechanism()).GetSocketFilename(),
+			Memif:      iface.Memif,
+		},
+		RxMode: iface.RxMode,
+	}
+}
+
+// AddClient adds the interface of a client connection with the source
+// addresses and the routes to the destination routes through the endpoint
+func (c *Config) AddClient(ifName string, iface nseconfig.Interface, conn *connection.Connection) {
+	ipContext := conn.GetContext().GetIpContext()
+
+	clientIf := ConnectionInterface(ifName, false, iface, conn)
+	clientIf.Addresses = connectionAddresses(ipContext.GetSrcIpAddr(), conn.Labels[SrcIPAddrsLabel])
+	c.Interfaces = append(c.Interfaces, clientIf)
+
+	// the routes need the endpoint address of their family as the next hop
+	dstIPs := connectionAddresses(ipContext.GetDstIpAddr(), conn.Labels[DstIPAddrsLabel])
+	for _, route := range ipContext.GetDstRoutes() {
+		if nextHop := nextHopFor(route.Prefix, dstIPs); nextHop != "" {
+			c.Routes = append(c.Routes, &Route{Dst: route.Prefix, NextHop: nextHop})
+		}
+	}
+}
+
+// AddEndpoint adds the interface of an endpoint connection with the
+// destination address, the routes to the source routes through the client
+// and, when the endpoint has a NAT, the NAT inside interface and the port
+// forwards the connection labels request. The requests are checked against
+// the NAT of the endpoint and the port forwards of the other connections
+// before anything is added, the labels of port forwards the NAT does not
+// declare are logged and skipped. The NAT pools are left to SetupNAT.
+func (c *Config) AddEndpoint(ifName string, endpoint *nseconfig.Endpoint, conn *connection.Connection) error {
+	ipContext := conn.GetContext().GetIpContext()
+	srcIP := hostIP(ipContext.GetSrcIpAddr())
+
+	// the port forwards need the client address too
+	var mappings []*StaticMapping
+	if srcIP != "" {
+		var err error
+		if mappings, err = c.portForwards(endpoint.NAT, conn.Labels, srcIP); err != nil {
+			return err
+		}
+	}
+
+	endpointIf := ConnectionInterface(ifName, true, endpoint.Interface, conn)
+	endpointIf.Addresses = connectionAddresses(ipContext.GetDstIpAddr(), conn.Labels[DstIPAddrsLabel])
+	if endpointIf.RxMode == "" {
+		endpointIf.RxMode = nseconfig.RxModeInterrupt
+	}
+	c.Interfaces = append(c.Interfaces, endpointIf)
+
+	// the routes need the client address of their family as the next hop
+	srcIPs := connectionAddresses(ipContext.GetSrcIpAddr(), conn.Labels[SrcIPAddrsLabel])
+	for _, route := range ipContext.GetSrcRoutes() {
+		if nextHop := nextHopFor(route.Prefix, srcIPs); nextHop != "" {
+			c.Routes = append(c.Routes, &Route{Dst: route.Prefix, NextHop: nextHop})
+		}
+	}
+
+	if endpoint.NAT != nil {
+		c.NAT.Interfaces = append(c.NAT.Interfaces, &NATInterface{Name: ifName, Inside: true})
+		c.NAT.StaticMappings = append(c.NAT.StaticMappings, mappings...)
+	}
+	return nil
+}
+
+// portForwards returns the static mappings of the port forwards the labels
+// request, a mapping per label forwarding its port range. The mappings may
+// not overlap each other nor the ones of the other connections.
+func (c *Config) portForwards(nat *nseconfig.NAT, labels map[string]string, localIP string) ([]*StaticMapping, error) {
+	requests, skipped, err := nat.RequestedPortForwards(labels)
+	for _, reason := range skipped {
+		logrus.Warnf("Skipping the port forward of the connection to %s: %v", localIP, reason)
+	}
+	if err != nil || len(requests) == 0 {
+		return nil, err
+	}
+
+	externalIP := nat.ExternalIP()
+	var mappings []*StaticMapping
+	for _, request := range requests {
+		protocol := ProtocolTCP
+		if request.Forward.Protocol == nseconfig.ProtocolUDP {
+			protocol = ProtocolUDP
+		}
+		m := &StaticMapping{
+			Label:        request.Label + "-to-" + localIP,
+			Protocol:     protocol,
+			ExternalIP:   externalIP,
+			ExternalPort: uint32(request.ExternalPort),
+			LocalIP:      localIP,
+			LocalPort:    uint32(request.LocalPort),
+			PortCount:    uint32(request.Count),
+			TwiceNAT:     request.Forward.TwiceNAT,
+		}
+		for _, others := range [][]*StaticMapping{c.NAT.StaticMappings, mappings} {
+			for _, other := range others {
+				if m.overlaps(other) {
+					return nil, fmt.Errorf("label %s requests %s ports %d-%d, which overlap the ports %d-%d forwarded to %s",
+						request.Label, m.Protocol, m.ExternalPort, m.ExternalPort+m.Ports()-1,
+						other.ExternalPort, other.ExternalPort+other.Ports()-1, other.LocalIP)
+				}
+			}
+		}
+		mappings = append(mappings, m)
+	}
+	return mappings, nil
+}
+
+// SetupNAT adds the pools and the outside interfaces of the endpoint NAT
+func (c *Config) SetupNAT(nat *nseconfig.NAT) {
+	if nat == nil {
+		return
+	}
+	for _, pool := range nat.Pools {
+		c.NAT.Pools = append(c.NAT.Pools, &NATPool{FirstIP: pool.FirstIP, LastIP: pool.LastIP, TwiceNAT: pool.TwiceNAT})
+	}
+	for _, name := range nat.OutsideInterfaces {
+		c.NAT.Interfaces = append(c.NAT.Interfaces, &NATInterface{Name: name, Outside: true})
+	}
+}
+
+// RemoveEndpointNAT removes the NAT inside interface and the port forwards of
+// the endpoint connection of the interface and the client address, and
+// returns them
+func (c *Config) RemoveEndpointNAT(ifName, localIP string) NAT {
+	var removed NAT
+
+	var interfaces []*NATInterface
+	for _, iface := range c.NAT.Interfaces {
+		if iface.Inside && iface.Name == ifName {
+			removed.Interfaces = append(removed.Interfaces, iface)
+		} else {
+			interfaces = append(interfaces, iface)
+		}
+	}
+	c.NAT.Interfaces = interfaces
+
+	var mappings []*StaticMapping
+	for _, m := range c.NAT.StaticMappings {
+		if m.LocalIP == localIP {
+			removed.StaticMappings = append(removed.StaticMappings, m)
+		} else {
+			mappings = append(mappings, m)
+		}
+	}
+	c.NAT.StaticMappings = mappings
+
+	return removed
+}
+
+// connectionAddresses returns the address of the IP context followed by the
+// addresses of the other families in the label value
+func connectionAddresses(address, labelValue string) []string {
+	var addresses []string
+	if address != "" {
+		addresses = append(addresses, address)
+	}
+	for _, a := range strings.Split(labelValue, ",") {
+		if a = strings.TrimSpace(a); a != "" {
+			addresses = append(addresses, a)
+		}
+	}
+	return addresses
+}
+
+// nextHopFor returns the host address of the addresses in the family of the
+// prefix, or "" when there is none
+func nextHopFor(prefix string, addresses []string) string {
+	_, dst, err := net.ParseCIDR(prefix)
+	if err != nil {
+		return ""
+	}
+	for _, address := range addresses {
+		ip := net.ParseIP(hostIP(address))
+		if ip != nil && (ip.To4() == nil) == (dst.IP.To4() == nil) {
+			return ip.String()
+		}
+	}
+	return ""
+}
+
+// hostIP returns the address of an IP address with a prefix length, or ""
+// when it is not one
+func hostIP(address string) string {
+	ip, _, err := net.ParseCIDR(address)
+	if err != nil {
+		return ""
+	}
+	return ip.String()
+}
@@ -0,0 +1,191 @@
+// Package dataplane is the backend-agnostic model of the dataplane
+// configuration of the universal CNF: the interfaces with their addresses,
+// the routes, the NAT and the ACLs. The backends translate it to their
+// dataplane.
+package dataplane
+
+import (
+	"go.ligato.io/vpp-agent/v3/proto/ligato/vpp"
+
+	"github.com/cisco-app-networking/nsm-nse/pkg/nseconfig"
+)
+
+// Config is the dpconfig of an init action or of the connections of an
+// endpoint. Items are identified by their name, removing a config removes the
+// items it lists.
+type Config struct {
+	Interfaces []*Interface `yaml:"interfaces"`
+	Routes     []*Route     `yaml:"routes"`
+	NAT        NAT          `yaml:"nat"`
+	ACLs       []*ACL       `yaml:"acls"`
+	// VPP is added as is to the VPP configuration by the vppagent backend,
+	// the other backends refuse it
+	VPP *vpp.ConfigData `yaml:"vpp"`
+}
+
+// InterfaceType is the kind of an interface
+type InterfaceType string
+
+const (
+	// InterfaceMemif is a memif interface, the VPP end of a memif connection
+	InterfaceMemif InterfaceType = "memif"
+	// InterfaceKernel is an existing kernel interface given by HostIfName,
+	// the kernel end of a kernel connection
+	InterfaceKernel InterfaceType = "kernel"
+	// InterfaceTap is a TAP interface created by the backend
+	InterfaceTap InterfaceType = "tap"
+	// InterfaceLoopback is a loopback interface created by the backend
+	InterfaceLoopback InterfaceType = "loopback"
+)
+
+// Interface is an interface of the dataplane
+type Interface struct {
+	Name string        `yaml:"name"`
+	Type InterfaceType `yaml:"type"`
+	// Disabled leaves the interface down
+	Disabled bool `yaml:"disabled"`
+	// Addresses are the IP addresses of the interface with their prefix length
+	Addresses []string `yaml:"addresses"`
+	MTU       uint32   `yaml:"mtu"`
+	// HostIfName is the kernel interface of kernel and tap interfaces, the
+	// name of a tap interface when not set
+	HostIfName string `yaml:"hostIfName"`
+	// Memif is the link of memif interfaces
+	Memif *Memif `yaml:"memif"`
+	// RxMode is left to the dataplane when not set
+	RxMode nseconfig.RxMode `yaml:"rxMode"`
+}
+
+// Memif is the link of a memif interface
+type Memif struct {
+	Master bool `yaml:"master"`
+	// SocketFile is the path of the memif socket relative to the NSM
+	// workspace of the CNF
+	SocketFile      string `yaml:"socketFile"`
+	nseconfig.Memif `yaml:",inline"`
+}
+
+// Route is a static route, the interface is looked up from the next hop when
+// not set
+type Route struct {
+	Dst       string `yaml:"dst"`
+	NextHop   string `yaml:"nextHop"`
+	Interface string `yaml:"interface"`
+}
+
+// Protocol is the transport protocol of NAT mappings and ACL rules
+type Protocol string
+
+const (
+	ProtocolTCP  Protocol = "tcp"
+	ProtocolUDP  Protocol = "udp"
+	ProtocolICMP Protocol = "icmp"
+)
+
+// NAT is the NAT44 configuration
+type NAT struct {
+	Pools          []*NATPool       `yaml:"pools"`
+	Interfaces     []*NATInterface  `yaml:"interfaces"`
+	StaticMappings []*StaticMapping `yaml:"staticMappings"`
+}
+
+// NATPool is a range of external addresses, LastIP is FirstIP when not set
+type NATPool struct {
+	FirstIP string `yaml:"firstIp"`
+	LastIP  string `yaml:"lastIp"`
+	// TwiceNAT pools translate the source of the twice-NAT mappings
+	TwiceNAT bool `yaml:"twiceNat"`
+}
+
+// NATInterface enables NAT on the inside or outside of an interface
+type NATInterface struct {
+	Name    string `yaml:"name"`
+	Inside  bool   `yaml:"inside"`
+	Outside bool   `yaml:"outside"`
+}
+
+// StaticMapping forwards an external address and port to a local one, the
+// ports are not translated when not set and the local port is the external
+// one when only that is set
+type StaticMapping struct {
+	Label        string   `yaml:"label"`
+	Protocol     Protocol `yaml:"protocol"`
+	ExternalIP   string   `yaml:"externalIp"`
+	ExternalPort uint32   `yaml:"externalPort"`
+	LocalIP      string   `yaml:"localIp"`
+	LocalPort    uint32   `yaml:"localPort"`
+	// PortCount is the number of consecutive ports from ExternalPort that
+	// are forwarded to the ports from LocalPort, 1 when not set
+	PortCount uint32 `yaml:"portCount"`
+	// TwiceNAT translates the source address too, to an address of a
+	// twice-NAT pool
+	TwiceNAT bool `yaml:"twiceNat"`
+}
+
+// Ports returns the number of ports of the mapping, 0 when it has no port
+func (m *StaticMapping) Ports() uint32 {
+	switch {
+	case m.ExternalPort == 0:
+		return 0
+	case m.PortCount == 0:
+		return 1
+	}
+	return m.PortCount
+}
+
+// LocalPortFor returns the local port the external port of the mapping is
+// forwarded to
+func (m *StaticMapping) LocalPortFor(externalPort uint32) uint32 {
+	if m.LocalPort == 0 {
+		return externalPort
+	}
+	return m.LocalPort + externalPort - m.ExternalPort
+}
+
+// overlaps reports whether the mappings forward a same external port
+func (m *StaticMapping) overlaps(other *StaticMapping) bool {
+	if m.Protocol != other.Protocol || m.ExternalIP != other.ExternalIP || m.Ports() == 0 || other.Ports() == 0 {
+		return false
+	}
+	return m.ExternalPort < other.ExternalPort+other.Ports() && other.ExternalPort < m.ExternalPort+m.Ports()
+}
+
+// ACLAction is what an ACL rule does with the matching packets
+type ACLAction string
+
+const (
+	ACLPermit ACLAction = "permit"
+	ACLDeny   ACLAction = "deny"
+	// ACLReflect permits the packets and the packets of their reverse flow
+	ACLReflect ACLAction = "reflect"
+)
+
+// ACL is an access list applied to interfaces
+type ACL struct {
+	Name  string     `yaml:"name"`
+	Rules []*ACLRule `yaml:"rules"`
+	// Ingress and Egress are the names of the interfaces the ACL is applied to
+	Ingress []string `yaml:"ingress"`
+	Egress  []string `yaml:"egress"`
+}
+
+// ACLRule matches packets by their networks, protocol and ports, the fields
+// that are not set match any packet
+type ACLRule struct {
+	Action   ACLAction `yaml:"action"`
+	Src      string    `yaml:"src"`
+	Dst      string    `yaml:"dst"`
+	Protocol Protocol  `yaml:"protocol"`
+	// SrcPorts and DstPorts match tcp and udp packets
+	SrcPorts *Range `yaml:"srcPorts"`
+	DstPorts *Range `yaml:"dstPorts"`
+	// ICMPTypes and ICMPCodes match icmp packets
+	ICMPTypes *Range `yaml:"icmpTypes"`
+	ICMPCodes *Range `yaml:"icmpCodes"`
+}
+
+// Range is an inclusive range of ports, ICMP types or codes
+type Range struct {
+	First uint32 `yaml:"first"`
+	Last  uint32 `yaml:"last"`
+}
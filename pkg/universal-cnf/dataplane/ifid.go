@@ -0,0 +1,59 @@
+package dataplane
+
+import "sync"
+
+// InterfaceIDs allocates the IDs naming the endpoint interfaces of the
+// services. A connection keeps its ID until it is released, and the lowest ID
+// that is not used is allocated first, so the IDs of closed connections are
+// reused. The zero value is ready to use.
+type InterfaceIDs struct {
+	mu       sync.Mutex
+	services map[string]*serviceIDs
+}
+
+// serviceIDs are the IDs of the connections of a service
+type serviceIDs struct {
+	conns map[string]int
+	used  map[int]bool
+}
+
+// Allocate returns the ID of the connection of the service
+func (a *InterfaceIDs) Allocate(serviceName, connID string) int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.services == nil {
+		a.services = map[string]*serviceIDs{}
+	}
+	ids, ok := a.services[serviceName]
+	if !ok {
+		ids = &serviceIDs{conns: map[string]int{}, used: map[int]bool{}}
+		a.services[serviceName] = ids
+	}
+	if id, ok := ids.conns[connID]; ok {
+		return id
+	}
+
+	id := 0
+	for ids.used[id] {
+		id++
+	}
+	ids.conns[connID] = id
+	ids.used[id] = true
+	return id
+}
+
+// Release frees the ID of the connection of the service
+func (a *InterfaceIDs) Release(serviceName, connID string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	ids, ok := a.services[serviceName]
+	if !ok {
+		return
+	}
+	if id, ok := ids.conns[connID]; ok {
+		delete(ids.conns, connID)
+		delete(ids.used, id)
+	}
+}
@@ -0,0 +1,150 @@
+package dataplane
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// ValidationErrors lists the problems of a dpconfig
+type ValidationErrors []error
+
+func (e ValidationErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// Validate checks the names, types, addresses and enums of the dpconfig, the
+// VPP passthrough is left to the vpp-agent
+func (c *Config) Validate() error {
+	var errs ValidationErrors
+	fail := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+
+	names := map[string]bool{}
+	for i, iface := range c.Interfaces {
+		if iface.Name == "" {
+			fail("interfaces[%d] has no name", i)
+		} else if names[iface.Name] {
+			fail("interfaces[%d]: interface %s is listed twice", i, iface.Name)
+		}
+		names[iface.Name] = true
+
+		switch iface.Type {
+		case InterfaceMemif:
+			if iface.Memif == nil {
+				fail("interfaces[%d]: memif interface %s has no memif link", i, iface.Name)
+			}
+		case InterfaceKernel:
+			if iface.HostIfName == "" {
+				fail("interfaces[%d]: kernel interface %s has no hostIfName", i, iface.Name)
+			}
+		case InterfaceTap, InterfaceLoopback:
+		default:
+			fail("interfaces[%d]: interface type %q is not one of memif, kernel, tap, loopback", i, iface.Type)
+		}
+
+		for _, address := range iface.Addresses {
+			if _, _, err := net.ParseCIDR(address); err != nil {
+				fail("interfaces[%d]: address %s is not an IP address with a prefix length", i, address)
+			}
+		}
+	}
+
+	for i, route := range c.Routes {
+		if _, _, err := net.ParseCIDR(route.Dst); err != nil {
+			fail("routes[%d]: destination %q is not a prefix", i, route.Dst)
+		}
+		if route.NextHop != "" && net.ParseIP(route.NextHop) == nil {
+			fail("routes[%d]: next hop %s is not an IP address", i, route.NextHop)
+		}
+	}
+
+	for i, pool := range c.NAT.Pools {
+		if net.ParseIP(pool.FirstIP) == nil {
+			fail("nat.pools[%d]: first IP %q is not an IP address", i, pool.FirstIP)
+		}
+		if pool.LastIP != "" && net.ParseIP(pool.LastIP) == nil {
+			fail("nat.pools[%d]: last IP %s is not an IP address", i, pool.LastIP)
+		}
+	}
+	for i, iface := range c.NAT.Interfaces {
+		if iface.Name == "" || iface.Inside == iface.Outside {
+			fail("nat.interfaces[%d] needs a name and either inside or outside", i)
+		}
+	}
+	for i, m := range c.NAT.StaticMappings {
+		if err := validateProtocol(m.Protocol, false); err != nil {
+			fail("nat.staticMappings[%d]: %v", i, err)
+		}
+		if net.ParseIP(m.ExternalIP) == nil || net.ParseIP(m.LocalIP) == nil {
+			fail("nat.staticMappings[%d]: externalIp and localIp have to be IP addresses", i)
+		}
+		if m.ExternalPort == 0 && (m.LocalPort != 0 || m.PortCount != 0) {
+			fail("nat.staticMappings[%d]: localPort and portCount need externalPort", i)
+		}
+		if last := uint64(m.ExternalPort) + uint64(m.Ports()); last > 65536 || uint64(m.LocalPortFor(m.ExternalPort))+uint64(m.Ports()) > 65536 {
+			fail("nat.staticMappings[%d]: the %d ports are not in range 1-65535", i, m.Ports())
+		}
+	}
+
+	for i, acl := range c.ACLs {
+		if acl.Name == "" {
+			fail("acls[%d] has no name", i)
+		}
+		for j, rule := range acl.Rules {
+			if err := rule.validate(); err != nil {
+				fail("acls[%d].rules[%d]: %v", i, j, err)
+			}
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func (r *ACLRule) validate() error {
+	switch r.Action {
+	case ACLPermit, ACLDeny, ACLReflect:
+	default:
+		return fmt.Errorf("action %q is not one of permit, deny, reflect", r.Action)
+	}
+	if err := validateProtocol(r.Protocol, true); err != nil {
+		return err
+	}
+	for _, network := range []string{r.Src, r.Dst} {
+		if _, _, err := net.ParseCIDR(network); network != "" && err != nil {
+			return fmt.Errorf("network %s is not a prefix", network)
+		}
+	}
+	if (r.SrcPorts != nil || r.DstPorts != nil) && r.Protocol != ProtocolTCP && r.Protocol != ProtocolUDP {
+		return fmt.Errorf("ports need the tcp or udp protocol")
+	}
+	if (r.ICMPTypes != nil || r.ICMPCodes != nil) && r.Protocol != ProtocolICMP {
+		return fmt.Errorf("ICMP types and codes need the icmp protocol")
+	}
+	for _, rng := range []*Range{r.SrcPorts, r.DstPorts, r.ICMPTypes, r.ICMPCodes} {
+		if rng != nil && rng.First > rng.Last {
+			return fmt.Errorf("range %d-%d is empty", rng.First, rng.Last)
+		}
+	}
+	return nil
+}
+
+func validateProtocol(p Protocol, anyAllowed bool) error {
+	switch p {
+	case ProtocolTCP, ProtocolUDP, ProtocolICMP:
+		return nil
+	case "":
+		if anyAllowed {
+			return nil
+		}
+	}
+	return fmt.Errorf("protocol %q is not one of tcp, udp, icmp", p)
+}
@@ -0,0 +1,59 @@
+// Package dryrun is the universal CNF backend that never touches the
+// dataplane, it records the dpconfigs the vppagent backend would apply
+package dryrun
+
+import (
+	"os"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/cisco-app-networking/nsm-nse/pkg/universal-cnf/config"
+	"github.com/cisco-app-networking/nsm-nse/pkg/universal-cnf/dataplane"
+	"github.com/cisco-app-networking/nsm-nse/pkg/universal-cnf/vppagent"
+)
+
+const (
+	// BackendName selects the backend in the configuration
+	BackendName = "dry-run"
+	// JournalEnv is the path of the journal file, the journal is written to
+	// stdout when not set
+	JournalEnv = "UCNF_DRYRUN_JOURNAL"
+)
+
+func init() {
+	config.RegisterBackend(BackendName, func() config.UniversalCNFBackend {
+		return &UniversalCNFDryRunBackend{}
+	})
+}
+
+// UniversalCNFDryRunBackend builds the dpconfigs like the vppagent backend
+// and records every ProcessDPConfig call in the journal instead of sending
+// it to the vpp-agent
+type UniversalCNFDryRunBackend struct {
+	vppagent.UniversalCNFVPPAgentBackend
+	Journal *Journal
+}
+
+// NewUniversalCNFBackend opens the journal selected by JournalEnv, unless
+// Journal is set
+func (b *UniversalCNFDryRunBackend) NewUniversalCNFBackend() error {
+	if b.Journal == nil {
+		journal, err := OpenJournal(os.Getenv(JournalEnv))
+		if err != nil {
+			return err
+		}
+		b.Journal = journal
+	}
+	logrus.Infof("Dry run, the dataplane configuration is recorded to %v", b.Journal)
+	return nil
+}
+
+// ProcessDPConfig records the VPP configuration the vppagent backend
+// translates the dpconfig to in the journal
+func (b *UniversalCNFDryRunBackend) ProcessDPConfig(dpconfig *dataplane.Config, update bool) error {
+	vppconfig, err := vppagent.BuildVppConfig(dpconfig)
+	if err != nil {
+		return err
+	}
+	return b.Journal.Record(update, vppconfig)
+}
@@ -0,0 +1,193 @@
+package dryrun
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/networkservicemesh/networkservicemesh/sdk/common"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.ligato.io/vpp-agent/v3/proto/ligato/vpp"
+
+	"github.com/cisco-app-networking/nsm-nse/pkg/nseconfig"
+	"github.com/cisco-app-networking/nsm-nse/pkg/universal-cnf/config"
+	"github.com/cisco-app-networking/nsm-nse/pkg/universal-cnf/config/backendtest"
+)
+
+func newBackend(journal *Journal) *UniversalCNFDryRunBackend {
+	return &UniversalCNFDryRunBackend{Journal: journal}
+}
+
+// tempWorkspace points the workspace to a new directory, the returned function
+// removes it and restores the workspace
+func tempWorkspace(t *testing.T) func() {
+	dir, err := ioutil.TempDir("", "dryrun")
+	require.NoError(t, err)
+	prior, set := os.LookupEnv(common.WorkspaceEnv)
+	require.NoError(t, os.Setenv(common.WorkspaceEnv, dir))
+	return func() {
+		if set {
+			_ = os.Setenv(common.WorkspaceEnv, prior)
+		} else {
+			_ = os.Unsetenv(common.WorkspaceEnv)
+		}
+		_ = os.RemoveAll(dir)
+	}
+}
+
+func TestConformance(t *testing.T) {
+	backendtest.Run(t, backendtest.Suite{
+		New: func(t *testing.T) config.UniversalCNFBackend {
+			return newBackend(NewJournal(ioutil.Discard, nseconfig.FormatJSON))
+		},
+		Apply: true,
+	})
+}
+
+func TestJournal(t *testing.T) {
+	dpconfig := &vpp.ConfigData{Routes: []*vpp.Route{{DstNetwork: "10.60.0.0/16", NextHopAddr: "10.60.1.1"}}}
+
+	var out bytes.Buffer
+	journal := NewJournal(&out, nseconfig.FormatJSON)
+	require.NoError(t, journal.Record(true, dpconfig))
+	// the entry is written when recorded, later changes are not
+	dpconfig.Routes = nil
+	require.NoError(t, journal.Record(false, dpconfig))
+	require.NoError(t, journal.Close())
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	require.Len(t, lines, 2)
+	var entries []Entry
+	for _, line := range lines {
+		entry := Entry{}
+		require.NoError(t, json.Unmarshal([]byte(line), &entry))
+		entries = append(entries, entry)
+	}
+	assert.Equal(t, 1, entries[0].Seq)
+	assert.Equal(t, OperationUpdate, entries[0].Operation)
+	require.Len(t, entries[0].Config.Routes, 1)
+	assert.Equal(t, "10.60.0.0/16", entries[0].Config.Routes[0].DstNetwork)
+	assert.Equal(t, 2, entries[1].Seq)
+	assert.Equal(t, OperationDelete, entries[1].Operation)
+	assert.Empty(t, entries[1].Config.Routes)
+
+	out.Reset()
+	journal = NewJournal(&out, nseconfig.FormatYAML)
+	require.NoError(t, journal.Record(true, &vpp.ConfigData{}))
+	require.NoError(t, journal.Record(false, &vpp.ConfigData{}))
+	require.NoError(t, journal.Close())
+	assert.Equal(t, 2, strings.Count(out.String(), "operation:"))
+	assert.Contains(t, out.String(), "\n---\n")
+}
+
+const testConfig = `
+apiVersion: v1
+backend: dry-run
+initActions:
+  - name: loopback
+    dpconfig:
+      interfaces:
+        - name: loop0
+          type: loopback
+endpoints:
+  - name: ucnf
+    vl3:
+      ifName: endpoint0
+      ipam:
+        defaultPrefixPool: 10.60.0.0/16
+`
+
+const testScenario = `
+steps:
+  - request:
+      id: nsc-1
+      endpoint: ucnf
+      srcIpAddr: 10.60.1.1/30
+      dstIpAddr: 10.60.1.2/30
+      srcRoutes: [10.70.0.0/16]
+      labels:
+        podName: nsc-1
+  - request:
+      id: nsc-2
+      endpoint: ucnf
+      srcIpAddr: 10.60.1.5/30
+      dstIpAddr: 10.60.1.6/30
+  - close: nsc-1
+`
+
+func TestReplay(t *testing.T) {
+	defer tempWorkspace(t)()
+
+	cfg := &config.UniversalCNFConfig{}
+	require.NoError(t, cfg.Load([]byte(testConfig), nseconfig.FormatYAML))
+	scenario, err := LoadScenario([]byte(testScenario))
+	require.NoError(t, err)
+
+	var out bytes.Buffer
+	journal := NewJournal(&out, nseconfig.FormatJSON)
+	require.NoError(t, Replay(context.Background(), cfg, newBackend(journal), scenario))
+
+	var operations, interfaces []string
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		// the interface links are not decoded, the journal is meant for diffs
+		entry := struct {
+			Operation string
+			Config    struct{ Interfaces []struct{ Name string } }
+		}{}
+		require.NoError(t, json.Unmarshal([]byte(line), &entry))
+		operations = append(operations, entry.Operation)
+		var names []string
+		for _, iface := range entry.Config.Interfaces {
+			names = append(names, iface.Name)
+		}
+		interfaces = append(interfaces, strings.Join(names, ","))
+	}
+	assert.Equal(t, []string{"update", "update", "update", "delete"}, operations)
+	// the endpoint dpconfig accumulates the connections, the delete lists the closed one
+	assert.Equal(t, []string{"loop0", "nsc-1", "nsc-1,endpoint0/0", "nsc-1"}, interfaces)
+}
+
+func TestReplayErrors(t *testing.T) {
+	cfg := &config.UniversalCNFConfig{}
+	require.NoError(t, cfg.Load([]byte(testConfig), nseconfig.FormatYAML))
+
+	for name, tc := range map[string]struct {
+		scenario string
+		expected string
+	}{
+		"unknown-field": {
+			scenario: "steps:\n  - close: a\n    open: b\n",
+			expected: "invalid scenario: yaml: unmarshal errors:\n  line 3: field open not found in type dryrun.Step",
+		},
+		"empty-step": {
+			scenario: "steps:\n  - {}\n",
+			expected: "invalid scenario: step 0 needs either request or close",
+		},
+		"unknown-endpoint": {
+			scenario: "steps:\n  - request: {id: a, endpoint: other}\n",
+			expected: "step 0 requests the unknown endpoint other",
+		},
+		"unknown-close": {
+			scenario: "steps:\n  - close: a\n",
+			expected: "step 0 closes the unknown connection a",
+		},
+		"duplicate-id": {
+			scenario: "steps:\n  - request: {id: a, endpoint: ucnf, dstIpAddr: 10.60.1.2/30}\n  - request: {id: a, endpoint: ucnf}\n",
+			expected: `step 1 requests the connection "a", which is empty or already requested`,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			defer tempWorkspace(t)()
+			scenario, err := LoadScenario([]byte(tc.scenario))
+			if err == nil {
+				err = Replay(context.Background(), cfg, newBackend(NewJournal(ioutil.Discard, nseconfig.FormatJSON)), scenario)
+			}
+			assert.EqualError(t, err, tc.expected)
+		})
+	}
+}
@@ -0,0 +1,114 @@
+package dryrun
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"go.ligato.io/vpp-agent/v3/proto/ligato/vpp"
+	"gopkg.in/yaml.v3"
+
+	"github.com/cisco-app-networking/nsm-nse/pkg/nseconfig"
+)
+
+// Operations of the journal entries
+const (
+	OperationUpdate = "update"
+	OperationDelete = "delete"
+)
+
+// Entry is a ProcessDPConfig call recorded in the journal
+type Entry struct {
+	Seq       int             `json:"seq" yaml:"seq"`
+	Operation string          `json:"operation" yaml:"operation"`
+	Config    *vpp.ConfigData `json:"config" yaml:"config"`
+}
+
+// Journal writes the recorded dpconfigs as JSON lines or YAML documents. The
+// entries hold no timestamps, so the journals of two runs of a scenario can
+// be diffed.
+type Journal struct {
+	mu     sync.Mutex
+	w      io.Writer
+	closer io.Closer
+	name   string
+	json   *json.Encoder
+	yaml   *yaml.Encoder
+	seq    int
+}
+
+// NewJournal returns a journal writing to w in the given format
+func NewJournal(w io.Writer, format nseconfig.Format) *Journal {
+	j := &Journal{w: w, name: "the journal"}
+	if format == nseconfig.FormatJSON {
+		j.json = json.NewEncoder(w)
+	} else {
+		j.yaml = yaml.NewEncoder(w)
+	}
+	return j
+}
+
+// OpenJournal creates the journal file at path, the format is selected by the
+// file extension. An empty path or - writes YAML to stdout.
+func OpenJournal(path string) (*Journal, error) {
+	if path == "" || path == "-" {
+		j := NewJournal(os.Stdout, nseconfig.FormatYAML)
+		j.name = "stdout"
+		return j, nil
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create the journal: %v", err)
+	}
+	j := NewJournal(f, nseconfig.FormatFromPath(path))
+	j.closer, j.name = f, path
+	return j, nil
+}
+
+// Record writes an entry with the dpconfig as it is now, the caller may
+// change it afterwards
+func (j *Journal) Record(update bool, vppconfig *vpp.ConfigData) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.seq++
+	entry := &Entry{Seq: j.seq, Operation: OperationDelete, Config: vppconfig}
+	if update {
+		entry.Operation = OperationUpdate
+	}
+
+	var err error
+	if j.json != nil {
+		err = j.json.Encode(entry)
+	} else {
+		err = j.yaml.Encode(entry)
+	}
+	if err != nil {
+		return fmt.Errorf("unable to record dpconfig %d: %v", j.seq, err)
+	}
+	return nil
+}
+
+// Close flushes the journal and closes its file
+func (j *Journal) Close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	var err error
+	if j.yaml != nil {
+		err = j.yaml.Close()
+	}
+	if j.closer != nil {
+		if cerr := j.closer.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+func (j *Journal) String() string {
+	return j.name
+}
@@ -0,0 +1,148 @@
+package dryrun
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+
+	"github.com/networkservicemesh/networkservicemesh/controlplane/api/connection"
+	"github.com/networkservicemesh/networkservicemesh/controlplane/api/connection/mechanisms/common"
+	"github.com/networkservicemesh/networkservicemesh/controlplane/api/connection/mechanisms/memif"
+	"github.com/networkservicemesh/networkservicemesh/controlplane/api/connectioncontext"
+	"github.com/networkservicemesh/networkservicemesh/controlplane/api/networkservice"
+	"gopkg.in/yaml.v3"
+
+	"github.com/cisco-app-networking/nsm-nse/pkg/nseconfig"
+	"github.com/cisco-app-networking/nsm-nse/pkg/universal-cnf/config"
+)
+
+// Scenario stands in for NSM: its steps request and close connections of the
+// endpoints of a configuration
+type Scenario struct {
+	Steps []Step `yaml:"steps"`
+}
+
+// Step requests a connection or closes the requested connection with the
+// given ID
+type Step struct {
+	Request *Connection `yaml:"request"`
+	Close   string      `yaml:"close"`
+}
+
+// Connection describes a connection request to an endpoint
+type Connection struct {
+	ID string `yaml:"id"`
+	// Endpoint is the name of the requested endpoint
+	Endpoint  string            `yaml:"endpoint"`
+	SrcIPAddr string            `yaml:"srcIpAddr"`
+	DstIPAddr string            `yaml:"dstIpAddr"`
+	SrcRoutes []string          `yaml:"srcRoutes"`
+	DstRoutes []string          `yaml:"dstRoutes"`
+	Labels    map[string]string `yaml:"labels"`
+}
+
+// LoadScenario decodes a YAML scenario, unknown fields are errors
+func LoadScenario(raw []byte) (*Scenario, error) {
+	decoder := yaml.NewDecoder(bytes.NewReader(raw))
+	decoder.KnownFields(true)
+
+	scenario := &Scenario{}
+	if err := decoder.Decode(scenario); err != nil {
+		return nil, fmt.Errorf("invalid scenario: %v", err)
+	}
+	for i, step := range scenario.Steps {
+		if (step.Request == nil) == (step.Close == "") {
+			return nil, fmt.Errorf("invalid scenario: step %d needs either request or close", i)
+		}
+	}
+	return scenario, nil
+}
+
+// Replay applies the dpconfigs of the init actions and runs the steps of the
+// scenario through the universal CNF endpoints of cfg. The commands and
+// clients of the init actions are not run.
+func Replay(ctx context.Context, cfg *config.UniversalCNFConfig, backend config.UniversalCNFBackend, scenario *Scenario) error {
+	for _, a := range cfg.Actions {
+		if a.DPConfig == nil {
+			continue
+		}
+		if err := backend.ProcessDPConfig(a.DPConfig, true); err != nil {
+			return fmt.Errorf("action %s: %v", a.Name, err)
+		}
+	}
+
+	endpoints := map[string]*config.UniversalCNFEndpoint{}
+	for _, e := range cfg.Endpoints {
+		endpoints[e.Name] = config.NewUniversalCNFEndpoint(backend, e)
+	}
+
+	type requested struct {
+		endpoint *config.UniversalCNFEndpoint
+		conn     *connection.Connection
+	}
+	conns := map[string]requested{}
+
+	for i, step := range scenario.Steps {
+		if step.Close != "" {
+			r, ok := conns[step.Close]
+			if !ok {
+				return fmt.Errorf("step %d closes the unknown connection %s", i, step.Close)
+			}
+			if _, err := r.endpoint.Close(ctx, r.conn); err != nil {
+				return fmt.Errorf("step %d: closing connection %s failed: %v", i, step.Close, err)
+			}
+			delete(conns, step.Close)
+			continue
+		}
+
+		c := step.Request
+		if _, ok := conns[c.ID]; ok || c.ID == "" {
+			return fmt.Errorf("step %d requests the connection %q, which is empty or already requested", i, c.ID)
+		}
+		uce, ok := endpoints[c.Endpoint]
+		if !ok {
+			return fmt.Errorf("step %d requests the unknown endpoint %s", i, c.Endpoint)
+		}
+		conn := c.connection(uce.Endpoint())
+		if _, err := uce.Request(ctx, &networkservice.NetworkServiceRequest{Connection: conn}); err != nil {
+			return fmt.Errorf("step %d: requesting connection %s failed: %v", i, c.ID, err)
+		}
+		conns[c.ID] = requested{endpoint: uce, conn: conn}
+	}
+	return nil
+}
+
+// connection builds the NSM connection of the request, with the mechanism of
+// the endpoint and a socket file or interface name derived from the ID
+func (c *Connection) connection(e *nseconfig.Endpoint) *connection.Connection {
+	ipContext := &connectioncontext.IPContext{
+		SrcIpAddr: c.SrcIPAddr,
+		DstIpAddr: c.DstIPAddr,
+	}
+	for _, prefix := range c.SrcRoutes {
+		ipContext.SrcRoutes = append(ipContext.SrcRoutes, &connectioncontext.Route{Prefix: prefix})
+	}
+	for _, prefix := range c.DstRoutes {
+		ipContext.DstRoutes = append(ipContext.DstRoutes, &connectioncontext.Route{Prefix: prefix})
+	}
+
+	parameters := map[string]string{memif.SocketFilename: c.ID + "/memif.sock"}
+	if e.Interface.Mechanism == nseconfig.MechanismKernel {
+		parameters = map[string]string{common.InterfaceNameKey: c.ID}
+	}
+
+	labels := map[string]string{}
+	for k, v := range c.Labels {
+		labels[k] = v
+	}
+	return &connection.Connection{
+		Id:             c.ID,
+		NetworkService: e.Name,
+		Context:        &connectioncontext.ConnectionContext{IpContext: ipContext},
+		Mechanism: &connection.Mechanism{
+			Type:       e.Interface.Mechanism.NSMMechanism(),
+			Parameters: parameters,
+		},
+		Labels: labels,
+	}
+}
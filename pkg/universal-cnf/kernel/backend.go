@@ -0,0 +1,194 @@
+// Package kernel is the universal CNF backend for plain Linux nodes, it
+// configures the connection interfaces in the kernel instead of VPP
+package kernel
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+
+	"github.com/networkservicemesh/networkservicemesh/controlplane/api/connection"
+	"github.com/networkservicemesh/networkservicemesh/controlplane/api/connection/mechanisms/common"
+	"github.com/networkservicemesh/networkservicemesh/controlplane/api/connection/mechanisms/kernel"
+	"github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+
+	"github.com/cisco-app-networking/nsm-nse/pkg/nseconfig"
+	"github.com/cisco-app-networking/nsm-nse/pkg/universal-cnf/config"
+	"github.com/cisco-app-networking/nsm-nse/pkg/universal-cnf/dataplane"
+)
+
+// BackendName selects the backend in the configuration
+const BackendName = "linux-kernel"
+
+func init() {
+	config.RegisterBackend(BackendName, func() config.UniversalCNFBackend {
+		return &UniversalCNFKernelBackend{}
+	})
+}
+
+// UniversalCNFKernelBackend configures the universal CNF in the Linux
+// kernel: the addresses and routes with netlink and the NAT with nftables.
+//
+// The connections use the kernel mechanism, their interfaces are the veth
+// ends NSM moves into the pod. TAP interfaces of the dpconfig are created and
+// removed by the backend. Memif and loopback interfaces, ACLs, twice-NAT and
+// the VPP passthrough are refused.
+type UniversalCNFKernelBackend struct {
+	// EndpointIfIDs are the IDs of the endpoint interfaces of the services
+	EndpointIfIDs dataplane.InterfaceIDs
+	// Handle is the netlink handle of the network namespace to configure,
+	// the one of the CNF when nil. TAP interfaces are created in the
+	// namespace of the calling thread.
+	Handle *netlink.Handle
+	// Nft applies an nftables script, the nft binary runs it when nil. It
+	// has to run in the network namespace of Handle.
+	Nft func(script string) error
+
+	mu sync.Mutex
+	// host interface names of the dpconfig interfaces that were applied
+	hostIfNames map[string]string
+	nat         natState
+}
+
+// NewDPConfig returns a plain DPConfig struct
+func (b *UniversalCNFKernelBackend) NewDPConfig() *dataplane.Config {
+	return &dataplane.Config{}
+}
+
+// NewUniversalCNFBackend opens the netlink handle and removes the NAT rules
+// left by an earlier run
+func (b *UniversalCNFKernelBackend) NewUniversalCNFBackend() error {
+	if b.Handle == nil {
+		handle, err := netlink.NewHandle()
+		if err != nil {
+			return fmt.Errorf("unable to open the netlink handle: %v", err)
+		}
+		b.Handle = handle
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.nat = natState{}
+	if err := b.applyNAT(); err != nil {
+		logrus.Warningf("Unable to reset the NAT rules, NAT is not available: %v", err)
+	}
+	return nil
+}
+
+// ProcessClient adds the kernel interface and the routes of a client connection
+func (b *UniversalCNFKernelBackend) ProcessClient(
+	dpconfig *dataplane.Config, ifName string, iface nseconfig.Interface, conn *connection.Connection) error {
+	if err := checkMechanism(conn); err != nil {
+		return err
+	}
+
+	routes := len(dpconfig.Routes)
+	dpconfig.AddClient(ifName, iface, conn)
+	setRouteInterface(dpconfig.Routes[routes:], ifName)
+	return nil
+}
+
+// ProcessEndpoint adds the kernel interface, the routes and the NAT of an
+// endpoint connection
+func (b *UniversalCNFKernelBackend) ProcessEndpoint(
+	dpconfig *dataplane.Config, endpoint *nseconfig.Endpoint, conn *connection.Connection) error {
+	if err := checkMechanism(conn); err != nil {
+		return err
+	}
+
+	ifName := b.buildIfName(endpoint.VL3.Ifname, endpoint.Name, conn)
+	routes := len(dpconfig.Routes)
+	if err := dpconfig.AddEndpoint(ifName, endpoint, conn); err != nil {
+		return err
+	}
+	setRouteInterface(dpconfig.Routes[routes:], ifName)
+	return nil
+}
+
+// SetupEndpoint adds the NAT pools and outside interfaces of the endpoint to
+// its dpconfig
+func (b *UniversalCNFKernelBackend) SetupEndpoint(dpconfig *dataplane.Config, endpoint *nseconfig.Endpoint) error {
+	dpconfig.SetupNAT(endpoint.NAT)
+	return nil
+}
+
+// ReleaseEndpoint releases the interface ID of the connection
+func (b *UniversalCNFKernelBackend) ReleaseEndpoint(endpoint *nseconfig.Endpoint, conn *connection.Connection) {
+	b.EndpointIfIDs.Release(endpoint.Name, conn.GetId())
+}
+
+// ProcessDPConfig applies the dpconfig to the kernel, or removes it
+func (b *UniversalCNFKernelBackend) ProcessDPConfig(dpconfig *dataplane.Config, update bool) error {
+	if err := checkSupported(dpconfig); err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var err error
+	if update {
+		err = b.apply(dpconfig)
+	} else {
+		err = b.remove(dpconfig)
+	}
+	if err != nil {
+		logrus.Errorf("Updating the kernel config failed with: %v", err)
+	}
+	return err
+}
+
+// GetEndpointIfID returns the interface ID of the connection of the service
+func (b *UniversalCNFKernelBackend) GetEndpointIfID(serviceName string, conn *connection.Connection) string {
+	return "/" + strconv.Itoa(b.EndpointIfIDs.Allocate(serviceName, conn.GetId()))
+}
+
+func (b *UniversalCNFKernelBackend) buildIfName(defaultIfName, serviceName string, conn *connection.Connection) string {
+	// NSC peer connection
+	if name, ok := conn.Labels[connection.PodNameKey]; ok {
+		return name
+	}
+
+	// vl3 NSE peer connection
+	if name, ok := conn.Labels[config.PEER_NAME]; ok {
+		return name
+	}
+
+	return defaultIfName + b.GetEndpointIfID(serviceName, conn)
+}
+
+// checkMechanism checks that NSM created a kernel interface for the connection
+func checkMechanism(conn *connection.Connection) error {
+	mechanism := conn.GetMechanism()
+	if mechanism.GetType() != kernel.MECHANISM {
+		return fmt.Errorf("the %s backend needs the kernel mechanism, connection %s uses %s",
+			BackendName, conn.GetId(), mechanism.GetType())
+	}
+	if mechanism.GetParameters()[common.InterfaceNameKey] == "" {
+		return fmt.Errorf("connection %s has no kernel interface name", conn.GetId())
+	}
+	return nil
+}
+
+// checkSupported refuses the parts of the dpconfig the kernel backend can't
+// translate
+func checkSupported(dpconfig *dataplane.Config) error {
+	if vppconfig := dpconfig.VPP; vppconfig != nil && (len(vppconfig.Interfaces) > 0 || len(vppconfig.Routes) > 0 ||
+		vppconfig.Nat44Global != nil || len(vppconfig.Dnat44S) > 0 || len(vppconfig.Nat44Interfaces) > 0 ||
+		len(vppconfig.Nat44Pools) > 0 || len(vppconfig.Acls) > 0) {
+		return fmt.Errorf("the %s backend does not support the vpp dpconfig", BackendName)
+	}
+	if len(dpconfig.ACLs) > 0 {
+		return fmt.Errorf("the %s backend does not support ACLs", BackendName)
+	}
+	return nil
+}
+
+// setRouteInterface sends the connection routes through the connection
+// interface
+func setRouteInterface(routes []*dataplane.Route, ifName string) {
+	for _, route := range routes {
+		route.Interface = ifName
+	}
+}
@@ -0,0 +1,306 @@
+package kernel
+
+import (
+	"net"
+	"runtime"
+	"testing"
+
+	"github.com/networkservicemesh/networkservicemesh/controlplane/api/connection"
+	"github.com/networkservicemesh/networkservicemesh/controlplane/api/connectioncontext"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+	"go.ligato.io/vpp-agent/v3/proto/ligato/vpp"
+	"golang.org/x/sys/unix"
+
+	"github.com/cisco-app-networking/nsm-nse/pkg/nseconfig"
+	"github.com/cisco-app-networking/nsm-nse/pkg/universal-cnf/config"
+	"github.com/cisco-app-networking/nsm-nse/pkg/universal-cnf/config/backendtest"
+	"github.com/cisco-app-networking/nsm-nse/pkg/universal-cnf/dataplane"
+)
+
+// newNamespace returns a new network namespace with the veth pair nsm0 and
+// nsm0-peer and its netlink handle, the test is skipped when namespaces can't
+// be created
+func newNamespace(t *testing.T) (netns.NsHandle, *netlink.Handle) {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	origin, err := netns.Get()
+	require.NoError(t, err)
+	defer origin.Close()
+
+	ns, err := netns.New()
+	if err != nil {
+		t.Skipf("network namespaces are not available: %v", err)
+	}
+	require.NoError(t, netns.Set(origin))
+	t.Cleanup(func() { ns.Close() })
+
+	handle, err := netlink.NewHandleAt(ns)
+	require.NoError(t, err)
+	t.Cleanup(handle.Delete)
+
+	veth := &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: "nsm0"}, PeerName: "nsm0-peer"}
+	require.NoError(t, handle.LinkAdd(veth))
+	peer, err := handle.LinkByName(veth.PeerName)
+	require.NoError(t, err)
+	require.NoError(t, handle.LinkSetUp(peer))
+	return ns, handle
+}
+
+// newBackend returns a backend configuring a new network namespace, with the
+// NAT scripts recorded in nft
+func newBackend(t *testing.T, nft *[]string) *UniversalCNFKernelBackend {
+	_, handle := newNamespace(t)
+	return &UniversalCNFKernelBackend{
+		Handle: handle,
+		Nft: func(script string) error {
+			if nft != nil {
+				*nft = append(*nft, script)
+			}
+			return nil
+		},
+	}
+}
+
+func TestConformance(t *testing.T) {
+	backendtest.Run(t, backendtest.Suite{
+		New: func(t *testing.T) config.UniversalCNFBackend {
+			return newBackend(t, nil)
+		},
+		Apply: true,
+	})
+}
+
+func TestProcessDPConfig(t *testing.T) {
+	var nft []string
+	b := newBackend(t, &nft)
+	conn := &connection.Connection{
+		Id: "1",
+		Context: &connectioncontext.ConnectionContext{
+			IpContext: &connectioncontext.IPContext{
+				SrcIpAddr: "10.60.1.1/30",
+				DstIpAddr: "10.60.1.2/30",
+				SrcRoutes: []*connectioncontext.Route{{Prefix: "10.70.0.0/16"}},
+			},
+		},
+		Mechanism: &connection.Mechanism{
+			Type:       nseconfig.MechanismKernel.NSMMechanism(),
+			Parameters: map[string]string{"name": "nsm0"},
+		},
+		Labels: map[string]string{"nat-port-forward-http": "8080:80"},
+	}
+	endpoint := &nseconfig.Endpoint{
+		Name: "ucnf",
+		NAT: &nseconfig.NAT{
+			Pools:        []nseconfig.NATPool{{FirstIP: "192.0.2.1"}},
+			PortForwards: []nseconfig.PortForward{{Name: "http", ExternalPorts: "8000-8999"}},
+		},
+		Interface: nseconfig.Interface{Mechanism: nseconfig.MechanismKernel},
+		VL3:       nseconfig.VL3{Ifname: "endpoint0"},
+	}
+
+	dpconfig := b.NewDPConfig()
+	require.NoError(t, b.SetupEndpoint(dpconfig, endpoint))
+	require.NoError(t, b.ProcessEndpoint(dpconfig, endpoint, conn))
+	require.NoError(t, b.ProcessDPConfig(dpconfig, true))
+
+	link, err := b.Handle.LinkByName("nsm0")
+	require.NoError(t, err)
+	assert.NotZero(t, link.Attrs().Flags&net.FlagUp)
+	addrs, err := b.Handle.AddrList(link, unix.AF_INET)
+	require.NoError(t, err)
+	require.Len(t, addrs, 1)
+	assert.Equal(t, "10.60.1.2/30", addrs[0].IPNet.String())
+	assert.Equal(t, []string{"10.70.0.0/16 via 10.60.1.1"}, routes(t, b.Handle, link))
+
+	require.Len(t, nft, 1)
+	assert.Contains(t, nft[0], `iifname "nsm0" snat to 192.0.2.1`)
+	assert.Contains(t, nft[0], "ip daddr 192.0.2.1 tcp dport 8080 dnat to 10.60.1.1:80")
+
+	// applying twice is not an error
+	require.NoError(t, b.ProcessDPConfig(dpconfig, true))
+	assert.Len(t, nft, 1)
+
+	require.NoError(t, b.ProcessDPConfig(dpconfig, false))
+	require.NoError(t, b.ProcessDPConfig(dpconfig, false))
+	require.NoError(t, b.ProcessDPConfig(dpconfig, false))
+	addrs, err = b.Handle.AddrList(link, unix.AF_INET)
+	require.NoError(t, err)
+	assert.Empty(t, addrs)
+	assert.Empty(t, routes(t, b.Handle, link))
+	require.Len(t, nft, 2)
+	assert.Equal(t, "table ip ucnf-nat\ndelete table ip ucnf-nat\n", nft[1])
+}
+
+func TestProcessDPConfigTap(t *testing.T) {
+	ns, handle := newNamespace(t)
+	b := &UniversalCNFKernelBackend{Handle: handle}
+
+	// the tap interfaces are created in the namespace of the thread
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	origin, err := netns.Get()
+	require.NoError(t, err)
+	defer origin.Close()
+	require.NoError(t, netns.Set(ns))
+	defer func() { require.NoError(t, netns.Set(origin)) }()
+
+	dpconfig := &dataplane.Config{
+		Interfaces: []*dataplane.Interface{{
+			Name:      "tap0",
+			Type:      dataplane.InterfaceTap,
+			Addresses: []string{"10.80.0.1/24"},
+			MTU:       1400,
+		}},
+	}
+
+	require.NoError(t, b.ProcessDPConfig(dpconfig, true))
+	link, err := handle.LinkByName("tap0")
+	require.NoError(t, err)
+	assert.Equal(t, "tun", link.Type())
+	assert.Equal(t, 1400, link.Attrs().MTU)
+
+	require.NoError(t, b.ProcessDPConfig(dpconfig, false))
+	_, err = b.Handle.LinkByName("tap0")
+	assert.IsType(t, netlink.LinkNotFoundError{}, err)
+}
+
+func TestProcessEndpointMemif(t *testing.T) {
+	b := &UniversalCNFKernelBackend{}
+	conn := &connection.Connection{Id: "1", Mechanism: &connection.Mechanism{Type: nseconfig.MechanismMemif.NSMMechanism()}}
+	err := b.ProcessEndpoint(b.NewDPConfig(), &nseconfig.Endpoint{Name: "ucnf"}, conn)
+	assert.EqualError(t, err, "the linux-kernel backend needs the kernel mechanism, connection 1 uses MEMIF")
+}
+
+func TestProcessDPConfigUnsupported(t *testing.T) {
+	b := &UniversalCNFKernelBackend{}
+	for _, tc := range []struct {
+		dpconfig *dataplane.Config
+		err      string
+	}{
+		{
+			dpconfig: &dataplane.Config{ACLs: []*dataplane.ACL{{Name: "acl"}}},
+			err:      "the linux-kernel backend does not support ACLs",
+		},
+		{
+			dpconfig: &dataplane.Config{VPP: &vpp.ConfigData{Interfaces: []*vpp.Interface{{Name: "loop0"}}}},
+			err:      "the linux-kernel backend does not support the vpp dpconfig",
+		},
+	} {
+		assert.EqualError(t, b.ProcessDPConfig(tc.dpconfig, true), tc.err)
+	}
+
+	// an empty passthrough is what a migrated dpconfig without VPP items holds
+	assert.NoError(t, checkSupported(&dataplane.Config{VPP: &vpp.ConfigData{}}))
+}
+
+func TestNATRuleset(t *testing.T) {
+	hostIfNames := map[string]string{"endpoint0/0": "nsm0", "endpoint0/1": "nsm1"}
+	hostIfName := func(name string) (string, error) { return hostIfNames[name], nil }
+	mapping := func(protocol dataplane.Protocol, external, local uint32) *dataplane.StaticMapping {
+		return &dataplane.StaticMapping{
+			Protocol:     protocol,
+			ExternalIP:   "192.0.2.1",
+			ExternalPort: external,
+			LocalIP:      "10.60.1.1",
+			LocalPort:    local,
+		}
+	}
+	pool := &dataplane.NATPool{FirstIP: "192.0.2.1", LastIP: "192.0.2.4"}
+	first := &dataplane.NAT{
+		Pools:          []*dataplane.NATPool{pool},
+		Interfaces:     []*dataplane.NATInterface{{Name: "endpoint0/0", Inside: true}},
+		StaticMappings: []*dataplane.StaticMapping{mapping(dataplane.ProtocolTCP, 8080, 80), mapping(dataplane.ProtocolICMP, 0, 0)},
+	}
+	second := &dataplane.NAT{
+		Interfaces:     []*dataplane.NATInterface{{Name: "endpoint0/1", Inside: true}},
+		StaticMappings: []*dataplane.StaticMapping{mapping(dataplane.ProtocolUDP, 53, 0)},
+	}
+
+	s := &natState{}
+	for _, nat := range []*dataplane.NAT{first, second} {
+		changed, err := s.update(nat, hostIfName, true)
+		require.NoError(t, err)
+		assert.True(t, changed)
+	}
+	assert.Equal(t, `table ip ucnf-nat
+delete table ip ucnf-nat
+table ip ucnf-nat {
+	chain prerouting {
+		type nat hook prerouting priority -100; policy accept;
+		ip daddr 192.0.2.1 dnat to 10.60.1.1
+		ip daddr 192.0.2.1 tcp dport 8080 dnat to 10.60.1.1:80
+		ip daddr 192.0.2.1 udp dport 53 dnat to 10.60.1.1:53
+	}
+	chain postrouting {
+		type nat hook postrouting priority 100; policy accept;
+		iifname "nsm0" snat to 192.0.2.1-192.0.2.4
+		iifname "nsm1" snat to 192.0.2.1-192.0.2.4
+	}
+}
+
+func TestNATRulesetPortRange(t *testing.T) {
+	ranged := func(external, local uint32) *dataplane.StaticMapping {
+		return &dataplane.StaticMapping{
+			Protocol:     dataplane.ProtocolTCP,
+			ExternalIP:   "192.0.2.1",
+			ExternalPort: external,
+			LocalIP:      "10.60.1.1",
+			LocalPort:    local,
+			PortCount:    2,
+		}
+	}
+
+	s := &natState{}
+	_, err := s.update(&dataplane.NAT{StaticMappings: []*dataplane.StaticMapping{ranged(8000, 0), ranged(9000, 90)}}, nil, true)
+	require.NoError(t, err)
+	ruleset := s.ruleset()
+	assert.Contains(t, ruleset, "ip daddr 192.0.2.1 tcp dport 8000-8001 dnat to 10.60.1.1\n")
+	assert.Contains(t, ruleset, "ip daddr 192.0.2.1 tcp dport 9000 dnat to 10.60.1.1:90\n")
+	assert.Contains(t, ruleset, "ip daddr 192.0.2.1 tcp dport 9001 dnat to 10.60.1.1:91\n")
+}
+`, s.ruleset())
+
+	// applying the same NAT again changes nothing
+	changed, err := s.update(first, hostIfName, true)
+	require.NoError(t, err)
+	assert.False(t, changed)
+
+	// the outside interfaces limit the translation of the inside traffic
+	outside := &dataplane.NAT{Interfaces: []*dataplane.NATInterface{{Name: "eth0", Outside: true}}}
+	_, err = s.update(outside, hostIfName, true)
+	require.NoError(t, err)
+	assert.Contains(t, s.ruleset(), `iifname "nsm0" oifname { "eth0" } snat to 192.0.2.1-192.0.2.4`)
+	_, err = s.update(outside, hostIfName, false)
+	require.NoError(t, err)
+
+	changed, err = s.update(second, hostIfName, false)
+	require.NoError(t, err)
+	assert.True(t, changed)
+	assert.Contains(t, s.ruleset(), `iifname "nsm0" snat to 192.0.2.1-192.0.2.4`)
+	assert.NotContains(t, s.ruleset(), "nsm1")
+	assert.NotContains(t, s.ruleset(), "dport 53")
+
+	changed, err = s.update(first, hostIfName, false)
+	require.NoError(t, err)
+	assert.True(t, changed)
+	assert.Equal(t, "table ip ucnf-nat\ndelete table ip ucnf-nat\n", s.ruleset())
+
+	_, err = s.update(&dataplane.NAT{Pools: []*dataplane.NATPool{{FirstIP: "192.0.2.1", TwiceNAT: true}}}, hostIfName, true)
+	assert.EqualError(t, err, "the linux-kernel backend does not support twice-NAT pools")
+}
+
+func routes(t *testing.T, handle *netlink.Handle, link netlink.Link) []string {
+	list, err := handle.RouteList(link, unix.AF_INET)
+	require.NoError(t, err)
+	var result []string
+	for _, r := range list {
+		if r.Gw != nil {
+			result = append(result, r.Dst.String()+" via "+r.Gw.String())
+		}
+	}
+	return result
+}
@@ -0,0 +1,231 @@
+package kernel
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/cisco-app-networking/nsm-nse/pkg/universal-cnf/config"
+	"github.com/cisco-app-networking/nsm-nse/pkg/universal-cnf/dataplane"
+)
+
+const (
+	// nftTable holds all the NAT rules of the backend, it is replaced as a
+	// whole on every change
+	nftTable   = "ucnf-nat"
+	nftTimeout = 10 * time.Second
+)
+
+// natState is the NAT of the applied dpconfigs: the pools, the inside and
+// outside interfaces and the static mappings. Like the vpp-agent it keeps an item
+// until a removed dpconfig lists it.
+type natState struct {
+	pools    map[string]bool
+	inside   map[string]bool
+	outside  map[string]bool
+	mappings map[staticMapping]bool
+}
+
+type staticMapping struct {
+	protocol     string
+	externalIP   string
+	externalPort uint32
+	localIP      string
+	localPort    uint32
+	portCount    uint32
+}
+
+// update adds or removes the NAT of the dpconfig and reports whether the
+// rules changed
+func (s *natState) update(nat *dataplane.NAT, hostIfName func(string) (string, error), add bool) (bool, error) {
+	if s.pools == nil {
+		s.pools, s.inside, s.outside = map[string]bool{}, map[string]bool{}, map[string]bool{}
+		s.mappings = map[staticMapping]bool{}
+	}
+
+	var pools, inside, outside []string
+	var mappings []staticMapping
+	for _, pool := range nat.Pools {
+		if pool.TwiceNAT {
+			return false, fmt.Errorf("the %s backend does not support twice-NAT pools", BackendName)
+		}
+		pools = append(pools, poolRange(pool))
+	}
+	for _, iface := range nat.Interfaces {
+		if iface.Outside {
+			// the outside interfaces are host interfaces
+			outside = append(outside, iface.Name)
+		}
+		if !iface.Inside {
+			continue
+		}
+		name, err := hostIfName(iface.Name)
+		if err != nil && !add {
+			// the interface was never applied, and neither was its NAT
+			continue
+		} else if err != nil {
+			return false, fmt.Errorf("NAT inside %v", err)
+		}
+		inside = append(inside, name)
+	}
+	for _, sm := range nat.StaticMappings {
+		m, err := buildStaticMapping(sm)
+		if err != nil {
+			return false, fmt.Errorf("NAT mapping %s: %v", sm.Label, err)
+		}
+		mappings = append(mappings, m)
+	}
+
+	changed := false
+	for _, pool := range pools {
+		changed = set(s.pools, pool, add) || changed
+	}
+	for _, name := range inside {
+		changed = set(s.inside, name, add) || changed
+	}
+	for _, name := range outside {
+		changed = set(s.outside, name, add) || changed
+	}
+	for _, m := range mappings {
+		if s.mappings[m] != add {
+			changed = true
+		}
+		if add {
+			s.mappings[m] = true
+		} else {
+			delete(s.mappings, m)
+		}
+	}
+	return changed, nil
+}
+
+// set adds or removes key and reports whether the set changed
+func set(s map[string]bool, key string, add bool) bool {
+	if s[key] == add {
+		return false
+	}
+	if add {
+		s[key] = true
+	} else {
+		delete(s, key)
+	}
+	return true
+}
+
+func poolRange(pool *dataplane.NATPool) string {
+	if pool.LastIP == "" || pool.LastIP == pool.FirstIP {
+		return pool.FirstIP
+	}
+	return pool.FirstIP + "-" + pool.LastIP
+}
+
+func buildStaticMapping(sm *dataplane.StaticMapping) (staticMapping, error) {
+	if sm.TwiceNAT {
+		return staticMapping{}, fmt.Errorf("the %s backend does not support twice-NAT", BackendName)
+	}
+
+	m := staticMapping{
+		externalIP: sm.ExternalIP,
+		localIP:    sm.LocalIP,
+	}
+	// ICMP and mappings without ports translate the address only
+	if (sm.Protocol == dataplane.ProtocolTCP || sm.Protocol == dataplane.ProtocolUDP) && sm.ExternalPort != 0 {
+		m.protocol = string(sm.Protocol)
+		m.externalPort, m.localPort, m.portCount = sm.ExternalPort, sm.LocalPortFor(sm.ExternalPort), sm.Ports()
+	}
+	return m, nil
+}
+
+// rules returns the DNAT rules of the mapping, a port range forwarded to the
+// same ports is a single rule and the other ranges a rule per port
+func (m staticMapping) rules() []string {
+	switch {
+	case m.protocol == "":
+		return []string{fmt.Sprintf("ip daddr %s dnat to %s", m.externalIP, m.localIP)}
+	case m.portCount > 1 && m.localPort == m.externalPort:
+		return []string{fmt.Sprintf("ip daddr %s %s dport %d-%d dnat to %s",
+			m.externalIP, m.protocol, m.externalPort, m.externalPort+m.portCount-1, m.localIP)}
+	}
+	var rules []string
+	for i := uint32(0); i < m.portCount; i++ {
+		rules = append(rules, fmt.Sprintf("ip daddr %s %s dport %d dnat to %s:%d",
+			m.externalIP, m.protocol, m.externalPort+i, m.localIP, m.localPort+i))
+	}
+	return rules
+}
+
+// ruleset returns the nftables script replacing the NAT table with the
+// current state, it only removes the table when there is no NAT
+func (s *natState) ruleset() string {
+	var b strings.Builder
+	// declaring the table first lets the delete succeed when it does not exist
+	fmt.Fprintf(&b, "table ip %s\ndelete table ip %s\n", nftTable, nftTable)
+	if len(s.mappings) == 0 && (len(s.inside) == 0 || len(s.pools) == 0) {
+		return b.String()
+	}
+
+	var dnat []string
+	for m := range s.mappings {
+		dnat = append(dnat, m.rules()...)
+	}
+	sort.Strings(dnat)
+
+	// traffic from the inside interfaces is translated on the way out of the
+	// outside interfaces, or on any way out when there are none
+	oif := ""
+	if len(s.outside) > 0 {
+		var names []string
+		for _, name := range sortedKeys(s.outside) {
+			names = append(names, fmt.Sprintf("%q", name))
+		}
+		oif = fmt.Sprintf(" oifname { %s }", strings.Join(names, ", "))
+	}
+
+	var snat []string
+	if len(s.pools) > 0 {
+		pools := sortedKeys(s.pools)
+		for _, name := range sortedKeys(s.inside) {
+			// nftables translates to a single range, the first pool is used
+			snat = append(snat, fmt.Sprintf("iifname %q%s snat to %s", name, oif, pools[0]))
+		}
+	}
+
+	fmt.Fprintf(&b, "table ip %s {\n", nftTable)
+	writeChain(&b, "prerouting", -100, dnat)
+	writeChain(&b, "postrouting", 100, snat)
+	b.WriteString("}\n")
+	return b.String()
+}
+
+func writeChain(b *strings.Builder, hook string, priority int, rules []string) {
+	fmt.Fprintf(b, "\tchain %s {\n\t\ttype nat hook %s priority %d; policy accept;\n", hook, hook, priority)
+	for _, rule := range rules {
+		fmt.Fprintf(b, "\t\t%s\n", rule)
+	}
+	b.WriteString("\t}\n")
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// applyNAT replaces the NAT table with the current state
+func (b *UniversalCNFKernelBackend) applyNAT() error {
+	script := b.nat.ruleset()
+	if b.Nft != nil {
+		return b.Nft(script)
+	}
+
+	nft := &config.Command{Name: "nft", Args: []string{"-f", "-"}, Stdin: script, Timeout: nftTimeout}
+	if _, err := nft.Run(context.Background(), nil); err != nil {
+		return fmt.Errorf("unable to apply the NAT rules: %v", err)
+	}
+	return nil
+}
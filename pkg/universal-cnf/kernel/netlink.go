@@ -0,0 +1,220 @@
+package kernel
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+
+	"github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+
+	"github.com/cisco-app-networking/nsm-nse/pkg/universal-cnf/dataplane"
+)
+
+// apply adds the interfaces, routes and NAT of the dpconfig, it stops at the
+// first error and leaves the removal of what was applied to the caller
+func (b *UniversalCNFKernelBackend) apply(dpconfig *dataplane.Config) error {
+	if b.hostIfNames == nil {
+		b.hostIfNames = map[string]string{}
+	}
+
+	for _, iface := range dpconfig.Interfaces {
+		if err := b.addInterface(iface); err != nil {
+			return fmt.Errorf("interface %s: %v", iface.Name, err)
+		}
+	}
+
+	for _, route := range dpconfig.Routes {
+		r, err := b.buildRoute(route)
+		if err != nil {
+			return err
+		}
+		if err := b.Handle.RouteAdd(r); err != nil && err != syscall.EEXIST {
+			return fmt.Errorf("unable to add the route to %s: %v", route.Dst, err)
+		}
+	}
+
+	if changed, err := b.nat.update(&dpconfig.NAT, b.hostIfName, true); err != nil {
+		return err
+	} else if changed {
+		return b.applyNAT()
+	}
+	return nil
+}
+
+// remove removes the interfaces, routes and NAT of the dpconfig, it goes on
+// after errors and returns the first one
+func (b *UniversalCNFKernelBackend) remove(dpconfig *dataplane.Config) error {
+	var first error
+	fail := func(err error) {
+		logrus.Warning(err)
+		if first == nil {
+			first = err
+		}
+	}
+
+	if changed, err := b.nat.update(&dpconfig.NAT, b.hostIfName, false); err != nil {
+		fail(err)
+	} else if changed {
+		if err := b.applyNAT(); err != nil {
+			fail(err)
+		}
+	}
+
+	for i := len(dpconfig.Routes) - 1; i >= 0; i-- {
+		route := dpconfig.Routes[i]
+		if _, ok := b.hostIfNames[route.Interface]; route.Interface != "" && !ok {
+			// the interface of the route was never applied
+			continue
+		}
+		r, err := b.buildRoute(route)
+		if err != nil {
+			// the interface of the route is gone, and so is the route
+			if _, notFound := err.(netlink.LinkNotFoundError); !notFound {
+				fail(err)
+			}
+			continue
+		}
+		if err := b.Handle.RouteDel(r); err != nil && err != syscall.ESRCH {
+			fail(fmt.Errorf("unable to remove the route to %s: %v", route.Dst, err))
+		}
+	}
+
+	for i := len(dpconfig.Interfaces) - 1; i >= 0; i-- {
+		iface := dpconfig.Interfaces[i]
+		if err := b.removeInterface(iface); err != nil {
+			fail(fmt.Errorf("interface %s: %v", iface.Name, err))
+		}
+		delete(b.hostIfNames, iface.Name)
+	}
+
+	return first
+}
+
+// hostIfName returns the kernel interface of an interface of the dpconfig,
+// interfaces of earlier dpconfigs are known by their name
+func (b *UniversalCNFKernelBackend) hostIfName(name string) (string, error) {
+	if hostIfName, ok := b.hostIfNames[name]; ok {
+		return hostIfName, nil
+	}
+	return "", fmt.Errorf("interface %s is not configured", name)
+}
+
+func (b *UniversalCNFKernelBackend) addInterface(iface *dataplane.Interface) error {
+	var link netlink.Link
+	switch iface.Type {
+	case dataplane.InterfaceKernel:
+		l, err := b.Handle.LinkByName(iface.HostIfName)
+		if err != nil {
+			return err
+		}
+		link = l
+	case dataplane.InterfaceTap:
+		tap := &netlink.Tuntap{
+			LinkAttrs: netlink.LinkAttrs{Name: tapName(iface)},
+			Mode:      netlink.TUNTAP_MODE_TAP,
+		}
+		if err := b.Handle.LinkAdd(tap); err != nil && err != syscall.EEXIST {
+			return fmt.Errorf("unable to create the tap interface: %v", err)
+		}
+		l, err := b.Handle.LinkByName(tap.Name)
+		if err != nil {
+			return err
+		}
+		link = l
+	default:
+		return fmt.Errorf("the %s backend does not support %s interfaces", BackendName, iface.Type)
+	}
+	b.hostIfNames[iface.Name] = link.Attrs().Name
+
+	for _, ipAddress := range iface.Addresses {
+		addr, err := netlink.ParseAddr(ipAddress)
+		if err != nil {
+			return err
+		}
+		if err := b.Handle.AddrAdd(link, addr); err != nil && err != syscall.EEXIST {
+			return fmt.Errorf("unable to add the address %s: %v", ipAddress, err)
+		}
+	}
+
+	if iface.MTU != 0 {
+		if err := b.Handle.LinkSetMTU(link, int(iface.MTU)); err != nil {
+			return fmt.Errorf("unable to set the MTU: %v", err)
+		}
+	}
+	if !iface.Disabled {
+		if err := b.Handle.LinkSetUp(link); err != nil {
+			return fmt.Errorf("unable to set the interface up: %v", err)
+		}
+	}
+	return nil
+}
+
+func (b *UniversalCNFKernelBackend) removeInterface(iface *dataplane.Interface) error {
+	hostIfName := iface.HostIfName
+	if iface.Type == dataplane.InterfaceTap {
+		hostIfName = tapName(iface)
+	} else if iface.Type != dataplane.InterfaceKernel {
+		// the interface was refused when applied
+		return nil
+	}
+
+	link, err := b.Handle.LinkByName(hostIfName)
+	if _, notFound := err.(netlink.LinkNotFoundError); notFound {
+		// the connection interfaces are removed by NSM with the connection
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if iface.Type == dataplane.InterfaceTap {
+		return b.Handle.LinkDel(link)
+	}
+
+	for _, ipAddress := range iface.Addresses {
+		addr, err := netlink.ParseAddr(ipAddress)
+		if err != nil {
+			return err
+		}
+		if err := b.Handle.AddrDel(link, addr); err != nil && err != syscall.EADDRNOTAVAIL {
+			return fmt.Errorf("unable to remove the address %s: %v", ipAddress, err)
+		}
+	}
+	return nil
+}
+
+func (b *UniversalCNFKernelBackend) buildRoute(route *dataplane.Route) (*netlink.Route, error) {
+	_, dst, err := net.ParseCIDR(route.Dst)
+	if err != nil {
+		return nil, fmt.Errorf("route destination %s: %v", route.Dst, err)
+	}
+	r := &netlink.Route{Dst: dst}
+
+	if route.NextHop != "" {
+		if r.Gw = net.ParseIP(route.NextHop); r.Gw == nil {
+			return nil, fmt.Errorf("route to %s has the invalid next hop %s", route.Dst, route.NextHop)
+		}
+	}
+
+	if route.Interface != "" {
+		hostIfName, err := b.hostIfName(route.Interface)
+		if err != nil {
+			return nil, fmt.Errorf("route to %s: %v", route.Dst, err)
+		}
+		link, err := b.Handle.LinkByName(hostIfName)
+		if err != nil {
+			return nil, err
+		}
+		r.LinkIndex = link.Attrs().Index
+	}
+	return r, nil
+}
+
+// tapName is the kernel name of a TAP interface, its host interface name
+// when set
+func tapName(iface *dataplane.Interface) string {
+	if iface.HostIfName != "" {
+		return iface.HostIfName
+	}
+	return iface.Name
+}
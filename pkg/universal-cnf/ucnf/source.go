@@ -0,0 +1,165 @@
+package ucnf
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/cisco-app-networking/nsm-nse/pkg/nseconfig"
+)
+
+const (
+	serviceAccountDir   = "/var/run/secrets/kubernetes.io/serviceaccount"
+	configMapPollPeriod = 10 * time.Second
+	kubeAPITimeout      = 10 * time.Second
+)
+
+// Source provides the configuration document
+type Source interface {
+	// Read returns the document and its format
+	Read(ctx context.Context) ([]byte, nseconfig.Format, error)
+	String() string
+}
+
+// NewSource returns the ConfigMap source when configMap is set, in the
+// namespace/name/key form, and the file source of configPath otherwise. An
+// empty format is selected by the file or key extension.
+func NewSource(configPath, configMap, format string) (Source, error) {
+	if format != "" {
+		if _, err := nseconfig.ParseFormat(format); err != nil {
+			return nil, err
+		}
+	}
+
+	if configMap == "" {
+		return &fileSource{path: configPath, format: format}, nil
+	}
+
+	parts := strings.Split(configMap, "/")
+	if len(parts) != 3 || parts[0] == "" || parts[1] == "" || parts[2] == "" {
+		return nil, fmt.Errorf("config map %q is not in the namespace/name/key form", configMap)
+	}
+	return &configMapSource{
+		namespace: parts[0],
+		name:      parts[1],
+		key:       parts[2],
+		format:    format,
+	}, nil
+}
+
+func sourceFormat(format, name string) nseconfig.Format {
+	if format == "" {
+		return nseconfig.FormatFromPath(name)
+	}
+	f, _ := nseconfig.ParseFormat(format)
+	return f
+}
+
+type fileSource struct {
+	path   string
+	format string
+}
+
+func (s *fileSource) Read(context.Context) ([]byte, nseconfig.Format, error) {
+	raw, err := ioutil.ReadFile(s.path)
+	return raw, sourceFormat(s.format, s.path), err
+}
+
+func (s *fileSource) String() string {
+	return s.path
+}
+
+// configMapSource reads a ConfigMap key with the in-cluster Kubernetes API
+// using the pod service account
+type configMapSource struct {
+	namespace string
+	name      string
+	key       string
+	format    string
+	client    *http.Client
+	host      string
+}
+
+func (s *configMapSource) Read(ctx context.Context) ([]byte, nseconfig.Format, error) {
+	format := sourceFormat(s.format, s.key)
+
+	if s.client == nil {
+		if err := s.init(); err != nil {
+			return nil, format, err
+		}
+	}
+
+	token, err := ioutil.ReadFile(serviceAccountDir + "/token")
+	if err != nil {
+		return nil, format, err
+	}
+
+	url := fmt.Sprintf("https://%s/api/v1/namespaces/%s/configmaps/%s", s.host, s.namespace, s.name)
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, format, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, format, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, format, fmt.Errorf("unable to get config map %s/%s: %s", s.namespace, s.name, resp.Status)
+	}
+
+	configMap := struct {
+		Data map[string]string `json:"data"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&configMap); err != nil {
+		return nil, format, err
+	}
+
+	data, ok := configMap.Data[s.key]
+	if !ok {
+		return nil, format, fmt.Errorf("config map %s/%s has no key %s", s.namespace, s.name, s.key)
+	}
+	return []byte(data), format, nil
+}
+
+func (s *configMapSource) init() error {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return fmt.Errorf("unable to read config map %s, not running in a Kubernetes cluster", s)
+	}
+
+	ca, err := ioutil.ReadFile(serviceAccountDir + "/ca.crt")
+	if err != nil {
+		return err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return fmt.Errorf("no certificates found in %s/ca.crt", serviceAccountDir)
+	}
+
+	s.host = net.JoinHostPort(host, port)
+	s.client = &http.Client{
+		Timeout: kubeAPITimeout,
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{RootCAs: pool},
+		},
+	}
+	return nil
+}
+
+func (s *configMapSource) String() string {
+	return fmt.Sprintf("configmap %s/%s/%s", s.namespace, s.name, s.key)
+}
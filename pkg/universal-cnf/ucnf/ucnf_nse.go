@@ -2,60 +2,101 @@ package ucnf
 
 import (
 	"context"
-	"os"
+	"crypto/sha256"
+	"io"
 
 	"github.com/cisco-app-networking/nsm-nse/pkg/nseconfig"
 	"github.com/cisco-app-networking/nsm-nse/pkg/universal-cnf/config"
-	"github.com/davecgh/go-spew/spew"
 	"github.com/networkservicemesh/networkservicemesh/sdk/common"
 	"github.com/sirupsen/logrus"
-	"gopkg.in/yaml.v2"
 )
 
-//
+// UcnfNse runs the init actions and the network service endpoints described
+// by an NSE configuration
 type UcnfNse struct {
+	backend          config.UniversalCNFBackend
 	processEndpoints *config.ProcessEndpoints
+	initActions      *config.ProcessInitActions
+	source           Source
+	config           *config.UniversalCNFConfig
+	configHash       [sha256.Size]byte
 }
 
+// Cleanup stops the endpoints, undoes the init actions and closes the backend
 func (ucnf *UcnfNse) Cleanup() {
 	ucnf.processEndpoints.Cleanup()
+	ucnf.initActions.Cleanup()
+	if closer, ok := ucnf.backend.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			logrus.Errorf("Closing the backend: %v", err)
+		}
+	}
 }
 
-func NewUcnfNse(configPath string, verify bool, backend config.UniversalCNFBackend, ceAddons config.CompositeEndpointAddons, ctx context.Context) *UcnfNse {
-
-	cnfConfig := &nseconfig.Config{}
-	f, err := os.Open(configPath)
+// NewUcnfNse loads the configuration from source, creates the backend it
+// selects, runs its init actions and starts its endpoints. An invalid
+// configuration is fatal, unless allowInvalid is set, and so is a failure of
+// the init actions that aborts them.
+func NewUcnfNse(source Source, allowInvalid bool, ceAddons config.CompositeEndpointAddons, ctx context.Context) *UcnfNse {
+	raw, format, err := source.Read(ctx)
 	if err != nil {
 		logrus.Fatal(err)
 	}
 
-	defer func() {
-		err = f.Close()
-		if err != nil {
-			logrus.Errorf("closing file failed %v", err)
+	cnfConfig, err := loadConfig(raw, format)
+	if err != nil {
+		if !allowInvalid {
+			logrus.Fatalf("NSE config errors: %v", err)
 		}
-	}()
+		logrus.Warningf("NSE config errors, starting anyway: %v", err)
+	}
 
-	err = nseconfig.NewConfig(yaml.NewDecoder(f), cnfConfig)
+	backend, err := config.NewBackend(cnfConfig.Backend)
 	if err != nil {
-		logrus.Warningf("NSE config errors: %v", err)
+		logrus.Fatal(err)
+	}
+	logrus.Infof("Using the %s backend", cnfConfig.Backend)
+	if configurable, ok := backend.(config.ConfigurableBackend); ok {
+		if err := configurable.Configure(&cnfConfig.Config); err != nil {
+			logrus.Fatal(err)
+		}
 	}
-
 	if err := backend.NewUniversalCNFBackend(); err != nil {
 		logrus.Fatal(err)
 	}
 
-	if verify {
-		spew.Dump(cnfConfig)
-		return nil
+	configuration := common.FromEnv()
+
+	pia, err := config.NewProcessInitActions(backend, cnfConfig.Actions, configuration, cnfConfig.CommandAllowlist)
+	if err != nil {
+		logrus.Fatalf("Error processing the init actions: %v", err)
 	}
+	pia.MaxParallelClients = cnfConfig.MaxParallelClients
 
-	configuration := common.FromEnv()
+	logrus.Infof("Running init actions")
+
+	// only a failure aborting the init actions is an error, the NSE starts
+	// after the failures the policies of the actions continue after
+	report, err := pia.Process(ctx, backend)
+	if err != nil {
+		pia.Cleanup()
+		logrus.Fatalf("Error running the init actions: %v", err)
+	}
+	for _, result := range report.Results {
+		if result.Status == config.ActionFailed {
+			logrus.Warningf("Init action %s failed, continuing: %v", result.Name, result.Err)
+		}
+	}
 
 	pe := config.NewProcessEndpoints(backend, cnfConfig.Endpoints, configuration, ceAddons, ctx)
 
 	ucnfnse := &UcnfNse{
+		backend:          backend,
 		processEndpoints: pe,
+		initActions:      pia,
+		source:           source,
+		config:           cnfConfig,
+		configHash:       sha256.Sum256(raw),
 	}
 
 	logrus.Infof("Starting endpoints")
@@ -65,3 +106,12 @@ func NewUcnfNse(configPath string, verify bool, backend config.UniversalCNFBacke
 	}
 	return ucnfnse
 }
+
+func loadConfig(raw []byte, format nseconfig.Format) (*config.UniversalCNFConfig, error) {
+	cnfConfig := &config.UniversalCNFConfig{}
+	err := cnfConfig.Load(raw, format)
+	for _, w := range cnfConfig.Warnings {
+		logrus.Warningf("NSE config: %s", w)
+	}
+	return cnfConfig, err
+}
@@ -0,0 +1,65 @@
+package ucnf
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/cisco-app-networking/nsm-nse/pkg/nseconfig"
+	"github.com/cisco-app-networking/nsm-nse/pkg/universal-cnf/config"
+)
+
+// Output formats of VerifyConfig
+const (
+	OutputText = "text"
+	OutputJSON = "json"
+)
+
+// VerifyConfig loads the configuration from source, writes the found errors and
+// warnings to out in the given format and returns an error if the
+// configuration is invalid
+func VerifyConfig(ctx context.Context, source Source, format string, out io.Writer) error {
+	var report *nseconfig.Report
+
+	raw, configFormat, err := source.Read(ctx)
+	if err != nil {
+		report = nseconfig.NewReport(nil, err)
+	} else {
+		cnfConfig := &config.UniversalCNFConfig{}
+		err = cnfConfig.Load(raw, configFormat)
+		report = nseconfig.NewReport(&cnfConfig.Config, err)
+	}
+
+	switch format {
+	case OutputJSON:
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(report); err != nil {
+			return err
+		}
+	case OutputText, "":
+		for _, issue := range report.Issues {
+			fmt.Fprintf(out, "%s: %s\n", issue.Severity, formatIssue(issue))
+		}
+		if report.Valid {
+			fmt.Fprintf(out, "%s: configuration is valid\n", source)
+		} else {
+			fmt.Fprintf(out, "%s: configuration is invalid\n", source)
+		}
+	default:
+		return fmt.Errorf("unknown output format %q, expected %s or %s", format, OutputText, OutputJSON)
+	}
+
+	if !report.Valid {
+		return fmt.Errorf("%s: configuration is invalid", source)
+	}
+	return nil
+}
+
+func formatIssue(issue nseconfig.Issue) string {
+	if issue.Line > 0 {
+		return fmt.Sprintf("line %d, column %d: %s", issue.Line, issue.Column, issue.Message)
+	}
+	return issue.Message
+}
@@ -0,0 +1,111 @@
+package ucnf
+
+import (
+	"context"
+	"crypto/sha256"
+	"path/filepath"
+	"time"
+
+	"github.com/cisco-app-networking/nsm-nse/pkg/nseconfig"
+	"github.com/fsnotify/fsnotify"
+	"github.com/sirupsen/logrus"
+)
+
+// Watch reloads the configuration whenever its source changes. For a config
+// file the parent directory is watched, so that the atomic symlink swap used
+// by Kubernetes for mounted ConfigMaps is detected as well, other sources are
+// polled. Watch blocks until ctx is done.
+func (ucnf *UcnfNse) Watch(ctx context.Context) error {
+	file, ok := ucnf.source.(*fileSource)
+	if !ok {
+		return ucnf.poll(ctx, configMapPollPeriod)
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = watcher.Close() }()
+
+	if err := watcher.Add(filepath.Dir(file.path)); err != nil {
+		return err
+	}
+
+	logrus.Infof("Watching %s for configuration changes", ucnf.source)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			logrus.Debugf("Config watcher event: %v", event)
+			ucnf.reloadOrKeep(ctx)
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			logrus.Errorf("Config watcher error: %v", err)
+		}
+	}
+}
+
+func (ucnf *UcnfNse) poll(ctx context.Context, period time.Duration) error {
+	logrus.Infof("Polling %s for configuration changes every %v", ucnf.source, period)
+
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			ucnf.reloadOrKeep(ctx)
+		}
+	}
+}
+
+func (ucnf *UcnfNse) reloadOrKeep(ctx context.Context) {
+	if err := ucnf.Reload(ctx); err != nil {
+		logrus.Errorf("Config reload failed, keeping the running configuration: %v", err)
+	}
+}
+
+// Reload reads the configuration and, if its content changed and is valid,
+// applies the endpoint changes to the running endpoints. The init actions are
+// not run again, their changes take effect on restart.
+func (ucnf *UcnfNse) Reload(ctx context.Context) error {
+	raw, format, err := ucnf.source.Read(ctx)
+	if err != nil {
+		return err
+	}
+
+	hash := sha256.Sum256(raw)
+	if hash == ucnf.configHash {
+		return nil
+	}
+
+	cnfConfig, err := loadConfig(raw, format)
+	if err != nil {
+		return err
+	}
+
+	diff := nseconfig.DiffEndpoints(ucnf.config.Endpoints, cnfConfig.Endpoints)
+	logrus.WithFields(logrus.Fields{
+		"added":   len(diff.Added),
+		"removed": len(diff.Removed),
+		"updated": len(diff.Updated),
+	}).Infof("Reloading configuration from %s", ucnf.source)
+
+	// a failed diff is applied again on the next reload, the running
+	// configuration is kept until it is fully applied
+	if err := ucnf.processEndpoints.Apply(diff); err != nil {
+		return err
+	}
+	ucnf.config = cnfConfig
+	ucnf.configHash = hash
+	return nil
+}
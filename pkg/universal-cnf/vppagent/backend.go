@@ -16,86 +16,108 @@
 package vppagent
 
 import (
+	"context"
 	"fmt"
-	"net"
 	"os"
 	"path"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/cisco-app-networking/nsm-nse/pkg/metrics"
+	"github.com/cisco-app-networking/nsm-nse/pkg/nseconfig"
 	"github.com/cisco-app-networking/nsm-nse/pkg/universal-cnf/config"
+	"github.com/cisco-app-networking/nsm-nse/pkg/universal-cnf/dataplane"
 	"github.com/networkservicemesh/networkservicemesh/controlplane/api/connection"
-	"github.com/networkservicemesh/networkservicemesh/controlplane/api/connection/mechanisms/memif"
 	"github.com/sirupsen/logrus"
-	"go.ligato.io/vpp-agent/v3/proto/ligato/vpp"
-	interfaces "go.ligato.io/vpp-agent/v3/proto/ligato/vpp/interfaces"
-	vpp_l3 "go.ligato.io/vpp-agent/v3/proto/ligato/vpp/l3"
-	vpp_nat "go.ligato.io/vpp-agent/v3/proto/ligato/vpp/nat"
 )
 
+const defaultReconcileInterval = 30 * time.Second
+
+func init() {
+	config.RegisterBackend("vppagent", func() config.UniversalCNFBackend {
+		return &UniversalCNFVPPAgentBackend{}
+	})
+}
+
 // UniversalCNFVPPAgentBackend is the VPP CNF backend struct
 type UniversalCNFVPPAgentBackend struct {
-	EndpointIfID map[string]int
+	// EndpointIfIDs are the IDs of the endpoint interfaces of the services
+	EndpointIfIDs dataplane.InterfaceIDs
+	// Client sends the configuration to the vpp-agent, DefaultClient when nil
+	Client *Client
+	// ReconcileInterval is the period of Reconcile, it does not run
+	// periodically when 0
+	ReconcileInterval time.Duration
+
+	// desired is the configuration the backend applied, the agent is
+	// corrected to it when its configuration drifts. owned are the keys the
+	// backend sent to the agent and did not delete, only they are reconciled.
+	// pending counts the transactions in flight, their items are desired
+	// before they are applied. version counts the changes of desired.
+	mu      sync.Mutex
+	idle    *sync.Cond
+	desired items
+	owned   map[string]bool
+	pending int
+	version uint64
+
+	// stop ends the reconciliation loop
+	stop context.CancelFunc
+}
+
+// Configure sets the reconcile interval from the vppAgent settings of the
+// configuration, 30s when not set
+func (b *UniversalCNFVPPAgentBackend) Configure(cfg *nseconfig.Config) error {
+	b.ReconcileInterval = defaultReconcileInterval
+	if interval := cfg.VPPAgent.ReconcileInterval; interval != nil {
+		b.ReconcileInterval = *interval
+	}
+	return nil
 }
 
 // NewDPConfig returns a plain DPConfig struct
-func (b *UniversalCNFVPPAgentBackend) NewDPConfig() *vpp.ConfigData {
-	return &vpp.ConfigData{}
+func (b *UniversalCNFVPPAgentBackend) NewDPConfig() *dataplane.Config {
+	return &dataplane.Config{}
 }
 
 // NewUniversalCNFBackend initializes the VPP CNF backend
 func (b *UniversalCNFVPPAgentBackend) NewUniversalCNFBackend() error {
-	b.EndpointIfID = make(map[string]int)
+	if b.Client == nil {
+		client, err := DefaultClient()
+		if err != nil {
+			return err
+		}
+		b.Client = client
+	}
 
-	if err := ResetVppAgent(); err != nil {
-		logrus.Fatalf("Error resetting vpp: %v", err)
+	logrus.Infof("Resetting vppagent at %v...", b.Client)
+	if err := b.Client.Reset(context.Background()); err != nil {
+		logrus.Errorf("failed to reset vppagent: %s", err)
 	}
 
+	if b.ReconcileInterval > 0 {
+		ctx, cancel := context.WithCancel(context.Background())
+		b.stop = cancel
+		go b.reconcileLoop(ctx)
+	}
 	return nil
 }
 
-// ProcessClient runs the client code for VPP CNF
-func (b *UniversalCNFVPPAgentBackend) ProcessClient(
-	dpconfig interface{}, ifName string, conn *connection.Connection) error {
-	vppconfig, ok := dpconfig.(*vpp.ConfigData)
-	if !ok {
-		return fmt.Errorf("unable to convert dpconfig to vppconfig	")
-	}
-
-	srcIP := conn.GetContext().GetIpContext().GetSrcIpAddr()
-	dstIP, _, _ := net.ParseCIDR(conn.GetContext().GetIpContext().GetDstIpAddr())
-	socketFilename := path.Join(getBaseDir(), memif.ToMechanism(conn.GetMechanism()).GetSocketFilename())
-
-	ipAddresses := []string{}
-	if len(srcIP) > net.IPv4len {
-		ipAddresses = append(ipAddresses, srcIP)
-	}
-
-	vppconfig.Interfaces = append(vppconfig.Interfaces,
-		&interfaces.Interface{
-			Name:        ifName,
-			Type:        interfaces.Interface_MEMIF,
-			Enabled:     true,
-			IpAddresses: ipAddresses,
-			Link: &interfaces.Interface_Memif{
-				Memif: &interfaces.MemifLink{
-					Master:         false, // The client is not the master in MEMIF
-					SocketFilename: socketFilename,
-					RingSize:       512,
-				},
-			},
-		})
-
-	// Process static routes
-	for _, route := range conn.GetContext().GetIpContext().GetDstRoutes() {
-		route := &vpp.Route{
-			Type:        vpp_l3.Route_INTER_VRF,
-			DstNetwork:  route.Prefix,
-			NextHopAddr: dstIP.String(),
-		}
-		vppconfig.Routes = append(vppconfig.Routes, route)
+// Close stops the reconciliation loop
+func (b *UniversalCNFVPPAgentBackend) Close() error {
+	if b.stop != nil {
+		b.stop()
 	}
+	return nil
+}
 
+// ProcessClient runs the client code for VPP CNF
+func (b *UniversalCNFVPPAgentBackend) ProcessClient(
+	dpconfig *dataplane.Config, ifName string, iface nseconfig.Interface, conn *connection.Connection) error {
+	// The client is not the master in MEMIF
+	dpconfig.AddClient(ifName, iface, conn)
 	return nil
 }
 
@@ -113,139 +135,209 @@ func (b *UniversalCNFVPPAgentBackend) buildVppIfName(defaultIfName, serviceName
 	}
 
 	// create a default interface name, using the prefix and the generated id
-	return defaultIfName + b.GetEndpointIfID(serviceName)
+	return defaultIfName + b.GetEndpointIfID(serviceName, conn)
 }
 
 // ProcessEndpoint runs the endpoint code for VPP CNF
 func (b *UniversalCNFVPPAgentBackend) ProcessEndpoint(
-	dpconfig interface{}, serviceName, ifName string, conn *connection.Connection) error {
-	vppconfig, ok := dpconfig.(*vpp.ConfigData)
-	if !ok {
-		return fmt.Errorf("unable to convert dpconfig to vppconfig	")
-	}
-
-	srcIP, _, _ := net.ParseCIDR(conn.GetContext().GetIpContext().GetSrcIpAddr())
-	dstIP := conn.GetContext().GetIpContext().GetDstIpAddr()
-	socketFilename := path.Join(getBaseDir(), memif.ToMechanism(conn.GetMechanism()).GetSocketFilename())
-
-	ipAddresses := []string{}
-	if len(dstIP) > net.IPv4len {
-		ipAddresses = append(ipAddresses, dstIP)
-	}
-
-	endpointIfName := b.buildVppIfName(ifName, serviceName, conn)
-
-	rxModes := []*interfaces.Interface_RxMode{
-		&interfaces.Interface_RxMode{
-			Mode:        interfaces.Interface_RxMode_INTERRUPT,
-			DefaultMode: true,
-		},
-	}
-
-	vppconfig.Interfaces = append(vppconfig.Interfaces,
-		&interfaces.Interface{
-			Name:        endpointIfName,
-			Type:        interfaces.Interface_MEMIF,
-			Enabled:     true,
-			IpAddresses: ipAddresses,
-			Link: &interfaces.Interface_Memif{
-				Memif: &interfaces.MemifLink{
-					Master:         true, // The endpoint is always the master in MEMIF
-					SocketFilename: socketFilename,
-					RingSize:       512,
-				},
-			},
-			RxModes: rxModes,
-		})
-
-	if err := os.MkdirAll(path.Dir(socketFilename), os.ModePerm); err != nil {
+	dpconfig *dataplane.Config, endpoint *nseconfig.Endpoint, conn *connection.Connection) error {
+	serviceName := endpoint.Name
+	endpointIfName := b.buildVppIfName(endpoint.VL3.Ifname, serviceName, conn)
+
+	// The endpoint is always the master in MEMIF
+	return dpconfig.AddEndpoint(endpointIfName, endpoint, conn)
+}
+
+// SetupEndpoint adds the NAT pools and outside interfaces of the endpoint to
+// its dpconfig
+func (b *UniversalCNFVPPAgentBackend) SetupEndpoint(dpconfig *dataplane.Config, endpoint *nseconfig.Endpoint) error {
+	dpconfig.SetupNAT(endpoint.NAT)
+	return nil
+}
+
+// ReleaseEndpoint releases the interface ID of the connection
+func (b *UniversalCNFVPPAgentBackend) ReleaseEndpoint(endpoint *nseconfig.Endpoint, conn *connection.Connection) {
+	b.EndpointIfIDs.Release(endpoint.Name, conn.GetId())
+}
+
+// GetEndpointIfID returns the interface ID of the connection of the service
+func (b *UniversalCNFVPPAgentBackend) GetEndpointIfID(serviceName string, conn *connection.Connection) string {
+	return "/" + strconv.Itoa(b.EndpointIfIDs.Allocate(serviceName, conn.GetId()))
+}
+
+// ProcessDPConfig translates the dpconfig and applies it to VPP
+func (b *UniversalCNFVPPAgentBackend) ProcessDPConfig(dpconfig *dataplane.Config, update bool) error {
+	vppconfig, err := BuildVppConfig(dpconfig)
+	if err != nil {
 		return err
 	}
 
-	// Process static routes
-	for _, route := range conn.GetContext().GetIpContext().GetSrcRoutes() {
-		route := &vpp.Route{
-			Type:        vpp_l3.Route_INTER_VRF,
-			DstNetwork:  route.Prefix,
-			NextHopAddr: srcIP.String(),
+	if update {
+		for _, iface := range vppconfig.Interfaces {
+			if memifLink := iface.GetMemif(); memifLink != nil {
+				if err := os.MkdirAll(path.Dir(memifLink.SocketFilename), os.ModePerm); err != nil {
+					return err
+				}
+			}
 		}
-		vppconfig.Routes = append(vppconfig.Routes, route)
 	}
 
-	// NAT configuration
-	if natIP := os.Getenv("NSE_NAT_IP"); natIP != "" {
-		// configure NAT pool (only once) - TODO: move pool config to some global init place?
-		if b.EndpointIfID[serviceName] == 0 {
-			natPool := &vpp_nat.Nat44AddressPool{FirstIp: natIP}
-			vppconfig.Nat44Pools = append(vppconfig.Nat44Pools, natPool)
+	// the desired configuration changes in the order of the transactions
+	b.mu.Lock()
+	b.init()
+	changed := configItems(vppconfig)
+	b.desired.apply(changed, update)
+	if update {
+		for key := range changed {
+			b.owned[key] = true
 		}
+	}
+	b.version++
+	b.pending++
+	ch := b.Client.enqueue(&change{update: update, config: vppconfig})
+	b.mu.Unlock()
 
-		// enable NAT on the interface
-		natIf := &vpp_nat.Nat44Interface{
-			Name:      endpointIfName,
-			NatInside: true,
-		}
-		vppconfig.Nat44Interfaces = append(vppconfig.Nat44Interfaces, natIf)
-
-		// add static NAT mappings for port forward requests
-		for k, v := range conn.Labels {
-			if strings.HasPrefix(k, "nat-port-forward") {
-				port, err := strconv.Atoi(v)
-				if err != nil {
-					logrus.Errorf("cannot convert port number %s: %v", v, err)
-					continue
-				}
-				natMapping := &vpp_nat.DNat44{
-					Label: k + "-to-" + srcIP.String(),
-					StMappings: []*vpp_nat.DNat44_StaticMapping{
-						{
-							ExternalIp:   natIP,
-							ExternalPort: uint32(port),
-							LocalIps: []*vpp_nat.DNat44_StaticMapping_LocalIP{
-								{
-									LocalIp:   srcIP.String(),
-									LocalPort: uint32(port),
-								},
-							},
-						},
-					},
-				}
-				if strings.Contains(k, "udp") {
-					natMapping.StMappings[0].Protocol = vpp_nat.DNat44_UDP
-				} else {
-					natMapping.StMappings[0].Protocol = vpp_nat.DNat44_TCP
-				}
-				vppconfig.Dnat44S = append(vppconfig.Dnat44S, natMapping)
-			}
-		}
+	err = b.Client.wait(context.Background(), ch)
+
+	b.mu.Lock()
+	if err != nil {
+		logrus.Errorf("Updating the VPP config failed with: %v", err)
+		b.desired.restore(changed, update, b.Client.appliedItems())
+		b.version++
+	} else if !update {
+		b.disown(changed)
 	}
+	b.pending--
+	b.idle.Broadcast()
+	b.mu.Unlock()
 
-	return nil
+	return err
 }
 
-// GetEndpointIfID generates a new interface ID from the service name
-func (b *UniversalCNFVPPAgentBackend) GetEndpointIfID(serviceName string) string {
-	if _, ok := b.EndpointIfID[serviceName]; !ok {
-		b.EndpointIfID[serviceName] = 0
-	} else {
-		b.EndpointIfID[serviceName]++
+// init creates the desired configuration, b.mu is held
+func (b *UniversalCNFVPPAgentBackend) init() {
+	if b.desired == nil {
+		b.desired = items{}
+		b.owned = map[string]bool{}
+		b.idle = sync.NewCond(&b.mu)
 	}
-
-	return "/" + strconv.Itoa(b.EndpointIfID[serviceName])
 }
 
-// ProcessDPConfig applies the VPP CNF configuration to VPP
-func (b *UniversalCNFVPPAgentBackend) ProcessDPConfig(dpconfig interface{}, update bool) error {
-	vppconfig, ok := dpconfig.(*vpp.ConfigData)
-	if !ok {
-		return fmt.Errorf("unable to convert dpconfig to vppconfig	")
+// disown forgets the deleted keys that are not desired again, b.mu is held
+func (b *UniversalCNFVPPAgentBackend) disown(deleted items) {
+	for key := range deleted {
+		if b.desired[key] == nil {
+			delete(b.owned, key)
+		}
 	}
+}
 
-	err := SendVppConfigToVppAgent(vppconfig, update)
+// Reconcile compares the desired configuration with the configuration of the
+// agent and with the interfaces and routes the agent dumps from VPP. When they
+// differ the items missing or modified are updated and the owned items that
+// are not desired are deleted, the other configuration of the agent, like the
+// one sent by SendVppConfigToVppAgent, is left alone. It waits for the
+// transactions in flight and compares a snapshot of the desired configuration,
+// the correction is left to the next reconciliation when the desired
+// configuration changes meanwhile.
+func (b *UniversalCNFVPPAgentBackend) Reconcile(ctx context.Context) error {
+	b.mu.Lock()
+	b.init()
+	for b.pending > 0 {
+		b.idle.Wait()
+	}
+	desired, version := b.desired.clone(), b.version
+	owned := make(map[string]bool, len(b.owned))
+	for key := range b.owned {
+		owned[key] = true
+	}
+	b.mu.Unlock()
 
+	agentConfig, err := b.Client.Get(ctx)
 	if err != nil {
-		logrus.Errorf("Updating the VPP config failed with: %v", err)
+		return fmt.Errorf("can't get the vppagent configuration: %v", err)
 	}
+	dumped, err := b.Client.Dump(ctx)
+	if err != nil {
+		return fmt.Errorf("can't dump the VPP configuration: %v", err)
+	}
+	agentItems := configItems(agentConfig)
 
-	return err
+	b.mu.Lock()
+	if b.pending > 0 || b.version != version {
+		b.mu.Unlock()
+		logrus.Infof("The desired VPP config changed while reconciling, the correction is left to the next reconciliation")
+		return nil
+	}
+	// the owned keys the agent does not have are deleted already
+	for key := range owned {
+		if desired[key] == nil && agentItems[key] == nil {
+			delete(b.owned, key)
+		}
+	}
+
+	drift := findDrift(desired, owned, agentItems, configItems(dumped))
+	if len(drift) == 0 {
+		b.mu.Unlock()
+		return nil
+	}
+	for kind, keys := range drift {
+		metrics.VPPDrift.WithLabelValues(kind).Add(float64(len(keys)))
+	}
+	logrus.Warnf("The vppagent configuration drifted from the desired one, correcting it: %v", drift)
+
+	updated, deleted := items{}, items{}
+	for _, key := range append(drift["missing"], drift["modified"]...) {
+		updated[key] = desired[key]
+	}
+	for _, key := range drift["extra"] {
+		deleted[key] = agentItems[key]
+	}
+	var changes []*change
+	if len(updated) > 0 {
+		changes = append(changes, b.Client.enqueue(&change{update: true, force: true, config: updated.config()}))
+	}
+	if len(deleted) > 0 {
+		changes = append(changes, b.Client.enqueue(&change{config: deleted.config()}))
+	}
+	b.pending++
+	b.mu.Unlock()
+
+	var errs []string
+	for _, ch := range changes {
+		if err := b.Client.wait(ctx, ch); err != nil {
+			errs = append(errs, err.Error())
+		} else if !ch.update {
+			b.mu.Lock()
+			b.disown(deleted)
+			b.mu.Unlock()
+		}
+	}
+
+	b.mu.Lock()
+	b.pending--
+	b.idle.Broadcast()
+	b.mu.Unlock()
+
+	if len(errs) > 0 {
+		metrics.VPPCorrections.WithLabelValues("failed").Inc()
+		return fmt.Errorf("can't correct the vppagent configuration: %s", strings.Join(errs, "; "))
+	}
+	metrics.VPPCorrections.WithLabelValues("succeeded").Inc()
+	return nil
+}
+
+func (b *UniversalCNFVPPAgentBackend) reconcileLoop(ctx context.Context) {
+	ticker := time.NewTicker(b.ReconcileInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := b.Reconcile(ctx); err != nil && ctx.Err() == nil {
+				logrus.Errorf("Reconciling the VPP config failed with: %v", err)
+			}
+		}
+	}
 }
@@ -1,14 +1,24 @@
 package vppagent
 
 import (
+	"context"
+	"fmt"
 	"os"
 	"testing"
+	"time"
 
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"go.ligato.io/vpp-agent/v3/proto/ligato/vpp"
 	interfaces "go.ligato.io/vpp-agent/v3/proto/ligato/vpp/interfaces"
 	vppl3 "go.ligato.io/vpp-agent/v3/proto/ligato/vpp/l3"
 
+	"github.com/cisco-app-networking/nsm-nse/pkg/metrics"
+	"github.com/cisco-app-networking/nsm-nse/pkg/nseconfig"
+	"github.com/cisco-app-networking/nsm-nse/pkg/universal-cnf/config"
+	"github.com/cisco-app-networking/nsm-nse/pkg/universal-cnf/config/backendtest"
+	"github.com/cisco-app-networking/nsm-nse/pkg/universal-cnf/dataplane"
 	"github.com/networkservicemesh/networkservicemesh/controlplane/api/connection"
 	"github.com/networkservicemesh/networkservicemesh/controlplane/api/connectioncontext"
 	"github.com/networkservicemesh/networkservicemesh/sdk/common"
@@ -58,9 +68,7 @@ func TestBuildVppIfNameVL3NSEPeer(t *testing.T) {
 
 func TestBuildVppIfNameDefault(t *testing.T) {
 
-	b := UniversalCNFVPPAgentBackend{
-		EndpointIfID: map[string]int {},
-	}
+	b := UniversalCNFVPPAgentBackend{}
 
 	conn := &connection.Connection{}
 
@@ -73,7 +81,7 @@ func TestBuildVppIfNameDefault(t *testing.T) {
 func TestProcessEndpoint(t *testing.T) {
 
 	b := UniversalCNFVPPAgentBackend{}
-	vppconfig := &vpp.ConfigData{}
+	dpconfig := &dataplane.Config{}
 	conn := &connection.Connection{
 		Context: &connectioncontext.ConnectionContext{
 			IpContext: &connectioncontext.IPContext{
@@ -95,7 +103,13 @@ func TestProcessEndpoint(t *testing.T) {
 
 	os.Setenv(common.WorkspaceEnv, workspaceEnv)
 
-	b.ProcessEndpoint(vppconfig, serviceName, ifName, conn)
+	endpoint := &nseconfig.Endpoint{
+		Name: serviceName,
+		VL3:  nseconfig.VL3{Ifname: ifName},
+	}
+	b.ProcessEndpoint(dpconfig, endpoint, conn)
+	vppconfig, err := BuildVppConfig(dpconfig)
+	assert.NoError(t, err)
 
 	//make sure the expected interface has been added to vppconfig
 	assert.NotNil(t, vppconfig)
@@ -131,10 +145,80 @@ func TestProcessEndpoint(t *testing.T) {
 	assert.Equal(t, srcIpAddrEndpoint, route.NextHopAddr)
 }
 
+func TestProcessEndpointInterface(t *testing.T) {
+	for name, tc := range map[string]struct {
+		iface    nseconfig.Interface
+		validate func(t *testing.T, iface *interfaces.Interface)
+	}{
+		"memif": {
+			iface: nseconfig.Interface{
+				RxMode: nseconfig.RxModePolling,
+				Memif:  nseconfig.Memif{RingSize: 2048, BufferSize: 4096, Queues: 4},
+			},
+			validate: func(t *testing.T, iface *interfaces.Interface) {
+				assert.Equal(t, interfaces.Interface_MEMIF, iface.GetType())
+				memif := iface.GetMemif()
+				assert.NotNil(t, memif)
+				assert.Equal(t, uint32(2048), memif.RingSize)
+				assert.Equal(t, uint32(4096), memif.BufferSize)
+				assert.Equal(t, uint32(4), memif.RxQueues)
+				assert.Equal(t, uint32(4), memif.TxQueues)
+				assert.Equal(t, interfaces.Interface_RxMode_POLLING, iface.RxModes[0].Mode)
+			},
+		},
+		"kernel": {
+			iface: nseconfig.Interface{
+				Mechanism: nseconfig.MechanismKernel,
+				RxMode:    nseconfig.RxModeAdaptive,
+			},
+			validate: func(t *testing.T, iface *interfaces.Interface) {
+				assert.Equal(t, interfaces.Interface_AF_PACKET, iface.GetType())
+				assert.Nil(t, iface.GetMemif())
+				afpacket := iface.GetAfpacket()
+				assert.NotNil(t, afpacket)
+				assert.Equal(t, "nsm0", afpacket.HostIfName)
+				assert.Equal(t, interfaces.Interface_RxMode_ADAPTIVE, iface.RxModes[0].Mode)
+			},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			b := UniversalCNFVPPAgentBackend{}
+			dpconfig := &dataplane.Config{}
+			conn := &connection.Connection{
+				Context: &connectioncontext.ConnectionContext{
+					IpContext: &connectioncontext.IPContext{
+						SrcIpAddr: srcIpAddrEndpoint + "/30",
+					},
+				},
+				Labels: map[string]string{
+					"podName": podName,
+				},
+				Mechanism: &connection.Mechanism{
+					Type:       tc.iface.Mechanism.NSMMechanism(),
+					Parameters: map[string]string{"name": "nsm0"},
+				},
+			}
+
+			os.Setenv(common.WorkspaceEnv, workspaceEnv)
+
+			endpoint := &nseconfig.Endpoint{
+				Name:      serviceName,
+				Interface: tc.iface,
+				VL3:       nseconfig.VL3{Ifname: ifName},
+			}
+			assert.NoError(t, b.ProcessEndpoint(dpconfig, endpoint, conn))
+			vppconfig, err := BuildVppConfig(dpconfig)
+			assert.NoError(t, err)
+			assert.Equal(t, 1, len(vppconfig.Interfaces))
+			tc.validate(t, vppconfig.Interfaces[0])
+		})
+	}
+}
+
 func TestProcessClient(t *testing.T) {
 
 	b := UniversalCNFVPPAgentBackend{}
-	vppconfig := &vpp.ConfigData{}
+	dpconfig := &dataplane.Config{}
 	conn := &connection.Connection{
 		Context: &connectioncontext.ConnectionContext{
 			IpContext: &connectioncontext.IPContext{
@@ -153,7 +237,9 @@ func TestProcessClient(t *testing.T) {
 
 	os.Setenv(common.WorkspaceEnv, workspaceEnv)
 
-	b.ProcessClient(vppconfig, ifName, conn)
+	b.ProcessClient(dpconfig, ifName, nseconfig.Interface{}, conn)
+	vppconfig, err := BuildVppConfig(dpconfig)
+	assert.NoError(t, err)
 
 	assert.NotNil(t, vppconfig)
 	assert.NotNil(t, vppconfig.Interfaces)
@@ -179,3 +265,194 @@ func TestProcessClient(t *testing.T) {
 	assert.Equal(t, dstIpRouteClient, route.DstNetwork)
 	assert.Equal(t, dstIpAddrClient, route.NextHopAddr)
 }
+
+func TestConformance(t *testing.T) {
+	backendtest.Run(t, backendtest.Suite{
+		New: func(t *testing.T) config.UniversalCNFBackend {
+			return &UniversalCNFVPPAgentBackend{}
+		},
+	})
+}
+
+func loopbackDPConfig(names ...string) *dataplane.Config {
+	dpconfig := &dataplane.Config{}
+	for _, name := range names {
+		dpconfig.Interfaces = append(dpconfig.Interfaces, &dataplane.Interface{Name: name, Type: dataplane.InterfaceLoopback})
+	}
+	return dpconfig
+}
+
+func TestProcessDPConfigDesired(t *testing.T) {
+	fake := &fakeConfigurator{fail: map[string]error{"update lo2": fmt.Errorf("agent failed")}}
+	b := &UniversalCNFVPPAgentBackend{Client: newTestClient(fake)}
+
+	require.NoError(t, b.ProcessDPConfig(loopbackDPConfig("lo0", "lo1"), true))
+	require.NoError(t, b.ProcessDPConfig(loopbackDPConfig("lo1"), false))
+	assert.Error(t, b.ProcessDPConfig(loopbackDPConfig("lo2"), true))
+
+	// the failed update is not desired
+	assert.Equal(t, []string{"interfaces/lo0"}, b.desired.keys())
+}
+
+func TestReconcile(t *testing.T) {
+	fake := &fakeConfigurator{}
+	b := &UniversalCNFVPPAgentBackend{Client: newTestClient(fake)}
+	ctx := context.Background()
+
+	dpconfig := loopbackDPConfig("lo0", "lo1")
+	dpconfig.Routes = []*dataplane.Route{{Dst: "10.0.0.0/24", NextHop: "10.0.1.1", Interface: "lo1"}}
+	require.NoError(t, b.ProcessDPConfig(dpconfig, true))
+
+	applied, err := BuildVppConfig(dpconfig)
+	require.NoError(t, err)
+	fake.agentConfig, fake.dumped = applied, applied
+	require.NoError(t, b.Reconcile(ctx))
+	assert.Equal(t, []string{"update lo0,lo1"}, fake.recorded(), "no drift")
+
+	missing := testutil.ToFloat64(metrics.VPPDrift.WithLabelValues("missing"))
+	extra := testutil.ToFloat64(metrics.VPPDrift.WithLabelValues("extra"))
+	corrections := testutil.ToFloat64(metrics.VPPCorrections.WithLabelValues("succeeded"))
+
+	// VPP restarted, lo1 and the route are gone and are sent again
+	fake.dumped = &vpp.ConfigData{Interfaces: applied.Interfaces[:1]}
+	require.NoError(t, b.Reconcile(ctx))
+	assert.Equal(t, missing+2, testutil.ToFloat64(metrics.VPPDrift.WithLabelValues("missing")))
+
+	// the rollback of lo2 failed
+	fake.Lock()
+	fake.fail = map[string]error{"update lo2": fmt.Errorf("agent failed"), "delete lo2": fmt.Errorf("agent failed")}
+	fake.Unlock()
+	assert.Error(t, b.ProcessDPConfig(loopbackDPConfig("lo2"), true))
+	fake.Lock()
+	fake.fail = nil
+	fake.Unlock()
+
+	// the agent restarted with the item of the failed rollback and an item of
+	// another client, only the owned one is deleted
+	fake.agentConfig = &vpp.ConfigData{Interfaces: []*vpp.Interface{{Name: "lo2"}, {Name: "stale", Enabled: true}}}
+	require.NoError(t, b.Reconcile(ctx))
+	assert.Equal(t, missing+5, testutil.ToFloat64(metrics.VPPDrift.WithLabelValues("missing")))
+	assert.Equal(t, extra+1, testutil.ToFloat64(metrics.VPPDrift.WithLabelValues("extra")))
+	assert.False(t, b.owned["interfaces/lo2"])
+
+	assert.Equal(t, corrections+2, testutil.ToFloat64(metrics.VPPCorrections.WithLabelValues("succeeded")))
+	assert.Equal(t, []string{
+		"update lo0,lo1", "update lo1", "update lo2", "delete lo2", "update lo0,lo1", "delete lo2(down)",
+	}, fake.recorded())
+}
+
+func TestReconcileForeignConfig(t *testing.T) {
+	fake := &fakeConfigurator{}
+	client := newTestClient(fake)
+	b := &UniversalCNFVPPAgentBackend{Client: client}
+	ctx := context.Background()
+
+	dpconfig := loopbackDPConfig("lo0")
+	require.NoError(t, b.ProcessDPConfig(dpconfig, true))
+	// the configuration of SendVppConfigToVppAgent goes through the same client
+	require.NoError(t, client.Send(ctx, interfaceConfig("foreign"), true))
+
+	applied, err := BuildVppConfig(dpconfig)
+	require.NoError(t, err)
+	applied.Interfaces = append(applied.Interfaces, interfaceConfig("foreign").Interfaces...)
+	fake.agentConfig, fake.dumped = applied, applied
+	require.NoError(t, b.Reconcile(ctx))
+	assert.Equal(t, []string{"update lo0", "update foreign"}, fake.recorded())
+}
+
+func TestReconcileUnlocked(t *testing.T) {
+	fake := &fakeConfigurator{}
+	b := &UniversalCNFVPPAgentBackend{Client: newTestClient(fake)}
+	require.NoError(t, b.ProcessDPConfig(loopbackDPConfig("lo0"), true))
+
+	release := make(chan struct{})
+	fake.Lock()
+	fake.releaseGet = release
+	fake.Unlock()
+	reconciled := make(chan error)
+	go func() { reconciled <- b.Reconcile(context.Background()) }()
+	require.Eventually(t, func() bool {
+		fake.Lock()
+		defer fake.Unlock()
+		return fake.releaseGet == nil
+	}, time.Second, time.Millisecond, "the agent is queried")
+
+	// the connections are not held back by the query, the missing lo0 it
+	// finds is not sent again since it was deleted meanwhile
+	require.NoError(t, b.ProcessDPConfig(loopbackDPConfig("lo0"), false))
+	close(release)
+	require.NoError(t, <-reconciled)
+	assert.Equal(t, []string{"update lo0", "delete lo0"}, fake.recorded())
+}
+
+// inFlight waits for the transaction the fake holds until release is closed
+func inFlight(t *testing.T, fake *fakeConfigurator) {
+	require.Eventually(t, func() bool {
+		fake.Lock()
+		defer fake.Unlock()
+		return fake.release == nil
+	}, time.Second, time.Millisecond, "the transaction is in flight")
+}
+
+func TestProcessDPConfigRestore(t *testing.T) {
+	release := make(chan struct{})
+	fake := &fakeConfigurator{release: release, fail: map[string]error{"update lo0,lo1": fmt.Errorf("agent failed")}}
+	b := &UniversalCNFVPPAgentBackend{Client: newTestClient(fake)}
+
+	failed := make(chan error)
+	go func() { failed <- b.ProcessDPConfig(loopbackDPConfig("lo0", "lo1"), true) }()
+	inFlight(t, fake)
+
+	// lo1 is updated again while the failing update is in flight
+	updated := make(chan error)
+	go func() { updated <- b.ProcessDPConfig(loopbackDPConfig("lo1"), true) }()
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	assert.Error(t, <-failed)
+	require.NoError(t, <-updated)
+
+	assert.Equal(t, []string{"interfaces/lo1"}, b.desired.keys())
+	assert.Equal(t, []string{"update lo0,lo1", "delete lo0,lo1", "update lo1"}, fake.recorded())
+}
+
+func TestReconcileInFlight(t *testing.T) {
+	release := make(chan struct{})
+	fake := &fakeConfigurator{release: release, fail: map[string]error{"update lo0": fmt.Errorf("agent failed")}}
+	b := &UniversalCNFVPPAgentBackend{Client: newTestClient(fake)}
+
+	failed := make(chan error)
+	go func() { failed <- b.ProcessDPConfig(loopbackDPConfig("lo0"), true) }()
+	inFlight(t, fake)
+
+	// the failing update is not compared with the agent
+	reconciled := make(chan error)
+	go func() { reconciled <- b.Reconcile(context.Background()) }()
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	assert.Error(t, <-failed)
+	require.NoError(t, <-reconciled)
+
+	assert.Empty(t, b.desired)
+	// the created interface is rolled back, the agent is not resynced
+	assert.Equal(t, []string{"update lo0", "delete lo0"}, fake.recorded())
+}
+
+func TestReconcileLoop(t *testing.T) {
+	fake := &fakeConfigurator{}
+	b := &UniversalCNFVPPAgentBackend{Client: newTestClient(fake)}
+	require.NoError(t, b.Configure(&nseconfig.Config{}))
+	assert.Equal(t, defaultReconcileInterval, b.ReconcileInterval)
+
+	interval := 5 * time.Millisecond
+	require.NoError(t, b.Configure(&nseconfig.Config{VPPAgent: nseconfig.VPPAgent{ReconcileInterval: &interval}}))
+	require.NoError(t, b.ProcessDPConfig(loopbackDPConfig("lo0"), true))
+	require.NoError(t, b.NewUniversalCNFBackend())
+
+	// the agent never has lo0, it is sent on every tick until the backend is closed
+	require.Eventually(t, func() bool { return len(fake.recorded()) >= 4 }, time.Second, time.Millisecond)
+	require.NoError(t, b.Close())
+	time.Sleep(20 * time.Millisecond)
+	calls := len(fake.recorded())
+	time.Sleep(20 * time.Millisecond)
+	assert.Equal(t, calls, len(fake.recorded()))
+}
@@ -0,0 +1,374 @@
+package vppagent
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/grpc-ecosystem/grpc-opentracing/go/otgrpc"
+	"github.com/opentracing/opentracing-go"
+	"github.com/sirupsen/logrus"
+	"go.ligato.io/vpp-agent/v3/proto/ligato/configurator"
+	"go.ligato.io/vpp-agent/v3/proto/ligato/vpp"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/backoff"
+)
+
+const (
+	// EndpointEnv is the address of the vpp-agent configurator service,
+	// localhost:9113 when not set
+	EndpointEnv = "VPP_AGENT_ENDPOINT"
+
+	defaultVPPAgentEndpoint = "localhost:9113"
+	defaultTimeout          = 120 * time.Second
+	defaultBatchWindow      = 5 * time.Millisecond
+)
+
+// connection backoff of the configurator client, the gRPC defaults with a
+// shorter maximum delay since the agent runs next to the CNF
+var connectParams = grpc.ConnectParams{
+	Backoff: backoff.Config{
+		BaseDelay:  100 * time.Millisecond,
+		Multiplier: 1.6,
+		Jitter:     0.2,
+		MaxDelay:   5 * time.Second,
+	},
+	MinConnectTimeout: 5 * time.Second,
+}
+
+// Client is a long-lived client of the vpp-agent configurator service. Its
+// gRPC connection is dialed once and reconnects with backoff when the agent
+// restarts. Changes sent concurrently are coalesced: consecutive updates are
+// sent as one update transaction and consecutive deletes as one delete
+// transaction, in the order they were sent. The client keeps the configuration
+// it applied, a transaction only holds the items it changes and a failed
+// transaction is rolled back to the configuration applied before it.
+type Client struct {
+	// Timeout limits a transaction including the wait for the connection,
+	// 2 minutes when not set
+	Timeout time.Duration
+	// BatchWindow is how long the changes are collected before they are sent,
+	// 5ms when not set
+	BatchWindow time.Duration
+
+	endpoint     string
+	conn         *grpc.ClientConn
+	configurator configurator.ConfiguratorServiceClient
+
+	mu       sync.Mutex
+	queue    []*change
+	flushing bool
+	// applied is the configuration the client applied to the agent
+	applied items
+}
+
+// change is a configuration sent to the agent, its transaction result is
+// sent on done. A resync replaces the configuration of the agent. The items
+// of a forced update are sent even when they are applied already.
+type change struct {
+	update bool
+	resync bool
+	force  bool
+	config *vpp.ConfigData
+	done   chan error
+}
+
+var (
+	defaultClient     *Client
+	defaultClientErr  error
+	defaultClientOnce sync.Once
+)
+
+// Endpoint returns the address of the vpp-agent from EndpointEnv
+func Endpoint() string {
+	if endpoint, ok := os.LookupEnv(EndpointEnv); ok && endpoint != "" {
+		return endpoint
+	}
+	return defaultVPPAgentEndpoint
+}
+
+// DefaultClient returns the client of the vpp-agent at Endpoint(), shared by
+// the backends of the CNF
+func DefaultClient() (*Client, error) {
+	defaultClientOnce.Do(func() {
+		defaultClient, defaultClientErr = NewClient(Endpoint())
+	})
+	return defaultClient, defaultClientErr
+}
+
+// NewClient returns a client of the vpp-agent at endpoint, the connection is
+// established in the background
+func NewClient(endpoint string) (*Client, error) {
+	tracer := opentracing.GlobalTracer()
+	conn, err := grpc.Dial(endpoint, grpc.WithInsecure(),
+		grpc.WithConnectParams(connectParams),
+		grpc.WithUnaryInterceptor(
+			otgrpc.OpenTracingClientInterceptor(tracer, otgrpc.LogPayloads())),
+		grpc.WithStreamInterceptor(
+			otgrpc.OpenTracingStreamClientInterceptor(tracer)))
+	if err != nil {
+		return nil, fmt.Errorf("can't dial the vpp-agent at %s: %v", endpoint, err)
+	}
+
+	return &Client{
+		endpoint:     endpoint,
+		conn:         conn,
+		configurator: configurator.NewConfiguratorServiceClient(conn),
+	}, nil
+}
+
+// Close closes the connection to the agent
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+func (c *Client) String() string {
+	return c.endpoint
+}
+
+// Reset replaces the configuration of the agent with an empty one, after the
+// changes sent before
+func (c *Client) Reset(ctx context.Context) error {
+	return c.wait(ctx, c.enqueue(&change{resync: true, config: &vpp.ConfigData{}}))
+}
+
+// Resync replaces the configuration of the agent with vppconfig, after the
+// changes sent before. The agent refreshes the configuration of VPP too.
+func (c *Client) Resync(ctx context.Context, vppconfig *vpp.ConfigData) error {
+	return c.wait(ctx, c.enqueue(&change{resync: true, config: vppconfig}))
+}
+
+// Get returns the configuration of the agent
+func (c *Client) Get(ctx context.Context) (*vpp.ConfigData, error) {
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+
+	resp, err := c.configurator.Get(ctx, &configurator.GetRequest{}, grpc.WaitForReady(true))
+	if err != nil {
+		return nil, err
+	}
+	return resp.GetConfig().GetVppConfig(), nil
+}
+
+// Dump returns the configuration the agent reads from VPP
+func (c *Client) Dump(ctx context.Context) (*vpp.ConfigData, error) {
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+
+	resp, err := c.configurator.Dump(ctx, &configurator.DumpRequest{}, grpc.WaitForReady(true))
+	if err != nil {
+		return nil, err
+	}
+	return resp.GetDump().GetVppConfig(), nil
+}
+
+// Send applies the configuration to the agent, or deletes it when update is
+// false. It returns when the transaction holding the configuration is done
+// or ctx is done, the configuration is sent in any case. The error of a
+// failed transaction is a *TransactionError.
+func (c *Client) Send(ctx context.Context, vppconfig *vpp.ConfigData, update bool) error {
+	return c.wait(ctx, c.enqueue(&change{update: update, config: vppconfig}))
+}
+
+// appliedItems returns the configuration the client applied, the items are
+// replaced and not modified by the later transactions
+func (c *Client) appliedItems() items {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.applied
+}
+
+// enqueue queues the change, the changes are sent in the order they are queued
+func (c *Client) enqueue(ch *change) *change {
+	ch.done = make(chan error, 1)
+
+	c.mu.Lock()
+	c.queue = append(c.queue, ch)
+	if !c.flushing {
+		c.flushing = true
+		go c.flush()
+	}
+	c.mu.Unlock()
+	return ch
+}
+
+// wait returns the result of the transaction of the change
+func (c *Client) wait(ctx context.Context, ch *change) error {
+	select {
+	case err := <-ch.done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// flush sends the queued changes until the queue stays empty for a batch window
+func (c *Client) flush() {
+	window := c.BatchWindow
+	if window == 0 {
+		window = defaultBatchWindow
+	}
+
+	for {
+		time.Sleep(window)
+
+		c.mu.Lock()
+		batch := c.queue
+		c.queue = nil
+		if len(batch) == 0 {
+			c.flushing = false
+			c.mu.Unlock()
+			return
+		}
+		c.mu.Unlock()
+
+		for len(batch) > 0 {
+			n := 1
+			for !batch[0].resync && n < len(batch) && !batch[n].resync && batch[n].update == batch[0].update {
+				n++
+			}
+			var err error
+			if batch[0].resync {
+				err = c.resync(context.Background(), batch[0].config)
+			} else {
+				err = c.commit(batch[0].update, batch[:n])
+			}
+			for _, ch := range batch[:n] {
+				ch.done <- err
+			}
+			batch = batch[n:]
+		}
+	}
+}
+
+// commit sends the delta of the changes against the applied configuration as
+// a single transaction. The changes are applied in order, the items they
+// leave as applied are not sent unless a forced change holds them. When the transaction fails the items it
+// created are deleted and the items it modified or deleted are restored.
+func (c *Client) commit(update bool, changes []*change) error {
+	c.mu.Lock()
+	applied := c.applied
+	c.mu.Unlock()
+
+	delta, forced := items{}, map[string]bool{}
+	for _, ch := range changes {
+		for key, it := range configItems(ch.config) {
+			delta[key] = it
+			forced[key] = forced[key] || ch.force
+		}
+	}
+	if update {
+		for key, it := range delta {
+			if prior, ok := applied[key]; ok && !forced[key] && proto.Equal(prior.value, it.value) {
+				delete(delta, key)
+			}
+		}
+	}
+	if len(delta) == 0 {
+		logrus.Infof("The %d changes are applied to vppagent already", len(changes))
+		return nil
+	}
+
+	vppconfig := delta.config()
+	logrus.Infof("Sending DataChange of %d changes to vppagent: %v", len(changes), vppconfig)
+
+	if err := c.send(update, vppconfig); err != nil {
+		return &TransactionError{
+			Update:      update,
+			Keys:        delta.keys(),
+			Err:         err,
+			RollbackErr: c.rollback(update, delta, applied),
+		}
+	}
+
+	next := applied.clone()
+	next.apply(delta, update)
+	c.mu.Lock()
+	c.applied = next
+	c.mu.Unlock()
+	return nil
+}
+
+// rollback restores the applied items of a failed transaction and deletes the
+// ones it created
+func (c *Client) rollback(update bool, delta, applied items) error {
+	created, prior := items{}, items{}
+	for key, it := range delta {
+		if applied[key] != nil {
+			prior[key] = applied[key]
+		} else if update {
+			created[key] = it
+		}
+	}
+
+	logrus.Infof("Restoring %d items and deleting %d items of the failed vppagent transaction", len(prior), len(created))
+
+	var errs []string
+	if len(created) > 0 {
+		if err := c.send(false, created.config()); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(prior) > 0 {
+		if err := c.send(true, prior.config()); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// resync sends the configuration in a full resync transaction of the agent
+func (c *Client) resync(ctx context.Context, vppconfig *vpp.ConfigData) error {
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+
+	logrus.Infof("Sending full resync to vppagent: %v", vppconfig)
+	_, err := c.configurator.Update(ctx, &configurator.UpdateRequest{
+		Update:     &configurator.Config{VppConfig: vppconfig},
+		FullResync: true,
+	}, grpc.WaitForReady(true))
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	c.applied = configItems(vppconfig)
+	c.mu.Unlock()
+	return nil
+}
+
+// send updates or deletes the configuration in one transaction of the agent
+func (c *Client) send(update bool, vppconfig *vpp.ConfigData) error {
+	ctx, cancel := c.withTimeout(context.Background())
+	defer cancel()
+
+	dataChange := &configurator.Config{
+		VppConfig: vppconfig,
+	}
+	var err error
+	if update {
+		_, err = c.configurator.Update(ctx, &configurator.UpdateRequest{
+			Update: dataChange,
+		}, grpc.WaitForReady(true))
+	} else {
+		_, err = c.configurator.Delete(ctx, &configurator.DeleteRequest{
+			Delete: dataChange,
+		}, grpc.WaitForReady(true))
+	}
+	return err
+}
+
+func (c *Client) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	timeout := c.Timeout
+	if timeout == 0 {
+		timeout = defaultTimeout
+	}
+	return context.WithTimeout(ctx, timeout)
+}
@@ -0,0 +1,283 @@
+package vppagent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.ligato.io/vpp-agent/v3/proto/ligato/configurator"
+	"go.ligato.io/vpp-agent/v3/proto/ligato/vpp"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// fakeConfigurator records the transactions by their interfaces, the first
+// one waits for release when it is set and the ones in fail fail. Get and
+// Dump return agentConfig and dumped, the first Get waits for releaseGet when
+// it is set.
+type fakeConfigurator struct {
+	configurator.ConfiguratorServiceClient
+	sync.Mutex
+	release     chan struct{}
+	releaseGet  chan struct{}
+	fail        map[string]error
+	calls       []string
+	agentConfig *vpp.ConfigData
+	dumped      *vpp.ConfigData
+}
+
+func (f *fakeConfigurator) record(op string, vppconfig *vpp.ConfigData) error {
+	f.Lock()
+	release := f.release
+	f.release = nil
+	f.Unlock()
+	if release != nil {
+		<-release
+	}
+
+	var names []string
+	for _, iface := range vppconfig.GetInterfaces() {
+		if iface.Enabled {
+			names = append(names, iface.Name)
+		} else {
+			names = append(names, iface.Name+"(down)")
+		}
+	}
+	call := op + " " + strings.Join(names, ",")
+	f.Lock()
+	defer f.Unlock()
+	f.calls = append(f.calls, call)
+	return f.fail[call]
+}
+
+func (f *fakeConfigurator) Update(ctx context.Context, in *configurator.UpdateRequest, opts ...grpc.CallOption) (*configurator.UpdateResponse, error) {
+	if in.FullResync {
+		return &configurator.UpdateResponse{}, f.record("resync", in.Update.GetVppConfig())
+	}
+	return &configurator.UpdateResponse{}, f.record("update", in.Update.GetVppConfig())
+}
+
+func (f *fakeConfigurator) Delete(ctx context.Context, in *configurator.DeleteRequest, opts ...grpc.CallOption) (*configurator.DeleteResponse, error) {
+	return &configurator.DeleteResponse{}, f.record("delete", in.Delete.GetVppConfig())
+}
+
+func (f *fakeConfigurator) Get(ctx context.Context, in *configurator.GetRequest, opts ...grpc.CallOption) (*configurator.GetResponse, error) {
+	f.Lock()
+	release := f.releaseGet
+	f.releaseGet = nil
+	f.Unlock()
+	if release != nil {
+		<-release
+	}
+
+	f.Lock()
+	defer f.Unlock()
+	return &configurator.GetResponse{Config: &configurator.Config{VppConfig: f.agentConfig}}, nil
+}
+
+func (f *fakeConfigurator) Dump(ctx context.Context, in *configurator.DumpRequest, opts ...grpc.CallOption) (*configurator.DumpResponse, error) {
+	f.Lock()
+	defer f.Unlock()
+	return &configurator.DumpResponse{Dump: &configurator.Config{VppConfig: f.dumped}}, nil
+}
+
+func (f *fakeConfigurator) recorded() []string {
+	f.Lock()
+	defer f.Unlock()
+	return append([]string{}, f.calls...)
+}
+
+func newTestClient(fake *fakeConfigurator) *Client {
+	return &Client{BatchWindow: time.Millisecond, configurator: fake}
+}
+
+func interfaceConfig(names ...string) *vpp.ConfigData {
+	vppconfig := &vpp.ConfigData{}
+	for _, name := range names {
+		vppconfig.Interfaces = append(vppconfig.Interfaces, &vpp.Interface{Name: name, Enabled: true})
+	}
+	return vppconfig
+}
+
+func disabled(vppconfig *vpp.ConfigData) *vpp.ConfigData {
+	for _, iface := range vppconfig.Interfaces {
+		iface.Enabled = false
+	}
+	return vppconfig
+}
+
+func TestClientCoalesce(t *testing.T) {
+	release := make(chan struct{})
+	fake := &fakeConfigurator{release: release}
+	c := newTestClient(fake)
+
+	// the first transaction is in flight while the others are queued
+	done := make(chan error, 5)
+	go func() { done <- c.Send(context.Background(), interfaceConfig("first"), true) }()
+	require.Eventually(t, func() bool {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return c.flushing && len(c.queue) == 0
+	}, time.Second, time.Millisecond)
+
+	for _, ch := range []struct {
+		name   string
+		update bool
+	}{{"a", true}, {"b", true}, {"c", false}, {"d", true}} {
+		c.mu.Lock()
+		c.queue = append(c.queue, &change{update: ch.update, config: interfaceConfig(ch.name), done: done})
+		c.mu.Unlock()
+	}
+	close(release)
+
+	for i := 0; i < 5; i++ {
+		assert.NoError(t, <-done)
+	}
+	assert.Equal(t, []string{"update first", "update a,b", "delete c", "update d"}, fake.recorded())
+}
+
+func TestClientSendConcurrent(t *testing.T) {
+	fake := &fakeConfigurator{}
+	c := newTestClient(fake)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			assert.NoError(t, c.Send(context.Background(), interfaceConfig(fmt.Sprintf("if%d", i)), true))
+		}(i)
+	}
+	wg.Wait()
+
+	sent := 0
+	for _, call := range fake.recorded() {
+		sent += len(strings.Split(strings.TrimPrefix(call, "update "), ","))
+	}
+	assert.Equal(t, 20, sent, "every interface is sent once")
+	assert.Less(t, len(fake.recorded()), 20, "the concurrent updates are coalesced")
+}
+
+func TestClientSendError(t *testing.T) {
+	fake := &fakeConfigurator{fail: map[string]error{"delete a": fmt.Errorf("agent failed")}}
+	c := newTestClient(fake)
+
+	assert.EqualError(t, c.Send(context.Background(), interfaceConfig("a"), false),
+		"vpp-agent delete of interfaces/a failed: agent failed; the prior configuration was restored")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Equal(t, context.Canceled, c.Send(ctx, interfaceConfig("b"), false))
+}
+
+func TestClientSendDelta(t *testing.T) {
+	fake := &fakeConfigurator{}
+	c := newTestClient(fake)
+	ctx := context.Background()
+
+	require.NoError(t, c.Send(ctx, interfaceConfig("a", "b"), true))
+	require.NoError(t, c.Send(ctx, interfaceConfig("b", "a"), true))
+	require.NoError(t, c.Send(ctx, interfaceConfig("c", "b"), true))
+	require.NoError(t, c.Send(ctx, disabled(interfaceConfig("a")), true))
+	require.NoError(t, c.Send(ctx, interfaceConfig("b"), false))
+
+	assert.Equal(t, []string{"update a,b", "update c", "update a(down)", "delete b"}, fake.recorded())
+	assert.Equal(t, []string{"interfaces/a", "interfaces/c"}, c.applied.keys())
+}
+
+func TestClientRollbackUpdate(t *testing.T) {
+	agentErr := status.Error(codes.FailedPrecondition, "transaction 2 failed: interfaces/c: memif socket not found")
+	fake := &fakeConfigurator{fail: map[string]error{"update a(down),c(down)": agentErr}}
+	c := newTestClient(fake)
+	ctx := context.Background()
+
+	require.NoError(t, c.Send(ctx, interfaceConfig("a", "b"), true))
+	err := c.Send(ctx, disabled(interfaceConfig("a", "c")), true)
+
+	var txnErr *TransactionError
+	require.True(t, errors.As(err, &txnErr))
+	assert.True(t, txnErr.Update)
+	assert.Equal(t, []string{"interfaces/a", "interfaces/c"}, txnErr.Keys)
+	assert.Equal(t, agentErr, txnErr.Err)
+	assert.NoError(t, txnErr.RollbackErr)
+	assert.EqualError(t, err, "vpp-agent update of interfaces/a, interfaces/c failed: "+
+		"FailedPrecondition: transaction 2 failed: interfaces/c: memif socket not found; "+
+		"the prior configuration was restored")
+
+	// c is deleted, a is restored and b is left alone
+	assert.Equal(t, []string{"update a,b", "update a(down),c(down)", "delete c(down)", "update a"}, fake.recorded())
+	assert.Equal(t, []string{"interfaces/a", "interfaces/b"}, c.applied.keys())
+}
+
+func TestClientRollbackDelete(t *testing.T) {
+	fake := &fakeConfigurator{fail: map[string]error{
+		"delete a,z": fmt.Errorf("delete failed"),
+		"update a":   fmt.Errorf("restore failed"),
+	}}
+	c := newTestClient(fake)
+	ctx := context.Background()
+
+	require.NoError(t, c.Send(ctx, interfaceConfig("a", "b"), true))
+	err := c.Send(ctx, interfaceConfig("a", "z"), false)
+
+	var txnErr *TransactionError
+	require.True(t, errors.As(err, &txnErr))
+	assert.False(t, txnErr.Update)
+	assert.EqualError(t, err, "vpp-agent delete of interfaces/a, interfaces/z failed: delete failed; "+
+		"restoring the prior configuration failed: restore failed")
+	assert.Equal(t, []string{"update a,b", "delete a,z", "update a"}, fake.recorded())
+	assert.Equal(t, []string{"interfaces/a", "interfaces/b"}, c.applied.keys())
+}
+
+func TestClientReset(t *testing.T) {
+	fake := &fakeConfigurator{}
+	c := newTestClient(fake)
+	require.NoError(t, c.Send(context.Background(), interfaceConfig("a"), true))
+	require.NoError(t, c.Reset(context.Background()))
+	assert.Empty(t, c.applied)
+
+	require.NoError(t, c.Send(context.Background(), interfaceConfig("a"), true))
+	assert.Equal(t, []string{"update a", "resync ", "update a"}, fake.recorded())
+}
+
+func TestClientResetQueued(t *testing.T) {
+	release := make(chan struct{})
+	fake := &fakeConfigurator{release: release}
+	c := newTestClient(fake)
+
+	sent := make(chan error)
+	go func() { sent <- c.Send(context.Background(), interfaceConfig("a"), true) }()
+	require.Eventually(t, func() bool {
+		fake.Lock()
+		defer fake.Unlock()
+		return fake.release == nil
+	}, time.Second, time.Millisecond, "the update is in flight")
+
+	// the reset waits for the update in flight, which does not bring back the
+	// configuration it applied
+	reset := make(chan error)
+	go func() { reset <- c.Reset(context.Background()) }()
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	require.NoError(t, <-sent)
+	require.NoError(t, <-reset)
+
+	assert.Empty(t, c.applied)
+	assert.Equal(t, []string{"update a", "resync "}, fake.recorded())
+}
+
+func TestEndpoint(t *testing.T) {
+	restore := setenv(t, EndpointEnv, "")
+	defer restore()
+	assert.Equal(t, "localhost:9113", Endpoint())
+	require.NoError(t, os.Setenv(EndpointEnv, "vpp-agent:9111"))
+	assert.Equal(t, "vpp-agent:9111", Endpoint())
+}
@@ -17,47 +17,21 @@ package vppagent
 
 import (
 	"context"
-	"time"
 
-	"github.com/grpc-ecosystem/grpc-opentracing/go/otgrpc"
-	"github.com/networkservicemesh/networkservicemesh/pkg/tools"
-	"github.com/opentracing/opentracing-go"
 	"github.com/sirupsen/logrus"
-	"go.ligato.io/vpp-agent/v3/proto/ligato/configurator"
 	"go.ligato.io/vpp-agent/v3/proto/ligato/vpp"
-	"google.golang.org/grpc"
-)
-
-const (
-	defaultVPPAgentEndpoint = "localhost:9113"
 )
 
 // ResetVppAgent resets the VPP instance settings to nil
 func ResetVppAgent() error {
-	ctx, cancel := context.WithTimeout(context.Background(), 120*time.Second)
-	defer cancel()
-
-	if err := tools.WaitForPortAvailable(ctx, "tcp", defaultVPPAgentEndpoint, 100*time.Millisecond); err != nil {
-		return err
-	}
-
-	conn, err := grpc.Dial(defaultVPPAgentEndpoint, grpc.WithInsecure())
+	client, err := DefaultClient()
 	if err != nil {
-		logrus.Errorf("can't dial grpc server: %v", err)
 		return err
 	}
 
-	defer func() { _ = conn.Close() }()
-
-	client := configurator.NewConfiguratorServiceClient(conn)
-
 	logrus.Infof("Resetting vppagent...")
 
-	_, err = client.Update(context.Background(), &configurator.UpdateRequest{
-		Update:     &configurator.Config{},
-		FullResync: true,
-	})
-	if err != nil {
+	if err := client.Reset(context.Background()); err != nil {
 		logrus.Errorf("failed to reset vppagent: %s", err)
 	}
 
@@ -66,52 +40,14 @@ func ResetVppAgent() error {
 	return nil
 }
 
-// SendVppConfigToVppAgent send the update to the VPP-Agent
+// SendVppConfigToVppAgent send the update to the VPP-Agent with the default
+// client, a failed update or delete is rolled back to the prior configuration.
+// The items are owned by the caller, the reconciliation of the vppagent
+// backend leaves them alone unless the backend configured them too.
 func SendVppConfigToVppAgent(vppconfig *vpp.ConfigData, update bool) error {
-	dataChange := &configurator.Config{
-		VppConfig: vppconfig,
-	}
-
-	ctx, cancel := context.WithTimeout(context.Background(), 120*time.Second)
-
-	defer cancel()
-
-	if err := tools.WaitForPortAvailable(ctx, "tcp", defaultVPPAgentEndpoint, 100*time.Millisecond); err != nil {
-		return err
-	}
-
-	tracer := opentracing.GlobalTracer()
-	conn, err := grpc.Dial(defaultVPPAgentEndpoint, grpc.WithInsecure(),
-		grpc.WithUnaryInterceptor(
-			otgrpc.OpenTracingClientInterceptor(tracer, otgrpc.LogPayloads())),
-		grpc.WithStreamInterceptor(
-			otgrpc.OpenTracingStreamClientInterceptor(tracer)))
-
+	client, err := DefaultClient()
 	if err != nil {
-		logrus.Errorf("can't dial grpc server: %v", err)
 		return err
 	}
-
-	defer func() { _ = conn.Close() }()
-
-	client := configurator.NewConfiguratorServiceClient(conn)
-
-	logrus.Infof("Sending DataChange to vppagent: %v", dataChange)
-
-	if update {
-		if _, err = client.Update(ctx, &configurator.UpdateRequest{
-			Update: dataChange,
-		}); err != nil {
-			logrus.Error(err)
-			_, err = client.Delete(ctx, &configurator.DeleteRequest{
-				Delete: dataChange,
-			})
-		}
-	} else {
-		_, err = client.Delete(ctx, &configurator.DeleteRequest{
-			Delete: dataChange,
-		})
-	}
-
-	return err
+	return client.Send(context.Background(), vppconfig, update)
 }
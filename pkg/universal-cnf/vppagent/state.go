@@ -0,0 +1,216 @@
+package vppagent
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+	"go.ligato.io/vpp-agent/v3/proto/ligato/vpp"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// item is a configuration item of the agent, an element of a list of
+// vpp.ConfigData or one of its singular messages
+type item struct {
+	field protoreflect.FieldDescriptor
+	value proto.Message
+}
+
+// items are the items of configurations by key, the key is the name of the
+// ConfigData field and the identity of the item in it
+type items map[string]*item
+
+// itemIdentity are the fields identifying the items of the lists without a
+// name or a label, like the kvscheduler keys of the agent. The other items
+// are identified by their name or label, or by their whole value.
+var itemIdentity = map[protoreflect.Name][]protoreflect.Name{
+	"routes":      {"vrf_id", "dst_network", "next_hop_addr"},
+	"nat44_pools": {"vrf_id", "first_ip", "last_ip"},
+}
+
+// configItems returns the items of the configuration
+func configItems(vppconfig *vpp.ConfigData) items {
+	configured := items{}
+	if vppconfig == nil {
+		return configured
+	}
+
+	proto.MessageReflect(vppconfig).Range(func(fd protoreflect.FieldDescriptor, v protoreflect.Value) bool {
+		if fd.Kind() != protoreflect.MessageKind {
+			return true
+		}
+		if !fd.IsList() {
+			configured[string(fd.Name())] = &item{field: fd, value: proto.MessageV1(v.Message().Interface())}
+			return true
+		}
+		list := v.List()
+		for i := 0; i < list.Len(); i++ {
+			m := list.Get(i).Message()
+			configured[itemKey(fd, m)] = &item{field: fd, value: proto.MessageV1(m.Interface())}
+		}
+		return true
+	})
+	return configured
+}
+
+func itemKey(fd protoreflect.FieldDescriptor, m protoreflect.Message) string {
+	fields := m.Descriptor().Fields()
+	identity, ok := itemIdentity[fd.Name()]
+	if !ok {
+		for _, name := range []protoreflect.Name{"name", "label"} {
+			if f := fields.ByName(name); f != nil && m.Has(f) {
+				identity = []protoreflect.Name{name}
+				break
+			}
+		}
+	}
+	if len(identity) == 0 {
+		return fmt.Sprintf("%s/%s", fd.Name(), proto.CompactTextString(proto.MessageV1(m.Interface())))
+	}
+
+	parts := []string{string(fd.Name())}
+	for _, name := range identity {
+		if f := fields.ByName(name); f != nil {
+			parts = append(parts, fmt.Sprint(m.Get(f).Interface()))
+		}
+	}
+	return strings.Join(parts, "/")
+}
+
+// keys returns the sorted keys of the items
+func (s items) keys() []string {
+	keys := make([]string, 0, len(s))
+	for key := range s {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// clone returns a copy of the items, the items are shared
+func (s items) clone() items {
+	cloned := make(items, len(s))
+	for key, it := range s {
+		cloned[key] = it
+	}
+	return cloned
+}
+
+// apply puts the changed items or deletes them when update is false
+func (s items) apply(changed items, update bool) {
+	for key, it := range changed {
+		if update {
+			s[key] = it
+		} else {
+			delete(s, key)
+		}
+	}
+}
+
+// restore undoes apply for a failed transaction, the keys are set back to
+// the applied items. The keys changed again since apply are left alone.
+func (s items) restore(changed items, update bool, applied items) {
+	for key, it := range changed {
+		if current, ok := s[key]; (update && current != it) || (!update && ok) {
+			continue
+		}
+		if applied[key] == nil {
+			delete(s, key)
+		} else {
+			s[key] = applied[key]
+		}
+	}
+}
+
+// config returns the configuration of the items, in the order of their keys
+func (s items) config() *vpp.ConfigData {
+	vppconfig := &vpp.ConfigData{}
+	m := proto.MessageReflect(vppconfig)
+	for _, key := range s.keys() {
+		it := s[key]
+		v := protoreflect.ValueOfMessage(proto.MessageReflect(it.value))
+		if it.field.IsList() {
+			m.Mutable(it.field).List().Append(v)
+		} else {
+			m.Set(it.field, v)
+		}
+	}
+	return vppconfig
+}
+
+// TransactionError is a transaction the agent failed. The client restores the
+// configuration applied before the transaction, RollbackErr is the error of
+// the agent restoring it.
+type TransactionError struct {
+	// Update is true for update transactions and false for deletes
+	Update bool
+	// Keys are the items of the transaction
+	Keys        []string
+	Err         error
+	RollbackErr error
+}
+
+func (e *TransactionError) Error() string {
+	op := "delete"
+	if e.Update {
+		op = "update"
+	}
+	msg := fmt.Sprintf("vpp-agent %s of %s failed: %s", op, strings.Join(e.Keys, ", "), transactionDetails(e.Err))
+	if e.RollbackErr != nil {
+		return msg + "; restoring the prior configuration failed: " + transactionDetails(e.RollbackErr)
+	}
+	return msg + "; the prior configuration was restored"
+}
+
+func (e *TransactionError) Unwrap() error {
+	return e.Err
+}
+
+// transactionDetails returns the error of the agent with its gRPC code and
+// the details of the kvscheduler transaction it carries
+func transactionDetails(err error) string {
+	st, ok := status.FromError(err)
+	if !ok {
+		return err.Error()
+	}
+	msg := fmt.Sprintf("%s: %s", st.Code(), st.Message())
+	for _, detail := range st.Details() {
+		msg += fmt.Sprintf(" [%v]", detail)
+	}
+	return msg
+}
+
+// dumpedFields are the items checked in the configuration dumped from VPP,
+// the dump of the others does not match the configuration of the agent
+var dumpedFields = map[protoreflect.Name]bool{
+	"interfaces": true,
+	"routes":     true,
+}
+
+// findDrift returns the keys of the desired items missing from the agent or
+// from VPP, the items the agent has with other values and the owned items
+// the agent has that are not desired, by kind. The items of the agent that
+// are not owned are configured by others and are left alone.
+func findDrift(desired items, owned map[string]bool, agentItems, dumped items) map[string][]string {
+	drift := map[string][]string{}
+	for _, key := range desired.keys() {
+		it := desired[key]
+		actual, ok := agentItems[key]
+		switch {
+		case !ok:
+			drift["missing"] = append(drift["missing"], key)
+		case dumpedFields[it.field.Name()] && dumped[key] == nil:
+			drift["missing"] = append(drift["missing"], key)
+		case !proto.Equal(it.value, actual.value):
+			drift["modified"] = append(drift["modified"], key)
+		}
+	}
+	for _, key := range agentItems.keys() {
+		if owned[key] && desired[key] == nil {
+			drift["extra"] = append(drift["extra"], key)
+		}
+	}
+	return drift
+}
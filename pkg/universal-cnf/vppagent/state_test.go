@@ -0,0 +1,42 @@
+package vppagent
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.ligato.io/vpp-agent/v3/proto/ligato/vpp"
+	vpp_acl "go.ligato.io/vpp-agent/v3/proto/ligato/vpp/acl"
+	vpp_nat "go.ligato.io/vpp-agent/v3/proto/ligato/vpp/nat"
+)
+
+func TestConfigItems(t *testing.T) {
+	vppconfig := &vpp.ConfigData{
+		Interfaces: []*vpp.Interface{{Name: "memif0"}, {Name: "memif1"}},
+		Routes: []*vpp.Route{
+			{DstNetwork: "10.0.0.0/24", NextHopAddr: "10.0.1.1"},
+			{VrfId: 1, DstNetwork: "10.0.0.0/24", NextHopAddr: "10.0.1.1"},
+		},
+		Nat44Global:     &vpp_nat.Nat44Global{Forwarding: true},
+		Nat44Pools:      []*vpp_nat.Nat44AddressPool{{FirstIp: "192.168.1.1"}},
+		Nat44Interfaces: []*vpp_nat.Nat44Interface{{Name: "memif0", NatInside: true}},
+		Dnat44S:         []*vpp_nat.DNat44{{Label: "nat-port-forward-to-10.0.0.2"}},
+		Acls:            []*vpp_acl.ACL{{Name: "deny-ssh"}},
+	}
+
+	configured := configItems(vppconfig)
+	assert.Equal(t, []string{
+		"acls/deny-ssh",
+		"dnat44s/nat-port-forward-to-10.0.0.2",
+		"interfaces/memif0",
+		"interfaces/memif1",
+		"nat44_global",
+		"nat44_interfaces/memif0",
+		"nat44_pools/0/192.168.1.1/",
+		"routes/0/10.0.0.0/24/10.0.1.1",
+		"routes/1/10.0.0.0/24/10.0.1.1",
+	}, configured.keys())
+
+	// the items make up the configuration again
+	assert.Equal(t, configured.keys(), configItems(configured.config()).keys())
+	assert.Empty(t, configItems(nil))
+}
@@ -0,0 +1,261 @@
+package vppagent
+
+import (
+	"fmt"
+	"path"
+
+	"github.com/golang/protobuf/proto"
+	"go.ligato.io/vpp-agent/v3/proto/ligato/vpp"
+	vpp_acl "go.ligato.io/vpp-agent/v3/proto/ligato/vpp/acl"
+	interfaces "go.ligato.io/vpp-agent/v3/proto/ligato/vpp/interfaces"
+	vpp_l3 "go.ligato.io/vpp-agent/v3/proto/ligato/vpp/l3"
+	vpp_nat "go.ligato.io/vpp-agent/v3/proto/ligato/vpp/nat"
+
+	"github.com/cisco-app-networking/nsm-nse/pkg/nseconfig"
+	"github.com/cisco-app-networking/nsm-nse/pkg/universal-cnf/dataplane"
+)
+
+// default ring size of the memif interfaces
+const defaultMemifRingSize = 512
+
+var vppRxModes = map[nseconfig.RxMode]interfaces.Interface_RxMode_Type{
+	nseconfig.RxModePolling:   interfaces.Interface_RxMode_POLLING,
+	nseconfig.RxModeInterrupt: interfaces.Interface_RxMode_INTERRUPT,
+	nseconfig.RxModeAdaptive:  interfaces.Interface_RxMode_ADAPTIVE,
+}
+
+var vppACLActions = map[dataplane.ACLAction]vpp_acl.ACL_Rule_Action{
+	dataplane.ACLPermit:  vpp_acl.ACL_Rule_PERMIT,
+	dataplane.ACLDeny:    vpp_acl.ACL_Rule_DENY,
+	dataplane.ACLReflect: vpp_acl.ACL_Rule_REFLECT,
+}
+
+// IP protocol numbers of the ACL rules
+var ipProtocols = map[dataplane.Protocol]uint32{
+	dataplane.ProtocolICMP: 1,
+	dataplane.ProtocolTCP:  6,
+	dataplane.ProtocolUDP:  17,
+}
+
+// BuildVppConfig translates the dpconfig to the vpp-agent configuration, the
+// VPP passthrough of the dpconfig comes first. The memif sockets are placed
+// in the NSM workspace.
+func BuildVppConfig(dpconfig *dataplane.Config) (*vpp.ConfigData, error) {
+	vppconfig := &vpp.ConfigData{}
+	if dpconfig.VPP != nil {
+		vppconfig = proto.Clone(dpconfig.VPP).(*vpp.ConfigData)
+	}
+
+	for _, iface := range dpconfig.Interfaces {
+		vppIf, err := buildInterface(iface)
+		if err != nil {
+			return nil, err
+		}
+		vppconfig.Interfaces = append(vppconfig.Interfaces, vppIf)
+	}
+
+	for _, route := range dpconfig.Routes {
+		vppconfig.Routes = append(vppconfig.Routes, &vpp.Route{
+			Type:              vpp_l3.Route_INTER_VRF,
+			DstNetwork:        route.Dst,
+			NextHopAddr:       route.NextHop,
+			OutgoingInterface: route.Interface,
+		})
+	}
+
+	buildNAT(vppconfig, &dpconfig.NAT)
+
+	for _, acl := range dpconfig.ACLs {
+		vppACL, err := buildACL(acl)
+		if err != nil {
+			return nil, err
+		}
+		vppconfig.Acls = append(vppconfig.Acls, vppACL)
+	}
+
+	return vppconfig, nil
+}
+
+// buildInterface returns the VPP interface of the dpconfig interface, kernel
+// interfaces are attached with AF_PACKET
+func buildInterface(iface *dataplane.Interface) (*interfaces.Interface, error) {
+	vppIf := &interfaces.Interface{
+		Name:        iface.Name,
+		Enabled:     !iface.Disabled,
+		IpAddresses: append([]string{}, iface.Addresses...),
+		Mtu:         iface.MTU,
+	}
+	if iface.RxMode != "" {
+		vppIf.RxModes = buildRxModes(iface.RxMode)
+	}
+
+	switch iface.Type {
+	case dataplane.InterfaceMemif:
+		m := iface.Memif
+		if m == nil {
+			return nil, fmt.Errorf("memif interface %s has no memif link", iface.Name)
+		}
+		ringSize := uint32(defaultMemifRingSize)
+		if m.RingSize != 0 {
+			ringSize = uint32(m.RingSize)
+		}
+		vppIf.Type = interfaces.Interface_MEMIF
+		vppIf.Link = &interfaces.Interface_Memif{
+			Memif: &interfaces.MemifLink{
+				Master:         m.Master,
+				SocketFilename: path.Join(getBaseDir(), m.SocketFile),
+				RingSize:       ringSize,
+				BufferSize:     uint32(m.BufferSize),
+				RxQueues:       uint32(m.Queues),
+				TxQueues:       uint32(m.Queues),
+			},
+		}
+	case dataplane.InterfaceKernel:
+		vppIf.Type = interfaces.Interface_AF_PACKET
+		vppIf.Link = &interfaces.Interface_Afpacket{
+			Afpacket: &interfaces.AfpacketLink{HostIfName: iface.HostIfName},
+		}
+	case dataplane.InterfaceTap:
+		vppIf.Type = interfaces.Interface_TAP
+		vppIf.Link = &interfaces.Interface_Tap{
+			Tap: &interfaces.TapLink{Version: 2, HostIfName: iface.HostIfName},
+		}
+	case dataplane.InterfaceLoopback:
+		vppIf.Type = interfaces.Interface_SOFTWARE_LOOPBACK
+	default:
+		return nil, fmt.Errorf("interface %s has the unknown type %q", iface.Name, iface.Type)
+	}
+	return vppIf, nil
+}
+
+func buildRxModes(mode nseconfig.RxMode) []*interfaces.Interface_RxMode {
+	return []*interfaces.Interface_RxMode{
+		{
+			Mode:        vppRxModes[mode],
+			DefaultMode: true,
+		},
+	}
+}
+
+func buildNAT(vppconfig *vpp.ConfigData, nat *dataplane.NAT) {
+	for _, pool := range nat.Pools {
+		vppconfig.Nat44Pools = append(vppconfig.Nat44Pools, &vpp_nat.Nat44AddressPool{
+			FirstIp:  pool.FirstIP,
+			LastIp:   pool.LastIP,
+			TwiceNat: pool.TwiceNAT,
+		})
+	}
+
+	for _, iface := range nat.Interfaces {
+		vppconfig.Nat44Interfaces = append(vppconfig.Nat44Interfaces, &vpp_nat.Nat44Interface{
+			Name:       iface.Name,
+			NatInside:  iface.Inside,
+			NatOutside: iface.Outside,
+		})
+	}
+
+	// VPP maps a port per static mapping, the mappings of the ports of a
+	// ranged mapping make up a single DNAT
+	for _, m := range nat.StaticMappings {
+		dnat := &vpp_nat.DNat44{Label: m.Label}
+		ports := m.Ports()
+		if ports == 0 {
+			// the mapping without ports translates the address only
+			ports = 1
+		}
+		for i := uint32(0); i < ports; i++ {
+			dnat.StMappings = append(dnat.StMappings, buildStaticMapping(m, m.ExternalPort+i))
+		}
+		vppconfig.Dnat44S = append(vppconfig.Dnat44S, dnat)
+	}
+}
+
+func buildStaticMapping(m *dataplane.StaticMapping, externalPort uint32) *vpp_nat.DNat44_StaticMapping {
+	mapping := &vpp_nat.DNat44_StaticMapping{
+		ExternalIp:   m.ExternalIP,
+		ExternalPort: externalPort,
+		LocalIps: []*vpp_nat.DNat44_StaticMapping_LocalIP{{
+			LocalIp:   m.LocalIP,
+			LocalPort: m.LocalPortFor(externalPort),
+		}},
+	}
+	switch m.Protocol {
+	case dataplane.ProtocolUDP:
+		mapping.Protocol = vpp_nat.DNat44_UDP
+	case dataplane.ProtocolICMP:
+		mapping.Protocol = vpp_nat.DNat44_ICMP
+	default:
+		mapping.Protocol = vpp_nat.DNat44_TCP
+	}
+	if m.TwiceNAT {
+		mapping.TwiceNat = vpp_nat.DNat44_StaticMapping_ENABLED
+	}
+	return mapping
+}
+
+func buildACL(acl *dataplane.ACL) (*vpp_acl.ACL, error) {
+	vppACL := &vpp_acl.ACL{
+		Name: acl.Name,
+		Interfaces: &vpp_acl.ACL_Interfaces{
+			Ingress: append([]string{}, acl.Ingress...),
+			Egress:  append([]string{}, acl.Egress...),
+		},
+	}
+
+	for i, rule := range acl.Rules {
+		action, ok := vppACLActions[rule.Action]
+		if !ok {
+			return nil, fmt.Errorf("acl %s rule %d has the unknown action %q", acl.Name, i, rule.Action)
+		}
+		ipRule := &vpp_acl.ACL_Rule_IpRule{}
+		if rule.Src != "" || rule.Dst != "" {
+			ipRule.Ip = &vpp_acl.ACL_Rule_IpRule_Ip{
+				SourceNetwork:      rule.Src,
+				DestinationNetwork: rule.Dst,
+			}
+		}
+
+		switch rule.Protocol {
+		case dataplane.ProtocolTCP:
+			ipRule.Tcp = &vpp_acl.ACL_Rule_IpRule_Tcp{
+				SourcePortRange:      buildPortRange(rule.SrcPorts),
+				DestinationPortRange: buildPortRange(rule.DstPorts),
+			}
+		case dataplane.ProtocolUDP:
+			ipRule.Udp = &vpp_acl.ACL_Rule_IpRule_Udp{
+				SourcePortRange:      buildPortRange(rule.SrcPorts),
+				DestinationPortRange: buildPortRange(rule.DstPorts),
+			}
+		case dataplane.ProtocolICMP:
+			ipRule.Icmp = &vpp_acl.ACL_Rule_IpRule_Icmp{
+				IcmpTypeRange: buildICMPRange(rule.ICMPTypes),
+				IcmpCodeRange: buildICMPRange(rule.ICMPCodes),
+			}
+		case "":
+		default:
+			return nil, fmt.Errorf("acl %s rule %d has the unknown protocol %q", acl.Name, i, rule.Protocol)
+		}
+		if ipRule.Ip != nil && rule.Protocol != "" {
+			ipRule.Ip.Protocol = ipProtocols[rule.Protocol]
+		}
+
+		vppACL.Rules = append(vppACL.Rules, &vpp_acl.ACL_Rule{Action: action, IpRule: ipRule})
+	}
+	return vppACL, nil
+}
+
+// buildPortRange returns the VPP port range, all ports when not set
+func buildPortRange(r *dataplane.Range) *vpp_acl.ACL_Rule_IpRule_PortRange {
+	if r == nil {
+		return &vpp_acl.ACL_Rule_IpRule_PortRange{LowerPort: 0, UpperPort: 65535}
+	}
+	return &vpp_acl.ACL_Rule_IpRule_PortRange{LowerPort: r.First, UpperPort: r.Last}
+}
+
+// buildICMPRange returns the VPP ICMP type or code range, all when not set
+func buildICMPRange(r *dataplane.Range) *vpp_acl.ACL_Rule_IpRule_Icmp_Range {
+	if r == nil {
+		return &vpp_acl.ACL_Rule_IpRule_Icmp_Range{First: 0, Last: 255}
+	}
+	return &vpp_acl.ACL_Rule_IpRule_Icmp_Range{First: r.First, Last: r.Last}
+}
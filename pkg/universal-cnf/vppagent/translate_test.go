@@ -0,0 +1,128 @@
+package vppagent
+
+import (
+	"os"
+	"testing"
+
+	"github.com/networkservicemesh/networkservicemesh/sdk/common"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.ligato.io/vpp-agent/v3/proto/ligato/vpp"
+	vpp_acl "go.ligato.io/vpp-agent/v3/proto/ligato/vpp/acl"
+	interfaces "go.ligato.io/vpp-agent/v3/proto/ligato/vpp/interfaces"
+	vpp_nat "go.ligato.io/vpp-agent/v3/proto/ligato/vpp/nat"
+
+	"github.com/cisco-app-networking/nsm-nse/pkg/universal-cnf/dataplane"
+)
+
+// setenv sets the environment variable, the returned function restores it
+func setenv(t *testing.T, key, value string) func() {
+	prior, set := os.LookupEnv(key)
+	require.NoError(t, os.Setenv(key, value))
+	return func() {
+		if set {
+			_ = os.Setenv(key, prior)
+		} else {
+			_ = os.Unsetenv(key)
+		}
+	}
+}
+
+func TestBuildVppConfig(t *testing.T) {
+	defer setenv(t, common.WorkspaceEnv, workspaceEnv)()
+
+	passthrough := &vpp.ConfigData{Interfaces: []*vpp.Interface{{Name: "loop1"}}}
+	vppconfig, err := BuildVppConfig(&dataplane.Config{
+		Interfaces: []*dataplane.Interface{
+			{Name: "tap0", Type: dataplane.InterfaceTap, HostIfName: "ucnf0", Disabled: true, MTU: 1400},
+			{Name: "loop0", Type: dataplane.InterfaceLoopback, Addresses: []string{"10.80.0.1/32"}},
+		},
+		Routes: []*dataplane.Route{{Dst: "10.90.0.0/16", NextHop: "10.80.0.2", Interface: "tap0"}},
+		NAT: dataplane.NAT{
+			Pools:      []*dataplane.NATPool{{FirstIP: "192.0.2.1", LastIP: "192.0.2.4"}},
+			Interfaces: []*dataplane.NATInterface{{Name: "tap0", Outside: true}},
+			StaticMappings: []*dataplane.StaticMapping{{
+				Label: "dns", Protocol: dataplane.ProtocolUDP, ExternalIP: "192.0.2.1", ExternalPort: 53,
+				LocalIP: "10.80.0.2", TwiceNAT: true,
+			}, {
+				Label: "http", ExternalIP: "192.0.2.1", ExternalPort: 8080, LocalIP: "10.80.0.2", LocalPort: 80, PortCount: 2,
+			}},
+		},
+		ACLs: []*dataplane.ACL{{
+			Name:    "web",
+			Ingress: []string{"tap0"},
+			Rules: []*dataplane.ACLRule{
+				{Action: dataplane.ACLReflect, Dst: "10.80.0.0/24", Protocol: dataplane.ProtocolTCP,
+					DstPorts: &dataplane.Range{First: 80, Last: 80}},
+				{Action: dataplane.ACLDeny},
+			},
+		}},
+		VPP: passthrough,
+	})
+	require.NoError(t, err)
+
+	require.Len(t, vppconfig.Interfaces, 3)
+	assert.Equal(t, "loop1", vppconfig.Interfaces[0].Name)
+	assert.Len(t, passthrough.Interfaces, 1, "the passthrough is not changed")
+	tap := vppconfig.Interfaces[1]
+	assert.Equal(t, interfaces.Interface_TAP, tap.Type)
+	assert.Equal(t, "ucnf0", tap.GetTap().GetHostIfName())
+	assert.False(t, tap.Enabled)
+	assert.Equal(t, uint32(1400), tap.Mtu)
+	assert.Nil(t, tap.RxModes)
+	loop := vppconfig.Interfaces[2]
+	assert.Equal(t, interfaces.Interface_SOFTWARE_LOOPBACK, loop.Type)
+	assert.True(t, loop.Enabled)
+	assert.Equal(t, []string{"10.80.0.1/32"}, loop.IpAddresses)
+
+	require.Len(t, vppconfig.Routes, 1)
+	assert.Equal(t, "tap0", vppconfig.Routes[0].OutgoingInterface)
+
+	assert.Equal(t, []*vpp_nat.Nat44AddressPool{{FirstIp: "192.0.2.1", LastIp: "192.0.2.4"}}, vppconfig.Nat44Pools)
+	assert.Equal(t, []*vpp_nat.Nat44Interface{{Name: "tap0", NatOutside: true}}, vppconfig.Nat44Interfaces)
+	assert.Equal(t, []*vpp_nat.DNat44{{
+		Label: "dns",
+		StMappings: []*vpp_nat.DNat44_StaticMapping{{
+			ExternalIp:   "192.0.2.1",
+			ExternalPort: 53,
+			Protocol:     vpp_nat.DNat44_UDP,
+			TwiceNat:     vpp_nat.DNat44_StaticMapping_ENABLED,
+			LocalIps:     []*vpp_nat.DNat44_StaticMapping_LocalIP{{LocalIp: "10.80.0.2", LocalPort: 53}},
+		}},
+	}, {
+		// the ports of the range are mapped by one DNAT
+		Label: "http",
+		StMappings: []*vpp_nat.DNat44_StaticMapping{{
+			ExternalIp:   "192.0.2.1",
+			ExternalPort: 8080,
+			Protocol:     vpp_nat.DNat44_TCP,
+			LocalIps:     []*vpp_nat.DNat44_StaticMapping_LocalIP{{LocalIp: "10.80.0.2", LocalPort: 80}},
+		}, {
+			ExternalIp:   "192.0.2.1",
+			ExternalPort: 8081,
+			Protocol:     vpp_nat.DNat44_TCP,
+			LocalIps:     []*vpp_nat.DNat44_StaticMapping_LocalIP{{LocalIp: "10.80.0.2", LocalPort: 81}},
+		}},
+	}}, vppconfig.Dnat44S)
+
+	assert.Equal(t, []*vpp_acl.ACL{{
+		Name:       "web",
+		Interfaces: &vpp_acl.ACL_Interfaces{Ingress: []string{"tap0"}, Egress: []string{}},
+		Rules: []*vpp_acl.ACL_Rule{
+			{
+				Action: vpp_acl.ACL_Rule_REFLECT,
+				IpRule: &vpp_acl.ACL_Rule_IpRule{
+					Ip: &vpp_acl.ACL_Rule_IpRule_Ip{DestinationNetwork: "10.80.0.0/24", Protocol: 6},
+					Tcp: &vpp_acl.ACL_Rule_IpRule_Tcp{
+						SourcePortRange:      &vpp_acl.ACL_Rule_IpRule_PortRange{LowerPort: 0, UpperPort: 65535},
+						DestinationPortRange: &vpp_acl.ACL_Rule_IpRule_PortRange{LowerPort: 80, UpperPort: 80},
+					},
+				},
+			},
+			{Action: vpp_acl.ACL_Rule_DENY, IpRule: &vpp_acl.ACL_Rule_IpRule{}},
+		},
+	}}, vppconfig.Acls)
+
+	_, err = BuildVppConfig(&dataplane.Config{Interfaces: []*dataplane.Interface{{Name: "veth0", Type: "veth"}}})
+	assert.EqualError(t, err, `interface veth0 has the unknown type "veth"`)
+}